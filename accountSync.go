@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Providers for account chains; main fills accountProviders from
+// -chain-provider. Chains without one use Etherscan, or the fake provider
+// while testing.
+var accountProviders = map[string]AccountProvider{}
+
+// accountProviderFor returns the provider that syncs account chain c.
+func accountProviderFor(c *Chain) AccountProvider {
+	if p, ok := accountProviders[c.Key()]; ok {
+		return p
+	}
+	if testing {
+		return fakeAccountProvider{}
+	}
+	return newEtherscanProvider(c, "")
+}
+
+// parseAccountProvider configures the provider of account chain c from the
+// name and url of a -chain-provider value.
+func parseAccountProvider(c *Chain, value string, name string, url string) error {
+	switch name {
+	case providerFake:
+		accountProviders[c.Key()] = fakeAccountProvider{}
+	case providerEtherscan:
+		accountProviders[c.Key()] = newEtherscanProvider(c, url)
+	default:
+		return fmt.Errorf("invalid -chain-provider %q: account chains use fake or etherscan", value)
+	}
+	return nil
+}
+
+// newAccountTxFetcher prepares the sync of an address on an account chain.
+// Nothing is known of the address's txs before they are fetched, so the
+// sync is planned as the txs already stored.
+func newAccountTxFetcher(db *sql.DB, info AddressInfo, chain *Chain) (TxFetcher, error) {
+	p := accountProviderFor(chain)
+	address := info.Address
+	log := logger.With("address", address, "type", info.Type, "chain", chain.Key(), "provider", p.Name())
+
+	if _, err := trackAddress(db, address); err != nil {
+		return TxFetcher{}, fmt.Errorf("failed to record address: %w", err)
+	}
+	if _, err := checkReorgs(db, chain, p, log, address); err != nil {
+		return TxFetcher{}, fmt.Errorf("failed to check for reorgs: %w", err)
+	}
+
+	var stored int
+	err := db.QueryRow(`SELECT COUNT(*) FROM txs WHERE address = $1 AND status = $2`, address, txConfirmed).Scan(&stored)
+	if err != nil {
+		return TxFetcher{}, fmt.Errorf("failed to count synced txs: %w", err)
+	}
+	var completed bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM syncs WHERE address = $1 AND status = 'COMPLETED')`, address).Scan(&completed)
+	if err != nil {
+		return TxFetcher{}, fmt.Errorf("failed to look up past syncs: %w", err)
+	}
+
+	log.Info("planned sync", "txs_synced", stored, "resume", completed)
+	return TxFetcher{
+		Address:        address,
+		db:             db,
+		log:            log,
+		chain:          chain,
+		account:        p,
+		completed:      completed,
+		TotalNumTxs:    stored,
+		TotalTxsSynced: stored,
+	}, nil
+}
+
+// syncAccount walks an account chain address's txs newest first, like
+// syncCursor, until the last page, or a page with nothing new if an earlier
+// sync completed and so stored everything older.
+func (txFetcher TxFetcher) syncAccount(log *slog.Logger, syncId string, ticker *time.Ticker) int {
+	cursor := ""
+	for page := 0; ; page++ {
+		waitStart := time.Now()
+		<-ticker.C
+		rateLimitWait.Observe(time.Since(waitStart).Seconds())
+
+		inserted, next, err := txFetcher.retryPage(log.With("page", page), page, syncId, func(log *slog.Logger) (int, string, error) {
+			log.Debug("making request")
+			txFetcher.stats.request(txFetcher.account)
+			txs, next, err := txFetcher.account.AccountTxsAfter(txFetcher.Address, cursor)
+			if err != nil {
+				return 0, "", err
+			}
+			log.Debug("received txs", "num_txs", len(txs))
+			inserted, err := txFetcher.storeAccountTxs(log, page, syncId, txs)
+			return inserted, next, err
+		})
+		if err != nil {
+			pagesSynced.WithLabelValues(txFetcher.Address, "failed").Inc()
+			syncProgress.pageFailed(syncId)
+			return 1
+		}
+		pagesSynced.WithLabelValues(txFetcher.Address, "ok").Inc()
+		syncProgress.pageDone(syncId, inserted)
+
+		if next == "" || (inserted == 0 && txFetcher.completed) {
+			return 0
+		}
+		cursor = next
+	}
+}
+
+// storeAccountTxs stores a page of account chain txs, returning how many
+// were new. An orphaned tx mined again is confirmed with its new block,
+// keeping the sync that first stored it.
+func (txFetcher TxFetcher) storeAccountTxs(log *slog.Logger, page int, syncId string, txs []EVMTx) (int, error) {
+	insertStart := time.Now()
+	tx, err := txFetcher.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO txs (address, tx_id, sync_id, raw, page, created_at, chain, network, model)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (address, tx_id) DO UPDATE SET raw = EXCLUDED.raw, status = 'CONFIRMED'
+		WHERE txs.status <> 'CONFIRMED'`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare statement for batch inserting: %w", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now().UTC()
+	inserted := 0
+	for _, etx := range txs {
+		log.Debug("inserting tx", "tx_id", etx.TransactionId)
+		raw, err := json.Marshal(etx)
+		if err != nil {
+			return 0, errors.New("failed to marshal JSON")
+		}
+		res, err := stmt.Exec(txFetcher.Address, etx.TransactionId, syncId, string(raw), page, now,
+			txFetcher.chain.Name, txFetcher.chain.Network, modelAccount)
+		if err != nil {
+			return 0, fmt.Errorf("failed to execute statement for batch inserting: %w", err)
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			inserted += int(n)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	dbInsertDuration.Observe(time.Since(insertStart).Seconds())
+	txsSynced.WithLabelValues(txFetcher.chain.Name, txFetcher.account.Name()).Add(float64(inserted))
+	return inserted, nil
+}
+
+// The fake account provider's txs: fakeAccountTxs of them, served
+// fakeAccountPageSize at a time.
+const (
+	fakeAccountTxs      = 12
+	fakeAccountPageSize = 5
+)
+
+// fakeAccountProvider makes up a stable history for any address: ETH
+// received, ETH sent and USDC received through a contract, in turn.
+type fakeAccountProvider struct{}
+
+func (fakeAccountProvider) Name() string { return providerFake }
+
+func (fakeAccountProvider) AccountTxsAfter(address string, cursor string) ([]EVMTx, string, error) {
+	requested := time.Now()
+	defer observeProviderRequest("account_txs", http.StatusOK, requested)
+
+	self := evmHex(address)
+	start := 0
+	if cursor != "" {
+		n, err := strconv.Atoi(cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+		}
+		start = n
+	}
+	txs := []EVMTx{}
+	for i := start; i < fakeAccountTxs && i < start+fakeAccountPageSize; i++ {
+		sum := sha256.Sum256([]byte(address + ":" + strconv.Itoa(i)))
+		hash := "0x" + hex.EncodeToString(sum[:])
+		height := fakeBlock - 10*i
+		tx := EVMTx{
+			TransactionId: hash, TransactionHash: hash,
+			MinedInBlockHeight: height, MinedInBlockHash: fakeHashAt(height),
+			Timestamp: 1708000000 - 120*int64(i), Value: "0", GasPrice: "0", Status: evmSuccess,
+		}
+		switch i % 3 {
+		case 0:
+			tx.From, tx.To, tx.Value = "0x1111111111111111111111111111111111111111", self, "250000000000000000"
+			tx.GasPrice, tx.Gas, tx.GasUsed = "20000000000", 21000, 21000
+		case 1:
+			tx.From, tx.To, tx.Value = self, "0x2222222222222222222222222222222222222222", "100000000000000000"
+			tx.GasPrice, tx.Gas, tx.GasUsed, tx.Nonce = "20000000000", 21000, 21000, uint64(i)
+		case 2:
+			tx.TokenTransfers = []TokenTransfer{{
+				Contract: "0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48", Symbol: "USDC", Decimals: 6,
+				From: "0x3333333333333333333333333333333333333333", To: self, Value: "100000000",
+			}}
+		}
+		txs = append(txs, tx)
+	}
+	next := ""
+	if start+fakeAccountPageSize < fakeAccountTxs {
+		next = strconv.Itoa(start + fakeAccountPageSize)
+	}
+	return txs, next, nil
+}
+
+func (fakeAccountProvider) ChainTip() (ChainTip, error) {
+	return ChainTip{Height: fakeTipHeight, Hash: fakeHashAt(fakeTipHeight), UpdatedAt: time.Now().UTC()}, nil
+}
+
+func (fakeAccountProvider) BlockHash(height int) (string, error) { return fakeHashAt(height), nil }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AddressSummary is a tracked address with its balance and latest sync.
+type AddressSummary struct {
+	Address   string      `json:"address"`
+	Type      string      `json:"type"`
+	Chain     string      `json:"chain"`
+	Network   string      `json:"network"`
+	Unit      string      `json:"unit"`
+	CreatedAt time.Time   `json:"createdAt"`
+	TxCount   int         `json:"txCount"`
+	Balance   int64       `json:"balance"`
+	Fiat      *FiatValue  `json:"fiat,omitempty"`
+	LastSync  *SyncRecord `json:"lastSync,omitempty"`
+
+	// Pending counts mempool txs, which are kept out of the balance.
+	PendingTxCount int   `json:"pendingTxCount"`
+	PendingBalance int64 `json:"pendingBalance"`
+
+	// Tokens are the balances of an EVM address in units other than its
+	// chain's, such as ERC-20 tokens.
+	Tokens []UnitBalance `json:"tokens,omitempty"`
+}
+
+// trackAddress validates address and records it, with its type, chain and
+// network, in the addresses table if it is new. Rows from before types or
+// chains were stored get them filled in.
+func trackAddress(db execer, address string) (AddressInfo, error) {
+	info, err := validateAddress(address)
+	if err != nil {
+		return info, err
+	}
+	now := time.Now().UTC()
+	stmt := `
+		INSERT INTO addresses (address, address_type, chain, network, created_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (address) DO UPDATE
+		SET address_type = EXCLUDED.address_type, chain = EXCLUDED.chain, network = EXCLUDED.network
+		WHERE addresses.address_type IS NULL OR addresses.chain IS NULL`
+	_, err = db.Exec(stmt, info.Address, info.Type, info.Chain, info.Network, now)
+	return info, err
+}
+
+// storedChain returns the chain stored with a tracked address. An address
+// that is not tracked is taken from its format.
+func storedChain(db *sql.DB, address string) (*Chain, error) {
+	var name, network string
+	err := db.QueryRow(`SELECT COALESCE(chain, ''), COALESCE(network, '') FROM addresses WHERE address = $1`,
+		address).Scan(&name, &network)
+	if errors.Is(err, sql.ErrNoRows) {
+		return addressChain(address), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return chainOf(name, network)
+}
+
+// listAddresses returns every tracked address, oldest first.
+func listAddresses(db *sql.DB) ([]AddressSummary, error) {
+	rows, err := db.Query(`
+		SELECT address, COALESCE(address_type, ''), COALESCE(chain, ''), COALESCE(network, ''), created_at
+		FROM addresses ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []AddressSummary{}
+	for rows.Next() {
+		var s AddressSummary
+		if err := rows.Scan(&s.Address, &s.Type, &s.Chain, &s.Network, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range summaries {
+		if err := summarizeAddress(db, &summaries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return summaries, nil
+}
+
+// summarizeAddress fills in the unit of the address's stored chain, its tx
+// counts and balances and its latest sync.
+func summarizeAddress(db *sql.DB, s *AddressSummary) error {
+	c, err := chainOf(s.Chain, s.Network)
+	if err != nil {
+		return err
+	}
+	s.Chain, s.Network, s.Unit = c.Name, c.Network, c.Unit
+	views, err := chainTxViews(db, s.Address, c)
+	if err != nil {
+		return err
+	}
+	p := summarizePortfolio([]string{s.Address}, views)
+	s.TxCount, s.PendingTxCount = p.TxCount, p.PendingTxCount
+	for _, u := range p.Units {
+		if u.Unit != s.Unit {
+			s.Tokens = append(s.Tokens, u)
+			continue
+		}
+		s.Balance, s.PendingBalance = u.Balance, u.PendingBalance
+	}
+
+	syncs, err := listSyncs(db, s.Address, 1)
+	if err != nil {
+		return err
+	}
+	if len(syncs) > 0 {
+		s.LastSync = &syncs[0]
+	}
+	return nil
+}
+
+// valueAddress values the balances of s at ts.
+func (t *priceTable) valueAddress(s *AddressSummary, ts time.Time) {
+	s.Fiat = t.valueBalance(s.Unit, ts, s.Balance)
+	for i := range s.Tokens {
+		s.Tokens[i].Fiat = t.valueBalance(s.Tokens[i].Unit, ts, s.Tokens[i].Balance)
+	}
+}
+
+// handleListAddresses serves GET /api/addresses.
+func (s *apiServer) handleListAddresses(w http.ResponseWriter, r *http.Request) {
+	prices, ok := s.fiatPrices(w, r)
+	if !ok {
+		return
+	}
+	summaries, err := listAddresses(s.db)
+	if err != nil {
+		s.internalError(w, "failed to list addresses", err)
+		return
+	}
+	if prices != nil {
+		now := time.Now().UTC()
+		for i := range summaries {
+			prices.valueAddress(&summaries[i], now)
+		}
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+// handleAddAddress serves POST /api/addresses with a body of
+// {"address": "..."}.
+func (s *apiServer) handleAddAddress(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	address := strings.TrimSpace(body.Address)
+	if address == "" {
+		writeError(w, http.StatusBadRequest, "address is required")
+		return
+	}
+
+	info, err := trackAddress(s.db, address)
+	if errors.Is(err, errInvalidAddress) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		s.internalError(w, "failed to add address", err)
+		return
+	}
+	c, err := chainOf(info.Chain, info.Network)
+	if err != nil {
+		s.internalError(w, "failed to add address", err)
+		return
+	}
+	summary := AddressSummary{Address: info.Address, Type: info.Type, Chain: c.Name, Network: c.Network, Unit: c.Unit,
+		CreatedAt: time.Now().UTC()}
+	writeJSON(w, http.StatusCreated, summary)
+}
+
+// addressFromPath returns the {address} path value normalized as it was
+// when tracked, so uppercase bech32, CashAddr without its prefix and EIP-55
+// checksummed addresses are found too. It writes the error response if the
+// address is invalid.
+func addressFromPath(w http.ResponseWriter, r *http.Request) (string, bool) {
+	info, err := validateAddress(r.PathValue("address"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	return info.Address, true
+}
+
+// handleGetAddress serves GET /api/addresses/{address}.
+func (s *apiServer) handleGetAddress(w http.ResponseWriter, r *http.Request) {
+	prices, ok := s.fiatPrices(w, r)
+	if !ok {
+		return
+	}
+	address, ok := addressFromPath(w, r)
+	if !ok {
+		return
+	}
+	summary := AddressSummary{Address: address}
+	err := s.db.QueryRow(`
+		SELECT COALESCE(address_type, ''), COALESCE(chain, ''), COALESCE(network, ''), created_at FROM addresses WHERE address = $1`,
+		summary.Address).Scan(&summary.Type, &summary.Chain, &summary.Network, &summary.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "address not tracked")
+		return
+	}
+	if err != nil {
+		s.internalError(w, "failed to get address", err)
+		return
+	}
+	if err := summarizeAddress(s.db, &summary); err != nil {
+		s.internalError(w, "failed to summarize address", err)
+		return
+	}
+	if prices != nil {
+		prices.valueAddress(&summary, time.Now().UTC())
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// handleSyncAddress serves POST /api/addresses/{address}/sync. The sync runs
+// in the background; follow it with /api/progress/events?address=.
+func (s *apiServer) handleSyncAddress(w http.ResponseWriter, r *http.Request) {
+	address, ok := addressFromPath(w, r)
+	if !ok {
+		return
+	}
+	err := s.syncs.start(address)
+	if errors.Is(err, errSyncRunning) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if errors.Is(err, errInvalidAddress) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		s.internalError(w, "failed to start sync", err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"address": address, "status": "STARTED"})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// apiServer holds what the JSON API handlers need.
+type apiServer struct {
+	db    *sql.DB
+	syncs *syncRunner
+}
+
+// registerAPI mounts the JSON API handlers on mux.
+func registerAPI(mux *http.ServeMux, db *sql.DB, syncs *syncRunner) {
+	s := &apiServer{db: db, syncs: syncs}
+
+	mux.HandleFunc("GET /api/progress", handleProgressList)
+	mux.HandleFunc("GET /api/progress/events", handleProgressEvents)
+	mux.HandleFunc("GET /api/progress/{syncId}", handleProgressGet)
+
+	mux.HandleFunc("GET /api/addresses", s.handleListAddresses)
+	mux.HandleFunc("POST /api/addresses", s.handleAddAddress)
+	mux.HandleFunc("GET /api/addresses/{address}", s.handleGetAddress)
+	mux.HandleFunc("POST /api/addresses/{address}/sync", s.handleSyncAddress)
+	mux.HandleFunc("GET /api/addresses/{address}/txs", s.handleListTxs)
+	mux.HandleFunc("GET /api/addresses/{address}/balance-history", s.handleBalanceHistory)
+	mux.HandleFunc("GET /api/addresses/{address}/utxos", s.handleListUTXOs)
+	mux.HandleFunc("GET /api/txs/{txId}", s.handleGetTx)
+	mux.HandleFunc("GET /api/portfolio", s.handlePortfolio)
+	mux.HandleFunc("GET /api/portfolio/txs", s.handlePortfolioTxs)
+	mux.HandleFunc("GET /api/portfolio/balance-history", s.handlePortfolioBalanceHistory)
+	mux.HandleFunc("GET /api/wallets", s.handleListWallets)
+	mux.HandleFunc("POST /api/wallets", s.handleCreateWallet)
+	mux.HandleFunc("POST /api/wallets/xpub", s.handleImportXpub)
+	mux.HandleFunc("POST /api/wallets/descriptor", s.handleImportDescriptor)
+	mux.HandleFunc("GET /api/wallets/{walletId}", s.handleGetWallet)
+	mux.HandleFunc("DELETE /api/wallets/{walletId}", s.handleDeleteWallet)
+	mux.HandleFunc("POST /api/wallets/{walletId}/addresses", s.handleAddWalletAddress)
+	mux.HandleFunc("DELETE /api/wallets/{walletId}/addresses/{address}", s.handleRemoveWalletAddress)
+	mux.HandleFunc("GET /api/wallets/{walletId}/txs", s.handleWalletTxs)
+	mux.HandleFunc("GET /api/wallets/{walletId}/balance-history", s.handleWalletBalanceHistory)
+	mux.HandleFunc("POST /api/wallets/{walletId}/sync", s.handleSyncWallet)
+	mux.HandleFunc("GET /api/export", s.handleExport)
+	mux.HandleFunc("GET /api/gains", s.handleGains)
+	mux.HandleFunc("GET /api/reorgs", s.handleListReorgs)
+	mux.HandleFunc("GET /api/discrepancies", s.handleListDiscrepancies)
+	mux.HandleFunc("GET /api/ledger", s.handleListLedger)
+
+	mux.HandleFunc("GET /api/addresses/{address}/syncs", s.handleListSyncs)
+	mux.HandleFunc("GET /api/syncs/{syncId}", s.handleGetSync)
+	mux.HandleFunc("GET /api/syncs/{syncId}/txs", s.handleSyncTxs)
+}
+
+// fiatPrices loads the price table for the ?fiat= currency. It returns nil
+// when no currency was asked for.
+func (s *apiServer) fiatPrices(w http.ResponseWriter, r *http.Request) (*priceTable, bool) {
+	currency := strings.ToUpper(r.URL.Query().Get("fiat"))
+	if currency == "" {
+		return nil, true
+	}
+	table, err := loadPriceTable(s.db, currency)
+	if err != nil {
+		s.internalError(w, "failed to load prices", err)
+		return nil, false
+	}
+	return table, true
+}
+
+func (s *apiServer) internalError(w http.ResponseWriter, msg string, err error) {
+	logger.Error(msg, "error", err)
+	writeError(w, http.StatusInternalServerError, msg)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("failed to write response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 
 	"github.com/google/uuid"
 )
@@ -102,7 +101,7 @@ func generateFakeItems(page int, pageLimit int, totalTxs int) ([]Item, error) {
 	var item Item
 
 	numItems := calculate_items_on_page(page, pageLimit, totalTxs)
-	fmt.Println("Num Items: ", numItems)
+	logger.Debug("generating fake items", "page", page, "num_items", numItems)
 	items := make([]Item, numItems)
 
 	// Unmarshal the JSON data into the struct
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// Networks an address can belong to. Testnet and signet share address
+// formats, so signet addresses are reported as testnet.
+const (
+	networkMainnet = "mainnet"
+	networkTestnet = "testnet"
+	networkRegtest = "regtest"
+)
+
+var errInvalidAddress = errors.New("invalid address")
+
+// AddressInfo is what validateAddress learned about an address.
+type AddressInfo struct {
+	Address string `json:"address"`
+	Type    string `json:"type"`
+	Chain   string `json:"chain"`
+	Network string `json:"network"`
+}
+
+// validateAddress checks that s is a Base58Check P2PKH or P2SH address, a
+// Bech32 P2WPKH or P2WSH address, a Bech32m P2TR address or a CashAddr
+// address on one of the supported UTXO chains, or an EVM address, and
+// detects its type, chain and network. Bech32 addresses are returned in
+// lower case and CashAddr ones with their prefix.
+func validateAddress(s string) (AddressInfo, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return AddressInfo{}, fmt.Errorf("%w: empty", errInvalidAddress)
+	}
+	if info, ok, err := validateEVMAddress(s); ok {
+		return info, err
+	}
+	if lower := strings.ToLower(s); strings.HasPrefix(lower, "bc1") || strings.HasPrefix(lower, "tb1") ||
+		strings.HasPrefix(lower, "bcrt1") || strings.HasPrefix(lower, "ltc1") {
+		if s != lower && s != strings.ToUpper(s) {
+			return AddressInfo{}, fmt.Errorf("%w: mixed case bech32", errInvalidAddress)
+		}
+		s = lower
+	}
+
+	// Report why s is not a Bitcoin address, the likeliest intent.
+	var firstErr error
+	for _, c := range chains {
+		if c.Model == modelAccount {
+			continue
+		}
+		addr, err := c.decodeAddress(s)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		info := AddressInfo{Address: c.encodeAddress(addr), Chain: c.Name, Network: c.Network}
+		switch a := addr.(type) {
+		case *btcutil.AddressPubKeyHash:
+			info.Type = scriptP2PKH
+		case *btcutil.AddressScriptHash:
+			info.Type = scriptP2SH
+		case *btcutil.AddressWitnessPubKeyHash:
+			if a.WitnessVersion() != 0 {
+				return AddressInfo{}, fmt.Errorf("%w: unsupported witness version %d", errInvalidAddress, a.WitnessVersion())
+			}
+			info.Type = scriptP2WPKH
+		case *btcutil.AddressWitnessScriptHash:
+			info.Type = scriptP2WSH
+		case *btcutil.AddressTaproot:
+			info.Type = scriptP2TR
+		default:
+			return AddressInfo{}, fmt.Errorf("%w: not a payment address", errInvalidAddress)
+		}
+		return info, nil
+	}
+	return AddressInfo{}, fmt.Errorf("%w: %v", errInvalidAddress, firstErr)
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultCoreURL = "http://127.0.0.1:8332"
+
+// corePageEntries is how many wallet entries one listtransactions call
+// returns. A tx has an entry per address and category, so a page can hold
+// fewer txs.
+const corePageEntries = 100
+
+// corePendingWindow is how many of the wallet's newest entries are searched
+// for mempool txs.
+const corePendingWindow = 1000
+
+// Bitcoin Core RPC error codes we act on.
+const (
+	rpcInvalidAddressOrKey = -5
+)
+
+// coreConfig is how to reach a bitcoind JSON-RPC server. User and Password
+// take precedence over the cookie file bitcoind writes on startup.
+type coreConfig struct {
+	URL        string
+	User       string
+	Password   string
+	CookieFile string
+	Wallet     string
+}
+
+// coreProvider talks JSON-RPC to a self-hosted Bitcoin Core node. Core has
+// no address index, so addresses are imported into a watch-only wallet,
+// labelled with the address, and their txs are listed from the wallet.
+// Txs are read with getrawtransaction at verbosity 2 and their block's hash,
+// so -txindex is not needed.
+type coreProvider struct {
+	config coreConfig
+	nextId atomic.Int64
+
+	mu      sync.Mutex
+	labels  map[string]string // address → the wallet label it is listed under
+	heights map[string]int    // block hash → height
+}
+
+func newCoreProvider(c coreConfig) *coreProvider {
+	if c.URL == "" {
+		c.URL = defaultCoreURL
+	}
+	c.URL = strings.TrimRight(c.URL, "/")
+	return &coreProvider{config: c, labels: map[string]string{}, heights: map[string]int{}}
+}
+
+func (c *coreProvider) Name() string { return providerCore }
+
+func (c *coreProvider) PageSize() int { return corePageEntries }
+
+// rpcError is an error returned by bitcoind.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string { return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message) }
+
+func isRPCError(err error, code int) bool {
+	var e *rpcError
+	return errors.As(err, &e) && e.Code == code
+}
+
+// call invokes method, on the configured wallet if wallet is set, and
+// decodes the result into out.
+func (c *coreProvider) call(method string, wallet bool, out interface{}, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "1.0",
+		"id":      c.nextId.Add(1),
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	url := c.config.URL
+	if wallet && c.config.Wallet != "" {
+		url += "/wallet/" + c.config.Wallet
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	user, password, err := c.credentials()
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(user, password)
+
+	requested := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		observeProviderRequest(method, 0, requested)
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+	observeProviderRequest(method, res.StatusCode, requested)
+	if res.StatusCode == http.StatusUnauthorized {
+		return errors.New("rpc authentication failed")
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	// bitcoind reports RPC errors in the body, with a non-200 status.
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return fmt.Errorf("unexpected status %d: %s", res.StatusCode, bytes.TrimSpace(data))
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(response.Result, out); err != nil {
+		return fmt.Errorf("failed to unmarshal %s result: %w", method, err)
+	}
+	return nil
+}
+
+// credentials returns the configured user and password, or those in the
+// cookie file, which is read on each call since bitcoind rewrites it on
+// restart.
+func (c *coreProvider) credentials() (string, string, error) {
+	if c.config.User != "" {
+		return c.config.User, c.config.Password, nil
+	}
+	path := c.config.CookieFile
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to find the rpc cookie: %w", err)
+		}
+		path = home + "/.bitcoin/.cookie"
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read rpc cookie: %w", err)
+	}
+	user, password, ok := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if !ok {
+		return "", "", fmt.Errorf("malformed rpc cookie %s", path)
+	}
+	return user, password, nil
+}
+
+// watch makes sure the wallet watches address and returns the label its
+// txs are listed under. A new address is imported with a rescan from the
+// genesis block, which can take a long time on mainnet.
+func (c *coreProvider) watch(address string) (string, error) {
+	c.mu.Lock()
+	label, ok := c.labels[address]
+	c.mu.Unlock()
+	if ok {
+		return label, nil
+	}
+
+	var info struct {
+		IsMine      bool     `json:"ismine"`
+		IsWatchOnly bool     `json:"iswatchonly"`
+		Labels      []string `json:"labels"`
+	}
+	if err := c.call("getaddressinfo", true, &info, address); err != nil {
+		return "", err
+	}
+	label = address
+	switch {
+	case (info.IsMine || info.IsWatchOnly) && len(info.Labels) > 0:
+		label = info.Labels[0]
+	case !info.IsMine && !info.IsWatchOnly:
+		if err := c.importAddress(address); err != nil {
+			return "", fmt.Errorf("failed to import %s: %w", address, err)
+		}
+	}
+
+	c.mu.Lock()
+	c.labels[address] = label
+	c.mu.Unlock()
+	return label, nil
+}
+
+func (c *coreProvider) importAddress(address string) error {
+	var wallet struct {
+		Descriptors bool `json:"descriptors"`
+	}
+	if err := c.call("getwalletinfo", true, &wallet); err != nil {
+		return err
+	}
+	logger.Info("importing address into the node wallet; the rescan can take a while", "address", address)
+	if !wallet.Descriptors {
+		return c.call("importaddress", true, nil, address, address, true)
+	}
+
+	desc := "addr(" + address + ")"
+	checksum, err := descriptorChecksum(desc)
+	if err != nil {
+		return err
+	}
+	var results []struct {
+		Success bool      `json:"success"`
+		Error   *rpcError `json:"error"`
+	}
+	request := []map[string]interface{}{{"desc": desc + "#" + checksum, "timestamp": 0, "label": address}}
+	if err := c.call("importdescriptors", true, &results, request); err != nil {
+		return err
+	}
+	if len(results) != 1 || !results[0].Success {
+		if len(results) == 1 && results[0].Error != nil {
+			return results[0].Error
+		}
+		return errors.New("importdescriptors failed")
+	}
+	return nil
+}
+
+// coreEntry is one listtransactions entry.
+type coreEntry struct {
+	Address       string `json:"address"`
+	Txid          string `json:"txid"`
+	Confirmations int    `json:"confirmations"`
+	Blockhash     string `json:"blockhash"`
+}
+
+// entries lists address's wallet entries, oldest first, after skipping the
+// skip newest.
+func (c *coreProvider) entries(address string, count int, skip int) ([]coreEntry, int, error) {
+	label, err := c.watch(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	var all []coreEntry
+	if err := c.call("listtransactions", true, &all, label, count, skip, true); err != nil {
+		return nil, 0, err
+	}
+	entries := []coreEntry{}
+	for _, e := range all {
+		if e.Address == address {
+			entries = append(entries, e)
+		}
+	}
+	return entries, len(all), nil
+}
+
+func (c *coreProvider) CountTxs(address string) (int, error) {
+	entries, _, err := c.entries(address, math.MaxInt32, 0)
+	if err != nil {
+		return -1, err
+	}
+	seen := map[string]bool{}
+	for _, e := range entries {
+		if e.Confirmations > 0 {
+			seen[e.Txid] = true
+		}
+	}
+	return len(seen), nil
+}
+
+// TxsAfter pages through the wallet's entries, newest first; the cursor is
+// the number of entries already skipped.
+func (c *coreProvider) TxsAfter(address string, cursor string) ([]Item, string, error) {
+	skip := 0
+	if cursor != "" {
+		n, err := strconv.Atoi(cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+		}
+		skip = n
+	}
+	entries, listed, err := c.entries(address, corePageEntries, skip)
+	if err != nil {
+		return nil, "", err
+	}
+
+	items := []Item{}
+	seen := map[string]bool{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.Confirmations <= 0 || seen[e.Txid] {
+			continue
+		}
+		seen[e.Txid] = true
+		item, err := c.rawTx(e.Txid, e.Blockhash)
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, item)
+	}
+	next := ""
+	if listed == corePageEntries {
+		next = strconv.Itoa(skip + listed)
+	}
+	return items, next, nil
+}
+
+func (c *coreProvider) PendingTxs(address string) ([]Item, error) {
+	entries, _, err := c.entries(address, corePendingWindow, 0)
+	if err != nil {
+		return nil, err
+	}
+	items := []Item{}
+	seen := map[string]bool{}
+	for _, e := range entries {
+		// Conflicted txs have negative confirmations.
+		if e.Confirmations != 0 || seen[e.Txid] {
+			continue
+		}
+		seen[e.Txid] = true
+		item, err := c.rawTx(e.Txid, "")
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Tx finds the tx's block through the wallet, falling back to the mempool
+// and -txindex for txs the wallet does not know.
+func (c *coreProvider) Tx(txId string) (Item, error) {
+	var wtx struct {
+		Blockhash string `json:"blockhash"`
+	}
+	err := c.call("gettransaction", true, &wtx, txId, true)
+	if err != nil && !isRPCError(err, rpcInvalidAddressOrKey) {
+		return Item{}, err
+	}
+	item, err := c.rawTx(txId, wtx.Blockhash)
+	if isRPCError(err, rpcInvalidAddressOrKey) {
+		return Item{}, errProviderNotFound
+	}
+	return item, err
+}
+
+func (c *coreProvider) ChainTip() (ChainTip, error) {
+	var info struct {
+		Blocks        int    `json:"blocks"`
+		BestBlockHash string `json:"bestblockhash"`
+	}
+	if err := c.call("getblockchaininfo", false, &info); err != nil {
+		return ChainTip{}, err
+	}
+	return ChainTip{Height: info.Blocks, Hash: info.BestBlockHash, UpdatedAt: time.Now().UTC()}, nil
+}
+
+func (c *coreProvider) BlockHash(height int) (string, error) {
+	var hash string
+	err := c.call("getblockhash", false, &hash, height)
+	return hash, err
+}
+
+// blockHeight returns the height of a block, caching it by hash.
+func (c *coreProvider) blockHeight(hash string) (int, error) {
+	c.mu.Lock()
+	height, ok := c.heights[hash]
+	c.mu.Unlock()
+	if ok {
+		return height, nil
+	}
+	var header struct {
+		Height int `json:"height"`
+	}
+	if err := c.call("getblockheader", false, &header, hash); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	c.heights[hash] = header.Height
+	c.mu.Unlock()
+	return header.Height, nil
+}
+
+type coreScriptPubKey struct {
+	Asm       string   `json:"asm"`
+	Hex       string   `json:"hex"`
+	Type      string   `json:"type"`
+	Address   string   `json:"address"`
+	Addresses []string `json:"addresses"` // before Core 22
+}
+
+func (s coreScriptPubKey) addresses() []string {
+	if s.Address != "" {
+		return []string{s.Address}
+	}
+	return s.Addresses
+}
+
+type coreTx struct {
+	Txid      string `json:"txid"`
+	Hash      string `json:"hash"`
+	Version   int    `json:"version"`
+	Size      int    `json:"size"`
+	Vsize     int    `json:"vsize"`
+	Locktime  int    `json:"locktime"`
+	Blockhash string `json:"blockhash"`
+	Blocktime int64  `json:"blocktime"`
+	Vin       []struct {
+		Txid      string `json:"txid"`
+		Vout      int    `json:"vout"`
+		ScriptSig struct {
+			Asm string `json:"asm"`
+			Hex string `json:"hex"`
+		} `json:"scriptSig"`
+		Txinwitness []string `json:"txinwitness"`
+		Prevout     *struct {
+			Value        json.Number      `json:"value"`
+			ScriptPubKey coreScriptPubKey `json:"scriptPubKey"`
+		} `json:"prevout"`
+		Sequence uint32 `json:"sequence"`
+	} `json:"vin"`
+	Vout []struct {
+		Value        json.Number      `json:"value"`
+		ScriptPubKey coreScriptPubKey `json:"scriptPubKey"`
+	} `json:"vout"`
+	Fee json.Number `json:"fee"`
+}
+
+// rawTx fetches a tx with its prevouts. blockhash is needed for confirmed
+// txs unless the node runs with -txindex.
+func (c *coreProvider) rawTx(txId string, blockhash string) (Item, error) {
+	params := []interface{}{txId, 2}
+	if blockhash != "" {
+		params = append(params, blockhash)
+	}
+	var t coreTx
+	if err := c.call("getrawtransaction", false, &t, params...); err != nil {
+		return Item{}, err
+	}
+	item, err := t.item()
+	if err != nil {
+		return Item{}, fmt.Errorf("failed to map tx %s: %w", txId, err)
+	}
+	if t.Blockhash != "" {
+		height, err := c.blockHeight(t.Blockhash)
+		if err != nil {
+			return Item{}, err
+		}
+		item.MinedInBlockHeight = height
+	}
+	return item, nil
+}
+
+// item maps a getrawtransaction result into our model. Core already uses
+// the script type names and amount format Item expects; amounts are
+// normalized to 8 decimals.
+func (t coreTx) item() (Item, error) {
+	item := Item{
+		TransactionId:    t.Txid,
+		TransactionHash:  t.Hash,
+		MinedInBlockHash: t.Blockhash,
+		Timestamp:        t.Blocktime,
+		BlockchainSpecific: BlockchainSpecific{
+			Locktime: t.Locktime,
+			Size:     t.Size,
+			VSize:    t.Vsize,
+			Version:  t.Version,
+		},
+	}
+	if item.Timestamp == 0 {
+		item.Timestamp = time.Now().Unix()
+	}
+
+	var totalIn, totalOut int64
+	prevoutsKnown := true
+	senders := participants{}
+	for _, in := range t.Vin {
+		vin := Vin{
+			ScriptSig:   ScriptSig{Asm: in.ScriptSig.Asm, Hex: in.ScriptSig.Hex},
+			Sequence:    strconv.FormatUint(uint64(in.Sequence), 10),
+			Txid:        in.Txid,
+			Txinwitness: in.Txinwitness,
+			Vout:        in.Vout,
+		}
+		if in.Prevout == nil {
+			prevoutsKnown = false
+		} else {
+			value, err := parseUnits(string(in.Prevout.Value), btcDecimals)
+			if err != nil {
+				return Item{}, err
+			}
+			totalIn += value
+			vin.Value = formatUnits(value, btcDecimals)
+			vin.ScriptSig.Type = in.Prevout.ScriptPubKey.Type
+			vin.Addresses = in.Prevout.ScriptPubKey.addresses()
+			if len(vin.Addresses) == 1 {
+				senders.add(vin.Addresses[0], value)
+			}
+		}
+		item.BlockchainSpecific.Vin = append(item.BlockchainSpecific.Vin, vin)
+	}
+
+	recipients := participants{}
+	for _, out := range t.Vout {
+		value, err := parseUnits(string(out.Value), btcDecimals)
+		if err != nil {
+			return Item{}, err
+		}
+		totalOut += value
+		spk := out.ScriptPubKey
+		vout := Vout{
+			ScriptPubKey: ScriptPubKey{Addresses: spk.addresses(), Asm: spk.Asm, Hex: spk.Hex, Type: spk.Type},
+			Value:        formatUnits(value, btcDecimals),
+		}
+		if len(vout.ScriptPubKey.Addresses) == 1 {
+			recipients.add(vout.ScriptPubKey.Addresses[0], value)
+		}
+		item.BlockchainSpecific.Vout = append(item.BlockchainSpecific.Vout, vout)
+	}
+	item.Senders = senders.list()
+	item.Recipients = recipients.list()
+
+	item.Fee = Fee{Unit: "BTC"}
+	switch {
+	case t.Fee != "":
+		fee, err := parseUnits(string(t.Fee), btcDecimals)
+		if err != nil {
+			return Item{}, err
+		}
+		item.Fee.Amount = formatUnits(fee, btcDecimals)
+	case prevoutsKnown && len(t.Vin) > 0:
+		item.Fee.Amount = formatUnits(totalIn-totalOut, btcDecimals)
+	}
+	return item, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	tt "testing"
+)
+
+const (
+	coreTestTxid  = "aa11000000000000000000000000000000000000000000000000000000000000"
+	coreTestWtxid = "bb22000000000000000000000000000000000000000000000000000000000000"
+	coreTestBlock = "0000000000000000000200000000000000000000000000000000000000000000"
+)
+
+// coreTestRawTx is getrawtransaction verbosity 2 output for a tx spending
+// 0.001 BTC from a Core 22+ prevout and 0.0005 from a pre-22 one.
+const coreTestRawTx = `{
+	"txid": "` + coreTestTxid + `", "hash": "` + coreTestWtxid + `",
+	"version": 2, "size": 370, "vsize": 208, "locktime": 0,
+	"blockhash": "` + coreTestBlock + `", "blocktime": 1713571767,
+	"vin": [
+		{"txid": "cc33000000000000000000000000000000000000000000000000000000000000", "vout": 0,
+		 "scriptSig": {"asm": "", "hex": ""}, "txinwitness": ["3044", "02aa"], "sequence": 4294967293,
+		 "prevout": {"value": 0.001, "scriptPubKey": {"type": "witness_v0_keyhash", "hex": "0014e8df018c7e326cc253faac7e46cdc51e68542c42",
+		  "address": "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"}}},
+		{"txid": "dd44000000000000000000000000000000000000000000000000000000000000", "vout": 3,
+		 "scriptSig": {"asm": "3044 02bb", "hex": "02304402bb"}, "sequence": 4294967295,
+		 "prevout": {"value": 0.0005, "scriptPubKey": {"type": "pubkeyhash", "addresses": ["1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"]}}}
+	],
+	"vout": [
+		{"value": 0.0012, "scriptPubKey": {"type": "witness_v0_keyhash", "hex": "0014751e76e8199196d454941c45d1b3a323f1433bd6",
+		 "asm": "0 751e76e8199196d454941c45d1b3a323f1433bd6", "address": "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"}},
+		{"value": 0, "scriptPubKey": {"type": "nulldata", "hex": "6a0568656c6c6f", "asm": "OP_RETURN 68656c6c6f"}}
+	]
+}`
+
+// coreStub answers JSON-RPC calls from results by method, recording them.
+// A result that is an *rpcError is returned as an error, as bitcoind does.
+type coreStub struct {
+	results map[string]interface{}
+	calls   []string
+	params  map[string][]interface{}
+}
+
+func (s *coreStub) serve(t *tt.T) *coreProvider {
+	t.Helper()
+	s.params = map[string][]interface{}{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "rpc" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Id     int64         `json:"id"`
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("bad request body: %v", err)
+		}
+		s.calls = append(s.calls, req.Method)
+		s.params[req.Method] = req.Params
+		res := map[string]interface{}{"id": req.Id, "result": nil, "error": nil}
+		switch v := s.results[req.Method].(type) {
+		case *rpcError:
+			res["error"] = v
+			w.WriteHeader(http.StatusInternalServerError)
+		case string:
+			res["result"] = json.RawMessage(v)
+		default:
+			res["result"] = v
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	t.Cleanup(srv.Close)
+	return newCoreProvider(coreConfig{URL: srv.URL, User: "rpc", Password: "secret", Wallet: "watch"})
+}
+
+func TestCoreTxMapping(t *tt.T) {
+	stub := &coreStub{results: map[string]interface{}{
+		"gettransaction":    map[string]string{"blockhash": coreTestBlock},
+		"getrawtransaction": coreTestRawTx,
+		"getblockheader":    map[string]int{"height": 840001},
+	}}
+	c := stub.serve(t)
+
+	item, err := c.Tx(coreTestTxid)
+	if err != nil {
+		t.Fatalf("Tx: %v", err)
+	}
+	// Without -txindex the block hash must be passed along.
+	if want := []interface{}{coreTestTxid, 2.0, coreTestBlock}; !reflect.DeepEqual(stub.params["getrawtransaction"], want) {
+		t.Errorf("getrawtransaction params = %v, want %v", stub.params["getrawtransaction"], want)
+	}
+	if item.TransactionId != coreTestTxid || item.TransactionHash != coreTestWtxid {
+		t.Errorf("ids = %s %s", item.TransactionId, item.TransactionHash)
+	}
+	if item.MinedInBlockHash != coreTestBlock || item.MinedInBlockHeight != 840001 || item.Timestamp != 1713571767 {
+		t.Errorf("block = %s %d at %d", item.MinedInBlockHash, item.MinedInBlockHeight, item.Timestamp)
+	}
+	// 0.0015 in, 0.0012 out, and no fee field: the fee comes from prevouts.
+	if item.Fee != (Fee{Amount: "0.00030000", Unit: "BTC"}) {
+		t.Errorf("Fee = %+v", item.Fee)
+	}
+
+	vin := item.BlockchainSpecific.Vin
+	if len(vin) != 2 {
+		t.Fatalf("got %d inputs, want 2", len(vin))
+	}
+	if vin[0].Value != "0.00100000" || vin[0].ScriptSig.Type != "witness_v0_keyhash" || vin[0].Sequence != "4294967293" ||
+		!reflect.DeepEqual(vin[0].Txinwitness, []string{"3044", "02aa"}) {
+		t.Errorf("vin[0] = %+v", vin[0])
+	}
+	if vin[1].Vout != 3 || vin[1].ScriptSig.Hex != "02304402bb" || !reflect.DeepEqual(vin[1].Addresses, []string{"1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"}) {
+		t.Errorf("vin[1] = %+v", vin[1])
+	}
+	vout := item.BlockchainSpecific.Vout
+	if len(vout) != 2 || vout[0].Value != "0.00120000" || vout[0].ScriptPubKey.Asm == "" ||
+		vout[1].ScriptPubKey.Type != "nulldata" || vout[1].ScriptPubKey.Addresses != nil {
+		t.Errorf("vout = %+v", vout)
+	}
+	wantSenders := []Participant{
+		{Address: "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq", Amount: "0.00100000"},
+		{Address: "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", Amount: "0.00050000"},
+	}
+	wantRecipients := []Participant{{Address: "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", Amount: "0.00120000"}}
+	if !reflect.DeepEqual(item.Senders, wantSenders) || !reflect.DeepEqual(item.Recipients, wantRecipients) {
+		t.Errorf("Senders = %+v, Recipients = %+v", item.Senders, item.Recipients)
+	}
+
+	// The block's height is cached by hash.
+	if _, err := c.Tx(coreTestTxid); err != nil {
+		t.Fatalf("Tx: %v", err)
+	}
+	headers := 0
+	for _, m := range stub.calls {
+		if m == "getblockheader" {
+			headers++
+		}
+	}
+	if headers != 1 {
+		t.Errorf("getblockheader called %d times, want 1", headers)
+	}
+}
+
+func TestCoreTxNotFound(t *tt.T) {
+	notFound := &rpcError{Code: rpcInvalidAddressOrKey, Message: "No such mempool or blockchain transaction"}
+	stub := &coreStub{results: map[string]interface{}{
+		"gettransaction":    &rpcError{Code: rpcInvalidAddressOrKey, Message: "Invalid or non-wallet transaction id"},
+		"getrawtransaction": notFound,
+	}}
+	c := stub.serve(t)
+
+	if _, err := c.Tx(coreTestTxid); !errors.Is(err, errProviderNotFound) {
+		t.Fatalf("Tx error = %v, want errProviderNotFound", err)
+	}
+	// Unknown to the wallet, the tx is looked up without a block hash.
+	if want := []interface{}{coreTestTxid, 2.0}; !reflect.DeepEqual(stub.params["getrawtransaction"], want) {
+		t.Errorf("getrawtransaction params = %v, want %v", stub.params["getrawtransaction"], want)
+	}
+}
+
+func TestCoreAuthFailure(t *tt.T) {
+	c := (&coreStub{}).serve(t)
+	c.config.Password = "wrong"
+	if _, err := c.ChainTip(); err == nil || err.Error() != "rpc authentication failed" {
+		t.Fatalf("ChainTip error = %v, want an authentication failure", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The fake provider's chain: its tip sits a few blocks above the block the
+// fake txs are mined in.
+const (
+	fakeTipHeight = 831100
+	fakeBlockHash = "0000000000000000000199dcfdf7852c9425a671fffa01e379dc133f5edb6fa5"
+	fakeBlock     = 831087
+)
+
+// ChainTip is the most recent block we have seen.
+type ChainTip struct {
+	Height    int       `json:"height"`
+	Hash      string    `json:"hash"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// confirmations returns how many blocks deep height is below the tip: 1 for
+// a tx in the tip itself, 0 for an unmined tx or an unknown tip.
+func (t ChainTip) confirmations(height int) int {
+	if height <= 0 || t.Height < height {
+		return 0
+	}
+	return t.Height - height + 1
+}
+
+// fakeHashAt makes up a stable hash for a fake block; the fake txs' block
+// keeps its real hash so it is never seen as orphaned.
+func fakeHashAt(height int) string {
+	if height == fakeBlock {
+		return fakeBlockHash
+	}
+	return fmt.Sprintf("%064x", height)
+}
+
+// updateChainTip fetches the tip of chain c from p and stores it.
+func updateChainTip(db *sql.DB, c *Chain, p tipSource) (ChainTip, error) {
+	tip, err := p.ChainTip()
+	if err != nil {
+		return tip, fmt.Errorf("failed to get chain tip: %w", err)
+	}
+	_, err = db.Exec(`
+		INSERT INTO chain_tip (chain, height, hash, updated_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (chain) DO UPDATE SET height = EXCLUDED.height, hash = EXCLUDED.hash, updated_at = EXCLUDED.updated_at`,
+		c.Key(), tip.Height, tip.Hash, tip.UpdatedAt)
+	if err != nil {
+		return tip, fmt.Errorf("failed to store chain tip: %w", err)
+	}
+	return tip, nil
+}
+
+// loadChainTip returns the stored tip of chain c, or a zero tip if no sync
+// has stored one yet.
+func loadChainTip(db *sql.DB, c *Chain) (ChainTip, error) {
+	var tip ChainTip
+	err := db.QueryRow(`SELECT height, hash, updated_at FROM chain_tip WHERE chain = $1`, c.Key()).
+		Scan(&tip.Height, &tip.Hash, &tip.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ChainTip{}, nil
+	}
+	return tip, err
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Chains an address can be on. Each is tracked per network, so Bitcoin
+// testnet is the chain "bitcoin" on the network "testnet".
+const (
+	chainNameBitcoin     = "bitcoin"
+	chainNameLitecoin    = "litecoin"
+	chainNameDogecoin    = "dogecoin"
+	chainNameBitcoinCash = "bitcoin-cash"
+	chainNameEthereum    = "ethereum"
+	chainNamePolygon     = "polygon"
+	chainNameArbitrum    = "arbitrum"
+)
+
+// Transaction models. UTXO chains store Items; account chains, the EVM
+// ones, store EVMTxs.
+const (
+	modelUTXO    = "utxo"
+	modelAccount = "account"
+)
+
+// Chain is a chain on one network, with everything that differs between
+// chains: address formats, the unit amounts are in and how providers name
+// it. UTXO chains share the Item model and account chains the EVMTx one.
+type Chain struct {
+	Name     string
+	Network  string
+	Model    string
+	Unit     string
+	Decimals int
+
+	params *chaincfg.Params
+	// cashAddrPrefix is set on chains whose addresses are in CashAddr form.
+	cashAddrPrefix string
+
+	cryptoapisBlockchain string
+	cryptoapisNetwork    string
+	esploraURL           string
+
+	// evmChainID is the EIP-155 chain id account chains are known by to
+	// Etherscan.
+	evmChainID int
+}
+
+// Key identifies the chain in the chain_tip table and in -chain-provider:
+// the chain's name on mainnet, else name-network.
+func (c *Chain) Key() string {
+	if c.Network == networkMainnet {
+		return c.Name
+	}
+	return c.Name + "-" + c.Network
+}
+
+var litecoinParams = func() chaincfg.Params {
+	p := chaincfg.MainNetParams
+	p.Name = "litecoin"
+	p.Net = wire.BitcoinNet(0xdbb6c0fb)
+	p.PubKeyHashAddrID = 0x30
+	p.ScriptHashAddrID = 0x32
+	p.Bech32HRPSegwit = "ltc"
+	return p
+}()
+
+var dogecoinParams = func() chaincfg.Params {
+	p := chaincfg.MainNetParams
+	p.Name = "dogecoin"
+	p.Net = wire.BitcoinNet(0xc0c0c0c0)
+	p.PubKeyHashAddrID = 0x1e
+	p.ScriptHashAddrID = 0x16
+	p.Bech32HRPSegwit = ""
+	return p
+}()
+
+// Bitcoin Cash forked from Bitcoin and kept its legacy address versions,
+// but its addresses are written in CashAddr.
+var bitcoinCashParams = func() chaincfg.Params {
+	p := chaincfg.MainNetParams
+	p.Name = "bitcoin-cash"
+	p.Net = wire.BitcoinNet(0xe8f3e1e3)
+	p.Bech32HRPSegwit = ""
+	return p
+}()
+
+func init() {
+	// Bech32 prefixes are only recognized once registered.
+	if err := chaincfg.Register(&litecoinParams); err != nil {
+		panic(err)
+	}
+}
+
+var (
+	chainBitcoin = &Chain{
+		Name: chainNameBitcoin, Network: networkMainnet, Model: modelUTXO, Unit: "BTC", Decimals: btcDecimals,
+		params:               &chaincfg.MainNetParams,
+		cryptoapisBlockchain: "bitcoin", cryptoapisNetwork: "mainnet",
+		esploraURL: defaultEsploraURL,
+	}
+	chainBitcoinTestnet = &Chain{
+		Name: chainNameBitcoin, Network: networkTestnet, Model: modelUTXO, Unit: "tBTC", Decimals: btcDecimals,
+		params:               &chaincfg.TestNet3Params,
+		cryptoapisBlockchain: "bitcoin", cryptoapisNetwork: "testnet",
+		esploraURL: "https://blockstream.info/testnet/api",
+	}
+	chainBitcoinRegtest = &Chain{
+		Name: chainNameBitcoin, Network: networkRegtest, Model: modelUTXO, Unit: "rBTC", Decimals: btcDecimals,
+		params: &chaincfg.RegressionNetParams,
+	}
+	chainLitecoin = &Chain{
+		Name: chainNameLitecoin, Network: networkMainnet, Model: modelUTXO, Unit: "LTC", Decimals: 8,
+		params:               &litecoinParams,
+		cryptoapisBlockchain: "litecoin", cryptoapisNetwork: "mainnet",
+		esploraURL: "https://litecoinspace.org/api",
+	}
+	chainDogecoin = &Chain{
+		Name: chainNameDogecoin, Network: networkMainnet, Model: modelUTXO, Unit: "DOGE", Decimals: 8,
+		params:               &dogecoinParams,
+		cryptoapisBlockchain: "dogecoin", cryptoapisNetwork: "mainnet",
+	}
+	chainBitcoinCash = &Chain{
+		Name: chainNameBitcoinCash, Network: networkMainnet, Model: modelUTXO, Unit: "BCH", Decimals: 8,
+		params:               &bitcoinCashParams,
+		cashAddrPrefix:       "bitcoincash",
+		cryptoapisBlockchain: "bitcoin-cash", cryptoapisNetwork: "mainnet",
+	}
+	chainEthereum = &Chain{
+		Name: chainNameEthereum, Network: networkMainnet, Model: modelAccount, Unit: "ETH", Decimals: evmDecimals,
+		evmChainID: 1,
+	}
+	chainPolygon = &Chain{
+		Name: chainNamePolygon, Network: networkMainnet, Model: modelAccount, Unit: "POL", Decimals: evmDecimals,
+		evmChainID: 137,
+	}
+	chainArbitrum = &Chain{
+		Name: chainNameArbitrum, Network: networkMainnet, Model: modelAccount, Unit: "ETH", Decimals: evmDecimals,
+		evmChainID: 42161,
+	}
+)
+
+// chains lists every supported chain in the order addresses are matched
+// against them. Legacy P2SH addresses of Litecoin and Bitcoin Cash use
+// Bitcoin's version byte and are taken as Bitcoin; Bitcoin Cash addresses
+// must be given in CashAddr form. EVM addresses are the same on every EVM
+// chain and are taken as Ethereum unless prefixed with another chain's
+// name, as in polygon:0x....
+var chains = []*Chain{chainBitcoin, chainBitcoinTestnet, chainBitcoinRegtest, chainLitecoin, chainDogecoin, chainBitcoinCash,
+	chainEthereum, chainPolygon, chainArbitrum}
+
+var errUnknownChain = errors.New("unknown chain")
+
+// chainOf returns the chain with the given name and network. Rows from
+// before chains were stored have no chain and are Bitcoin.
+func chainOf(name string, network string) (*Chain, error) {
+	if name == "" {
+		name = chainNameBitcoin
+	}
+	if network == "" {
+		network = networkMainnet
+	}
+	for _, c := range chains {
+		if c.Name == name && c.Network == network {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s on %s", errUnknownChain, name, network)
+}
+
+// addressChain returns the chain of a tracked address. An address that
+// does not validate has nothing stored and is taken as Bitcoin.
+func addressChain(address string) *Chain {
+	info, err := validateAddress(address)
+	if err != nil {
+		return chainBitcoin
+	}
+	c, err := chainOf(info.Chain, info.Network)
+	if err != nil {
+		return chainBitcoin
+	}
+	return c
+}
+
+func chainByKey(key string) (*Chain, error) {
+	for _, c := range chains {
+		if c.Key() == key {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errUnknownChain, key)
+}
+
+// chainOfUnit returns the first chain whose amounts are in unit. Arbitrum
+// pays its fees in ETH too, with the same decimals.
+func chainOfUnit(unit string) (*Chain, bool) {
+	for _, c := range chains {
+		if c.Unit == unit {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// unitDecimals is how many decimals amounts in unit have. Txs stored before
+// units were normalized say BTC or nothing; any other unit is an ERC-20
+// token.
+func unitDecimals(unit string) int {
+	if c, ok := chainOfUnit(unit); ok {
+		return c.Decimals
+	}
+	if unit == "" {
+		return btcDecimals
+	}
+	return tokenUnitDecimals(unit)
+}
+
+// normalizeItem puts a provider's tx in the chain's terms: amounts in the
+// chain's unit, whatever the provider calls it, and CashAddr addresses with
+// their prefix, as tracked addresses are stored.
+func (c *Chain) normalizeItem(item *Item) {
+	item.Fee.Unit = c.Unit
+	if c.cashAddrPrefix == "" {
+		return
+	}
+	prefix := func(address string) string {
+		if address == "" || strings.Contains(address, ":") {
+			return address
+		}
+		if _, _, err := decodeCashAddr(c.cashAddrPrefix, address); err != nil {
+			return address
+		}
+		return c.cashAddrPrefix + ":" + strings.ToLower(address)
+	}
+	for i := range item.Senders {
+		item.Senders[i].Address = prefix(item.Senders[i].Address)
+	}
+	for i := range item.Recipients {
+		item.Recipients[i].Address = prefix(item.Recipients[i].Address)
+	}
+	for i := range item.BlockchainSpecific.Vin {
+		for j, a := range item.BlockchainSpecific.Vin[i].Addresses {
+			item.BlockchainSpecific.Vin[i].Addresses[j] = prefix(a)
+		}
+	}
+	for i := range item.BlockchainSpecific.Vout {
+		for j, a := range item.BlockchainSpecific.Vout[i].ScriptPubKey.Addresses {
+			item.BlockchainSpecific.Vout[i].ScriptPubKey.Addresses[j] = prefix(a)
+		}
+	}
+}
+
+// encodeAddress writes addr in the chain's address format.
+func (c *Chain) encodeAddress(addr btcutil.Address) string {
+	if c.cashAddrPrefix == "" {
+		return addr.EncodeAddress()
+	}
+	switch a := addr.(type) {
+	case *btcutil.AddressPubKeyHash:
+		return encodeCashAddr(c.cashAddrPrefix, cashAddrP2PKH, a.ScriptAddress())
+	case *btcutil.AddressScriptHash:
+		return encodeCashAddr(c.cashAddrPrefix, cashAddrP2SH, a.ScriptAddress())
+	}
+	return addr.EncodeAddress()
+}
+
+// decodeAddress parses s as an address of the chain.
+func (c *Chain) decodeAddress(s string) (btcutil.Address, error) {
+	if c.cashAddrPrefix == "" {
+		addr, err := btcutil.DecodeAddress(s, c.params)
+		if err != nil {
+			return nil, err
+		}
+		if !addr.IsForNet(c.params) {
+			return nil, fmt.Errorf("not a %s address", c.Key())
+		}
+		return addr, nil
+	}
+	kind, hash, err := decodeCashAddr(c.cashAddrPrefix, s)
+	if err != nil {
+		return nil, err
+	}
+	if kind == cashAddrP2SH {
+		return btcutil.NewAddressScriptHashFromHash(hash, c.params)
+	}
+	return btcutil.NewAddressPubKeyHash(hash, c.params)
+}
+
+// Providers for chains other than Bitcoin mainnet, which uses provider.
+// main fills chainProviders from -chain-provider; chains without one use
+// cryptoapis.io, or the fake provider while testing.
+var chainProviders = map[string]Provider{}
+
+// providerFor returns the provider that syncs chain.
+func providerFor(c *Chain) (Provider, error) {
+	if c == chainBitcoin {
+		return provider, nil
+	}
+	if c.Model == modelAccount {
+		return nil, fmt.Errorf("%s is an account chain; sync it with an AccountProvider", c.Key())
+	}
+	if p, ok := chainProviders[c.Key()]; ok {
+		return p, nil
+	}
+	if testing {
+		return fakeProvider{}, nil
+	}
+	if c.cryptoapisBlockchain == "" {
+		return nil, fmt.Errorf("no provider for %s; set one with -chain-provider", c.Key())
+	}
+	return newCryptoapisProvider(c), nil
+}
+
+// parseChainProvider configures a provider from a -chain-provider value,
+// chain=name or chain=esplora:url. Esplora defaults to the chain's public
+// instance. Account chains take chain=fake or chain=etherscan[:url].
+func parseChainProvider(value string) error {
+	key, spec, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("invalid -chain-provider %q: use chain=provider", value)
+	}
+	c, err := chainByKey(key)
+	if err != nil {
+		return fmt.Errorf("invalid -chain-provider %q: %w; use one of %s", value, err, strings.Join(chainKeys(), ", "))
+	}
+	name, url, _ := strings.Cut(spec, ":")
+	if c.Model == modelAccount {
+		return parseAccountProvider(c, value, name, url)
+	}
+	switch name {
+	case providerFake:
+		chainProviders[c.Key()] = fakeProvider{}
+	case providerCryptoapis:
+		if c.cryptoapisBlockchain == "" {
+			return fmt.Errorf("cryptoapis.io does not serve %s", c.Key())
+		}
+		chainProviders[c.Key()] = newCryptoapisProvider(c)
+	case providerEsplora:
+		if url == "" {
+			url = c.esploraURL
+		}
+		if url == "" {
+			return fmt.Errorf("no public Esplora for %s; give its url as %s=esplora:url", c.Key(), c.Key())
+		}
+		chainProviders[c.Key()] = newEsploraProvider(url)
+	default:
+		return fmt.Errorf("invalid -chain-provider %q: other chains use fake, cryptoapis or esplora", value)
+	}
+	return nil
+}
+
+func chainKeys() []string {
+	keys := make([]string, 0, len(chains))
+	for _, c := range chains {
+		keys = append(keys, c.Key())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CashAddr address types.
+const (
+	cashAddrP2PKH = 0
+	cashAddrP2SH  = 1
+)
+
+const cashAddrCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func cashAddrPolymod(values []byte) uint64 {
+	c := uint64(1)
+	for _, d := range values {
+		c0 := byte(c >> 35)
+		c = ((c & 0x07ffffffff) << 5) ^ uint64(d)
+		if c0&0x01 != 0 {
+			c ^= 0x98f2bc8e61
+		}
+		if c0&0x02 != 0 {
+			c ^= 0x79b76d99e2
+		}
+		if c0&0x04 != 0 {
+			c ^= 0xf33e5fb3c4
+		}
+		if c0&0x08 != 0 {
+			c ^= 0xae2eabe2a8
+		}
+		if c0&0x10 != 0 {
+			c ^= 0x1e4f43e470
+		}
+	}
+	return c ^ 1
+}
+
+func cashAddrPrefixValues(prefix string) []byte {
+	values := make([]byte, 0, len(prefix)+1)
+	for i := 0; i < len(prefix); i++ {
+		values = append(values, prefix[i]&0x1f)
+	}
+	return append(values, 0)
+}
+
+// convertBits regroups data from groups of from bits into groups of to bits.
+func convertBits(data []byte, from uint, to uint, pad bool) ([]byte, error) {
+	var acc, bits uint
+	out := []byte{}
+	maxv := uint(1)<<to - 1
+	for _, v := range data {
+		acc = acc<<from | uint(v)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, errors.New("invalid padding")
+	}
+	return out, nil
+}
+
+// encodeCashAddr writes a 20 byte hash as a CashAddr address.
+func encodeCashAddr(prefix string, kind byte, hash []byte) string {
+	payload, _ := convertBits(append([]byte{kind << 3}, hash...), 8, 5, true)
+	checksum := cashAddrPolymod(append(append(cashAddrPrefixValues(prefix), payload...), make([]byte, 8)...))
+	var b strings.Builder
+	b.WriteString(prefix + ":")
+	for _, v := range payload {
+		b.WriteByte(cashAddrCharset[v])
+	}
+	for i := 0; i < 8; i++ {
+		b.WriteByte(cashAddrCharset[checksum>>(5*(7-i))&0x1f])
+	}
+	return b.String()
+}
+
+// decodeCashAddr parses a CashAddr address, with or without its prefix,
+// into its type and 20 byte hash.
+func decodeCashAddr(prefix string, s string) (byte, []byte, error) {
+	if s != strings.ToLower(s) && s != strings.ToUpper(s) {
+		return 0, nil, errors.New("mixed case cashaddr")
+	}
+	s = strings.ToLower(s)
+	if p, rest, ok := strings.Cut(s, ":"); ok {
+		if p != prefix {
+			return 0, nil, fmt.Errorf("cashaddr prefix %q, want %q", p, prefix)
+		}
+		s = rest
+	}
+	if len(s) != 42 {
+		return 0, nil, errors.New("not a cashaddr")
+	}
+	values := make([]byte, len(s))
+	for i := 0; i < len(s); i++ {
+		v := strings.IndexByte(cashAddrCharset, s[i])
+		if v < 0 {
+			return 0, nil, fmt.Errorf("invalid cashaddr character %q", s[i])
+		}
+		values[i] = byte(v)
+	}
+	if cashAddrPolymod(append(cashAddrPrefixValues(prefix), values...)) != 0 {
+		return 0, nil, errors.New("invalid cashaddr checksum")
+	}
+	data, err := convertBits(values[:len(values)-8], 5, 8, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	version, hash := data[0], data[1:]
+	if version&0x07 != 0 || len(hash) != 20 {
+		return 0, nil, errors.New("unsupported cashaddr hash size")
+	}
+	kind := version >> 3
+	if kind != cashAddrP2PKH && kind != cashAddrP2SH {
+		return 0, nil, fmt.Errorf("unsupported cashaddr type %d", kind)
+	}
+	return kind, hash, nil
+}
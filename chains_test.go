@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	tt "testing"
+)
+
+// CashAddr test vectors from the spec and Bitcoin ABC.
+var cashAddrVectors = []struct {
+	prefix string
+	kind   byte
+	hash   string
+	addr   string
+}{
+	{"bitcoincash", cashAddrP2PKH, "f5bf48b397dae70be82b3cca4793f8eb2b6cdac9", "bitcoincash:qr6m7j9njldwwzlg9v7v53unlr4jkmx6eylep8ekg2"},
+	{"bchtest", cashAddrP2SH, "f5bf48b397dae70be82b3cca4793f8eb2b6cdac9", "bchtest:pr6m7j9njldwwzlg9v7v53unlr4jkmx6eyvwc0uz5t"},
+	{"bitcoincash", cashAddrP2PKH, "76a04053bda0a88bda5177b86a15c3b29f559873", "bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a"},
+}
+
+func TestCashAddrRoundTrip(t *tt.T) {
+	for _, v := range cashAddrVectors {
+		hash, _ := hex.DecodeString(v.hash)
+		if got := encodeCashAddr(v.prefix, v.kind, hash); got != v.addr {
+			t.Errorf("encodeCashAddr(%d, %s) = %s, want %s", v.kind, v.hash, got, v.addr)
+		}
+		for _, in := range []string{v.addr, strings.TrimPrefix(v.addr, v.prefix+":"), strings.ToUpper(v.addr)} {
+			kind, got, err := decodeCashAddr(v.prefix, in)
+			if err != nil || kind != v.kind || !bytes.Equal(got, hash) {
+				t.Errorf("decodeCashAddr(%s) = %d %x, %v; want %d %s", in, kind, got, err, v.kind, v.hash)
+			}
+		}
+	}
+}
+
+func TestDecodeCashAddrErrors(t *tt.T) {
+	const addr = "bitcoincash:qr6m7j9njldwwzlg9v7v53unlr4jkmx6eylep8ekg2"
+	tests := []struct {
+		name    string
+		prefix  string
+		in      string
+		wantErr string
+	}{
+		{"mixed case", "bitcoincash", "bitcoincash:Qr6m7j9njldwwzlg9v7v53unlr4jkmx6eylep8ekg2", "mixed case"},
+		{"other prefix", "bchtest", addr, "prefix"},
+		{"checksum under another prefix", "bchtest", strings.TrimPrefix(addr, "bitcoincash:"), "checksum"},
+		{"typo", "bitcoincash", strings.Replace(addr, "qr6m", "qr6n", 1), "checksum"},
+		{"not base32", "bitcoincash", strings.Replace(addr, "qr6m", "qr6b", 1), "character"},
+		{"too short", "bitcoincash", addr[:len(addr)-1], "not a cashaddr"},
+	}
+	for _, tc := range tests {
+		if _, _, err := decodeCashAddr(tc.prefix, tc.in); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: error = %v, want one containing %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestValidateAddressNormalizesCashAddr(t *tt.T) {
+	const addr = "bitcoincash:qr6m7j9njldwwzlg9v7v53unlr4jkmx6eylep8ekg2"
+	for _, in := range []string{addr, strings.TrimPrefix(addr, "bitcoincash:"), strings.ToUpper(addr)} {
+		info, err := validateAddress(in)
+		if err != nil {
+			t.Errorf("validateAddress(%s): %v", in, err)
+			continue
+		}
+		if info.Address != addr || info.Chain != chainNameBitcoinCash {
+			t.Errorf("validateAddress(%s) = %s on %s, want %s", in, info.Address, info.Chain, addr)
+		}
+	}
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Lot disposal methods.
+const (
+	methodFIFO     = "fifo"
+	methodLIFO     = "lifo"
+	methodHIFO     = "hifo"
+	methodSpecific = "specific"
+)
+
+var lotMethods = []string{methodFIFO, methodLIFO, methodHIFO, methodSpecific}
+
+// Holding periods. Disposals more than a year after acquisition are long-term.
+const (
+	termShort = "short"
+	termLong  = "long"
+)
+
+// Lot is an amount of BTC acquired in one receipt. Amounts are satoshis and
+// cost basis is fiat minor units.
+type Lot struct {
+	TxId       string    `json:"txId"`
+	Address    string    `json:"address"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	Amount     int64     `json:"amount"`
+	Remaining  int64     `json:"remaining"`
+	CostBasis  int64     `json:"costBasis"`
+	Unpriced   bool      `json:"unpriced,omitempty"`
+
+	remainingBasis int64
+}
+
+// Disposal is the part of a send matched against one lot.
+type Disposal struct {
+	TxId       string    `json:"txId"`
+	Address    string    `json:"address"`
+	DisposedAt time.Time `json:"disposedAt"`
+	LotTxId    string    `json:"lotTxId"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	Amount     int64     `json:"amount"`
+	Proceeds   int64     `json:"proceeds"`
+	CostBasis  int64     `json:"costBasis"`
+	Gain       int64     `json:"gain"`
+	Term       string    `json:"term"`
+}
+
+// lotSelection assigns part of a disposal to a specific lot.
+type lotSelection struct {
+	LotTxId    string
+	LotAddress string
+	Amount     int64
+}
+
+// YearGains totals the disposals of one tax year.
+type YearGains struct {
+	Year          int   `json:"year"`
+	ShortProceeds int64 `json:"shortProceeds"`
+	ShortBasis    int64 `json:"shortBasis"`
+	ShortGain     int64 `json:"shortGain"`
+	LongProceeds  int64 `json:"longProceeds"`
+	LongBasis     int64 `json:"longBasis"`
+	LongGain      int64 `json:"longGain"`
+	TotalGain     int64 `json:"totalGain"`
+}
+
+// GainsReport is the output of the lot engine.
+type GainsReport struct {
+	Method    string      `json:"method"`
+	Unit      string      `json:"unit"`
+	Currency  string      `json:"currency"`
+	Years     []YearGains `json:"years"`
+	Disposals []Disposal  `json:"disposals"`
+	OpenLots  []Lot       `json:"openLots"`
+	Warnings  []string    `json:"warnings"`
+}
+
+// lotEngine replays receipts and sends in time order, opening a lot for each
+// receipt and disposing lots for each send.
+type lotEngine struct {
+	method     string
+	unit       string
+	prices     *priceTable
+	selections map[string][]lotSelection // by disposal tx id
+
+	lots      []*Lot
+	disposals []Disposal
+	warnings  []string
+}
+
+// computeGains runs the lot engine over views, which are all in unit. A send
+// disposes of the amount paid out plus its fee; the proceeds are the fiat
+// value of the amount paid out, so the fee's cost basis reduces the gain.
+// Self-sends and internal transfers (merged by mergeTransfers) dispose of
+// the fee with no proceeds.
+func computeGains(views []TxView, unit string, method string, prices *priceTable, selections map[string][]lotSelection) (GainsReport, error) {
+	if !isLotMethod(method) {
+		return GainsReport{}, fmt.Errorf("unknown lot method %q", method)
+	}
+	e := &lotEngine{method: method, unit: unit, prices: prices, selections: selections}
+
+	sorted := append([]TxView(nil), views...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].Timestamp.Equal(sorted[j].Timestamp) {
+			return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+		}
+		// Receipts first so a same-second send can spend them.
+		return sorted[i].Net > sorted[j].Net
+	})
+
+	for _, v := range sorted {
+		switch {
+		case v.Net > 0:
+			e.open(v)
+		case v.Net < 0:
+			e.dispose(v, -v.Net, sentExcludingFee(v))
+		}
+	}
+	return e.report(), nil
+}
+
+func (e *lotEngine) open(v TxView) {
+	lot := &Lot{TxId: v.TxId, Address: exportAddress(v), AcquiredAt: v.Timestamp, Amount: v.Net, Remaining: v.Net}
+	p, err := e.prices.at(e.unit, v.Timestamp)
+	if err != nil {
+		lot.Unpriced = true
+		e.warn("receipt %s: %v; cost basis taken as zero", v.TxId, err)
+	} else {
+		lot.CostBasis = fiatValue(v.Net, unitDecimals(e.unit), p.Price)
+	}
+	lot.remainingBasis = lot.CostBasis
+	e.lots = append(e.lots, lot)
+}
+
+// dispose consumes amount satoshis of lots for a send whose proceeds are the
+// value of paidOut.
+func (e *lotEngine) dispose(v TxView, amount int64, paidOut int64) {
+	var proceeds int64
+	p, err := e.prices.at(e.unit, v.Timestamp)
+	if err != nil {
+		e.warn("send %s: %v; proceeds taken as zero", v.TxId, err)
+	} else {
+		proceeds = fiatValue(paidOut, unitDecimals(e.unit), p.Price)
+	}
+
+	parts := e.consume(v, amount)
+
+	// Spread the proceeds over the matched lots by amount; the last part
+	// takes the rounding remainder.
+	var matched, assigned int64
+	for _, d := range parts {
+		matched += d.Amount
+	}
+	for i := range parts {
+		if i == len(parts)-1 {
+			parts[i].Proceeds = proceeds - assigned
+		} else {
+			parts[i].Proceeds = mulDiv(proceeds, parts[i].Amount, matched)
+			assigned += parts[i].Proceeds
+		}
+		parts[i].Gain = parts[i].Proceeds - parts[i].CostBasis
+	}
+	e.disposals = append(e.disposals, parts...)
+}
+
+func (e *lotEngine) consume(v TxView, amount int64) []Disposal {
+	var parts []Disposal
+	take := func(lot *Lot, want int64) {
+		n := want
+		if n > lot.Remaining {
+			n = lot.Remaining
+		}
+		if n <= 0 {
+			return
+		}
+		basis := mulDiv(lot.remainingBasis, n, lot.Remaining)
+		lot.Remaining -= n
+		lot.remainingBasis -= basis
+		amount -= n
+
+		term := termShort
+		if v.Timestamp.After(lot.AcquiredAt.AddDate(1, 0, 0)) {
+			term = termLong
+		}
+		parts = append(parts, Disposal{
+			TxId: v.TxId, Address: exportAddress(v), DisposedAt: v.Timestamp,
+			LotTxId: lot.TxId, AcquiredAt: lot.AcquiredAt,
+			Amount: n, CostBasis: basis, Term: term,
+		})
+	}
+
+	if e.method == methodSpecific {
+		for _, sel := range e.selections[v.TxId] {
+			lot := e.findLot(sel.LotTxId, sel.LotAddress)
+			if lot == nil {
+				e.warn("send %s: selected lot %s is not open", v.TxId, sel.LotTxId)
+				continue
+			}
+			take(lot, min64(sel.Amount, amount))
+		}
+		if amount > 0 {
+			e.warn("send %s: %s not covered by lot selections; used FIFO for the rest", v.TxId, formatUnits(amount, unitDecimals(e.unit)))
+		}
+	}
+
+	for _, lot := range e.ordered(v.Timestamp) {
+		if amount <= 0 {
+			break
+		}
+		take(lot, amount)
+	}
+	if amount > 0 {
+		e.warn("send %s: %s more than the open lots hold; disposed without cost basis", v.TxId, formatUnits(amount, unitDecimals(e.unit)))
+		parts = append(parts, Disposal{
+			TxId: v.TxId, Address: exportAddress(v), DisposedAt: v.Timestamp,
+			Amount: amount, Term: termShort,
+		})
+	}
+	return parts
+}
+
+// ordered returns the open lots acquired by ts in the order the method
+// consumes them. Specific ID falls back to FIFO.
+func (e *lotEngine) ordered(ts time.Time) []*Lot {
+	var open []*Lot
+	for _, lot := range e.lots {
+		if lot.Remaining > 0 && !lot.AcquiredAt.After(ts) {
+			open = append(open, lot)
+		}
+	}
+	switch e.method {
+	case methodLIFO:
+		sort.SliceStable(open, func(i, j int) bool { return open[i].AcquiredAt.After(open[j].AcquiredAt) })
+	case methodHIFO:
+		sort.SliceStable(open, func(i, j int) bool {
+			// Compare basis per satoshi without dividing.
+			a := new(big.Int).Mul(big.NewInt(open[i].remainingBasis), big.NewInt(open[j].Remaining))
+			b := new(big.Int).Mul(big.NewInt(open[j].remainingBasis), big.NewInt(open[i].Remaining))
+			return a.Cmp(b) > 0
+		})
+	}
+	return open
+}
+
+func (e *lotEngine) findLot(txId string, address string) *Lot {
+	for _, lot := range e.lots {
+		if lot.TxId == txId && (address == "" || hasAddress(lot.Address, address)) && lot.Remaining > 0 {
+			return lot
+		}
+	}
+	return nil
+}
+
+func (e *lotEngine) warn(format string, args ...interface{}) {
+	e.warnings = append(e.warnings, fmt.Sprintf(format, args...))
+}
+
+func (e *lotEngine) report() GainsReport {
+	r := GainsReport{
+		Method:    e.method,
+		Unit:      e.unit,
+		Currency:  e.prices.Currency,
+		Years:     []YearGains{},
+		Disposals: e.disposals,
+		OpenLots:  []Lot{},
+		Warnings:  e.warnings,
+	}
+	if r.Disposals == nil {
+		r.Disposals = []Disposal{}
+	}
+	if r.Warnings == nil {
+		r.Warnings = []string{}
+	}
+
+	r.Years = summarizeYears(e.disposals)
+
+	for _, lot := range e.lots {
+		if lot.Remaining > 0 {
+			open := *lot
+			open.CostBasis = lot.remainingBasis
+			r.OpenLots = append(r.OpenLots, open)
+		}
+	}
+	return r
+}
+
+// summarizeYears totals disposals by the year they happened in.
+func summarizeYears(disposals []Disposal) []YearGains {
+	byYear := map[int]*YearGains{}
+	for _, d := range disposals {
+		y := d.DisposedAt.Year()
+		g, ok := byYear[y]
+		if !ok {
+			g = &YearGains{Year: y}
+			byYear[y] = g
+		}
+		if d.Term == termLong {
+			g.LongProceeds += d.Proceeds
+			g.LongBasis += d.CostBasis
+			g.LongGain += d.Gain
+		} else {
+			g.ShortProceeds += d.Proceeds
+			g.ShortBasis += d.CostBasis
+			g.ShortGain += d.Gain
+		}
+		g.TotalGain += d.Gain
+	}
+	years := []YearGains{}
+	for _, g := range byYear {
+		years = append(years, *g)
+	}
+	sort.Slice(years, func(i, j int) bool { return years[i].Year < years[j].Year })
+	return years
+}
+
+// forYear keeps only the disposals and totals of one tax year.
+func (r GainsReport) forYear(year int) GainsReport {
+	out := r
+	out.Disposals = []Disposal{}
+	for _, d := range r.Disposals {
+		if d.DisposedAt.Year() == year {
+			out.Disposals = append(out.Disposals, d)
+		}
+	}
+	out.Years = summarizeYears(out.Disposals)
+	return out
+}
+
+// forAddress keeps only the disposals and open lots involving address.
+func (r GainsReport) forAddress(address string) GainsReport {
+	out := r
+	out.Disposals = []Disposal{}
+	for _, d := range r.Disposals {
+		if hasAddress(d.Address, address) {
+			out.Disposals = append(out.Disposals, d)
+		}
+	}
+	out.OpenLots = []Lot{}
+	for _, lot := range r.OpenLots {
+		if hasAddress(lot.Address, address) {
+			out.OpenLots = append(out.OpenLots, lot)
+		}
+	}
+	out.Years = summarizeYears(out.Disposals)
+	return out
+}
+
+// hasAddress reports whether address is in the space-separated list.
+func hasAddress(list string, address string) bool {
+	for _, a := range strings.Fields(list) {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+func isLotMethod(method string) bool {
+	for _, m := range lotMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// mulDiv returns a*b/c without intermediate overflow, truncating.
+func mulDiv(a int64, b int64, c int64) int64 {
+	if c == 0 {
+		return 0
+	}
+	v := new(big.Int).Mul(big.NewInt(a), big.NewInt(b))
+	return v.Quo(v, big.NewInt(c)).Int64()
+}
+
+func min64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// loadLotSelections returns the specific-ID lot choices in unit by
+// disposal tx id. A tx on an account chain can dispose of several units.
+func loadLotSelections(db *sql.DB, unit string) (map[string][]lotSelection, error) {
+	rows, err := db.Query(`SELECT disposal_tx_id, lot_tx_id, lot_address, amount FROM lot_selections WHERE unit = $1 ORDER BY id`, unit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	selections := map[string][]lotSelection{}
+	for rows.Next() {
+		var disposal string
+		var s lotSelection
+		if err := rows.Scan(&disposal, &s.LotTxId, &s.LotAddress, &s.Amount); err != nil {
+			return nil, err
+		}
+		selections[disposal] = append(selections[disposal], s)
+	}
+	return selections, rows.Err()
+}
+
+// gainsForAddresses runs the lot engine over the txs in unit of every
+// tracked address, with internal transfers merged so they are neither
+// income nor disposals. Lots are pooled across addresses; a non-empty
+// address narrows the report to the disposals and lots involving it.
+func gainsForAddresses(db *sql.DB, address string, unit string, method string, currency string) (GainsReport, error) {
+	prices, err := loadPriceTable(db, currency)
+	if err != nil {
+		return GainsReport{}, err
+	}
+	views, err := loadExportViews(db, exportFilter{Unit: unit})
+	if err != nil {
+		return GainsReport{}, err
+	}
+	selections, err := loadLotSelections(db, unit)
+	if err != nil {
+		return GainsReport{}, err
+	}
+	report, err := computeGains(views, unit, method, prices, selections)
+	if err != nil || address == "" {
+		return report, err
+	}
+	return report.forAddress(address), nil
+}
+
+// handleGains serves GET /api/gains?method=&fiat=&year=&address=&unit=.
+// Lots are kept per unit, so the report covers one unit, BTC by default.
+func (s *apiServer) handleGains(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	method := firstNonEmpty(q.Get("method"), methodFIFO)
+	if !isLotMethod(method) {
+		writeError(w, http.StatusBadRequest, "unknown lot method")
+		return
+	}
+	currency := strings.ToUpper(firstNonEmpty(q.Get("fiat"), "USD"))
+	unit := firstNonEmpty(q.Get("unit"), chainBitcoin.Unit)
+
+	report, err := gainsForAddresses(s.db, q.Get("address"), unit, method, currency)
+	if err != nil {
+		s.internalError(w, "failed to compute gains", err)
+		return
+	}
+	if y := q.Get("year"); y != "" {
+		year, err := strconv.Atoi(y)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid year")
+			return
+		}
+		report = report.forYear(year)
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// runGains implements the gains command: a realized gains report, or
+// "gains select" to record a specific-ID lot choice.
+func runGains(db *sql.DB, args []string, out io.Writer) error {
+	if len(args) > 0 && args[0] == "select" {
+		return runLotSelect(db, args[1:])
+	}
+
+	fs := flag.NewFlagSet("gains", flag.ExitOnError)
+	method := fs.String("method", methodFIFO, "lot method: fifo, lifo, hifo or specific")
+	currency := fs.String("fiat", "USD", "fiat currency of the report")
+	year := fs.Int("year", 0, "only report this tax year")
+	addr := fs.String("address", "", "only report disposals and lots involving this address")
+	unit := fs.String("unit", chainBitcoin.Unit, "unit to report, such as BTC or LTC")
+	fs.Parse(args)
+
+	report, err := gainsForAddresses(db, *addr, *unit, *method, strings.ToUpper(*currency))
+	if err != nil {
+		return err
+	}
+	if *year != 0 {
+		report = report.forYear(*year)
+	}
+
+	money := func(v int64) string { return formatUnits(v, fiatDecimals) }
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(out, "Realized gains on %s (%s, %s)\n", report.Unit, strings.ToUpper(report.Method), report.Currency)
+	fmt.Fprintln(tw, "YEAR\tSHORT PROCEEDS\tSHORT BASIS\tSHORT GAIN\tLONG PROCEEDS\tLONG BASIS\tLONG GAIN\tTOTAL\t")
+	for _, g := range report.Years {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", g.Year,
+			money(g.ShortProceeds), money(g.ShortBasis), money(g.ShortGain),
+			money(g.LongProceeds), money(g.LongBasis), money(g.LongGain), money(g.TotalGain))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(report.Disposals) > 0 {
+		fmt.Fprintln(out)
+		tw = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "DISPOSED\tTX\tLOT\tACQUIRED\tAMOUNT\tPROCEEDS\tBASIS\tGAIN\tTERM")
+		for _, d := range report.Disposals {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				d.DisposedAt.Format("2006-01-02"), shortId(d.TxId), shortId(d.LotTxId), d.AcquiredAt.Format("2006-01-02"),
+				formatUnits(d.Amount, unitDecimals(report.Unit)), money(d.Proceeds), money(d.CostBasis), money(d.Gain), d.Term)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	for _, w := range report.Warnings {
+		fmt.Fprintln(out, "warning:", w)
+	}
+	return nil
+}
+
+func runLotSelect(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("gains select", flag.ExitOnError)
+	disposal := fs.String("disposal", "", "tx id of the send")
+	lot := fs.String("lot", "", "tx id of the receipt whose lot to use")
+	lotAddress := fs.String("lot-address", "", "address of the lot, if the receipt funded several tracked addresses")
+	amount := fs.String("amount", "", "amount of -unit to take from the lot")
+	unit := fs.String("unit", chainBitcoin.Unit, "unit of the lot, such as BTC or ETH")
+	fs.Parse(args)
+
+	if *disposal == "" || *lot == "" || *amount == "" {
+		return errors.New("-disposal, -lot and -amount are required")
+	}
+	units, err := parseUnits(*amount, unitDecimals(*unit))
+	if err != nil || units <= 0 {
+		return fmt.Errorf("invalid -amount %q", *amount)
+	}
+
+	_, err = db.Exec(`INSERT INTO lot_selections (disposal_tx_id, lot_tx_id, lot_address, amount, unit, created_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		*disposal, *lot, *lotAddress, units, *unit, time.Now().UTC())
+	return err
+}
+
+func shortId(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	tt "testing"
+	"time"
+)
+
+// btcPrices is a table of daily BTC/USD prices in whole dollars by date.
+func btcPrices(t *tt.T, dollars map[string]int64) *priceTable {
+	t.Helper()
+	table := &priceTable{Currency: "USD", points: map[string][]PricePoint{}}
+	for date, price := range dollars {
+		at, err := time.Parse(time.DateOnly, date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table.points["BTC"] = append(table.points["BTC"], PricePoint{At: at, Price: price * 1e8, Granularity: granularityDaily})
+	}
+	sort.Slice(table.points["BTC"], func(i, j int) bool { return table.points["BTC"][i].At.Before(table.points["BTC"][j].At) })
+	return table
+}
+
+func btcView(txId string, at string, net int64, fee int64) TxView {
+	ts, _ := time.Parse(time.RFC3339, at)
+	return TxView{Address: "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", TxId: txId, Timestamp: ts, Net: net, Fee: fee, Unit: "BTC"}
+}
+
+// lotPart is what the tests check of a disposal.
+type lotPart struct {
+	lot                     string
+	amount, basis, proceeds int64
+	term                    string
+}
+
+func checkDisposals(t *tt.T, name string, got []Disposal, want []lotPart) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d disposals, want %d: %+v", name, len(got), len(want), got)
+	}
+	for i, w := range want {
+		d := got[i]
+		p := lotPart{d.LotTxId, d.Amount, d.CostBasis, d.Proceeds, d.Term}
+		if p != w {
+			t.Errorf("%s: disposal %d = %+v, want %+v", name, i, p, w)
+		}
+		if d.Gain != d.Proceeds-d.CostBasis {
+			t.Errorf("%s: disposal %d gain %d, want proceeds less basis", name, i, d.Gain)
+		}
+	}
+}
+
+func TestComputeGainsLotOrder(t *tt.T) {
+	prices := btcPrices(t, map[string]int64{"2023-01-01": 10000, "2023-02-01": 30000, "2023-03-01": 20000, "2023-04-01": 40000})
+	// Three 1 BTC lots at $10,000, $30,000 and $20,000, then a 1.5 BTC sale
+	// at $40,000 for $60,000 in all.
+	views := []TxView{
+		btcView("sale", "2023-04-01T12:00:00Z", -150000000, 0),
+		btcView("l1", "2023-01-01T12:00:00Z", 100000000, 0),
+		btcView("l2", "2023-02-01T12:00:00Z", 100000000, 0),
+		btcView("l3", "2023-03-01T12:00:00Z", 100000000, 0),
+	}
+	tests := []struct {
+		method     string
+		selections map[string][]lotSelection
+		want       []lotPart
+		warnings   []string
+	}{
+		{methodFIFO, nil, []lotPart{{"l1", 100000000, 1000000, 4000000, termShort}, {"l2", 50000000, 1500000, 2000000, termShort}}, nil},
+		{methodLIFO, nil, []lotPart{{"l3", 100000000, 2000000, 4000000, termShort}, {"l2", 50000000, 1500000, 2000000, termShort}}, nil},
+		{methodHIFO, nil, []lotPart{{"l2", 100000000, 3000000, 4000000, termShort}, {"l3", 50000000, 1000000, 2000000, termShort}}, nil},
+		// Half of l3 is selected; a missing lot is skipped and the uncovered
+		// 1 BTC falls back to FIFO.
+		{methodSpecific, map[string][]lotSelection{"sale": {{LotTxId: "l3", Amount: 50000000}, {LotTxId: "gone", Amount: 100000000}}},
+			[]lotPart{{"l3", 50000000, 1000000, 2000000, termShort}, {"l1", 100000000, 1000000, 4000000, termShort}},
+			[]string{"selected lot gone is not open", "1.00000000 not covered by lot selections; used FIFO"}},
+	}
+	for _, tc := range tests {
+		r, err := computeGains(views, "BTC", tc.method, prices, tc.selections)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.method, err)
+		}
+		checkDisposals(t, tc.method, r.Disposals, tc.want)
+		if len(r.Warnings) != len(tc.warnings) {
+			t.Errorf("%s: warnings = %q, want %d", tc.method, r.Warnings, len(tc.warnings))
+		}
+		for i := range tc.warnings {
+			if i < len(r.Warnings) && !strings.Contains(r.Warnings[i], tc.warnings[i]) {
+				t.Errorf("%s: warning %d = %q, want one containing %q", tc.method, i, r.Warnings[i], tc.warnings[i])
+			}
+		}
+		// 1.5 BTC of the 3 remain open, with the basis not disposed of.
+		var open, basis int64
+		for _, lot := range r.OpenLots {
+			open += lot.Remaining
+			basis += lot.CostBasis
+		}
+		disposed := int64(0)
+		for _, d := range r.Disposals {
+			disposed += d.CostBasis
+		}
+		if open != 150000000 || basis+disposed != 6000000 {
+			t.Errorf("%s: open lots hold %d with basis %d, want 150000000 and %d", tc.method, open, basis, 6000000-disposed)
+		}
+	}
+
+	if _, err := computeGains(views, "BTC", "average", prices, nil); err == nil {
+		t.Error("computeGains accepted an unknown method")
+	}
+}
+
+func TestComputeGainsProceedsRemainder(t *tt.T) {
+	// Three 1 BTC lots sold together at $33.33333333 for $100.00, which does
+	// not split evenly; the last lot takes the extra cent.
+	prices := btcPrices(t, map[string]int64{"2023-01-01": 10})
+	prices.points["BTC"] = append(prices.points["BTC"], PricePoint{At: time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC),
+		Price: 3333333333, Granularity: granularityDaily})
+	views := []TxView{
+		btcView("l1", "2023-01-01T01:00:00Z", 100000000, 0),
+		btcView("l2", "2023-01-01T02:00:00Z", 100000000, 0),
+		btcView("l3", "2023-01-01T03:00:00Z", 100000000, 0),
+		btcView("sale", "2023-01-02T12:00:00Z", -300000000, 0),
+	}
+	r, err := computeGains(views, "BTC", methodFIFO, prices, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDisposals(t, "remainder", r.Disposals, []lotPart{
+		{"l1", 100000000, 1000, 3333, termShort},
+		{"l2", 100000000, 1000, 3333, termShort},
+		{"l3", 100000000, 1000, 3334, termShort},
+	})
+	if y := r.Years; len(y) != 1 || y[0].ShortProceeds != 10000 || y[0].TotalGain != 7000 {
+		t.Errorf("years = %+v, want $100.00 of proceeds and $70.00 of gain", y)
+	}
+}
+
+func TestComputeGainsFees(t *tt.T) {
+	prices := btcPrices(t, map[string]int64{"2023-01-01": 10000, "2023-06-01": 40000})
+	views := []TxView{
+		btcView("l1", "2023-01-01T12:00:00Z", 100000000, 0),
+		// A transfer between tracked addresses disposes of its fee alone,
+		// for no proceeds.
+		btcView("transfer", "2023-06-01T10:00:00Z", -10000, 10000),
+		// A payment of 0.5 BTC disposes of the fee too, but the proceeds are
+		// what was paid out.
+		btcView("payment", "2023-06-01T11:00:00Z", -50010000, 10000),
+	}
+	r, err := computeGains(views, "BTC", methodFIFO, prices, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDisposals(t, "fees", r.Disposals, []lotPart{
+		{"l1", 10000, 100, 0, termShort},
+		{"l1", 50010000, 500100, 2000000, termShort},
+	})
+}
+
+func TestComputeGainsTerm(t *tt.T) {
+	prices := btcPrices(t, map[string]int64{"2023-01-01": 10000, "2024-01-01": 40000})
+	// Exactly a year after acquisition is still short-term; a second later
+	// is long-term.
+	views := []TxView{
+		btcView("l1", "2023-01-01T00:00:00Z", 200000000, 0),
+		btcView("year", "2024-01-01T00:00:00Z", -100000000, 0),
+		btcView("later", "2024-01-01T00:00:01Z", -100000000, 0),
+	}
+	r, err := computeGains(views, "BTC", methodFIFO, prices, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDisposals(t, "term", r.Disposals, []lotPart{
+		{"l1", 100000000, 1000000, 4000000, termShort},
+		{"l1", 100000000, 1000000, 4000000, termLong},
+	})
+	want := YearGains{Year: 2024, ShortProceeds: 4000000, ShortBasis: 1000000, ShortGain: 3000000,
+		LongProceeds: 4000000, LongBasis: 1000000, LongGain: 3000000, TotalGain: 6000000}
+	if len(r.Years) != 1 || r.Years[0] != want {
+		t.Errorf("years = %+v, want %+v", r.Years, want)
+	}
+}
+
+func TestComputeGainsOverDisposal(t *tt.T) {
+	prices := btcPrices(t, map[string]int64{"2023-01-01": 10000, "2023-02-01": 20000})
+	views := []TxView{
+		btcView("l1", "2023-01-01T12:00:00Z", 100000000, 0),
+		btcView("sale", "2023-02-01T12:00:00Z", -150000000, 0),
+		// Unpriced, so its proceeds are zero.
+		btcView("unpriced", "2023-05-01T12:00:00Z", -10000, 0),
+	}
+	r, err := computeGains(views, "BTC", methodFIFO, prices, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The half BTC the lots do not cover is disposed of without basis.
+	checkDisposals(t, "over", r.Disposals, []lotPart{
+		{"l1", 100000000, 1000000, 2000000, termShort},
+		{"", 50000000, 0, 1000000, termShort},
+		{"", 10000, 0, 0, termShort},
+	})
+	wants := []string{"send unpriced: no price data", "send unpriced: 0.00010000 more than the open lots hold",
+		"send sale: 0.50000000 more than the open lots hold"}
+	if len(r.Warnings) != len(wants) {
+		t.Fatalf("warnings = %q, want %d", r.Warnings, len(wants))
+	}
+	for _, w := range wants {
+		found := false
+		for _, got := range r.Warnings {
+			found = found || strings.HasPrefix(got, w)
+		}
+		if !found {
+			t.Errorf("warnings = %q, want one starting %q", r.Warnings, w)
+		}
+	}
+	if len(r.OpenLots) != 0 {
+		t.Errorf("open lots = %+v, want none", r.OpenLots)
+	}
+}
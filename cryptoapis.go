@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const apiKey = "f45402fbaf2f7649ce26a55aa9ab555033c48b7f"
+
+const limitNumResultsInProd = true
+const limitNumResults = 10
+
+// Credits cryptoapis.io charges for one request.
+const creditsPerCryptoapisRequest = 1
+
+// maxPendingTxs caps the mempool txs fetched for one address.
+const maxPendingTxs = 50
+
+// cryptoapisProvider uses the cryptoapis.io REST API, which needs a paid
+// API key, for one chain.
+type cryptoapisProvider struct {
+	// baseURL is the API root of the chain, ending in a slash.
+	baseURL string
+}
+
+func newCryptoapisProvider(c *Chain) cryptoapisProvider {
+	return cryptoapisProvider{
+		baseURL: "https://rest.cryptoapis.io/blockchain-data/" + c.cryptoapisBlockchain + "/" + c.cryptoapisNetwork + "/",
+	}
+}
+
+func (cryptoapisProvider) Name() string { return providerCryptoapis }
+
+func (cryptoapisProvider) creditsPerRequest() int { return creditsPerCryptoapisRequest }
+
+func (p cryptoapisProvider) CountTxs(address string) (int, error) {
+	var response APIResponse
+	path := "addresses/" + address + "/transactions?context=yourExampleString&limit=" + strconv.Itoa(pageLimit) + "&offset=1304404"
+	if err := p.get("total", path, &response); err != nil {
+		return -1, err
+	}
+	if limitNumResultsInProd {
+		return limitNumResults, nil
+	}
+	return response.Data.Total, nil
+}
+
+func (p cryptoapisProvider) TxsAt(address string, offset int, limit int) ([]Item, error) {
+	var response APIResponse
+	path := fmt.Sprintf("addresses/%s/transactions?context=yourExampleString&limit=%d&offset=%d", address, limit, offset)
+	if err := p.get("transactions", path, &response); err != nil {
+		return nil, err
+	}
+	return response.Data.Items, nil
+}
+
+func (p cryptoapisProvider) PendingTxs(address string) ([]Item, error) {
+	var response APIResponse
+	path := fmt.Sprintf("address-transactions-unconfirmed/%s?limit=%d&offset=0", address, maxPendingTxs)
+	if err := p.get("pending", path, &response); err != nil {
+		return nil, err
+	}
+	return response.Data.Items, nil
+}
+
+type txResponse struct {
+	Data struct {
+		Item Item `json:"item"`
+	} `json:"data"`
+}
+
+func (p cryptoapisProvider) Tx(txId string) (Item, error) {
+	var response txResponse
+	if err := p.get("transaction", "transactions/"+txId, &response); err != nil {
+		return Item{}, err
+	}
+	return response.Data.Item, nil
+}
+
+type blockResponse struct {
+	Data struct {
+		Item struct {
+			Hash   string `json:"hash"`
+			Height int    `json:"height"`
+		} `json:"item"`
+	} `json:"data"`
+}
+
+func (p cryptoapisProvider) ChainTip() (ChainTip, error) {
+	var block blockResponse
+	if err := p.get("last_block", "blocks/last", &block); err != nil {
+		return ChainTip{}, err
+	}
+	return ChainTip{Height: block.Data.Item.Height, Hash: block.Data.Item.Hash, UpdatedAt: time.Now().UTC()}, nil
+}
+
+func (p cryptoapisProvider) BlockHash(height int) (string, error) {
+	var block blockResponse
+	if err := p.get("block", "blocks/height/"+strconv.Itoa(height), &block); err != nil {
+		return "", err
+	}
+	return block.Data.Item.Hash, nil
+}
+
+// get sends a GET to path under the chain's cryptoapis.io API and decodes
+// the response into out. A 404 is errProviderNotFound.
+func (p cryptoapisProvider) get(endpoint string, path string, out interface{}) error {
+	url := p.baseURL + path
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", apiKey)
+
+	requested := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		observeProviderRequest(endpoint, 0, requested)
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+	observeProviderRequest(endpoint, res.StatusCode, requested)
+	if res.StatusCode == http.StatusNotFound {
+		return errProviderNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to unmarshal JSON: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The dashboard is a static single-page app built into the binary. It talks
+// to the JSON API only.
+//
+//go:embed static
+var staticFiles embed.FS
+
+func dashboardHandler() http.Handler {
+	sub, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		// The embed directive guarantees the directory exists.
+		panic(err)
+	}
+	return http.FileServer(http.FS(sub))
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// Most keys a multi script may have. A P2SH redeem script is limited to 520
+// bytes, which fits 15 compressed keys; witness scripts allow the 20 of
+// OP_CHECKMULTISIG.
+const (
+	maxMultiKeysP2SH    = 15
+	maxMultiKeysWitness = 20
+)
+
+// Script types of descriptor outputs, besides the single-key ones.
+const (
+	scriptP2SH  = "p2sh"
+	scriptP2WSH = "p2wsh"
+	scriptP2TR  = "p2tr"
+)
+
+// BIP 380 descriptor checksum character sets.
+const (
+	descInputCharset    = "0123456789()[],'/*abcdefgh@:$%{}IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+	descChecksumCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+func descPolymod(c uint64, val uint64) uint64 {
+	c0 := c >> 35
+	c = ((c & 0x7ffffffff) << 5) ^ val
+	if c0&1 != 0 {
+		c ^= 0xf5dee51989
+	}
+	if c0&2 != 0 {
+		c ^= 0xa9fdca3312
+	}
+	if c0&4 != 0 {
+		c ^= 0x1bab10e32d
+	}
+	if c0&8 != 0 {
+		c ^= 0x3706b1677a
+	}
+	if c0&16 != 0 {
+		c ^= 0x644d626ffd
+	}
+	return c
+}
+
+// descriptorChecksum computes the 8 character checksum of a descriptor
+// without its #checksum suffix.
+func descriptorChecksum(desc string) (string, error) {
+	c := uint64(1)
+	var cls, clsCount uint64
+	for _, ch := range desc {
+		pos := strings.IndexRune(descInputCharset, ch)
+		if pos < 0 {
+			return "", fmt.Errorf("invalid character %q in descriptor", ch)
+		}
+		c = descPolymod(c, uint64(pos)&31)
+		cls = cls*3 + uint64(pos)>>5
+		clsCount++
+		if clsCount == 3 {
+			c = descPolymod(c, cls)
+			cls, clsCount = 0, 0
+		}
+	}
+	if clsCount > 0 {
+		c = descPolymod(c, cls)
+	}
+	for i := 0; i < 8; i++ {
+		c = descPolymod(c, 0)
+	}
+	c ^= 1
+
+	out := make([]byte, 8)
+	for i := range out {
+		out[i] = descChecksumCharset[(c>>(5*(7-i)))&31]
+	}
+	return string(out), nil
+}
+
+// descriptor is a parsed output descriptor. Ranged descriptors (with a /*
+// wildcard) derive one address per index on each chain; a <a;b> multipath
+// step gives one chain per alternative.
+type descriptor struct {
+	String string // with checksum
+	Script string
+	net    *chaincfg.Params
+	keys   []*descriptorKey
+	build  func(keys []*btcec.PublicKey) (btcutil.Address, error)
+}
+
+// descriptorKey is a key expression: a fixed public key, or an extended
+// public key with an unhardened derivation path.
+type descriptorKey struct {
+	pub       *btcec.PublicKey
+	xpub      *hdkeychain.ExtendedKey
+	path      []uint32
+	multipath []uint32 // alternatives of the <a;b> step, at path[multiStep]
+	multiStep int
+	wildcard  bool
+}
+
+// parseDescriptor parses desc, which must end in its #checksum so that a
+// mistyped descriptor is not imported as some other wallet. Supported forms are pkh, wpkh, sh(wpkh), tr with a key path only, and
+// multi or sortedmulti under sh, wsh or sh(wsh).
+func parseDescriptor(desc string) (*descriptor, error) {
+	desc = strings.TrimSpace(desc)
+	body, sum, hasSum := strings.Cut(desc, "#")
+	want, err := descriptorChecksum(body)
+	if err != nil {
+		return nil, err
+	}
+	if !hasSum {
+		return nil, fmt.Errorf("descriptor has no checksum; if it is correct, import it as %s#%s", body, want)
+	}
+	if sum != want {
+		return nil, fmt.Errorf("descriptor checksum mismatch: got %q, expected %q", sum, want)
+	}
+
+	d := &descriptor{String: body + "#" + want}
+	if err := d.parseTop(body); err != nil {
+		return nil, err
+	}
+
+	multi := 0
+	for _, k := range d.keys {
+		if k.xpub == nil {
+			continue
+		}
+		if len(k.multipath) > 0 {
+			if multi != 0 && multi != len(k.multipath) {
+				return nil, errors.New("multipath steps must have the same number of alternatives in every key")
+			}
+			multi = len(k.multipath)
+		}
+	}
+	if d.net == nil {
+		d.net = &chaincfg.MainNetParams
+	}
+	return d, nil
+}
+
+func (d *descriptor) parseTop(s string) error {
+	fn, args, err := splitDescCall(s)
+	if err != nil {
+		return err
+	}
+	switch fn {
+	case "pkh", "wpkh":
+		if len(args) != 1 {
+			return fmt.Errorf("%s takes one key", fn)
+		}
+		if err := d.addKey(args[0], false); err != nil {
+			return err
+		}
+		if fn == "pkh" {
+			d.Script = scriptP2PKH
+			d.build = func(keys []*btcec.PublicKey) (btcutil.Address, error) {
+				return btcutil.NewAddressPubKeyHash(btcutil.Hash160(keys[0].SerializeCompressed()), d.net)
+			}
+		} else {
+			d.Script = scriptP2WPKH
+			d.build = func(keys []*btcec.PublicKey) (btcutil.Address, error) {
+				return btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(keys[0].SerializeCompressed()), d.net)
+			}
+		}
+		return nil
+	case "tr":
+		if len(args) != 1 {
+			return errors.New("tr script trees are not supported, only tr(KEY)")
+		}
+		if err := d.addKey(args[0], true); err != nil {
+			return err
+		}
+		d.Script = scriptP2TR
+		d.build = func(keys []*btcec.PublicKey) (btcutil.Address, error) {
+			out := txscript.ComputeTaprootKeyNoScript(keys[0])
+			return btcutil.NewAddressTaproot(schnorr.SerializePubKey(out), d.net)
+		}
+		return nil
+	case "wsh":
+		if len(args) != 1 {
+			return errors.New("wsh takes one script")
+		}
+		script, err := d.parseMulti(args[0], maxMultiKeysWitness)
+		if err != nil {
+			return err
+		}
+		d.Script = scriptP2WSH
+		d.build = func(keys []*btcec.PublicKey) (btcutil.Address, error) {
+			s, err := script(keys)
+			if err != nil {
+				return nil, err
+			}
+			h := sha256.Sum256(s)
+			return btcutil.NewAddressWitnessScriptHash(h[:], d.net)
+		}
+		return nil
+	case "sh":
+		if len(args) != 1 {
+			return errors.New("sh takes one script")
+		}
+		return d.parseSh(args[0])
+	default:
+		return fmt.Errorf("unsupported descriptor function %q", fn)
+	}
+}
+
+func (d *descriptor) parseSh(s string) error {
+	fn, args, err := splitDescCall(s)
+	if err != nil {
+		return err
+	}
+	switch fn {
+	case "wpkh":
+		if len(args) != 1 {
+			return errors.New("wpkh takes one key")
+		}
+		if err := d.addKey(args[0], false); err != nil {
+			return err
+		}
+		d.Script = scriptP2SHP2WPKH
+		d.build = func(keys []*btcec.PublicKey) (btcutil.Address, error) {
+			redeem := append([]byte{0x00, 0x14}, btcutil.Hash160(keys[0].SerializeCompressed())...)
+			return btcutil.NewAddressScriptHash(redeem, d.net)
+		}
+		return nil
+	case "wsh":
+		if len(args) != 1 {
+			return errors.New("wsh takes one script")
+		}
+		script, err := d.parseMulti(args[0], maxMultiKeysWitness)
+		if err != nil {
+			return err
+		}
+		d.Script = scriptP2SH
+		d.build = func(keys []*btcec.PublicKey) (btcutil.Address, error) {
+			s, err := script(keys)
+			if err != nil {
+				return nil, err
+			}
+			h := sha256.Sum256(s)
+			return btcutil.NewAddressScriptHash(append([]byte{0x00, 0x20}, h[:]...), d.net)
+		}
+		return nil
+	default:
+		script, err := d.parseMulti(s, maxMultiKeysP2SH)
+		if err != nil {
+			return err
+		}
+		d.Script = scriptP2SH
+		d.build = func(keys []*btcec.PublicKey) (btcutil.Address, error) {
+			s, err := script(keys)
+			if err != nil {
+				return nil, err
+			}
+			return btcutil.NewAddressScriptHash(s, d.net)
+		}
+		return nil
+	}
+}
+
+// parseMulti parses multi(k,KEY,...) or sortedmulti(k,KEY,...) and returns
+// a function building its script from the derived keys. maxKeys is the
+// limit of the wrapping script type.
+func (d *descriptor) parseMulti(s string, maxKeys int) (func(keys []*btcec.PublicKey) ([]byte, error), error) {
+	fn, args, err := splitDescCall(s)
+	if err != nil {
+		return nil, err
+	}
+	if fn != "multi" && fn != "sortedmulti" {
+		return nil, fmt.Errorf("unsupported script %q, expected multi or sortedmulti", fn)
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("%s needs a threshold and at least one key", fn)
+	}
+	k, err := strconv.Atoi(args[0])
+	n := len(args) - 1
+	if n > maxKeys {
+		return nil, fmt.Errorf("%s has %d keys, but at most %d fit this script type", fn, n, maxKeys)
+	}
+	if err != nil || k < 1 || k > n {
+		return nil, fmt.Errorf("invalid %s threshold %q for %d keys", fn, args[0], n)
+	}
+	for _, a := range args[1:] {
+		if err := d.addKey(a, false); err != nil {
+			return nil, err
+		}
+	}
+	sorted := fn == "sortedmulti"
+	return func(keys []*btcec.PublicKey) ([]byte, error) {
+		pubs := make([][]byte, len(keys))
+		for i, key := range keys {
+			pubs[i] = key.SerializeCompressed()
+		}
+		if sorted {
+			sort.Slice(pubs, func(i, j int) bool { return bytes.Compare(pubs[i], pubs[j]) < 0 })
+		}
+		b := txscript.NewScriptBuilder().AddInt64(int64(k))
+		for _, p := range pubs {
+			b.AddData(p)
+		}
+		return b.AddInt64(int64(n)).AddOp(txscript.OP_CHECKMULTISIG).Script()
+	}, nil
+}
+
+// addKey parses a key expression: an optional [fingerprint/path] origin,
+// then a hex public key or an xpub followed by /steps, where the last step
+// may be a * wildcard and one step may be <a;b>.
+func (d *descriptor) addKey(s string, xonly bool) error {
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return fmt.Errorf("unterminated key origin in %q", s)
+		}
+		s = s[end+1:]
+	}
+
+	parts := strings.Split(s, "/")
+	k := &descriptorKey{multiStep: -1}
+	if raw, err := hex.DecodeString(parts[0]); err == nil {
+		if len(parts) > 1 {
+			return fmt.Errorf("key %q: only extended keys can have a derivation path", s)
+		}
+		if xonly && len(raw) == 32 {
+			k.pub, err = schnorr.ParsePubKey(raw)
+		} else {
+			k.pub, err = btcec.ParsePubKey(raw)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid public key %q: %w", parts[0], err)
+		}
+		d.keys = append(d.keys, k)
+		return nil
+	}
+
+	xpub, err := hdkeychain.NewKeyFromString(parts[0])
+	if err != nil {
+		return fmt.Errorf("invalid key %q: %w", parts[0], err)
+	}
+	if xpub.IsPrivate() {
+		return errors.New("descriptors with private keys are not accepted")
+	}
+	net := &chaincfg.MainNetParams
+	if bytes.Equal(xpub.Version(), chaincfg.TestNet3Params.HDPublicKeyID[:]) {
+		net = &chaincfg.TestNet3Params
+	} else if !bytes.Equal(xpub.Version(), chaincfg.MainNetParams.HDPublicKeyID[:]) {
+		return fmt.Errorf("key %q: descriptors use xpub or tpub keys", parts[0])
+	}
+	if d.net != nil && d.net != net {
+		return errors.New("descriptor mixes mainnet and testnet keys")
+	}
+	d.net = net
+	k.xpub = xpub
+
+	for i, step := range parts[1:] {
+		last := i == len(parts)-2
+		switch {
+		case step == "*" && last:
+			k.wildcard = true
+		case step == "*'" || step == "*h":
+			return errors.New("hardened wildcards need private keys")
+		case strings.HasPrefix(step, "<") && strings.HasSuffix(step, ">"):
+			if k.multiStep >= 0 {
+				return errors.New("only one multipath step is allowed per key")
+			}
+			for _, alt := range strings.Split(step[1:len(step)-1], ";") {
+				n, err := parseDescStep(alt)
+				if err != nil {
+					return err
+				}
+				k.multipath = append(k.multipath, n)
+			}
+			if len(k.multipath) < 2 {
+				return fmt.Errorf("multipath step %q needs at least two alternatives", step)
+			}
+			k.multiStep = len(k.path)
+			k.path = append(k.path, 0)
+		default:
+			n, err := parseDescStep(step)
+			if err != nil {
+				return err
+			}
+			k.path = append(k.path, n)
+		}
+	}
+	d.keys = append(d.keys, k)
+	return nil
+}
+
+func parseDescStep(step string) (uint32, error) {
+	if strings.HasSuffix(step, "'") || strings.HasSuffix(step, "h") {
+		return 0, fmt.Errorf("hardened step %q needs private keys", step)
+	}
+	n, err := strconv.ParseUint(step, 10, 31)
+	if err != nil {
+		return 0, fmt.Errorf("invalid derivation step %q", step)
+	}
+	return uint32(n), nil
+}
+
+// splitDescCall splits "fn(a,b,...)" into fn and its top-level arguments.
+func splitDescCall(s string) (string, []string, error) {
+	open := strings.Index(s, "(")
+	if open <= 0 || !strings.HasSuffix(s, ")") {
+		return "", nil, fmt.Errorf("expected a function call, got %q", s)
+	}
+	fn, inner := s[:open], s[open+1:len(s)-1]
+
+	var args []string
+	depth, start := 0, 0
+	for i, ch := range inner {
+		switch ch {
+		case '(', '[', '{', '<':
+			depth++
+		case ')', ']', '}', '>':
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, inner[start:i])
+				start = i + 1
+			}
+		}
+		if depth < 0 {
+			return "", nil, fmt.Errorf("unbalanced brackets in %q", s)
+		}
+	}
+	if depth != 0 {
+		return "", nil, fmt.Errorf("unbalanced brackets in %q", s)
+	}
+	return fn, append(args, inner[start:]), nil
+}
+
+func (d *descriptor) isRanged() bool {
+	for _, k := range d.keys {
+		if k.wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *descriptor) chains() []uint32 {
+	for _, k := range d.keys {
+		if len(k.multipath) > 0 {
+			chains := make([]uint32, len(k.multipath))
+			for i := range chains {
+				chains[i] = uint32(i)
+			}
+			return chains
+		}
+	}
+	return []uint32{chainReceive}
+}
+
+// address derives the address at index on chain, where chain picks the
+// alternative of multipath steps.
+func (d *descriptor) address(chain uint32, index uint32) (string, error) {
+	pubs := make([]*btcec.PublicKey, len(d.keys))
+	for i, k := range d.keys {
+		pub, err := k.derive(chain, index)
+		if err != nil {
+			return "", err
+		}
+		pubs[i] = pub
+	}
+	addr, err := d.build(pubs)
+	if err != nil {
+		return "", err
+	}
+	return addr.EncodeAddress(), nil
+}
+
+func (k *descriptorKey) derive(chain uint32, index uint32) (*btcec.PublicKey, error) {
+	if k.pub != nil {
+		return k.pub, nil
+	}
+	key := k.xpub
+	for i, step := range k.path {
+		if i == k.multiStep {
+			step = k.multipath[chain]
+		}
+		var err error
+		if key, err = key.Derive(step); err != nil {
+			return nil, err
+		}
+	}
+	if k.wildcard {
+		var err error
+		if key, err = key.Derive(index); err != nil {
+			return nil, err
+		}
+	}
+	return key.ECPubKey()
+}
+
+// handleImportDescriptor serves POST /api/wallets/descriptor with a body of
+// {"name": "...", "owner": "...", "descriptor": "...", "gapLimit": 20}.
+func (s *apiServer) handleImportDescriptor(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name       string `json:"name"`
+		Owner      string `json:"owner"`
+		Descriptor string `json:"descriptor"`
+		GapLimit   int    `json:"gapLimit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	d, err := parseDescriptor(body.Descriptor)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.importHDWallet(w, name, strings.TrimSpace(body.Owner), walletKey{Descriptor: d.String}, body.GapLimit)
+}
+
+// runImportDescriptor implements wallet import-descriptor.
+func runImportDescriptor(syncs *syncRunner, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("wallet import-descriptor", flag.ExitOnError)
+	owner := fs.String("owner", "", "owner of the wallet")
+	gapLimit := fs.Int("gap-limit", defaultGapLimit, "stop after this many consecutive unused addresses")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("usage: wallet import-descriptor [-owner OWNER] [-gap-limit N] NAME DESCRIPTOR")
+	}
+	d, err := parseDescriptor(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	return runImportHD(syncs, fs.Arg(0), *owner, walletKey{Descriptor: d.String}, *gapLimit, out)
+}
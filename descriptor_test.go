@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	tt "testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// withChecksum appends the computed checksum to a descriptor body.
+func withChecksum(t *tt.T, body string) string {
+	t.Helper()
+	sum, err := descriptorChecksum(body)
+	if err != nil {
+		t.Fatalf("descriptorChecksum(%q): %v", body, err)
+	}
+	return body + "#" + sum
+}
+
+// multiDescriptor builds a 1-of-n multi descriptor body from fresh keys.
+func multiDescriptor(t *tt.T, wrap string, n int) string {
+	t.Helper()
+	keys := make([]string, n)
+	for i := range keys {
+		var b [32]byte
+		b[31] = byte(i + 1)
+		priv, _ := btcec.PrivKeyFromBytes(b[:])
+		keys[i] = hex.EncodeToString(priv.PubKey().SerializeCompressed())
+	}
+	inner := fmt.Sprintf("multi(1,%s)", strings.Join(keys, ","))
+	return strings.ReplaceAll(wrap, "%", inner)
+}
+
+func TestDescriptorChecksum(t *tt.T) {
+	// Test vector from BIP 380.
+	sum, err := descriptorChecksum("raw(deadbeef)")
+	if err != nil || sum != "89f8spxm" {
+		t.Fatalf("descriptorChecksum(raw(deadbeef)) = %q, %v, want 89f8spxm", sum, err)
+	}
+}
+
+func TestParseDescriptor(t *tt.T) {
+	const wpkh = "wpkh(0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798)"
+	good := withChecksum(t, wpkh)
+
+	tests := []struct {
+		name    string
+		in      string
+		wantErr string
+	}{
+		{"valid checksum", good, ""},
+		{"surrounding space", "  " + good + "\n", ""},
+		{"missing checksum", wpkh, "import it as " + good},
+		{"wrong checksum", wpkh + "#qqqqqqqq", "checksum mismatch"},
+		{"16 keys under sh", withChecksum(t, multiDescriptor(t, "sh(%)", 16)), "at most 15"},
+		{"15 keys under sh", withChecksum(t, multiDescriptor(t, "sh(%)", 15)), ""},
+		{"20 keys under wsh", withChecksum(t, multiDescriptor(t, "wsh(%)", 20)), ""},
+		{"21 keys under wsh", withChecksum(t, multiDescriptor(t, "wsh(%)", 21)), "at most 20"},
+		{"20 keys under sh(wsh)", withChecksum(t, multiDescriptor(t, "sh(wsh(%))", 20)), ""},
+		{"threshold above keys", withChecksum(t, strings.Replace(multiDescriptor(t, "wsh(%)", 2), "multi(1,", "multi(3,", 1)), "invalid multi threshold"},
+		{"unsupported function", withChecksum(t, "combo(0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798)"), "unsupported"},
+	}
+	for _, tc := range tests {
+		d, err := parseDescriptor(tc.in)
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: parseDescriptor: %v", tc.name, err)
+			} else if d.String != strings.TrimSpace(tc.in) {
+				t.Errorf("%s: String = %q, want %q", tc.name, d.String, strings.TrimSpace(tc.in))
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: error = %v, want one containing %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestDescriptorAddress(t *tt.T) {
+	d, err := parseDescriptor(withChecksum(t, "wpkh(0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798)"))
+	if err != nil {
+		t.Fatalf("parseDescriptor: %v", err)
+	}
+	addr, err := d.address(chainReceive, 0)
+	if err != nil {
+		t.Fatalf("address: %v", err)
+	}
+	if want := "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"; addr != want {
+		t.Errorf("address = %s, want %s", addr, want)
+	}
+}
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const defaultElectrumURL = "ssl://electrum.blockstream.info:50002"
+
+// electrumPageSize is how many confirmed txs TxsAfter returns. Electrum
+// returns an address's whole history at once; pages only bound how many
+// txs are fetched between stores.
+const electrumPageSize = 25
+
+const (
+	electrumTimeout      = 30 * time.Second
+	electrumPingInterval = time.Minute
+	electrumVersion      = "1.4"
+)
+
+// electrumMaxHeights bounds how many tx heights are remembered from
+// histories. Past it they are forgotten, and Tx looks them up again.
+const electrumMaxHeights = 100000
+
+// bitcoindScriptTypes maps our script types back to the bitcoind names used
+// in Item.
+var bitcoindScriptTypes = func() map[string]string {
+	m := map[string]string{}
+	for name, t := range providerScriptTypes {
+		m[t] = name
+	}
+	return m
+}()
+
+// electrumConfig is how to reach an Electrum server, as ssl://host:port or
+// tcp://host:port. InsecureTLS skips certificate checks, for self-hosted
+// servers with self-signed certificates.
+type electrumConfig struct {
+	URL         string
+	InsecureTLS bool
+}
+
+// electrumProvider speaks the Electrum protocol, newline-delimited JSON-RPC
+// over TCP or TLS, to an Electrs, Fulcrum or ElectrumX server. Requests
+// share one connection, which is redialed on demand; address subscriptions
+// are renewed on each new connection.
+type electrumProvider struct {
+	config electrumConfig
+	host   string
+	useTLS bool
+
+	mu            sync.Mutex
+	conn          net.Conn
+	nextId        int64
+	waiting       map[int64]chan electrumResponse
+	subscriptions map[string]electrumSubscription // by scripthash
+	pinging       bool
+	heights       map[string]int           // txid → height in the latest history fetched
+	headers       map[int]wire.BlockHeader // by height
+}
+
+type electrumSubscription struct {
+	address string
+	notify  func(address string)
+}
+
+func newElectrumProvider(c electrumConfig) (*electrumProvider, error) {
+	if c.URL == "" {
+		c.URL = defaultElectrumURL
+	}
+	scheme, host, ok := strings.Cut(c.URL, "://")
+	if !ok {
+		scheme, host = "ssl", c.URL
+	}
+	if scheme != "ssl" && scheme != "tcp" {
+		return nil, fmt.Errorf("invalid electrum url %q: use ssl://host:port or tcp://host:port", c.URL)
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return nil, fmt.Errorf("invalid electrum url %q: %w", c.URL, err)
+	}
+	return &electrumProvider{
+		config:        c,
+		host:          host,
+		useTLS:        scheme == "ssl",
+		waiting:       map[int64]chan electrumResponse{},
+		subscriptions: map[string]electrumSubscription{},
+		heights:       map[string]int{},
+		headers:       map[int]wire.BlockHeader{},
+	}, nil
+}
+
+func (e *electrumProvider) Name() string { return providerElectrum }
+
+func (e *electrumProvider) PageSize() int { return electrumPageSize }
+
+// electrumError is an error returned by the server.
+type electrumError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *electrumError) Error() string {
+	return fmt.Sprintf("electrum error %d: %s", err.Code, err.Message)
+}
+
+type electrumResponse struct {
+	Result json.RawMessage
+	Error  *electrumError
+	err    error
+}
+
+// call sends a request and decodes its result into out.
+func (e *electrumProvider) call(method string, out interface{}, params ...interface{}) error {
+	requested := time.Now()
+	conn, ch, err := e.send(method, params)
+	if err != nil {
+		observeProviderRequest(method, 0, requested)
+		return err
+	}
+
+	var res electrumResponse
+	select {
+	case res = <-ch:
+	case <-time.After(electrumTimeout):
+		e.drop(conn, fmt.Errorf("%s timed out", method))
+		res = <-ch
+	}
+	if res.err != nil {
+		observeProviderRequest(method, 0, requested)
+		return res.err
+	}
+	observeProviderRequest(method, http.StatusOK, requested)
+	if res.Error != nil {
+		return res.Error
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(res.Result, out); err != nil {
+		return fmt.Errorf("failed to unmarshal %s result: %w", method, err)
+	}
+	return nil
+}
+
+// send writes a request, dialing first if there is no connection. A new
+// connection starts with the version handshake and renews subscriptions;
+// their responses are not waited for.
+func (e *electrumProvider) send(method string, params []interface{}) (net.Conn, chan electrumResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.conn == nil {
+		conn, err := e.dial()
+		if err != nil {
+			return nil, nil, err
+		}
+		e.conn = conn
+		go e.read(conn)
+		e.write(conn, "server.version", []interface{}{"cointracker", electrumVersion})
+		for scripthash := range e.subscriptions {
+			e.write(conn, "blockchain.scripthash.subscribe", []interface{}{scripthash})
+		}
+	}
+
+	conn := e.conn
+	id, err := e.write(conn, method, params)
+	if err != nil {
+		e.dropLocked(conn, err)
+		return nil, nil, err
+	}
+	ch := make(chan electrumResponse, 1)
+	e.waiting[id] = ch
+	return conn, ch, nil
+}
+
+func (e *electrumProvider) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: electrumTimeout}
+	if !e.useTLS {
+		conn, err := dialer.Dial("tcp", e.host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to electrum server: %w", err)
+		}
+		return conn, nil
+	}
+	serverName, _, _ := net.SplitHostPort(e.host)
+	conn, err := tls.DialWithDialer(dialer, "tcp", e.host, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: e.config.InsecureTLS,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to electrum server: %w", err)
+	}
+	return conn, nil
+}
+
+// write sends one request line. The caller holds mu.
+func (e *electrumProvider) write(conn net.Conn, method string, params []interface{}) (int64, error) {
+	if params == nil {
+		params = []interface{}{}
+	}
+	e.nextId++
+	line, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      e.nextId,
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	conn.SetWriteDeadline(time.Now().Add(electrumTimeout))
+	if _, err := conn.Write(append(line, '\n')); err != nil {
+		return 0, fmt.Errorf("failed to send request: %w", err)
+	}
+	return e.nextId, nil
+}
+
+// read delivers responses and notifications from conn until it fails.
+func (e *electrumProvider) read(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			e.drop(conn, fmt.Errorf("electrum connection lost: %w", err))
+			return
+		}
+		var msg struct {
+			Id     *int64            `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+			Result json.RawMessage   `json:"result"`
+			Error  *electrumError    `json:"error"`
+		}
+		if err := json.Unmarshal(line, &msg); err != nil {
+			logger.Warn("ignoring malformed electrum message", "error", err)
+			continue
+		}
+		if msg.Method != "" {
+			e.notified(msg.Method, msg.Params)
+			continue
+		}
+		if msg.Id == nil {
+			continue
+		}
+		e.mu.Lock()
+		ch, ok := e.waiting[*msg.Id]
+		delete(e.waiting, *msg.Id)
+		e.mu.Unlock()
+		if ok {
+			ch <- electrumResponse{Result: msg.Result, Error: msg.Error}
+		}
+	}
+}
+
+// notified handles a notification. Only address activity is acted on;
+// new block headers are picked up by the next sync.
+func (e *electrumProvider) notified(method string, params []json.RawMessage) {
+	if method != "blockchain.scripthash.subscribe" || len(params) == 0 {
+		return
+	}
+	var scripthash string
+	if err := json.Unmarshal(params[0], &scripthash); err != nil {
+		return
+	}
+	e.mu.Lock()
+	sub, ok := e.subscriptions[scripthash]
+	e.mu.Unlock()
+	if ok {
+		go sub.notify(sub.address)
+	}
+}
+
+func (e *electrumProvider) drop(conn net.Conn, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dropLocked(conn, err)
+}
+
+// dropLocked closes conn, if it is still current, and fails the requests
+// waiting on it. The caller holds mu.
+func (e *electrumProvider) dropLocked(conn net.Conn, err error) {
+	if e.conn != conn {
+		return
+	}
+	conn.Close()
+	e.conn = nil
+	for id, ch := range e.waiting {
+		ch <- electrumResponse{err: err}
+		delete(e.waiting, id)
+	}
+}
+
+// Subscribe asks the server to push changes to address's history, and
+// calls notify on each. The connection is pinged so that a lost one is
+// redialed and its subscriptions renewed.
+func (e *electrumProvider) Subscribe(address string, notify func(address string)) error {
+	scripthash, err := electrumScripthash(address)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.subscriptions[scripthash] = electrumSubscription{address: address, notify: notify}
+	startPing := !e.pinging
+	e.pinging = true
+	e.mu.Unlock()
+
+	if startPing {
+		go func() {
+			for range time.Tick(electrumPingInterval) {
+				if err := e.call("server.ping", nil); err != nil {
+					logger.Warn("electrum ping failed", "error", err)
+				}
+			}
+		}()
+	}
+	return e.call("blockchain.scripthash.subscribe", nil, scripthash)
+}
+
+// electrumScripthash is the key Electrum servers index addresses by: the
+// SHA-256 of the output script, byte-reversed.
+func electrumScripthash(address string) (string, error) {
+	addr, err := chainBitcoin.decodeAddress(address)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidAddress, err)
+	}
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return "", fmt.Errorf("failed to build output script: %w", err)
+	}
+	return scripthashOf(script), nil
+}
+
+// scripthashOf is the Electrum scripthash of an output script.
+func scripthashOf(script []byte) string {
+	h := sha256.Sum256(script)
+	slices.Reverse(h[:])
+	return hex.EncodeToString(h[:])
+}
+
+type electrumHistoryEntry struct {
+	Height int    `json:"height"`
+	TxHash string `json:"tx_hash"`
+}
+
+// history returns address's history, oldest first, with mempool txs, which
+// have a height of 0 or -1, last. Heights are remembered for Tx.
+func (e *electrumProvider) history(address string) ([]electrumHistoryEntry, error) {
+	scripthash, err := electrumScripthash(address)
+	if err != nil {
+		return nil, err
+	}
+	return e.scripthashHistory(scripthash)
+}
+
+func (e *electrumProvider) scripthashHistory(scripthash string) ([]electrumHistoryEntry, error) {
+	var history []electrumHistoryEntry
+	if err := e.call("blockchain.scripthash.get_history", &history, scripthash); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	if len(e.heights)+len(history) > electrumMaxHeights {
+		clear(e.heights)
+	}
+	for _, h := range history {
+		e.heights[h.TxHash] = h.Height
+	}
+	e.mu.Unlock()
+	return history, nil
+}
+
+// confirmedHistory returns the txids of address's confirmed txs, newest
+// first.
+func (e *electrumProvider) confirmedHistory(address string) ([]electrumHistoryEntry, error) {
+	history, err := e.history(address)
+	if err != nil {
+		return nil, err
+	}
+	confirmed := []electrumHistoryEntry{}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Height > 0 {
+			confirmed = append(confirmed, history[i])
+		}
+	}
+	return confirmed, nil
+}
+
+func (e *electrumProvider) CountTxs(address string) (int, error) {
+	confirmed, err := e.confirmedHistory(address)
+	if err != nil {
+		return -1, err
+	}
+	return len(confirmed), nil
+}
+
+// TxsAfter pages through the address's confirmed history, newest first; the
+// cursor is the number of txs already returned.
+func (e *electrumProvider) TxsAfter(address string, cursor string) ([]Item, string, error) {
+	skip := 0
+	if cursor != "" {
+		n, err := strconv.Atoi(cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+		}
+		skip = n
+	}
+	confirmed, err := e.confirmedHistory(address)
+	if err != nil {
+		return nil, "", err
+	}
+	if skip > len(confirmed) {
+		skip = len(confirmed)
+	}
+	page := confirmed[skip:MinInt(skip+electrumPageSize, len(confirmed))]
+
+	items := make([]Item, 0, len(page))
+	for _, h := range page {
+		item, err := e.tx(h.TxHash, h.Height)
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, item)
+	}
+	next := ""
+	if skip+len(page) < len(confirmed) {
+		next = strconv.Itoa(skip + len(page))
+	}
+	return items, next, nil
+}
+
+func (e *electrumProvider) PendingTxs(address string) ([]Item, error) {
+	history, err := e.history(address)
+	if err != nil {
+		return nil, err
+	}
+	items := []Item{}
+	for _, h := range history {
+		if h.Height > 0 {
+			continue
+		}
+		item, err := e.tx(h.TxHash, 0)
+		if errors.Is(err, errProviderNotFound) {
+			// Evicted or replaced since the history was fetched.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Tx returns a tx by id. Electrum does not report which block a tx is in,
+// so its height comes from the latest history that listed it or, for txs
+// not seen in one, from the history of one of its outputs' scripts.
+func (e *electrumProvider) Tx(txId string) (Item, error) {
+	msg, err := e.rawTx(txId)
+	if err != nil {
+		return Item{}, err
+	}
+	e.mu.Lock()
+	height, ok := e.heights[txId]
+	e.mu.Unlock()
+	if !ok {
+		height, err = e.outputHeight(msg)
+		if err != nil {
+			return Item{}, err
+		}
+	}
+	return e.txItem(msg, max(height, 0))
+}
+
+// outputHeight finds a tx in the histories of the scripts it pays, which
+// list it with its height. OP_RETURN outputs have no history and are
+// skipped, as are scripts whose history the server refuses, e.g. for
+// being too large.
+func (e *electrumProvider) outputHeight(msg *wire.MsgTx) (int, error) {
+	txId := msg.TxHash().String()
+	var lastErr error
+	for _, out := range msg.TxOut {
+		if txscript.IsUnspendable(out.PkScript) {
+			continue
+		}
+		history, err := e.scripthashHistory(scripthashOf(out.PkScript))
+		var rpcErr *electrumError
+		if errors.As(err, &rpcErr) {
+			lastErr = err
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		for _, h := range history {
+			if h.TxHash == txId {
+				return h.Height, nil
+			}
+		}
+	}
+	if lastErr != nil {
+		return 0, fmt.Errorf("failed to find the height of tx %s: %w", txId, lastErr)
+	}
+	return 0, fmt.Errorf("failed to find the height of tx %s: it is in none of its outputs' histories", txId)
+}
+
+func (e *electrumProvider) ChainTip() (ChainTip, error) {
+	var tip struct {
+		Height int    `json:"height"`
+		Hex    string `json:"hex"`
+	}
+	if err := e.call("blockchain.headers.subscribe", &tip); err != nil {
+		return ChainTip{}, err
+	}
+	header, err := parseBlockHeader(tip.Hex)
+	if err != nil {
+		return ChainTip{}, err
+	}
+	return ChainTip{Height: tip.Height, Hash: header.BlockHash().String(), UpdatedAt: time.Now().UTC()}, nil
+}
+
+// BlockHash always asks the server, since it is how reorgs are found, and
+// refreshes the cached header.
+func (e *electrumProvider) BlockHash(height int) (string, error) {
+	header, err := e.fetchHeader(height)
+	if err != nil {
+		return "", err
+	}
+	return header.BlockHash().String(), nil
+}
+
+func (e *electrumProvider) header(height int) (wire.BlockHeader, error) {
+	e.mu.Lock()
+	header, ok := e.headers[height]
+	e.mu.Unlock()
+	if ok {
+		return header, nil
+	}
+	return e.fetchHeader(height)
+}
+
+func (e *electrumProvider) fetchHeader(height int) (wire.BlockHeader, error) {
+	var headerHex string
+	if err := e.call("blockchain.block.header", &headerHex, height); err != nil {
+		return wire.BlockHeader{}, err
+	}
+	header, err := parseBlockHeader(headerHex)
+	if err != nil {
+		return wire.BlockHeader{}, err
+	}
+	e.mu.Lock()
+	e.headers[height] = header
+	e.mu.Unlock()
+	return header, nil
+}
+
+func parseBlockHeader(headerHex string) (wire.BlockHeader, error) {
+	var header wire.BlockHeader
+	b, err := hex.DecodeString(headerHex)
+	if err != nil {
+		return header, fmt.Errorf("invalid block header hex: %w", err)
+	}
+	if err := header.Deserialize(bytes.NewReader(b)); err != nil {
+		return header, fmt.Errorf("invalid block header: %w", err)
+	}
+	return header, nil
+}
+
+// rawTx fetches and parses a tx. A tx the server does not know is
+// errProviderNotFound.
+func (e *electrumProvider) rawTx(txId string) (*wire.MsgTx, error) {
+	var rawHex string
+	if err := e.call("blockchain.transaction.get", &rawHex, txId); err != nil {
+		var rpcErr *electrumError
+		if errors.As(err, &rpcErr) && strings.Contains(strings.ToLower(rpcErr.Message), "no such mempool or blockchain transaction") {
+			return nil, errProviderNotFound
+		}
+		return nil, err
+	}
+	raw, err := hex.DecodeString(rawHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tx hex: %w", err)
+	}
+	msg := wire.NewMsgTx(wire.TxVersion)
+	if err := msg.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("failed to parse tx %s: %w", txId, err)
+	}
+	if msg.TxHash().String() != txId {
+		return nil, fmt.Errorf("tx %s hashes to %s", txId, msg.TxHash())
+	}
+	return msg, nil
+}
+
+// tx fetches a tx mined at height, or 0 if it is unconfirmed, and maps it
+// into our model.
+func (e *electrumProvider) tx(txId string, height int) (Item, error) {
+	msg, err := e.rawTx(txId)
+	if err != nil {
+		return Item{}, err
+	}
+	return e.txItem(msg, height)
+}
+
+// txItem fetches the txs msg's inputs spend, and maps them into our model.
+// Scripts are decoded locally, so asm, types and addresses are ours. An
+// unconfirmed tx is timestamped when it is first seen.
+func (e *electrumProvider) txItem(msg *wire.MsgTx, height int) (Item, error) {
+	txId := msg.TxHash().String()
+	weight := msg.SerializeSizeStripped()*3 + msg.SerializeSize()
+	item := Item{
+		TransactionId:   txId,
+		TransactionHash: msg.WitnessHash().String(),
+		Timestamp:       time.Now().Unix(),
+		BlockchainSpecific: BlockchainSpecific{
+			Locktime: int(msg.LockTime),
+			Size:     msg.SerializeSize(),
+			VSize:    (weight + 3) / 4,
+			Version:  int(msg.Version),
+		},
+	}
+	if height > 0 {
+		header, err := e.header(height)
+		if err != nil {
+			return Item{}, err
+		}
+		item.MinedInBlockHeight = height
+		item.MinedInBlockHash = header.BlockHash().String()
+		item.Timestamp = header.Timestamp.Unix()
+	}
+
+	var totalIn, totalOut int64
+	coinbase := len(msg.TxIn) == 1 && msg.TxIn[0].PreviousOutPoint.Index == wire.MaxPrevOutIndex
+	parents := map[string]*wire.MsgTx{}
+	senders := participants{}
+	for _, in := range msg.TxIn {
+		vin := Vin{
+			ScriptSig: ScriptSig{Hex: hex.EncodeToString(in.SignatureScript)},
+			Sequence:  strconv.FormatUint(uint64(in.Sequence), 10),
+			Txid:      in.PreviousOutPoint.Hash.String(),
+			Vout:      int(in.PreviousOutPoint.Index),
+		}
+		vin.ScriptSig.Asm, _ = txscript.DisasmString(in.SignatureScript)
+		for _, w := range in.Witness {
+			vin.Txinwitness = append(vin.Txinwitness, hex.EncodeToString(w))
+		}
+		if !coinbase {
+			parent, ok := parents[vin.Txid]
+			if !ok {
+				var err error
+				parent, err = e.rawTx(vin.Txid)
+				if err != nil {
+					return Item{}, fmt.Errorf("failed to get input tx %s: %w", vin.Txid, err)
+				}
+				parents[vin.Txid] = parent
+			}
+			if vin.Vout >= len(parent.TxOut) {
+				return Item{}, fmt.Errorf("input %s:%d does not exist", vin.Txid, vin.Vout)
+			}
+			prevout := parent.TxOut[vin.Vout]
+			d, _ := decodeScript(chainBitcoin, hex.EncodeToString(prevout.PkScript))
+			vin.ScriptSig.Type = bitcoindScriptTypes[d.Type]
+			vin.Addresses = d.Addresses
+			vin.Value = formatUnits(prevout.Value, btcDecimals)
+			totalIn += prevout.Value
+			if len(d.Addresses) == 1 {
+				senders.add(d.Addresses[0], prevout.Value)
+			}
+		}
+		item.BlockchainSpecific.Vin = append(item.BlockchainSpecific.Vin, vin)
+	}
+
+	recipients := participants{}
+	for _, out := range msg.TxOut {
+		scriptHex := hex.EncodeToString(out.PkScript)
+		d, _ := decodeScript(chainBitcoin, scriptHex)
+		vout := Vout{
+			ScriptPubKey: ScriptPubKey{Addresses: d.Addresses, Asm: d.Asm, Hex: scriptHex, Type: bitcoindScriptTypes[d.Type]},
+			Value:        formatUnits(out.Value, btcDecimals),
+		}
+		totalOut += out.Value
+		if len(d.Addresses) == 1 {
+			recipients.add(d.Addresses[0], out.Value)
+		}
+		item.BlockchainSpecific.Vout = append(item.BlockchainSpecific.Vout, vout)
+	}
+	item.Senders = senders.list()
+	item.Recipients = recipients.list()
+
+	fee := int64(0)
+	if !coinbase {
+		fee = totalIn - totalOut
+	}
+	item.Fee = Fee{Amount: formatUnits(fee, btcDecimals), Unit: "BTC"}
+	return item, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	tt "testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// electrumStub answers Electrum requests with histories by scripthash, raw
+// txs by id and headers by height, counting the requests of each method.
+type electrumStub struct {
+	histories map[string][]electrumHistoryEntry
+	txs       map[string]*wire.MsgTx
+	headers   map[int]wire.BlockHeader
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (s *electrumStub) serve(t *tt.T) *electrumProvider {
+	t.Helper()
+	s.calls = map[string]int{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go s.answer(conn)
+		}
+	}()
+	e, err := newElectrumProvider(electrumConfig{URL: "tcp://" + ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func (s *electrumStub) answer(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var req struct {
+			Id     int64             `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.Unmarshal(line, &req)
+		s.mu.Lock()
+		s.calls[req.Method]++
+		s.mu.Unlock()
+
+		var param string
+		if len(req.Params) > 0 {
+			json.Unmarshal(req.Params[0], &param)
+		}
+		res := map[string]interface{}{"jsonrpc": "2.0", "id": req.Id}
+		switch req.Method {
+		case "blockchain.scripthash.get_history":
+			history := s.histories[param]
+			if history == nil {
+				history = []electrumHistoryEntry{}
+			}
+			res["result"] = history
+		case "blockchain.transaction.get":
+			msg, ok := s.txs[param]
+			if !ok {
+				res["error"] = electrumError{Code: 2, Message: "No such mempool or blockchain transaction"}
+				break
+			}
+			var buf bytes.Buffer
+			msg.Serialize(&buf)
+			res["result"] = hex.EncodeToString(buf.Bytes())
+		case "blockchain.block.header":
+			var height int
+			json.Unmarshal(req.Params[0], &height)
+			var buf bytes.Buffer
+			header := s.headers[height]
+			header.Serialize(&buf)
+			res["result"] = hex.EncodeToString(buf.Bytes())
+		default:
+			res["result"] = nil
+		}
+		out, _ := json.Marshal(res)
+		conn.Write(append(out, '\n'))
+	}
+}
+
+func (s *electrumStub) called(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[method]
+}
+
+func outputScript(t *tt.T, address string) []byte {
+	t.Helper()
+	addr, err := chainBitcoin.decodeAddress(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+const (
+	electrumTestPayer = "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+	electrumTestPayee = "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"
+)
+
+// electrumTestTxs returns a tx paying 150000 sats to the payer and 50000 to
+// a P2PKH address, and a child spending both for 120000 sats to the payee
+// and an OP_RETURN, mined at height 840001.
+func electrumTestTxs(t *tt.T) (*electrumStub, *wire.MsgTx, *wire.MsgTx) {
+	parent := wire.NewMsgTx(2)
+	parent.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 7}, []byte{0x51}, nil))
+	parent.AddTxOut(wire.NewTxOut(150000, outputScript(t, electrumTestPayer)))
+	parent.AddTxOut(wire.NewTxOut(50000, outputScript(t, "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2")))
+
+	parentHash := parent.TxHash()
+	child := wire.NewMsgTx(2)
+	child.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&parentHash, 0), nil, wire.TxWitness{{0x30, 0x44}, {0x02, 0xaa}}))
+	child.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&parentHash, 1), []byte{0x02, 0x30, 0x44}, nil))
+	child.AddTxOut(wire.NewTxOut(120000, outputScript(t, electrumTestPayee)))
+	nulldata, _ := txscript.NullDataScript([]byte("hello"))
+	child.AddTxOut(wire.NewTxOut(0, nulldata))
+
+	stub := &electrumStub{
+		histories: map[string][]electrumHistoryEntry{},
+		txs:       map[string]*wire.MsgTx{parentHash.String(): parent, child.TxHash().String(): child},
+		headers:   map[int]wire.BlockHeader{840001: {Version: 4, PrevBlock: chainhash.Hash{1}, Timestamp: time.Unix(1713571767, 0)}},
+	}
+	return stub, parent, child
+}
+
+func TestElectrumScripthash(t *tt.T) {
+	// The example from the Electrum protocol docs.
+	got, err := electrumScripthash("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa")
+	if err != nil || got != "8b01df4e368ea28f8dc0423bcf7a4923e3a12d307c875e47a0cfbf90b5c39161" {
+		t.Errorf("electrumScripthash = %s, %v", got, err)
+	}
+	if _, err := electrumScripthash("0x1111111111111111111111111111111111111111"); !errors.Is(err, errInvalidAddress) {
+		t.Errorf("electrumScripthash of an EVM address: %v, want errInvalidAddress", err)
+	}
+}
+
+func TestElectrumTxMapping(t *tt.T) {
+	stub, parent, child := electrumTestTxs(t)
+	txId := child.TxHash().String()
+	scripthash, _ := electrumScripthash(electrumTestPayee)
+	stub.histories[scripthash] = []electrumHistoryEntry{{Height: 840001, TxHash: txId}}
+	e := stub.serve(t)
+
+	items, next, err := e.TxsAfter(electrumTestPayee, "")
+	if err != nil || len(items) != 1 || next != "" {
+		t.Fatalf("TxsAfter = %d items, %q, %v", len(items), next, err)
+	}
+	item := items[0]
+	header := stub.headers[840001]
+	if item.TransactionId != txId || item.TransactionHash != child.WitnessHash().String() {
+		t.Errorf("ids = %s %s", item.TransactionId, item.TransactionHash)
+	}
+	if item.MinedInBlockHeight != 840001 || item.MinedInBlockHash != header.BlockHash().String() || item.Timestamp != 1713571767 {
+		t.Errorf("block = %s %d at %d", item.MinedInBlockHash, item.MinedInBlockHeight, item.Timestamp)
+	}
+	if item.Fee != (Fee{Amount: "0.00080000", Unit: "BTC"}) {
+		t.Errorf("Fee = %+v", item.Fee)
+	}
+
+	vin := item.BlockchainSpecific.Vin
+	if len(vin) != 2 || vin[0].Txid != parent.TxHash().String() || vin[0].ScriptSig.Type != "witness_v0_keyhash" ||
+		vin[0].Value != "0.00150000" || !reflect.DeepEqual(vin[0].Txinwitness, []string{"3044", "02aa"}) {
+		t.Errorf("vin = %+v", vin)
+	}
+	if len(vin) == 2 && (vin[1].Vout != 1 || vin[1].ScriptSig.Type != "pubkeyhash" || vin[1].ScriptSig.Hex != "023044") {
+		t.Errorf("vin[1] = %+v", vin[1])
+	}
+	vout := item.BlockchainSpecific.Vout
+	if len(vout) != 2 || vout[0].ScriptPubKey.Type != "witness_v0_keyhash" || vout[1].ScriptPubKey.Type != "nulldata" ||
+		vout[1].ScriptPubKey.Addresses != nil || !strings.HasPrefix(vout[1].ScriptPubKey.Asm, "OP_RETURN") {
+		t.Errorf("vout = %+v", vout)
+	}
+	wantSenders := []Participant{
+		{Address: electrumTestPayer, Amount: "0.00150000"},
+		{Address: "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", Amount: "0.00050000"},
+	}
+	wantRecipients := []Participant{{Address: electrumTestPayee, Amount: "0.00120000"}}
+	if !reflect.DeepEqual(item.Senders, wantSenders) || !reflect.DeepEqual(item.Recipients, wantRecipients) {
+		t.Errorf("Senders = %+v, Recipients = %+v", item.Senders, item.Recipients)
+	}
+
+	// Tx finds the height in the history already fetched.
+	if _, err := e.Tx(txId); err != nil {
+		t.Fatalf("Tx: %v", err)
+	}
+	if n := stub.called("blockchain.scripthash.get_history"); n != 1 {
+		t.Errorf("get_history called %d times, want 1", n)
+	}
+}
+
+func TestElectrumTxHeightFromOutputs(t *tt.T) {
+	stub, _, child := electrumTestTxs(t)
+	txId := child.TxHash().String()
+	e := stub.serve(t)
+
+	// Not in any history of its outputs, the tx has no height to report.
+	if _, err := e.Tx(txId); err == nil || !strings.Contains(err.Error(), "none of its outputs' histories") {
+		t.Fatalf("Tx error = %v, want its height not found", err)
+	}
+	// Only the payee's history was asked for, not the OP_RETURN's.
+	if n := stub.called("blockchain.scripthash.get_history"); n != 1 {
+		t.Errorf("get_history called %d times, want 1", n)
+	}
+
+	stub.histories[scripthashOf(outputScript(t, electrumTestPayee))] = []electrumHistoryEntry{{Height: 840001, TxHash: txId}}
+	item, err := e.Tx(txId)
+	if err != nil {
+		t.Fatalf("Tx: %v", err)
+	}
+	if item.MinedInBlockHeight != 840001 || item.Timestamp != 1713571767 {
+		t.Errorf("Tx = height %d at %d, want 840001 at 1713571767", item.MinedInBlockHeight, item.Timestamp)
+	}
+
+	if _, err := e.Tx(strings.Repeat("0", 64)); !errors.Is(err, errProviderNotFound) {
+		t.Errorf("Tx of an unknown tx: %v, want errProviderNotFound", err)
+	}
+}
+
+func TestElectrumHeightsBounded(t *tt.T) {
+	stub, _, _ := electrumTestTxs(t)
+	// Two histories of distinct txs that together hold more than the bound.
+	for i, scripthash := range []string{"a", "b"} {
+		history := make([]electrumHistoryEntry, electrumMaxHeights/2+1)
+		for j := range history {
+			history[j] = electrumHistoryEntry{Height: j + 1, TxHash: fmt.Sprintf("%d%063x", i, j)}
+		}
+		stub.histories[scripthash] = history
+	}
+	e := stub.serve(t)
+	for _, scripthash := range []string{"a", "b"} {
+		if _, err := e.scripthashHistory(scripthash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(e.heights) != electrumMaxHeights/2+1 {
+		t.Errorf("%d heights remembered, want only the latest history's %d", len(e.heights), electrumMaxHeights/2+1)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	tt "testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	esploraSender   = "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"
+	esploraPayee    = "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+	esploraPayeeHex = "0014751e76e8199196d454941c45d1b3a323f1433bd6"
+	esploraChange   = "0014e8df018c7e326cc253faac7e46cdc51e68542c42"
+)
+
+// esploraSegwitTx builds a segwit spend of 100000 sats paying 50000 and
+// 40000, and returns it as Esplora serves it.
+func esploraSegwitTx(t *tt.T) (esploraTx, *wire.MsgTx) {
+	t.Helper()
+	prev := chainhash.HashH([]byte("prev"))
+	msg := wire.NewMsgTx(2)
+	msg.LockTime = 840000
+	in := wire.NewTxIn(wire.NewOutPoint(&prev, 1), nil, wire.TxWitness{bytes.Repeat([]byte{0x30}, 71), bytes.Repeat([]byte{0x02}, 33)})
+	in.Sequence = 0xfffffffd
+	msg.AddTxIn(in)
+	for _, out := range []struct {
+		script string
+		value  int64
+	}{{esploraPayeeHex, 50000}, {esploraChange, 40000}} {
+		script, _ := hex.DecodeString(out.script)
+		msg.AddTxOut(wire.NewTxOut(out.value, script))
+	}
+
+	tx := esploraTx{
+		Txid: msg.TxHash().String(), Version: 2, Locktime: 840000,
+		Vin: []esploraVin{{
+			Txid: prev.String(), Vout: 1, Sequence: 0xfffffffd,
+			Witness: []string{hex.EncodeToString(in.Witness[0]), hex.EncodeToString(in.Witness[1])},
+			Prevout: &esploraVout{Scriptpubkey: esploraChange, ScriptpubkeyType: "v0_p2wpkh", ScriptpubkeyAddress: esploraSender, Value: 100000},
+		}},
+		Vout: []esploraVout{
+			{Scriptpubkey: esploraPayeeHex, ScriptpubkeyType: "v0_p2wpkh", ScriptpubkeyAddress: esploraPayee, Value: 50000},
+			{Scriptpubkey: esploraChange, ScriptpubkeyType: "v0_p2wpkh", ScriptpubkeyAddress: esploraSender, Value: 40000},
+		},
+		Size: msg.SerializeSize(), Weight: msg.SerializeSizeStripped()*3 + msg.SerializeSize(), Fee: 10000,
+	}
+	tx.Status.Confirmed = true
+	tx.Status.BlockHeight = 840001
+	tx.Status.BlockHash = "00000000000000000001"
+	tx.Status.BlockTime = 1713571767
+	return tx, msg
+}
+
+func serveJSON(t *tt.T, routes map[string]interface{}) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := routes[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestEsploraTxMapping(t *tt.T) {
+	tx, msg := esploraSegwitTx(t)
+	srv := serveJSON(t, map[string]interface{}{"/tx/" + tx.Txid: tx})
+
+	item, err := newEsploraProvider(srv.URL + "/").Tx(tx.Txid)
+	if err != nil {
+		t.Fatalf("Tx: %v", err)
+	}
+	if item.TransactionId != tx.Txid {
+		t.Errorf("TransactionId = %s, want %s", item.TransactionId, tx.Txid)
+	}
+	if want := msg.WitnessHash().String(); item.TransactionHash != want || want == tx.Txid {
+		t.Errorf("TransactionHash = %s, want the wtxid %s", item.TransactionHash, want)
+	}
+	if item.MinedInBlockHeight != 840001 || item.MinedInBlockHash != tx.Status.BlockHash || item.Timestamp != 1713571767 {
+		t.Errorf("block = %d %s at %d", item.MinedInBlockHeight, item.MinedInBlockHash, item.Timestamp)
+	}
+	if item.Fee != (Fee{Amount: "0.00010000", Unit: "BTC"}) {
+		t.Errorf("Fee = %+v", item.Fee)
+	}
+	if bs := item.BlockchainSpecific; bs.Version != 2 || bs.Locktime != 840000 || bs.VSize != (tx.Weight+3)/4 {
+		t.Errorf("BlockchainSpecific = %d %d %d", bs.Version, bs.Locktime, bs.VSize)
+	}
+
+	wantVin := Vin{
+		Addresses:   []string{esploraSender},
+		ScriptSig:   ScriptSig{Type: "witness_v0_keyhash"},
+		Sequence:    "4294967293",
+		Txid:        tx.Vin[0].Txid,
+		Vout:        1,
+		Value:       "0.00100000",
+		Txinwitness: tx.Vin[0].Witness,
+	}
+	if len(item.BlockchainSpecific.Vin) != 1 || !reflect.DeepEqual(item.BlockchainSpecific.Vin[0], wantVin) {
+		t.Errorf("Vin = %+v, want %+v", item.BlockchainSpecific.Vin, wantVin)
+	}
+	vout := item.BlockchainSpecific.Vout
+	if len(vout) != 2 || vout[0].Value != "0.00050000" || vout[0].ScriptPubKey.Hex != esploraPayeeHex ||
+		vout[0].ScriptPubKey.Type != "witness_v0_keyhash" || !reflect.DeepEqual(vout[0].ScriptPubKey.Addresses, []string{esploraPayee}) {
+		t.Errorf("Vout = %+v", vout)
+	}
+	wantSenders := []Participant{{Address: esploraSender, Amount: "0.00100000"}}
+	wantRecipients := []Participant{{Address: esploraPayee, Amount: "0.00050000"}, {Address: esploraSender, Amount: "0.00040000"}}
+	if !reflect.DeepEqual(item.Senders, wantSenders) || !reflect.DeepEqual(item.Recipients, wantRecipients) {
+		t.Errorf("Senders = %+v, Recipients = %+v", item.Senders, item.Recipients)
+	}
+}
+
+func TestEsploraTxRejectsMismatchedTxid(t *tt.T) {
+	tx, _ := esploraSegwitTx(t)
+	tx.Vout[0].Value++
+	srv := serveJSON(t, map[string]interface{}{"/tx/" + tx.Txid: tx})
+
+	if _, err := newEsploraProvider(srv.URL).Tx(tx.Txid); err == nil {
+		t.Fatal("Tx accepted a tx that does not hash to its txid")
+	}
+}
+
+func TestEsploraTxsAfterSkipsMempool(t *tt.T) {
+	tx, _ := esploraSegwitTx(t)
+	pending := tx
+	pending.Status.Confirmed = false
+	srv := serveJSON(t, map[string]interface{}{
+		"/address/" + esploraPayee + "/txs":         []esploraTx{pending, tx},
+		"/address/" + esploraPayee + "/txs/mempool": []esploraTx{pending},
+	})
+	p := newEsploraProvider(srv.URL)
+
+	items, next, err := p.TxsAfter(esploraPayee, "")
+	if err != nil {
+		t.Fatalf("TxsAfter: %v", err)
+	}
+	if len(items) != 1 || items[0].MinedInBlockHeight != 840001 || next != "" {
+		t.Errorf("TxsAfter = %d items, next %q; want the confirmed tx only", len(items), next)
+	}
+	items, err = p.PendingTxs(esploraPayee)
+	if err != nil {
+		t.Fatalf("PendingTxs: %v", err)
+	}
+	if len(items) != 1 || items[0].MinedInBlockHeight != 0 {
+		t.Errorf("PendingTxs = %+v, want the mempool tx", items)
+	}
+}
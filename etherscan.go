@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultEtherscanURL is Etherscan's multichain API; the chain is picked
+// with chainid. Blockscout serves the same API at its own URL per chain.
+const defaultEtherscanURL = "https://api.etherscan.io/v2/api"
+
+// etherscanPageSize is how many rows are fetched from each of the normal,
+// internal and token tx lists per page.
+const etherscanPageSize = 100
+
+// etherscanMaxRows is the most rows Etherscan returns for one query.
+const etherscanMaxRows = 10000
+
+// etherscanAPIKey is the key sent with every request; main sets it from
+// -etherscan-key.
+var etherscanAPIKey string
+
+// etherscanProvider uses the Etherscan API, or a Blockscout instance, for
+// one EVM chain.
+type etherscanProvider struct {
+	baseURL string
+	chainID int
+}
+
+func newEtherscanProvider(c *Chain, baseURL string) etherscanProvider {
+	if baseURL == "" {
+		baseURL = defaultEtherscanURL
+	}
+	return etherscanProvider{baseURL: baseURL, chainID: c.evmChainID}
+}
+
+func (etherscanProvider) Name() string { return providerEtherscan }
+
+// etherscanRow is a row of any of the txlist, txlistinternal and tokentx
+// lists, which share most of their fields.
+type etherscanRow struct {
+	BlockNumber     string `json:"blockNumber"`
+	TimeStamp       string `json:"timeStamp"`
+	Hash            string `json:"hash"`
+	BlockHash       string `json:"blockHash"`
+	Nonce           string `json:"nonce"`
+	From            string `json:"from"`
+	To              string `json:"to"`
+	Value           string `json:"value"`
+	ContractAddress string `json:"contractAddress"`
+	Gas             string `json:"gas"`
+	GasPrice        string `json:"gasPrice"`
+	GasUsed         string `json:"gasUsed"`
+	IsError         string `json:"isError"`
+	TraceId         string `json:"traceId"`
+	TokenSymbol     string `json:"tokenSymbol"`
+	TokenDecimal    string `json:"tokenDecimal"`
+	LogIndex        string `json:"logIndex"`
+}
+
+func (r etherscanRow) height() int {
+	n, _ := strconv.Atoi(r.BlockNumber)
+	return n
+}
+
+// AccountTxsAfter returns a page of the address's txs, newest first, from
+// the three lists Etherscan keeps per address. The cursor is the highest
+// block of the page. A page ends at a block boundary below which a full
+// list may have more rows, so every tx on it is complete.
+func (p etherscanProvider) AccountTxsAfter(address string, cursor string) ([]EVMTx, string, error) {
+	address = evmHex(address)
+	end := 999999999
+	if cursor != "" {
+		n, err := strconv.Atoi(cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+		}
+		end = n
+	}
+
+	actions := []string{"txlist", "txlistinternal", "tokentx"}
+	lists := make([][]etherscanRow, len(actions))
+	boundary := 0
+	for i, action := range actions {
+		rows, err := p.list(action, address, 0, end, etherscanPageSize)
+		if err != nil {
+			return nil, "", err
+		}
+		lists[i] = rows
+		if len(rows) == etherscanPageSize && rows[len(rows)-1].height()+1 > boundary {
+			boundary = rows[len(rows)-1].height() + 1
+		}
+	}
+
+	next := ""
+	if boundary > 0 {
+		if boundary > end {
+			// A whole page is in one block: take all of that block.
+			boundary = end
+			for i, action := range actions {
+				if len(lists[i]) < etherscanPageSize || lists[i][len(lists[i])-1].height() != end {
+					continue
+				}
+				rows, err := p.list(action, address, end, end, etherscanMaxRows)
+				if err != nil {
+					return nil, "", err
+				}
+				lists[i] = rows
+			}
+		}
+		next = strconv.Itoa(boundary - 1)
+	}
+
+	txs, err := p.assemble(lists[0], lists[1], lists[2], boundary)
+	if err != nil {
+		return nil, "", err
+	}
+	return txs, next, nil
+}
+
+// assemble groups the rows of blocks from boundary up into txs, newest
+// first.
+func (p etherscanProvider) assemble(normal []etherscanRow, internal []etherscanRow, tokens []etherscanRow, boundary int) ([]EVMTx, error) {
+	byHash := map[string]*EVMTx{}
+	var order []string
+	get := func(r etherscanRow) *EVMTx {
+		hash := strings.ToLower(r.Hash)
+		tx, ok := byHash[hash]
+		if !ok {
+			ts, _ := strconv.ParseInt(r.TimeStamp, 10, 64)
+			tx = &EVMTx{TransactionId: hash, TransactionHash: hash, MinedInBlockHeight: r.height(), Timestamp: ts, Status: evmSuccess}
+			byHash[hash] = tx
+			order = append(order, hash)
+		}
+		if tx.MinedInBlockHash == "" {
+			tx.MinedInBlockHash = r.BlockHash
+		}
+		return tx
+	}
+
+	for _, r := range normal {
+		if r.height() < boundary {
+			continue
+		}
+		tx := get(r)
+		tx.From, tx.To = strings.ToLower(r.From), strings.ToLower(r.To)
+		tx.ContractAddress = strings.ToLower(r.ContractAddress)
+		tx.Value, tx.GasPrice = r.Value, r.GasPrice
+		tx.Nonce, _ = strconv.ParseUint(r.Nonce, 10, 64)
+		tx.Gas, _ = strconv.ParseUint(r.Gas, 10, 64)
+		tx.GasUsed, _ = strconv.ParseUint(r.GasUsed, 10, 64)
+		if r.IsError == "1" {
+			tx.Status = evmFailed
+		}
+	}
+	for _, r := range internal {
+		// A reverted call moved nothing.
+		if r.height() < boundary || r.IsError == "1" {
+			continue
+		}
+		tx := get(r)
+		tx.Internal = append(tx.Internal, InternalTx{
+			From: strings.ToLower(r.From), To: strings.ToLower(r.To), Value: r.Value, TraceId: r.TraceId,
+		})
+	}
+	for _, r := range tokens {
+		if r.height() < boundary {
+			continue
+		}
+		tx := get(r)
+		decimals, _ := strconv.Atoi(r.TokenDecimal)
+		logIndex, _ := strconv.Atoi(r.LogIndex)
+		tx.TokenTransfers = append(tx.TokenTransfers, TokenTransfer{
+			Contract: strings.ToLower(r.ContractAddress), Symbol: r.TokenSymbol, Decimals: decimals,
+			From: strings.ToLower(r.From), To: strings.ToLower(r.To), Value: r.Value, LogIndex: logIndex,
+		})
+	}
+
+	// The internal list has no block hashes.
+	hashes := map[int]string{}
+	txs := make([]EVMTx, 0, len(order))
+	for _, hash := range order {
+		tx := byHash[hash]
+		if tx.MinedInBlockHash == "" {
+			h, ok := hashes[tx.MinedInBlockHeight]
+			if !ok {
+				var err error
+				if h, err = p.BlockHash(tx.MinedInBlockHeight); err != nil {
+					return nil, fmt.Errorf("failed to get block %d: %w", tx.MinedInBlockHeight, err)
+				}
+				hashes[tx.MinedInBlockHeight] = h
+			}
+			tx.MinedInBlockHash = h
+		}
+		txs = append(txs, *tx)
+	}
+	sort.SliceStable(txs, func(i, j int) bool { return txs[i].MinedInBlockHeight > txs[j].MinedInBlockHeight })
+	return txs, nil
+}
+
+// list fetches up to limit rows of one of the address's tx lists between
+// two blocks, newest first.
+func (p etherscanProvider) list(action string, address string, start int, end int, limit int) ([]etherscanRow, error) {
+	params := url.Values{
+		"module":     {"account"},
+		"action":     {action},
+		"address":    {address},
+		"startblock": {strconv.Itoa(start)},
+		"endblock":   {strconv.Itoa(end)},
+		"page":       {"1"},
+		"offset":     {strconv.Itoa(limit)},
+		"sort":       {"desc"},
+	}
+	var rows []etherscanRow
+	if err := p.get(action, params, &rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+type etherscanBlock struct {
+	Number string `json:"number"`
+	Hash   string `json:"hash"`
+}
+
+func (p etherscanProvider) block(tag string) (etherscanBlock, error) {
+	params := url.Values{
+		"module":  {"proxy"},
+		"action":  {"eth_getBlockByNumber"},
+		"tag":     {tag},
+		"boolean": {"false"},
+	}
+	var block *etherscanBlock
+	if err := p.get("block", params, &block); err != nil {
+		return etherscanBlock{}, err
+	}
+	if block == nil {
+		return etherscanBlock{}, errProviderNotFound
+	}
+	return *block, nil
+}
+
+func (p etherscanProvider) ChainTip() (ChainTip, error) {
+	block, err := p.block("latest")
+	if err != nil {
+		return ChainTip{}, err
+	}
+	height, err := strconv.ParseInt(strings.TrimPrefix(block.Number, "0x"), 16, 64)
+	if err != nil {
+		return ChainTip{}, fmt.Errorf("invalid block number %q", block.Number)
+	}
+	return ChainTip{Height: int(height), Hash: block.Hash, UpdatedAt: time.Now().UTC()}, nil
+}
+
+func (p etherscanProvider) BlockHash(height int) (string, error) {
+	block, err := p.block("0x" + strconv.FormatInt(int64(height), 16))
+	if err != nil {
+		return "", err
+	}
+	return block.Hash, nil
+}
+
+// get sends a GET with params and decodes the result into out. Account
+// queries fail with status 0, except when there is simply nothing to list;
+// proxy queries fail with a JSON-RPC error.
+func (p etherscanProvider) get(endpoint string, params url.Values, out interface{}) error {
+	params.Set("chainid", strconv.Itoa(p.chainID))
+	if etherscanAPIKey != "" {
+		params.Set("apikey", etherscanAPIKey)
+	}
+
+	requested := time.Now()
+	res, err := client.Get(p.baseURL + "?" + params.Encode())
+	if err != nil {
+		observeProviderRequest(endpoint, 0, requested)
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+	observeProviderRequest(endpoint, res.StatusCode, requested)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	var body struct {
+		Status  string          `json:"status"`
+		Message string          `json:"message"`
+		Result  json.RawMessage `json:"result"`
+		Error   *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return fmt.Errorf("failed to unmarshal JSON: %w", err)
+	}
+	if body.Error != nil {
+		return fmt.Errorf("etherscan: %s", body.Error.Message)
+	}
+	if body.Status == "0" {
+		if strings.HasPrefix(body.Message, "No ") {
+			return nil
+		}
+		var reason string
+		json.Unmarshal(body.Result, &reason)
+		return fmt.Errorf("etherscan: %s: %s", body.Message, reason)
+	}
+	if err := json.Unmarshal(body.Result, out); err != nil {
+		return fmt.Errorf("failed to unmarshal result: %w", err)
+	}
+	return nil
+}
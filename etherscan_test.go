@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	tt "testing"
+)
+
+const testEVMAddress = "0x1111111111111111111111111111111111111111"
+
+// etherscanStub serves an address's txlist, txlistinternal and tokentx
+// rows, newest first, honouring the block range and offset of each query.
+type etherscanStub struct {
+	rows       map[string][]etherscanRow
+	blockCalls int
+}
+
+func (s *etherscanStub) serve(t *tt.T) etherscanProvider {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("chainid") != strconv.Itoa(chainEthereum.evmChainID) {
+			t.Errorf("chainid = %q", q.Get("chainid"))
+		}
+		if q.Get("module") == "proxy" {
+			s.blockCalls++
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"jsonrpc": "2.0", "id": 1,
+				"result": map[string]string{"number": q.Get("tag"), "hash": "0xblock" + q.Get("tag")},
+			})
+			return
+		}
+		start, _ := strconv.Atoi(q.Get("startblock"))
+		end, _ := strconv.Atoi(q.Get("endblock"))
+		limit, _ := strconv.Atoi(q.Get("offset"))
+		rows := []etherscanRow{}
+		for _, row := range s.rows[q.Get("action")] {
+			if h := row.height(); h >= start && h <= end && len(rows) < limit {
+				rows = append(rows, row)
+			}
+		}
+		if len(rows) == 0 {
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": "0", "message": "No transactions found", "result": []string{}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "1", "message": "OK", "result": rows})
+	}))
+	t.Cleanup(srv.Close)
+	return newEtherscanProvider(chainEthereum, srv.URL)
+}
+
+func etherscanHash(block int, i int) string {
+	return fmt.Sprintf("0x%060x%04x", block, i)
+}
+
+// allAccountTxs pages through the address's txs, failing on a repeated tx.
+func allAccountTxs(t *tt.T, p etherscanProvider) ([][]EVMTx, map[string]EVMTx) {
+	t.Helper()
+	var pages [][]EVMTx
+	seen := map[string]EVMTx{}
+	cursor := ""
+	for {
+		txs, next, err := p.AccountTxsAfter(testEVMAddress, cursor)
+		if err != nil {
+			t.Fatalf("AccountTxsAfter(%q): %v", cursor, err)
+		}
+		pages = append(pages, txs)
+		for _, tx := range txs {
+			if _, ok := seen[tx.TransactionId]; ok {
+				t.Fatalf("tx %s returned twice", tx.TransactionId)
+			}
+			seen[tx.TransactionId] = tx
+		}
+		if next == "" {
+			return pages, seen
+		}
+		if len(pages) > 10 {
+			t.Fatal("paging does not end")
+		}
+		cursor = next
+	}
+}
+
+func TestEtherscanPaging(t *tt.T) {
+	stub := &etherscanStub{rows: map[string][]etherscanRow{}}
+	// One sent tx in each of blocks 1149 down to 1000.
+	for b := 1149; b >= 1000; b-- {
+		stub.rows["txlist"] = append(stub.rows["txlist"], etherscanRow{
+			BlockNumber: strconv.Itoa(b), TimeStamp: "1708000000", Hash: etherscanHash(b, 0), BlockHash: "0xb" + strconv.Itoa(b),
+			From: testEVMAddress, To: "0x2222222222222222222222222222222222222222", Value: "1", GasPrice: "1", GasUsed: "21000",
+		})
+	}
+	// A contract payout with no normal row, and token transfers in the
+	// sent txs of blocks 1100 and 1050, the first block of page two.
+	stub.rows["txlistinternal"] = []etherscanRow{{BlockNumber: "1120", TimeStamp: "1708000000", Hash: etherscanHash(1120, 1),
+		From: "0x4444444444444444444444444444444444444444", To: testEVMAddress, Value: "5", TraceId: "0"}}
+	for _, b := range []int{1100, 1050} {
+		stub.rows["tokentx"] = append(stub.rows["tokentx"], etherscanRow{BlockNumber: strconv.Itoa(b), TimeStamp: "1708000000",
+			Hash: etherscanHash(b, 0), BlockHash: "0xb" + strconv.Itoa(b), ContractAddress: "0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48",
+			TokenSymbol: "USDC", TokenDecimal: "6", From: testEVMAddress, To: "0x2222222222222222222222222222222222222222", Value: "7"})
+	}
+
+	pages, seen := allAccountTxs(t, stub.serve(t))
+	if len(pages) != 2 {
+		t.Fatalf("got %d pages, want 2", len(pages))
+	}
+	// The full txlist page ends at block 1050, which may continue below it,
+	// so the first page stops above it.
+	first := pages[0]
+	if len(first) != 100 || first[0].MinedInBlockHeight != 1149 || first[len(first)-1].MinedInBlockHeight != 1051 {
+		t.Errorf("first page has %d txs, blocks %d to %d", len(first), first[0].MinedInBlockHeight, first[len(first)-1].MinedInBlockHeight)
+	}
+	if len(seen) != 151 {
+		t.Errorf("got %d txs, want 151", len(seen))
+	}
+	for _, b := range []int{1100, 1050} {
+		tx := seen[etherscanHash(b, 0)]
+		if tx.From != testEVMAddress || len(tx.TokenTransfers) != 1 || tx.TokenTransfers[0].Decimals != 6 {
+			t.Errorf("tx in block %d = %+v, want the sent tx with its USDC transfer", b, tx)
+		}
+	}
+	payout := seen[etherscanHash(1120, 1)]
+	if len(payout.Internal) != 1 || payout.MinedInBlockHash != "0xblock0x460" || stub.blockCalls != 1 {
+		t.Errorf("internal-only tx = %+v after %d block lookups, want its block hash looked up once", payout, stub.blockCalls)
+	}
+}
+
+func TestEtherscanPagingWithinOneBlock(t *tt.T) {
+	stub := &etherscanStub{rows: map[string][]etherscanRow{}}
+	// 120 token airdrops in one block, more than a page.
+	for i := 0; i < 120; i++ {
+		stub.rows["tokentx"] = append(stub.rows["tokentx"], etherscanRow{BlockNumber: "2000", TimeStamp: "1708000000",
+			Hash: etherscanHash(2000, i), BlockHash: "0xb2000", ContractAddress: "0x4444444444444444444444444444444444444444",
+			TokenSymbol: "DROP", TokenDecimal: "0", From: "0x4444444444444444444444444444444444444444", To: testEVMAddress, Value: "1"})
+	}
+	stub.rows["txlist"] = []etherscanRow{{BlockNumber: "1999", TimeStamp: "1708000000", Hash: etherscanHash(1999, 0), BlockHash: "0xb1999",
+		From: testEVMAddress, To: "0x2222222222222222222222222222222222222222", Value: "1", GasPrice: "1", GasUsed: "21000"}}
+
+	pages, seen := allAccountTxs(t, stub.serve(t))
+	if len(seen) != 121 {
+		t.Fatalf("got %d txs over %d pages, want 121", len(seen), len(pages))
+	}
+	for _, page := range pages {
+		blocks := map[int]int{}
+		for _, tx := range page {
+			blocks[tx.MinedInBlockHeight]++
+		}
+		if n, ok := blocks[2000]; ok && n != 120 {
+			t.Errorf("a page holds %d of block 2000's 120 txs", n)
+		}
+	}
+}
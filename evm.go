@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// EVM amounts are in wei, 18 decimals, and too large for int64 base units,
+// so views keep evmDecimals of them: gwei for ETH. What is below that is
+// dropped.
+const (
+	weiDecimals = 18
+	evmDecimals = 9
+)
+
+// tokenDecimals is what views keep of ERC-20 tokens that are not in
+// knownTokens: enough for stablecoins, while leaving room in int64 for
+// large balances of tokens with big supplies.
+const tokenDecimals = 6
+
+// addressAccount is the type of EVM addresses. Whether one is a contract
+// cannot be told from the address alone.
+const addressAccount = "account"
+
+// Statuses of an EVMTx. A failed tx still pays its fee but moves nothing.
+const (
+	evmSuccess = "success"
+	evmFailed  = "failed"
+)
+
+// EVMTx is a tx on an account chain, stored in txs.raw like an Item. It
+// shares Item's id, block and timestamp fields, so queries on those work
+// for both. Amounts are decimal strings: Value and GasPrice in wei, token
+// values in the token's smallest unit.
+type EVMTx struct {
+	TransactionId      string `json:"transactionId"`
+	TransactionHash    string `json:"transactionHash"`
+	MinedInBlockHeight int    `json:"minedInBlockHeight"`
+	MinedInBlockHash   string `json:"minedInBlockHash"`
+	Timestamp          int64  `json:"timestamp"`
+
+	// From, To and the fee fields are only known for txs the address sent
+	// or was the direct recipient of; txs that reached it through a
+	// contract carry only their internal and token transfers.
+	From            string `json:"from,omitempty"`
+	To              string `json:"to,omitempty"`
+	ContractAddress string `json:"contractAddress,omitempty"`
+	Value           string `json:"value"`
+	Nonce           uint64 `json:"nonce"`
+	Gas             uint64 `json:"gas"`
+	GasPrice        string `json:"gasPrice"`
+	GasUsed         uint64 `json:"gasUsed"`
+	Status          string `json:"status"`
+
+	Internal       []InternalTx    `json:"internal,omitempty"`
+	TokenTransfers []TokenTransfer `json:"tokenTransfers,omitempty"`
+}
+
+// InternalTx is a native transfer made by a contract during a tx.
+type InternalTx struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Value   string `json:"value"`
+	TraceId string `json:"traceId,omitempty"`
+}
+
+// TokenTransfer is an ERC-20 Transfer log emitted by a tx.
+type TokenTransfer struct {
+	Contract string `json:"contract"`
+	Symbol   string `json:"symbol"`
+	Decimals int    `json:"decimals"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Value    string `json:"value"`
+	LogIndex int    `json:"logIndex"`
+}
+
+// evmToken is how a token is shown: its unit and the decimals views keep.
+type evmToken struct {
+	Unit     string
+	Decimals int
+}
+
+// knownTokens maps chain key:contract to well-known tokens, which get
+// their plain symbol as unit so they can be priced. Other tokens are
+// SYMBOL-0xabcd, after their contract, since anyone can deploy a token
+// with any symbol.
+var knownTokens = map[string]evmToken{
+	"ethereum:0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48": {"USDC", 6},
+	"ethereum:0xdac17f958d2ee523a2206206994597c13d831ec7": {"USDT", 6},
+	"ethereum:0x6b175474e89094c44da98b954eedeac495271d0f": {"DAI", 6},
+	"ethereum:0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2": {"WETH", evmDecimals},
+	"ethereum:0x2260fac5e5542a773aa44fbcfedf7c193bc2c599": {"WBTC", 8},
+	"polygon:0x3c499c542cef5e3811e1192ce70d8cc03d5c3359":  {"USDC", 6},
+	"polygon:0xc2132d05d31c914a87c6611c10748aeb04b58e8f":  {"USDT", 6},
+	"arbitrum:0xaf88d065e77c8cc2239327c5edb3a432268e5831": {"USDC", 6},
+	"arbitrum:0xfd086bc7cd5c481dcc9c85ebe478a1c0b69fcbb9": {"USDT", 6},
+}
+
+var tokenSymbolJunk = regexp.MustCompile(`[^A-Za-z0-9]`)
+
+// token returns how the chain's token at contract, which calls itself
+// symbol, is shown.
+func (c *Chain) token(contract string, symbol string) evmToken {
+	contract = strings.ToLower(contract)
+	if t, ok := knownTokens[c.Key()+":"+contract]; ok {
+		return t
+	}
+	symbol = tokenSymbolJunk.ReplaceAllString(symbol, "")
+	if len(symbol) > 12 {
+		symbol = symbol[:12]
+	}
+	if symbol == "" {
+		symbol = "TOKEN"
+	}
+	if len(contract) > 6 {
+		contract = contract[:6]
+	}
+	return evmToken{Unit: strings.ToUpper(symbol) + "-" + contract, Decimals: tokenDecimals}
+}
+
+// tokenUnitDecimals returns the decimals views keep of a token unit.
+func tokenUnitDecimals(unit string) int {
+	for _, t := range knownTokens {
+		if t.Unit == unit {
+			return t.Decimals
+		}
+	}
+	return tokenDecimals
+}
+
+// validateEVMAddress checks s if it is an EVM address: 0x and 40 hex
+// digits, optionally prefixed with an EVM chain's name, as in polygon:0x....
+// Mixed case addresses must carry a valid EIP-55 checksum. It reports
+// whether s looked like an EVM address at all; addresses are returned in
+// lower case, with the chain prefix unless on Ethereum.
+func validateEVMAddress(s string) (AddressInfo, bool, error) {
+	c := chainEthereum
+	if name, rest, ok := strings.Cut(s, ":"); ok {
+		found := false
+		for _, ch := range chains {
+			if ch.Model == modelAccount && ch.Name == strings.ToLower(name) {
+				c, found = ch, true
+			}
+		}
+		if !found {
+			return AddressInfo{}, false, nil
+		}
+		s = rest
+	}
+	if !strings.HasPrefix(s, "0x") && !strings.HasPrefix(s, "0X") {
+		return AddressInfo{}, c != chainEthereum, fmt.Errorf("%w: not an EVM address", errInvalidAddress)
+	}
+	digits := s[2:]
+	if len(digits) != 40 {
+		return AddressInfo{}, true, fmt.Errorf("%w: EVM addresses have 40 hex digits, got %d", errInvalidAddress, len(digits))
+	}
+	if _, err := hex.DecodeString(digits); err != nil {
+		return AddressInfo{}, true, fmt.Errorf("%w: not hex", errInvalidAddress)
+	}
+	if digits != strings.ToLower(digits) && digits != strings.ToUpper(digits) && eip55(digits) != "0x"+digits {
+		return AddressInfo{}, true, fmt.Errorf("%w: invalid EIP-55 checksum", errInvalidAddress)
+	}
+
+	address := "0x" + strings.ToLower(digits)
+	if c != chainEthereum {
+		address = c.Name + ":" + address
+	}
+	return AddressInfo{Address: address, Type: addressAccount, Chain: c.Name, Network: c.Network}, true, nil
+}
+
+// eip55 writes 40 hex digits in EIP-55 mixed case checksum form.
+func eip55(digits string) string {
+	digits = strings.ToLower(digits)
+	h := sha3.NewLegacyKeccak256()
+	h.Write([]byte(digits))
+	sum := h.Sum(nil)
+	out := []byte(digits)
+	for i := range out {
+		nibble := sum[i/2] >> 4
+		if i%2 == 1 {
+			nibble = sum[i/2] & 0x0f
+		}
+		if out[i] > '9' && nibble >= 8 {
+			out[i] -= 'a' - 'A'
+		}
+	}
+	return "0x" + string(out)
+}
+
+// evmHex returns the bare 0x address of a tracked EVM address, as
+// providers write it.
+func evmHex(address string) string {
+	if _, rest, ok := strings.Cut(address, ":"); ok {
+		return rest
+	}
+	return address
+}
+
+// parseBigUnits parses a decimal string of base units, such as wei.
+func parseBigUnits(s string) (*big.Int, error) {
+	v := new(big.Int)
+	if s == "" {
+		return v, nil
+	}
+	if _, ok := v.SetString(s, 10); !ok {
+		return nil, fmt.Errorf("%w: %q", errInvalidAmount, s)
+	}
+	return v, nil
+}
+
+// rescale converts an amount with from decimals to one with to decimals,
+// dropping what is below the smallest unit kept.
+func rescale(amount *big.Int, from int, to int) *big.Int {
+	v := new(big.Int).Set(amount)
+	if from > to {
+		return v.Quo(v, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(from-to)), nil))
+	}
+	return v.Mul(v, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(to-from)), nil))
+}
+
+// toViewUnits rescales amount to to decimals as int64 base units.
+func toViewUnits(amount *big.Int, from int, to int) (int64, error) {
+	v := rescale(amount, from, to)
+	if !v.IsInt64() {
+		return 0, fmt.Errorf("%w: %s is too large", errInvalidAmount, amount)
+	}
+	return v.Int64(), nil
+}
+
+// viewEVMTx classifies tx from address's point of view on chain c, giving
+// one view per unit it moved: the chain's own unit first, then each token.
+// The sender pays the whole fee, even if the tx failed; a failed tx moves
+// nothing else. The native view is left out when the address only moved
+// tokens it did not pay gas for, and token views that round to nothing or
+// are too large for int64 are left out.
+func viewEVMTx(tx EVMTx, address string, c *Chain) ([]TxView, error) {
+	self := evmHex(address)
+	base := TxView{
+		Address:     address,
+		TxId:        tx.TransactionId,
+		Hash:        tx.TransactionHash,
+		Timestamp:   time.Unix(tx.Timestamp, 0).UTC(),
+		BlockHeight: tx.MinedInBlockHeight,
+		BlockHash:   tx.MinedInBlockHash,
+	}
+	ok := tx.Status != evmFailed
+
+	sent, received, fee := new(big.Int), new(big.Int), new(big.Int)
+	if tx.From == self {
+		gasPrice, err := parseBigUnits(tx.GasPrice)
+		if err != nil {
+			return nil, err
+		}
+		fee.Mul(new(big.Int).SetUint64(tx.GasUsed), gasPrice)
+	}
+	if ok {
+		value, err := parseBigUnits(tx.Value)
+		if err != nil {
+			return nil, err
+		}
+		if tx.From == self {
+			sent.Add(sent, value)
+		}
+		if tx.To == self {
+			received.Add(received, value)
+		}
+		for _, in := range tx.Internal {
+			value, err := parseBigUnits(in.Value)
+			if err != nil {
+				return nil, err
+			}
+			if in.From == self {
+				sent.Add(sent, value)
+			}
+			if in.To == self {
+				received.Add(received, value)
+			}
+		}
+	}
+
+	views := []TxView{}
+	if ok {
+		var units []string
+		sums := map[string]*[2]*big.Int{}
+		tokens := map[string]evmToken{}
+		onlySelf := map[string]bool{}
+		for _, t := range tx.TokenTransfers {
+			if t.From != self && t.To != self {
+				continue
+			}
+			token := c.token(t.Contract, t.Symbol)
+			value, err := parseBigUnits(t.Value)
+			if err != nil {
+				return nil, err
+			}
+			// Contracts with the same unit may differ in decimals, so values
+			// are summed at wei scale.
+			value = rescale(value, t.Decimals, weiDecimals)
+			s, seen := sums[token.Unit]
+			if !seen {
+				s = &[2]*big.Int{new(big.Int), new(big.Int)}
+				sums[token.Unit] = s
+				tokens[token.Unit] = token
+				onlySelf[token.Unit] = true
+				units = append(units, token.Unit)
+			}
+			if t.From == self {
+				s[0].Add(s[0], value)
+			}
+			if t.To == self {
+				s[1].Add(s[1], value)
+			}
+			onlySelf[token.Unit] = onlySelf[token.Unit] && t.From == self && t.To == self
+		}
+		for _, unit := range units {
+			v, err := evmView(base, unit, tokens[unit].Decimals, sums[unit][0], sums[unit][1], new(big.Int), onlySelf[unit])
+			if errors.Is(err, errInvalidAmount) {
+				// Spam tokens are often sent in amounts no real token has,
+				// beyond what a view can hold.
+				logger.Warn("skipped token transfer too large to show", "tx_id", tx.TransactionId, "unit", unit, "error", err)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			// Zero value transfers are mostly spam, sent to plant look-alike
+			// addresses in the history.
+			if v.Sent == 0 && v.Received == 0 {
+				continue
+			}
+			views = append(views, v)
+		}
+	}
+
+	if tx.From == self || sent.Sign() > 0 || received.Sign() > 0 || len(views) == 0 {
+		native, err := evmView(base, c.Unit, c.Decimals, sent, received, fee, tx.From == self && tx.To == self)
+		if err != nil {
+			return nil, err
+		}
+		views = append([]TxView{native}, views...)
+	}
+	return views, nil
+}
+
+// evmView builds the view of one unit from amounts in wei scale.
+func evmView(base TxView, unit string, decimals int, sent *big.Int, received *big.Int, fee *big.Int, onlySelf bool) (TxView, error) {
+	v := base
+	v.Unit = unit
+	var err error
+	if v.Sent, err = toViewUnits(sent, weiDecimals, decimals); err != nil {
+		return v, err
+	}
+	if v.Received, err = toViewUnits(received, weiDecimals, decimals); err != nil {
+		return v, err
+	}
+	if v.Fee, err = toViewUnits(fee, weiDecimals, decimals); err != nil {
+		return v, err
+	}
+	// The fee is scaled on its own so that a tx between tracked addresses
+	// nets out to exactly its fee.
+	v.Sent += v.Fee
+	v.Net = v.Received - v.Sent
+	switch {
+	case v.Sent > 0 && onlySelf:
+		v.Direction = directionSelf
+	case v.Net < 0:
+		v.Direction = directionSend
+	default:
+		v.Direction = directionReceive
+	}
+	return v, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	tt "testing"
+)
+
+func TestViewEVMTxSkipsOversizedTokenTransfer(t *tt.T) {
+	const uint256Max = "115792089237316195423570985008687907853269984665640564039457584007913129639935"
+	tx := EVMTx{
+		TransactionId: "0xaa", TransactionHash: "0xaa", Timestamp: 1708000000, Status: evmSuccess,
+		From: "0x2222222222222222222222222222222222222222", To: "0x3333333333333333333333333333333333333333", Value: "0",
+		TokenTransfers: []TokenTransfer{
+			{Contract: "0x4444444444444444444444444444444444444444", Symbol: "SPAM", Decimals: 18,
+				From: "0x2222222222222222222222222222222222222222", To: testEVMAddress, Value: uint256Max},
+			{Contract: "0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48", Symbol: "USDC", Decimals: 6,
+				From: "0x2222222222222222222222222222222222222222", To: testEVMAddress, Value: "2500000"},
+		},
+	}
+
+	views, err := viewEVMTx(tx, testEVMAddress, chainEthereum)
+	if err != nil {
+		t.Fatalf("viewEVMTx: %v", err)
+	}
+	if len(views) != 1 {
+		t.Fatalf("got %d views, want only USDC: %+v", len(views), views)
+	}
+	if v := views[0]; v.Unit != "USDC" || v.Received != 2500000 || v.Direction != directionReceive {
+		t.Errorf("got %s %s %d, want USDC receive 2500000", v.Unit, v.Direction, v.Received)
+	}
+}
+
+func TestViewEVMTxOnlyOversizedTokenTransfer(t *tt.T) {
+	tx := EVMTx{
+		TransactionId: "0xbb", TransactionHash: "0xbb", Timestamp: 1708000000, Status: evmSuccess,
+		From: "0x2222222222222222222222222222222222222222", To: "0x4444444444444444444444444444444444444444", Value: "0",
+		TokenTransfers: []TokenTransfer{{Contract: "0x4444444444444444444444444444444444444444", Symbol: "SPAM", Decimals: 0,
+			From: "0x2222222222222222222222222222222222222222", To: testEVMAddress,
+			Value: "115792089237316195423570985008687907853269984665640564039457584007913129639935"}},
+	}
+
+	views, err := viewEVMTx(tx, testEVMAddress, chainEthereum)
+	if err != nil {
+		t.Fatalf("viewEVMTx: %v", err)
+	}
+	// With no token view left, the tx still shows as moving nothing in ETH.
+	if len(views) != 1 || views[0].Unit != chainEthereum.Unit || views[0].Net != 0 {
+		t.Fatalf("got %+v, want one empty ETH view", views)
+	}
+}
+
+func TestViewEVMTxFailedPaysFee(t *tt.T) {
+	tx := EVMTx{
+		TransactionId: "0xcc", TransactionHash: "0xcc", Timestamp: 1708000000, Status: evmFailed,
+		From: testEVMAddress, To: "0x2222222222222222222222222222222222222222", Value: "1000000000000000000",
+		GasPrice: "20000000000", GasUsed: 21000,
+	}
+
+	views, err := viewEVMTx(tx, testEVMAddress, chainEthereum)
+	if err != nil {
+		t.Fatalf("viewEVMTx: %v", err)
+	}
+	// 21000 gas at 20 gwei is 420000 gwei.
+	if len(views) != 1 || views[0].Fee != 420000 || views[0].Net != -420000 {
+		t.Fatalf("got %+v, want a fee-only view of 420000 gwei", views)
+	}
+}
+
+func TestValidateEVMAddressChecksum(t *tt.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", true},
+		{"0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", true},
+		{"0x5AAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", "", false},
+		{"0x5aaeb6053f3e94c9b9a09f33669435e7ef1bea", "", false},
+	}
+	for _, tc := range tests {
+		info, _, err := validateEVMAddress(tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("validateEVMAddress(%q) error = %v, want ok %v", tc.in, err, tc.ok)
+			continue
+		}
+		if tc.ok && info.Address != tc.want {
+			t.Errorf("validateEVMAddress(%q) = %q, want %q", tc.in, info.Address, tc.want)
+		}
+	}
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of exchange ledger entry. Deposits and withdrawals are matched to
+// on-chain txs; other operations an exchange reports keep its own name.
+const (
+	kindTrade      = "trade"
+	kindDeposit    = "deposit"
+	kindWithdrawal = "withdrawal"
+	kindIncome     = "income"
+	kindFee        = "fee"
+	kindTransfer   = "transfer"
+)
+
+// exchangeMatchWindow is how far apart an exchange's record of a deposit or
+// withdrawal and the on-chain tx's block time may be.
+const exchangeMatchWindow = 24 * time.Hour
+
+// exchangeMatchTolerance is how much less than the exchange's amount an
+// on-chain tx may carry and still match it, since exchanges deduct
+// withdrawal fees they do not always report.
+const exchangeMatchTolerance = 0.02
+
+// fiatCurrencies are left out of imports: only crypto balances are
+// tracked, and the fiat side of a trade is kept in its description.
+var fiatCurrencies = map[string]bool{"USD": true, "EUR": true, "GBP": true, "CAD": true, "AUD": true, "JPY": true,
+	"CHF": true, "NZD": true, "SGD": true, "HKD": true, "TRY": true, "BRL": true, "ZAR": true, "PLN": true}
+
+// krakenAssets maps Kraken's legacy asset codes to the usual symbols.
+var krakenAssets = map[string]string{"XXBT": "BTC", "XBT": "BTC", "XETH": "ETH", "XLTC": "LTC", "XXDG": "DOGE",
+	"XDG": "DOGE", "XXRP": "XRP", "XXLM": "XLM", "XETC": "ETC", "XXMR": "XMR", "XZEC": "ZEC", "ETH2": "ETH",
+	"ZUSD": "USD", "ZEUR": "EUR", "ZGBP": "GBP", "ZCAD": "CAD", "ZJPY": "JPY", "ZAUD": "AUD", "ZCHF": "CHF"}
+
+// exchangeUnit is the unit of an exchange's asset code. Kraken's staking
+// variants, such as ETH2.S or DOT.S, are the asset itself.
+func exchangeUnit(asset string) string {
+	asset = strings.ToUpper(strings.TrimSpace(asset))
+	asset, _, _ = strings.Cut(asset, ".")
+	if u, ok := krakenAssets[asset]; ok {
+		return u
+	}
+	return asset
+}
+
+var amountJunk = regexp.MustCompile(`[\s,$€£]`)
+
+// parseExchangeAmount reads an exchange's decimal amount, which may have
+// thousands separators, a currency sign or an exponent, in unit's base
+// units. Digits below one base unit are dropped.
+func parseExchangeAmount(s string, unit string) (int64, error) {
+	s = amountJunk.ReplaceAllString(s, "")
+	if s == "" {
+		return 0, nil
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", errInvalidAmount, s)
+	}
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(unitDecimals(unit))), nil)
+	v := new(big.Int).Quo(new(big.Int).Mul(r.Num(), scale), r.Denom())
+	if !v.IsInt64() {
+		return 0, fmt.Errorf("%w: %q is out of range", errInvalidAmount, s)
+	}
+	return v.Int64(), nil
+}
+
+// parseExchangeTime reads an exchange's timestamp: the formats prices take,
+// with or without a UTC suffix or fractional seconds, or Binance's two digit
+// years.
+func parseExchangeTime(s string) (time.Time, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), " UTC")
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999", "06-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return parseLedgerTime(s)
+}
+
+// txHashPattern matches the tx hashes exchanges report; anything else, such
+// as "Internal transfer", is not on-chain.
+var txHashPattern = regexp.MustCompile(`^(0x)?[0-9a-f]{64}$`)
+
+func exchangeTxId(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if !txHashPattern.MatchString(s) {
+		return ""
+	}
+	return s
+}
+
+// exchangeKind classifies an operation named by an exchange.
+func exchangeKind(op string) string {
+	op = strings.ToLower(strings.TrimSpace(op))
+	has := func(words ...string) bool {
+		for _, w := range words {
+			if strings.Contains(op, w) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("deposit"):
+		return kindDeposit
+	case has("withdraw"):
+		return kindWithdrawal
+	case has("transfer", "subscription", "redemption"):
+		return kindTransfer
+	case has("fee", "commission"):
+		return kindFee
+	case has("reward", "interest", "staking", "distribution", "airdrop", "rebate", "income", "earn"):
+		return kindIncome
+	case has("buy", "sell", "trade", "transaction", "convert", "spend", "receive", "exchange"):
+		return kindTrade
+	}
+	return strings.ReplaceAll(op, " ", "_")
+}
+
+// exchangeImport collects the ledger entries read from an exchange's CSV
+// export.
+type exchangeImport struct {
+	source  string
+	account string
+	header  []string
+	index   map[string]int
+	ids     csvRowIds
+	entries []LedgerEntry
+	// skipped counts the rows left out, by why.
+	skipped map[string]int
+}
+
+// exchangeFormat is an exchange's CSV export: the columns read from it,
+// which of them must be present, and how a row becomes entries.
+type exchangeFormat struct {
+	source   string
+	columns  map[string][]string
+	required []string
+	read     func(x *exchangeImport, row []string) error
+}
+
+var exchangeFormats = map[string]exchangeFormat{
+	"coinbase": {
+		source: "coinbase",
+		columns: map[string][]string{
+			"id":       {"id"},
+			"date":     {"timestamp"},
+			"type":     {"transactiontype"},
+			"asset":    {"asset"},
+			"quantity": {"quantitytransacted"},
+			"notes":    {"notes"},
+		},
+		required: []string{"date", "type", "asset", "quantity"},
+		read:     readCoinbaseRow,
+	},
+	"kraken": {
+		source: "kraken",
+		columns: map[string][]string{
+			"id":      {"txid"},
+			"refid":   {"refid"},
+			"date":    {"time"},
+			"type":    {"type"},
+			"subtype": {"subtype"},
+			"asset":   {"asset"},
+			"amount":  {"amount"},
+			"fee":     {"fee"},
+		},
+		required: []string{"id", "refid", "date", "type", "asset", "amount"},
+		read:     readKrakenRow,
+	},
+	"binance": {
+		source: "binance",
+		columns: map[string][]string{
+			"date":      {"utctime"},
+			"operation": {"operation"},
+			"coin":      {"coin"},
+			"change":    {"change"},
+			"remark":    {"remark"},
+		},
+		required: []string{"date", "operation", "coin", "change"},
+		read:     readBinanceRow,
+	},
+	"binance-deposits":    binanceHistoryFormat(kindDeposit),
+	"binance-withdrawals": binanceHistoryFormat(kindWithdrawal),
+}
+
+func (x *exchangeImport) col(row []string, field string) string {
+	if i, ok := x.index[field]; ok && i < len(row) {
+		return strings.TrimSpace(row[i])
+	}
+	return ""
+}
+
+// add records an entry of row moving amount of asset, which is made
+// negative if out, less fee, which is in the same asset. Fiat is skipped.
+func (x *exchangeImport) add(row []string, id string, kind string, asset string, amount string, out bool, fee string,
+	at time.Time, description string) error {
+	unit := exchangeUnit(asset)
+	if unit == "" || fiatCurrencies[unit] {
+		x.skipped["fiat"]++
+		return nil
+	}
+	value, err := parseExchangeAmount(amount, unit)
+	if err != nil {
+		return err
+	}
+	paid, err := parseExchangeAmount(fee, unit)
+	if err != nil {
+		return err
+	}
+	if value < 0 {
+		value, out = -value, true
+	}
+	if paid < 0 {
+		paid = -paid
+	}
+	if out {
+		value = -value
+	}
+	x.entries = append(x.entries, LedgerEntry{Source: x.source, Account: x.account, EntryId: id, Kind: kind, Unit: unit,
+		Amount: value - paid, Fee: paid, OccurredAt: at, Description: description, Raw: csvRecord(x.header, row)})
+	return nil
+}
+
+// coinbaseConvert is the note on a Coinbase conversion.
+var coinbaseConvert = regexp.MustCompile(`(?i)converted\s+([\d.,]+)\s+(\S+)\s+to\s+([\d.,]+)\s+(\S+)`)
+
+// readCoinbaseRow reads a row of Coinbase's transaction history. Quantities
+// are unsigned, or negative only in newer reports, so the type says which
+// way they went.
+func readCoinbaseRow(x *exchangeImport, row []string) error {
+	at, err := parseExchangeTime(x.col(row, "date"))
+	if err != nil {
+		return err
+	}
+	id := x.col(row, "id")
+	if id == "" {
+		id = x.ids.id(row)
+	}
+	typ, asset, notes := x.col(row, "type"), x.col(row, "asset"), x.col(row, "notes")
+	quantity := strings.TrimPrefix(x.col(row, "quantity"), "-")
+
+	switch t := strings.ToLower(typ); {
+	case t == "buy" || t == "advanced trade buy":
+		return x.add(row, id, kindTrade, asset, quantity, false, "", at, notes)
+	case t == "sell" || t == "advanced trade sell":
+		return x.add(row, id, kindTrade, asset, quantity, true, "", at, notes)
+	case t == "send" || t == "withdrawal":
+		return x.add(row, id, kindWithdrawal, asset, quantity, true, "", at, notes)
+	case t == "receive" || t == "deposit":
+		return x.add(row, id, kindDeposit, asset, quantity, false, "", at, notes)
+	case t == "pro withdrawal":
+		return x.add(row, id, kindTransfer, asset, quantity, false, "", at, notes)
+	case t == "pro deposit":
+		return x.add(row, id, kindTransfer, asset, quantity, true, "", at, notes)
+	case t == "convert":
+		m := coinbaseConvert.FindStringSubmatch(notes)
+		if m == nil {
+			return fmt.Errorf("cannot read conversion %q", notes)
+		}
+		if err := x.add(row, id+"/"+exchangeUnit(m[2]), kindTrade, m[2], m[1], true, "", at, notes); err != nil {
+			return err
+		}
+		return x.add(row, id+"/"+exchangeUnit(m[4]), kindTrade, m[4], m[3], false, "", at, notes)
+	case exchangeKind(t) == kindIncome:
+		return x.add(row, id, kindIncome, asset, quantity, false, "", at, notes)
+	}
+	x.skipped[typ]++
+	return nil
+}
+
+// readKrakenRow reads a row of Kraken's ledger export. Amounts are signed
+// and the fee is charged on top; the two legs of a trade share a refid.
+// Rows without a txid are deposits not yet credited.
+func readKrakenRow(x *exchangeImport, row []string) error {
+	id := x.col(row, "id")
+	if id == "" {
+		x.skipped["unconfirmed"]++
+		return nil
+	}
+	at, err := parseExchangeTime(x.col(row, "date"))
+	if err != nil {
+		return err
+	}
+	typ := x.col(row, "type")
+	description := strings.TrimSpace(typ + " " + x.col(row, "subtype") + " " + x.col(row, "refid"))
+	return x.add(row, id, exchangeKind(typ), x.col(row, "asset"), x.col(row, "amount"), false, x.col(row, "fee"), at,
+		description)
+}
+
+// readBinanceRow reads a row of Binance's transaction history statement,
+// where each row is a signed change to one coin's balance.
+func readBinanceRow(x *exchangeImport, row []string) error {
+	at, err := parseExchangeTime(x.col(row, "date"))
+	if err != nil {
+		return err
+	}
+	op := x.col(row, "operation")
+	description := strings.TrimSpace(op + " " + x.col(row, "remark"))
+	return x.add(row, x.ids.id(row), exchangeKind(op), x.col(row, "coin"), x.col(row, "change"), false, "", at,
+		description)
+}
+
+// binanceHistoryFormat reads Binance's deposit or withdrawal history, which
+// gives the tx hash of each. The file does not say which it is, so kind
+// does. A withdrawal's amount excludes its fee. Rows without a tx hash are
+// skipped.
+func binanceHistoryFormat(kind string) exchangeFormat {
+	return exchangeFormat{
+		source: "binance",
+		columns: map[string][]string{
+			"date":   {"dateutc", "date", "time"},
+			"coin":   {"coin"},
+			"amount": {"amount"},
+			"fee":    {"transactionfee", "fee"},
+			"txId":   {"txid"},
+			"status": {"status"},
+		},
+		required: []string{"date", "coin", "amount", "txId"},
+		read: func(x *exchangeImport, row []string) error {
+			if status := strings.ToLower(x.col(row, "status")); status != "" && status != "completed" && status != "success" {
+				x.skipped[x.col(row, "status")]++
+				return nil
+			}
+			at, err := parseExchangeTime(x.col(row, "date"))
+			if err != nil {
+				return err
+			}
+			// Transfers between Binance users never reach the chain, and
+			// the statement has them already.
+			txId := exchangeTxId(x.col(row, "txId"))
+			if txId == "" {
+				x.skipped["off-chain"]++
+				return nil
+			}
+			id := kind + ":" + txId
+			fee := ""
+			if kind == kindWithdrawal {
+				fee = x.col(row, "fee")
+			}
+			n := len(x.entries)
+			if err := x.add(row, id, kind, x.col(row, "coin"), x.col(row, "amount"), kind == kindWithdrawal, fee, at, ""); err != nil {
+				return err
+			}
+			if len(x.entries) > n {
+				x.entries[n].TxId = txId
+			}
+			return nil
+		},
+	}
+}
+
+// readExchangeCSV reads an exchange's CSV export as ledger entries of
+// account. Lines before the header, such as the title and account details
+// Coinbase puts at the top, are skipped.
+func readExchangeCSV(r io.Reader, format exchangeFormat, account string) (*exchangeImport, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	x := &exchangeImport{source: format.source, account: account, ids: csvRowIds{}, entries: []LedgerEntry{}, skipped: map[string]int{}}
+	start := -1
+	for i := 0; i < len(rows) && i < 20 && start < 0; i++ {
+		index := csvHeaderIndex(rows[i], format.columns)
+		found := true
+		for _, field := range format.required {
+			if _, ok := index[field]; !ok {
+				found = false
+			}
+		}
+		if found {
+			x.header, x.index, start = rows[i], index, i
+		}
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("no %s header found", format.source)
+	}
+
+	for i, row := range rows[start+1:] {
+		if len(row) == 1 && strings.TrimSpace(row[0]) == "" {
+			continue
+		}
+		if err := format.read(x, row); err != nil {
+			return nil, fmt.Errorf("line %d: %w", start+i+2, err)
+		}
+	}
+	return x, nil
+}
+
+// storeExchangeEntries stores entries like storeLedgerEntries, except that
+// a deposit or withdrawal with a tx hash first fills in the hash of the
+// same one already imported from a statement without hashes.
+func storeExchangeEntries(db *sql.DB, entries []LedgerEntry) (int, error) {
+	rest := []LedgerEntry{}
+	linked := 0
+	for _, e := range entries {
+		if e.TxId == "" {
+			rest = append(rest, e)
+			continue
+		}
+		var known bool
+		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM ledger_entries WHERE account = $1 AND kind = $2 AND unit = $3 AND tx_id = $4)`,
+			e.Account, e.Kind, e.Unit, e.TxId).Scan(&known)
+		if err != nil {
+			return 0, fmt.Errorf("failed to look up entry %s: %w", e.EntryId, err)
+		}
+		if known {
+			continue
+		}
+		// A statement may or may not count the fee in a withdrawal.
+		res, err := db.Exec(`
+			UPDATE ledger_entries SET tx_id = $1 WHERE id = (
+				SELECT id FROM ledger_entries
+				WHERE account = $2 AND source = $3 AND kind = $4 AND unit = $5 AND tx_id = '' AND amount IN ($6, $7)
+					AND occurred_at BETWEEN $8::timestamptz - $9::int * interval '1 second' AND $8::timestamptz + $9::int * interval '1 second'
+				ORDER BY abs(extract(epoch FROM occurred_at - $8::timestamptz)), id
+				LIMIT 1)`,
+			e.TxId, e.Account, e.Source, e.Kind, e.Unit, e.Amount, e.Amount+e.Fee, e.OccurredAt.UTC(), int(exchangeMatchWindow.Seconds()))
+		if err != nil {
+			return 0, fmt.Errorf("failed to link entry %s: %w", e.EntryId, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			linked++
+			continue
+		}
+		rest = append(rest, e)
+	}
+	inserted, err := storeLedgerEntries(db, rest)
+	return linked + inserted, err
+}
+
+// matchExchangeTransfers links deposits and withdrawals without a tx hash
+// to the on-chain txs of tracked addresses that moved the same unit within
+// exchangeMatchWindow, so the two net out as a transfer. A deposit matches a
+// tx that paid out at least what was credited, a withdrawal one that paid
+// in at most what was withdrawn, either within exchangeMatchTolerance. The
+// closest amount wins, then the closest time, and a tx is linked only once.
+// It returns how many entries were linked.
+func matchExchangeTransfers(db *sql.DB) (int, error) {
+	rows, err := db.Query(`
+		SELECT id, kind, unit, amount, fee, occurred_at FROM ledger_entries
+		WHERE tx_id = '' AND kind IN ($1, $2) ORDER BY occurred_at, id`, kindDeposit, kindWithdrawal)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load unlinked entries: %w", err)
+	}
+	var entries []LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		if err := rows.Scan(&e.Id, &e.Kind, &e.Unit, &e.Amount, &e.Fee, &e.OccurredAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	used := map[string]bool{}
+	linkedRows, err := db.Query(`SELECT DISTINCT tx_id FROM ledger_entries WHERE tx_id <> ''`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load linked txs: %w", err)
+	}
+	for linkedRows.Next() {
+		var txId string
+		if err := linkedRows.Scan(&txId); err != nil {
+			linkedRows.Close()
+			return 0, err
+		}
+		used[txId] = true
+	}
+	linkedRows.Close()
+
+	addresses, err := trackedAddresses(db)
+	if err != nil {
+		return 0, err
+	}
+	views, err := loadPortfolioViews(db, addresses)
+	if err != nil {
+		return 0, err
+	}
+	views = confirmedOnly(views)
+
+	linked := 0
+	for _, e := range entries {
+		best := closestExchangeTx(e, views, used)
+		if best < 0 {
+			continue
+		}
+		txId := views[best].TxId
+		if _, err := db.Exec(`UPDATE ledger_entries SET tx_id = $1 WHERE id = $2`, txId, e.Id); err != nil {
+			return linked, fmt.Errorf("failed to link entry %d: %w", e.Id, err)
+		}
+		used[txId] = true
+		linked++
+	}
+	return linked, nil
+}
+
+// closestExchangeTx returns the index of the view that best matches deposit
+// or withdrawal e, or -1 if none does.
+func closestExchangeTx(e LedgerEntry, views []TxView, used map[string]bool) int {
+	best := -1
+	var bestDiff int64
+	var bestGap time.Duration
+	for i, v := range views {
+		if used[v.TxId] || unitOf(v) != e.Unit {
+			continue
+		}
+		gap := v.Timestamp.Sub(e.OccurredAt)
+		if gap < 0 {
+			gap = -gap
+		}
+		if gap > exchangeMatchWindow {
+			continue
+		}
+		// onChain is what the tx moved, want what the exchange recorded.
+		var onChain, want int64
+		if e.Kind == kindDeposit {
+			onChain, want = -v.Net-v.Fee, e.Amount+e.Fee
+		} else {
+			onChain, want = v.Net, -e.Amount-e.Fee
+		}
+		diff := onChain - want
+		if e.Kind == kindWithdrawal {
+			diff = -diff
+		}
+		if onChain <= 0 || diff < 0 || float64(diff) > float64(want)*exchangeMatchTolerance {
+			continue
+		}
+		if best < 0 || diff < bestDiff || (diff == bestDiff && gap < bestGap) {
+			best, bestDiff, bestGap = i, diff, gap
+		}
+	}
+	return best
+}
+
+// runExchange implements the exchange command: "exchange import -format F
+// FILE" imports an exchange's CSV export and "exchange match" links
+// deposits and withdrawals to on-chain txs synced since.
+func runExchange(db *sql.DB, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: exchange import|match ...")
+	}
+	sub, args := args[0], args[1:]
+
+	names := make([]string, 0, len(exchangeFormats))
+	for name := range exchangeFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fs := flag.NewFlagSet("exchange "+sub, flag.ExitOnError)
+	formatName := fs.String("format", "", "export format: "+strings.Join(names, ", "))
+	account := fs.String("account", "", "ledger account to import into (default the exchange's name)")
+	fs.Parse(args)
+
+	switch sub {
+	case "import":
+		format, ok := exchangeFormats[*formatName]
+		if !ok {
+			return fmt.Errorf("unknown -format %q: use one of %s", *formatName, strings.Join(names, ", "))
+		}
+		if fs.NArg() != 1 {
+			return errors.New("usage: exchange import -format FORMAT [-account NAME] FILE")
+		}
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		x, err := readExchangeCSV(f, format, firstNonEmpty(*account, format.source))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", fs.Arg(0), err)
+		}
+		n, err := storeExchangeEntries(db, x.entries)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "imported %d new entries of %d\n", n, len(x.entries))
+		reasons := make([]string, 0, len(x.skipped))
+		for reason := range x.skipped {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(out, "skipped %d %s rows\n", x.skipped[reason], reason)
+		}
+	case "match":
+	default:
+		return fmt.Errorf("unknown exchange command %q", sub)
+	}
+
+	linked, err := matchExchangeTransfers(db)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "linked %d deposits and withdrawals to on-chain txs\n", linked)
+	return nil
+}
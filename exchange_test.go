@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	tt "testing"
+	"time"
+)
+
+func TestParseExchangeAmount(t *tt.T) {
+	tests := []struct {
+		in   string
+		unit string
+		want int64
+		err  bool
+	}{
+		{"1.5", "BTC", 150000000, false},
+		{"-0.25", "BTC", -25000000, false},
+		{"1,234.5678901299", "BTC", 123456789012, false},
+		{" $1,000 ", "BTC", 100000000000, false},
+		{"1e-8", "BTC", 1, false},
+		{"0.000000019", "BTC", 1, false},
+		{"2.5E-3", "ETH", 2500000, false},
+		{"", "BTC", 0, false},
+		{"abc", "BTC", 0, true},
+		{"1e20", "BTC", 0, true},
+	}
+	for _, tc := range tests {
+		got, err := parseExchangeAmount(tc.in, tc.unit)
+		if tc.err {
+			if !errors.Is(err, errInvalidAmount) {
+				t.Errorf("parseExchangeAmount(%q, %s) error = %v, want errInvalidAmount", tc.in, tc.unit, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("parseExchangeAmount(%q, %s) = %d, %v; want %d", tc.in, tc.unit, got, err, tc.want)
+		}
+	}
+}
+
+func TestExchangeUnitAndKind(t *tt.T) {
+	units := map[string]string{"XXBT": "BTC", "xbt": "BTC", "ETH2.S": "ETH", "DOT.S": "DOT", "ZUSD": "USD", " sol ": "SOL"}
+	for in, want := range units {
+		if got := exchangeUnit(in); got != want {
+			t.Errorf("exchangeUnit(%q) = %s, want %s", in, got, want)
+		}
+	}
+	kinds := map[string]string{"Deposit": kindDeposit, "Withdraw": kindWithdrawal, "Transaction Related": kindTrade,
+		"Simple Earn Flexible Interest": kindIncome, "Fee": kindFee, "Staking Rewards": kindIncome, "Margin Call": "margin_call"}
+	for in, want := range kinds {
+		if got := exchangeKind(in); got != want {
+			t.Errorf("exchangeKind(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+// entrySummary is what the import tests check of each entry.
+type entrySummary struct {
+	id, kind, unit string
+	amount, fee    int64
+	txId           string
+}
+
+func checkEntries(t *tt.T, x *exchangeImport, want []entrySummary) {
+	t.Helper()
+	if len(x.entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(x.entries), len(want), x.entries)
+	}
+	for i, w := range want {
+		e := x.entries[i]
+		got := entrySummary{e.EntryId, e.Kind, e.Unit, e.Amount, e.Fee, e.TxId}
+		if w.id == "" {
+			got.id = ""
+		}
+		if got != w {
+			t.Errorf("entry %d = %+v, want %+v", i, got, w)
+		}
+		if e.Source != x.source || e.Account != "main" || len(e.Raw) == 0 {
+			t.Errorf("entry %d source %s account %s raw %s", i, e.Source, e.Account, e.Raw)
+		}
+	}
+}
+
+// unitScaled is s in unit's base units.
+func unitScaled(t *tt.T, s string, unit string) int64 {
+	t.Helper()
+	v, err := parseExchangeAmount(s, unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestReadCoinbaseCSV(t *tt.T) {
+	const data = `"You can use this transaction report to inform your likely tax obligations."
+User,alice@example.com,abc
+
+ID,Timestamp,Transaction Type,Asset,Quantity Transacted,Price Currency,Notes
+c1,2024-01-05 10:00:00 UTC,Buy,BTC,0.01,USD,Bought 0.01 BTC for $450.00 USD
+c2,2024-01-06T11:00:00Z,Send,BTC,-0.004,USD,Sent 0.004 BTC to bc1q...
+c3,2024-01-07 12:00:00 UTC,Convert,ETH,0.5,USD,"Converted 0.5 ETH to 1,000.25 USDC"
+c4,2024-01-08 12:00:00 UTC,Staking Income,SOL,0.01,USD,
+c5,2024-01-09 12:00:00 UTC,Learning Reward,USD,1,USD,
+`
+	x, err := readExchangeCSV(strings.NewReader(data), exchangeFormats["coinbase"], "main")
+	if err != nil {
+		t.Fatalf("readExchangeCSV: %v", err)
+	}
+	checkEntries(t, x, []entrySummary{
+		{"c1", kindTrade, "BTC", 1000000, 0, ""},
+		{"c2", kindWithdrawal, "BTC", -400000, 0, ""},
+		{"c3/ETH", kindTrade, "ETH", -500000000, 0, ""},
+		{"c3/USDC", kindTrade, "USDC", 1000250000, 0, ""},
+		{"c4", kindIncome, "SOL", unitScaled(t, "0.01", "SOL"), 0, ""},
+	})
+	if x.skipped["fiat"] != 1 {
+		t.Errorf("skipped = %v, want the USD reward skipped as fiat", x.skipped)
+	}
+	if !x.entries[0].OccurredAt.Equal(time.Date(2024, 1, 5, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("OccurredAt = %s", x.entries[0].OccurredAt)
+	}
+}
+
+func TestReadKrakenCSV(t *tt.T) {
+	const data = `"txid","refid","time","type","subtype","aclass","asset","amount","fee","balance"
+"L1","R1","2024-02-01 09:00:00","trade","","currency","ZUSD","-5000.0000","8.0000","0"
+"L2","R1","2024-02-01 09:00:00","trade","","currency","XXBT","0.1000000000","0.0000000000","0.1"
+"L3","W1","2024-02-02 09:00:00.123","withdrawal","","currency","XXBT","-0.0500000000","0.0001500000","0.0498"
+"","D1","2024-02-03 09:00:00","deposit","","currency","XXBT","0.2","0","0"
+"L4","S1","2024-02-04 09:00:00","staking","","currency","ETH2.S","0.0010000000","0","0.001"
+`
+	x, err := readExchangeCSV(strings.NewReader(data), exchangeFormats["kraken"], "main")
+	if err != nil {
+		t.Fatalf("readExchangeCSV: %v", err)
+	}
+	// A withdrawal's fee is charged on top of its amount.
+	checkEntries(t, x, []entrySummary{
+		{"L2", kindTrade, "BTC", 10000000, 0, ""},
+		{"L3", kindWithdrawal, "BTC", -5015000, 15000, ""},
+		{"L4", kindIncome, "ETH", 1000000, 0, ""},
+	})
+	if x.skipped["fiat"] != 1 || x.skipped["unconfirmed"] != 1 {
+		t.Errorf("skipped = %v, want one fiat leg and one unconfirmed deposit", x.skipped)
+	}
+}
+
+func TestReadBinanceCSV(t *tt.T) {
+	const statement = `User_ID,UTC_Time,Account,Operation,Coin,Change,Remark
+1,24-03-01 08:00:00,Spot,Deposit,BTC,0.3,
+1,24-03-01 09:00:00,Spot,Transaction Related,BTC,-0.1,
+1,24-03-01 09:00:00,Spot,Transaction Related,ETH,1.8,
+1,24-03-01 09:00:00,Spot,Transaction Related,ETH,1.8,
+`
+	x, err := readExchangeCSV(strings.NewReader(statement), exchangeFormats["binance"], "main")
+	if err != nil {
+		t.Fatalf("readExchangeCSV: %v", err)
+	}
+	checkEntries(t, x, []entrySummary{
+		{"", kindDeposit, "BTC", 30000000, 0, ""},
+		{"", kindTrade, "BTC", -10000000, 0, ""},
+		{"", kindTrade, "ETH", 1800000000, 0, ""},
+		{"", kindTrade, "ETH", 1800000000, 0, ""},
+	})
+	// Two identical fills are two entries.
+	if x.entries[2].EntryId == x.entries[3].EntryId {
+		t.Errorf("identical rows share id %s", x.entries[2].EntryId)
+	}
+	if !x.entries[0].OccurredAt.Equal(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("OccurredAt = %s", x.entries[0].OccurredAt)
+	}
+
+	const hash = "AB00000000000000000000000000000000000000000000000000000000000001"
+	const withdrawals = `Date(UTC),Coin,Network,Amount,TransactionFee,Address,TXID,Status
+2024-03-02 10:00:00,BTC,BTC,0.05,0.0002,bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4,` + hash + `,Completed
+2024-03-02 11:00:00,BTC,BTC,0.01,0,someone,Internal transfer,Completed
+2024-03-02 12:00:00,BTC,BTC,0.02,0.0002,bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4,,Cancelled
+`
+	x, err = readExchangeCSV(strings.NewReader(withdrawals), exchangeFormats["binance-withdrawals"], "main")
+	if err != nil {
+		t.Fatalf("readExchangeCSV: %v", err)
+	}
+	txId := strings.ToLower(hash)
+	checkEntries(t, x, []entrySummary{{kindWithdrawal + ":" + txId, kindWithdrawal, "BTC", -5020000, 20000, txId}})
+	if x.skipped["off-chain"] != 1 || x.skipped["Cancelled"] != 1 {
+		t.Errorf("skipped = %v", x.skipped)
+	}
+}
+
+func TestReadExchangeCSVWithoutHeader(t *tt.T) {
+	_, err := readExchangeCSV(strings.NewReader("a,b,c\n1,2,3\n"), exchangeFormats["kraken"], "main")
+	if err == nil || !strings.Contains(err.Error(), "no kraken header") {
+		t.Fatalf("error = %v, want no kraken header", err)
+	}
+}
+
+func TestClosestExchangeTx(t *tt.T) {
+	at := time.Date(2024, 3, 2, 10, 0, 0, 0, time.UTC)
+	// A withdrawal of 0.05 BTC, with a 0.0002 BTC fee charged on top.
+	withdrawal := LedgerEntry{Kind: kindWithdrawal, Unit: "BTC", Amount: -5020000, Fee: 20000, OccurredAt: at}
+	// A deposit of 0.1 BTC, sent with a 1000 sat fee.
+	deposit := LedgerEntry{Kind: kindDeposit, Unit: "BTC", Amount: 10000000, OccurredAt: at}
+
+	views := []TxView{
+		{TxId: "late", Timestamp: at.Add(25 * time.Hour), Net: 5000000},
+		{TxId: "short", Timestamp: at.Add(time.Hour), Net: 4800000},
+		{TxId: "far", Timestamp: at.Add(3 * time.Hour), Net: 4990000},
+		{TxId: "near", Timestamp: at.Add(-time.Hour), Net: 4990000},
+		{TxId: "exact", Timestamp: at.Add(5 * time.Hour), Net: 5000000},
+		{TxId: "ltc", Timestamp: at, Net: 5000000, Unit: "LTC"},
+		{TxId: "sent", Timestamp: at.Add(time.Minute), Net: -10001000, Fee: 1000},
+		{TxId: "sent-more", Timestamp: at, Net: -10101000, Fee: 1000},
+	}
+	tests := []struct {
+		name  string
+		entry LedgerEntry
+		used  map[string]bool
+		want  string
+	}{
+		{"exact amount wins over nearer", withdrawal, nil, "exact"},
+		{"nearer of equal amounts", withdrawal, map[string]bool{"exact": true}, "near"},
+		{"none within tolerance or window", withdrawal, map[string]bool{"exact": true, "near": true, "far": true}, ""},
+		{"deposit matches a send", deposit, nil, "sent"},
+		{"deposit within tolerance", deposit, map[string]bool{"sent": true}, "sent-more"},
+		{"other unit", LedgerEntry{Kind: kindWithdrawal, Unit: "DOGE", Amount: -5000000, OccurredAt: at}, nil, ""},
+	}
+	for _, tc := range tests {
+		got := ""
+		if i := closestExchangeTx(tc.entry, views, tc.used); i >= 0 {
+			got = views[i].TxId
+		}
+		if got != tc.want {
+			t.Errorf("%s: matched %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
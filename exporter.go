@@ -0,0 +1,429 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export formats. Generic is our own layout; the others follow the import
+// templates of the tax tools they are named after.
+const (
+	exportGeneric      = "generic"
+	exportKoinly       = "koinly"
+	exportCoinTracking = "cointracking"
+	exportCoinLedger   = "coinledger"
+)
+
+var exportFormats = []string{exportGeneric, exportKoinly, exportCoinTracking, exportCoinLedger}
+
+// exportFilter selects the txs to export. Zero values mean no restriction;
+// To is exclusive.
+type exportFilter struct {
+	Address string
+	// Unit keeps only txs in this unit, e.g. BTC.
+	Unit string
+	From time.Time
+	To   time.Time
+}
+
+func (f exportFilter) matches(v TxView) bool {
+	if f.Unit != "" && unitOf(v) != f.Unit {
+		return false
+	}
+	if !f.From.IsZero() && v.Timestamp.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !v.Timestamp.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+// loadExportViews returns the confirmed txs matching filter, oldest first. For a single
+// address, transfers with other tracked addresses are flagged; across all
+// addresses they are merged so each tx appears once and internal moves net
+// out.
+func loadExportViews(db *sql.DB, filter exportFilter) ([]TxView, error) {
+	var all []TxView
+	var err error
+	if filter.Address != "" {
+		all, err = loadTxViews(db, filter.Address)
+		if err == nil {
+			err = markAddressTransfers(db, filter.Address, all)
+		}
+	} else {
+		var addresses []string
+		addresses, err = portfolioAccounts(db)
+		if err == nil {
+			all, err = loadPortfolioViews(db, addresses)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	views := []TxView{}
+	for _, v := range confirmedOnly(all) {
+		if filter.matches(v) {
+			views = append(views, v)
+		}
+	}
+	return views, nil
+}
+
+// classification is the exported label of a view.
+func classification(v TxView) string {
+	switch {
+	case !v.Transfer || v.Direction == directionTransfer:
+		return v.Direction
+	case v.Net < 0:
+		return "transfer_out"
+	default:
+		return "transfer_in"
+	}
+}
+
+// exportAddress is the address column of a view; merged views list every
+// member address.
+func exportAddress(v TxView) string {
+	if len(v.Addresses) > 0 {
+		return strings.Join(v.Addresses, " ")
+	}
+	return v.Address
+}
+
+// ledgerPlatforms names ledger sources as tax tools know them.
+var ledgerPlatforms = map[string]string{sourceLND: "Lightning", sourceLightningCSV: "Lightning", "coinbase": "Coinbase",
+	"kraken": "Kraken", "binance": "Binance"}
+
+// exportPlatform names where a view's funds are held, for the exchange or
+// platform column: the chain of its first member address, or the source of
+// a ledger entry. onChain reports which.
+func exportPlatform(v TxView) (name string, onChain bool) {
+	members := v.Addresses
+	if len(members) == 0 {
+		members = []string{v.Address}
+	}
+	for _, a := range members {
+		info, err := validateAddress(a)
+		if err != nil {
+			continue
+		}
+		if c, err := chainOf(info.Chain, info.Network); err == nil {
+			return chainTitle(c), true
+		}
+	}
+	if p, ok := ledgerPlatforms[v.Source]; ok {
+		return p, false
+	}
+	return titleCase(v.Source), false
+}
+
+// chainTitle is a chain's name as shown to people, e.g. Bitcoin Cash or
+// Bitcoin Testnet.
+func chainTitle(c *Chain) string {
+	name := titleCase(strings.ReplaceAll(c.Name, "-", " "))
+	if c.Network != networkMainnet {
+		name += " " + titleCase(c.Network)
+	}
+	return name
+}
+
+// titleCase capitalizes the first letter of each word of s.
+func titleCase(s string) string {
+	words := strings.Fields(s)
+	for i, w := range words {
+		words[i] = strings.ToUpper(w[:1]) + w[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// writeExport writes views as CSV in the given format.
+func writeExport(w io.Writer, format string, views []TxView) error {
+	var header []string
+	var row func(v TxView) []string
+	switch format {
+	case exportGeneric:
+		header, row = genericHeader, genericRow
+	case exportKoinly:
+		header, row = koinlyHeader, koinlyRow
+	case exportCoinTracking:
+		header, row = coinTrackingHeader, coinTrackingRow
+	case exportCoinLedger:
+		header, row = coinLedgerHeader, coinLedgerRow
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, v := range views {
+		if err := cw.Write(row(v)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// sentExcludingFee is what a send paid to other addresses; the fee is
+// reported separately by every format.
+func sentExcludingFee(v TxView) int64 {
+	if v.Net >= 0 {
+		return 0
+	}
+	return -v.Net - v.Fee
+}
+
+func unitOf(v TxView) string {
+	if v.Unit == "" {
+		return "BTC"
+	}
+	return v.Unit
+}
+
+func amountOrEmpty(amount int64, unit string) string {
+	if amount == 0 {
+		return ""
+	}
+	return formatUnits(amount, unitDecimals(unit))
+}
+
+var genericHeader = []string{"Date (UTC)", "Address", "Tx ID", "Tx Hash", "Classification", "Net Amount", "Fee", "Unit", "Block Height",
+	"Fiat Net", "Fiat Fee", "Fiat Currency"}
+
+// fiatColumns returns the net value, fee value and currency of a priced
+// view, or empty strings when it was not priced.
+func fiatColumns(v TxView) (string, string, string) {
+	if v.Fiat == nil || v.Fiat.Missing {
+		return "", "", ""
+	}
+	return formatUnits(v.Fiat.Net, fiatDecimals), formatUnits(v.Fiat.Fee, fiatDecimals), v.Fiat.Currency
+}
+
+func genericRow(v TxView) []string {
+	fiatNet, fiatFee, fiatCurrency := fiatColumns(v)
+	return []string{
+		v.Timestamp.Format(time.RFC3339),
+		exportAddress(v),
+		v.TxId,
+		v.Hash,
+		classification(v),
+		formatUnits(v.Net, unitDecimals(unitOf(v))),
+		formatUnits(v.Fee, unitDecimals(unitOf(v))),
+		unitOf(v),
+		strconv.Itoa(v.BlockHeight),
+		fiatNet,
+		fiatFee,
+		fiatCurrency,
+	}
+}
+
+// Koinly universal template.
+var koinlyHeader = []string{"Date", "Sent Amount", "Sent Currency", "Received Amount", "Received Currency",
+	"Fee Amount", "Fee Currency", "Net Worth Amount", "Net Worth Currency", "Label", "Description", "TxHash"}
+
+func koinlyRow(v TxView) []string {
+	unit := unitOf(v)
+	var sent, received int64
+	label := ""
+	switch v.Direction {
+	case directionReceive:
+		received = v.Net
+	case directionSend:
+		sent = sentExcludingFee(v)
+	case directionSelf, directionTransfer:
+		label = "cost"
+	}
+	fiatNet, _, fiatCurrency := fiatColumns(v)
+	fiatNet = strings.TrimPrefix(fiatNet, "-")
+	row := []string{v.Timestamp.Format("2006-01-02 15:04:05") + " UTC", amountOrEmpty(sent, unit), "", amountOrEmpty(received, unit), "",
+		amountOrEmpty(v.Fee, unit), "", fiatNet, fiatCurrency, label, exportAddress(v), v.Hash}
+	if sent != 0 {
+		row[2] = unit
+	}
+	if received != 0 {
+		row[4] = unit
+	}
+	if v.Fee != 0 {
+		row[6] = unit
+	}
+	return row
+}
+
+// CoinTracking CSV import template.
+var coinTrackingHeader = []string{"Type", "Buy Amount", "Buy Currency", "Sell Amount", "Sell Currency",
+	"Fee", "Fee Currency", "Exchange", "Trade-Group", "Comment", "Date", "Tx-ID"}
+
+func coinTrackingRow(v TxView) []string {
+	unit := unitOf(v)
+	exchange, onChain := exportPlatform(v)
+	if onChain {
+		exchange += " Wallet"
+	}
+	row := []string{"", "", "", "", "", amountOrEmpty(v.Fee, unit), "", exchange, "", exportAddress(v),
+		v.Timestamp.Format("2006-01-02 15:04:05"), v.Hash}
+	switch v.Direction {
+	case directionReceive:
+		row[0], row[1], row[2] = "Deposit", formatUnits(v.Net, unitDecimals(unit)), unit
+	case directionSend:
+		row[0], row[3], row[4] = "Withdrawal", formatUnits(sentExcludingFee(v), unitDecimals(unit)), unit
+	case directionSelf, directionTransfer:
+		row[0], row[3], row[4] = "Other Fee", formatUnits(v.Fee, unitDecimals(unit)), unit
+		row[5] = ""
+	}
+	if row[5] != "" {
+		row[6] = unit
+	}
+	return row
+}
+
+// CoinLedger universal import template.
+var coinLedgerHeader = []string{"Date (UTC)", "Platform (Optional)", "Asset Sent", "Amount Sent", "Asset Received",
+	"Amount Received", "Fee Currency (Optional)", "Fee Amount (Optional)", "Type", "Description (Optional)", "TxHash (Optional)"}
+
+func coinLedgerRow(v TxView) []string {
+	unit := unitOf(v)
+	platform, _ := exportPlatform(v)
+	row := []string{v.Timestamp.Format("01/02/2006 15:04:05"), platform, "", "", "", "", "", amountOrEmpty(v.Fee, unit), "", exportAddress(v), v.Hash}
+	switch v.Direction {
+	case directionReceive:
+		row[4], row[5], row[8] = unit, formatUnits(v.Net, unitDecimals(unit)), "Deposit"
+	default:
+		row[2], row[3], row[8] = unit, formatUnits(sentExcludingFee(v), unitDecimals(unit)), "Withdrawal"
+	}
+	if v.Fee != 0 {
+		row[6] = unit
+	}
+	return row
+}
+
+// parseDateFlag parses YYYY-MM-DD (UTC) or RFC 3339; empty is the zero time.
+func parseDateFlag(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// handleExport serves GET /api/export?format=&address=&from=&to=&fiat= as a
+// CSV download. from is inclusive and to exclusive. With fiat, unpriced txs
+// are exported without fiat values and counted in X-Unpriced-Txs.
+func (s *apiServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = exportGeneric
+	}
+	from, err := parseDateFlag(q.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid from date")
+		return
+	}
+	to, err := parseDateFlag(q.Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid to date")
+		return
+	}
+	if !isExportFormat(format) {
+		writeError(w, http.StatusBadRequest, "unknown export format")
+		return
+	}
+	prices, ok := s.fiatPrices(w, r)
+	if !ok {
+		return
+	}
+
+	views, err := loadExportViews(s.db, exportFilter{Address: q.Get("address"), From: from, To: to})
+	if err != nil {
+		s.internalError(w, "failed to load txs", err)
+		return
+	}
+	if prices != nil {
+		if missing := prices.valueViews(views); missing > 0 {
+			w.Header().Set("X-Unpriced-Txs", strconv.Itoa(missing))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="cointracker-%s.csv"`, format))
+	if err := writeExport(w, format, views); err != nil {
+		logger.Warn("failed to write export", "error", err)
+	}
+}
+
+func isExportFormat(format string) bool {
+	for _, f := range exportFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// runExport implements the export command.
+func runExport(db *sql.DB, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", exportGeneric, "one of generic, koinly, cointracking, coinledger")
+	addr := fs.String("address", "", "only export txs of this address (default all tracked addresses)")
+	fromFlag := fs.String("from", "", "first day to include, YYYY-MM-DD (UTC)")
+	toFlag := fs.String("to", "", "day to stop before, YYYY-MM-DD (UTC)")
+	outPath := fs.String("o", "", "write to this file instead of stdout")
+	fiat := fs.String("fiat", "", "value txs in this fiat currency using imported prices")
+	fs.Parse(args)
+
+	if !isExportFormat(*format) {
+		return fmt.Errorf("unknown export format %q", *format)
+	}
+	from, err := parseDateFlag(*fromFlag)
+	if err != nil {
+		return fmt.Errorf("invalid -from: %w", err)
+	}
+	to, err := parseDateFlag(*toFlag)
+	if err != nil {
+		return fmt.Errorf("invalid -to: %w", err)
+	}
+
+	views, err := loadExportViews(db, exportFilter{Address: *addr, From: from, To: to})
+	if err != nil {
+		return err
+	}
+	if *fiat != "" {
+		prices, err := loadPriceTable(db, strings.ToUpper(*fiat))
+		if err != nil {
+			return err
+		}
+		if missing := prices.valueViews(views); missing > 0 {
+			logger.Warn("some txs have no price data and are exported without fiat values",
+				"currency", prices.Currency, "unpriced", missing)
+		}
+	}
+
+	out := stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := writeExport(out, *format, views); err != nil {
+		return err
+	}
+	logger.Info("exported txs", "format", *format, "txs", len(views))
+	return nil
+}
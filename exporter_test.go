@@ -0,0 +1,38 @@
+package main
+
+import (
+	tt "testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+func TestExportPlatform(t *tt.T) {
+	ltc, err := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), &litecoinParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		view       TxView
+		coinTrack  string
+		coinLedger string
+	}{
+		{"bitcoin", TxView{Address: address, Unit: "BTC"}, "Bitcoin Wallet", "Bitcoin"},
+		{"litecoin", TxView{Address: ltc.EncodeAddress(), Unit: "LTC"}, "Litecoin Wallet", "Litecoin"},
+		{"polygon token", TxView{Address: "polygon:0x1111111111111111111111111111111111111111", Unit: "USDC"}, "Polygon Wallet", "Polygon"},
+		{"exchange", TxView{Address: "kraken", Source: "kraken", Unit: "ETH"}, "Kraken", "Kraken"},
+		{"lightning", TxView{Address: "lnd:02abc", Source: sourceLND, Unit: "BTC"}, "Lightning", "Lightning"},
+		{"merged deposit", TxView{Addresses: []string{"coinbase", address}, Source: "coinbase", Unit: "BTC"}, "Bitcoin Wallet", "Bitcoin"},
+	}
+	for _, tc := range tests {
+		tc.view.Timestamp = time.Unix(1708000000, 0).UTC()
+		tc.view.Direction = directionReceive
+		if got := coinTrackingRow(tc.view)[7]; got != tc.coinTrack {
+			t.Errorf("%s: CoinTracking exchange = %q, want %q", tc.name, got, tc.coinTrack)
+		}
+		if got := coinLedgerRow(tc.view)[1]; got != tc.coinLedger {
+			t.Errorf("%s: CoinLedger platform = %q, want %q", tc.name, got, tc.coinLedger)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A backend that fails failoverThreshold requests in a row is skipped for
+// failoverCooldown, unless every backend is down.
+const (
+	failoverThreshold = 3
+	failoverCooldown  = time.Minute
+)
+
+// failoverProvider tries its backends in priority order, moving past ones
+// that fail. Not found is an answer, not a failure, so it is not retried
+// elsewhere.
+//
+// Pages are fetched one at a time, with cursors of the form
+// "backend index:backend cursor". Cursors mean nothing to another backend,
+// so when the backend a walk started on fails, the walk restarts from the
+// first page on the next one; stored txs are skipped as usual.
+type failoverProvider struct {
+	backends []*failoverBackend
+
+	mu sync.Mutex
+}
+
+type failoverBackend struct {
+	Provider
+	failures  int // in a row
+	downUntil time.Time
+}
+
+func newFailoverProvider(backends []Provider) *failoverProvider {
+	f := &failoverProvider{}
+	for _, p := range backends {
+		f.backends = append(f.backends, &failoverBackend{Provider: p})
+	}
+	return f
+}
+
+func (f *failoverProvider) Name() string {
+	names := make([]string, 0, len(f.backends))
+	for _, b := range f.backends {
+		names = append(names, b.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// order returns the indexes of the backends to try: healthy ones by
+// priority, then those cooling down, also by priority.
+func (f *failoverProvider) order() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	var up, down []int
+	for i, b := range f.backends {
+		if now.Before(b.downUntil) {
+			down = append(down, i)
+		} else {
+			up = append(up, i)
+		}
+	}
+	return append(up, down...)
+}
+
+// record updates the health of backend i after a request.
+func (f *failoverProvider) record(i int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b := f.backends[i]
+	if err == nil || errors.Is(err, errProviderNotFound) {
+		b.failures = 0
+		b.downUntil = time.Time{}
+		return
+	}
+	b.failures++
+	providerFailures.WithLabelValues(b.Name()).Inc()
+	if b.failures >= failoverThreshold {
+		b.downUntil = time.Now().Add(failoverCooldown)
+		logger.Warn("provider marked down", "provider", b.Name(), "failures", b.failures, "until", b.downUntil)
+	}
+}
+
+func (f *failoverProvider) down(i int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Now().Before(f.backends[i].downUntil)
+}
+
+// try calls call on each backend in order until one succeeds or answers
+// not found, and returns the index of that backend.
+func (f *failoverProvider) try(op string, call func(p Provider) error) (int, error) {
+	var err error
+	for _, i := range f.order() {
+		err = call(f.backends[i].Provider)
+		f.record(i, err)
+		if err == nil || errors.Is(err, errProviderNotFound) {
+			return i, err
+		}
+		logger.Warn("provider request failed; failing over", "provider", f.backends[i].Name(), "op", op, "error", err)
+	}
+	return -1, err
+}
+
+func (f *failoverProvider) CountTxs(address string) (int, error) {
+	var n int
+	_, err := f.try("count", func(p Provider) (err error) {
+		n, err = p.CountTxs(address)
+		return err
+	})
+	return n, err
+}
+
+func (f *failoverProvider) PendingTxs(address string) ([]Item, error) {
+	var items []Item
+	_, err := f.try("pending", func(p Provider) (err error) {
+		items, err = p.PendingTxs(address)
+		return err
+	})
+	return items, err
+}
+
+func (f *failoverProvider) Tx(txId string) (Item, error) {
+	var item Item
+	_, err := f.try("transaction", func(p Provider) (err error) {
+		item, err = p.Tx(txId)
+		return err
+	})
+	return item, err
+}
+
+func (f *failoverProvider) ChainTip() (ChainTip, error) {
+	var tip ChainTip
+	_, err := f.try("tip", func(p Provider) (err error) {
+		tip, err = p.ChainTip()
+		return err
+	})
+	return tip, err
+}
+
+func (f *failoverProvider) BlockHash(height int) (string, error) {
+	var hash string
+	_, err := f.try("block", func(p Provider) (err error) {
+		hash, err = p.BlockHash(height)
+		return err
+	})
+	return hash, err
+}
+
+// PageSize is the page size of the first backend.
+func (f *failoverProvider) PageSize() int {
+	return backendPageSize(f.backends[0].Provider)
+}
+
+func backendPageSize(p Provider) int {
+	if cp, ok := p.(cursorPager); ok {
+		return cp.PageSize()
+	}
+	return pageLimit
+}
+
+// TxsAfter continues a walk on the backend that started it, or starts one on
+// the first backend that answers.
+func (f *failoverProvider) TxsAfter(address string, cursor string) ([]Item, string, error) {
+	if cursor != "" {
+		index, inner, ok := strings.Cut(cursor, ":")
+		i, err := strconv.Atoi(index)
+		if !ok || err != nil || i < 0 || i >= len(f.backends) {
+			return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+		}
+		items, next, err := backendTxsAfter(f.backends[i].Provider, address, inner)
+		f.record(i, err)
+		if err == nil {
+			return items, failoverCursor(i, next), nil
+		}
+		// Let the page be retried until the backend is marked down.
+		if !f.down(i) {
+			return nil, "", err
+		}
+		logger.Warn("provider down; restarting from the first page on the next provider",
+			"provider", f.backends[i].Name(), "error", err)
+	}
+
+	var items []Item
+	var next string
+	i, err := f.try("transactions", func(p Provider) (err error) {
+		items, next, err = backendTxsAfter(p, address, "")
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return items, failoverCursor(i, next), nil
+}
+
+func failoverCursor(i int, next string) string {
+	if next == "" {
+		return ""
+	}
+	return strconv.Itoa(i) + ":" + next
+}
+
+// backendTxsAfter pages through any backend by cursor. An offset backend's
+// cursor is the offset of its next page.
+func backendTxsAfter(p Provider, address string, cursor string) ([]Item, string, error) {
+	if cp, ok := p.(cursorPager); ok {
+		return cp.TxsAfter(address, cursor)
+	}
+	op, ok := p.(offsetPager)
+	if !ok {
+		return nil, "", fmt.Errorf("provider %s cannot page through txs", p.Name())
+	}
+	offset := 0
+	if cursor != "" {
+		n, err := strconv.Atoi(cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+		}
+		offset = n
+	}
+	items, err := op.TxsAt(address, offset, pageLimit)
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(items) == pageLimit {
+		next = strconv.Itoa(offset + len(items))
+	}
+	return items, next, nil
+}
+
+// Subscribe uses the first backend that pushes address activity.
+func (f *failoverProvider) Subscribe(address string, notify func(address string)) error {
+	for _, b := range f.backends {
+		if n, ok := b.Provider.(notifier); ok {
+			return n.Subscribe(address, notify)
+		}
+	}
+	return errNotifyUnsupported
+}
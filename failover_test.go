@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	tt "testing"
+)
+
+var errBackendDown = errors.New("backend down")
+
+// pagedBackend serves pages of txs by cursor, the page index, and fails
+// every request while failing is set.
+type pagedBackend struct {
+	name    string
+	pages   [][]string
+	failing bool
+	calls   int
+}
+
+func (b *pagedBackend) Name() string                         { return b.name }
+func (b *pagedBackend) PageSize() int                        { return 2 }
+func (b *pagedBackend) CountTxs(string) (int, error)         { return 0, b.err() }
+func (b *pagedBackend) PendingTxs(string) ([]Item, error)    { return nil, b.err() }
+func (b *pagedBackend) ChainTip() (ChainTip, error)          { return ChainTip{}, b.err() }
+func (b *pagedBackend) BlockHash(height int) (string, error) { return "", b.err() }
+
+func (b *pagedBackend) err() error {
+	b.calls++
+	if b.failing {
+		return errBackendDown
+	}
+	return nil
+}
+
+func (b *pagedBackend) Tx(txId string) (Item, error) {
+	if err := b.err(); err != nil {
+		return Item{}, err
+	}
+	if txId == "" {
+		return Item{}, errProviderNotFound
+	}
+	return Item{TransactionId: txId, Fee: Fee{Amount: b.name}}, nil
+}
+
+func (b *pagedBackend) TxsAfter(address string, cursor string) ([]Item, string, error) {
+	if err := b.err(); err != nil {
+		return nil, "", err
+	}
+	page, _ := strconv.Atoi(cursor)
+	var items []Item
+	for _, id := range b.pages[page] {
+		items = append(items, Item{TransactionId: id})
+	}
+	next := ""
+	if page+1 < len(b.pages) {
+		next = strconv.Itoa(page + 1)
+	}
+	return items, next, nil
+}
+
+func itemIds(items []Item) []string {
+	ids := []string{}
+	for _, item := range items {
+		ids = append(ids, item.TransactionId)
+	}
+	return ids
+}
+
+func TestFailoverCursorRestart(t *tt.T) {
+	a := &pagedBackend{name: "a", pages: [][]string{{"t5", "t4"}, {"t3", "t2"}, {"t1"}}}
+	b := &pagedBackend{name: "b", pages: [][]string{{"t5", "t4"}, {"t3", "t2"}, {"t1"}}}
+	f := newFailoverProvider([]Provider{a, b})
+
+	items, cursor, err := f.TxsAfter("addr", "")
+	if err != nil || cursor != "0:1" || !reflect.DeepEqual(itemIds(items), []string{"t5", "t4"}) {
+		t.Fatalf("first page = %v, %q, %v", itemIds(items), cursor, err)
+	}
+
+	// The page is retried on the same backend until it is marked down.
+	a.failing = true
+	for i := 1; i < failoverThreshold; i++ {
+		if _, _, err := f.TxsAfter("addr", cursor); !errors.Is(err, errBackendDown) {
+			t.Fatalf("attempt %d: error = %v, want the backend's", i, err)
+		}
+	}
+	if b.calls != 0 {
+		t.Fatalf("backend b called %d times before a was down", b.calls)
+	}
+	// Then the walk restarts from the first page on the next backend, as
+	// a's cursor means nothing to it.
+	items, cursor, err = f.TxsAfter("addr", cursor)
+	if err != nil || cursor != "1:1" || !reflect.DeepEqual(itemIds(items), []string{"t5", "t4"}) {
+		t.Fatalf("page after failover = %v, %q, %v", itemIds(items), cursor, err)
+	}
+	// The walk stays on b even once a is back.
+	a.failing = false
+	for cursor != "" {
+		if items, cursor, err = f.TxsAfter("addr", cursor); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(itemIds(items), []string{"t1"}) || a.calls != failoverThreshold+1 {
+		t.Errorf("last page = %v after %d calls to a", itemIds(items), a.calls)
+	}
+
+	for _, bad := range []string{"1", "x:1", "2:1", "-1:1"} {
+		if _, _, err := f.TxsAfter("addr", bad); err == nil || !strings.Contains(err.Error(), "invalid cursor") {
+			t.Errorf("TxsAfter(%q) error = %v, want an invalid cursor", bad, err)
+		}
+	}
+}
+
+func TestFailoverTx(t *tt.T) {
+	a := &pagedBackend{name: "a"}
+	b := &pagedBackend{name: "b"}
+	f := newFailoverProvider([]Provider{a, b})
+
+	// Not found is an answer, so b is not asked.
+	if _, err := f.Tx(""); !errors.Is(err, errProviderNotFound) || b.calls != 0 {
+		t.Errorf("Tx of a missing tx = %v after %d calls to b", err, b.calls)
+	}
+	a.failing = true
+	item, err := f.Tx("t1")
+	if err != nil || item.Fee.Amount != "b" {
+		t.Errorf("Tx = %+v, %v; want b's copy", item, err)
+	}
+	b.failing = true
+	if _, err := f.Tx("t1"); !errors.Is(err, errBackendDown) {
+		t.Errorf("Tx with every backend down = %v", err)
+	}
+	if f.Name() != "a,b" {
+		t.Errorf("Name = %s", f.Name())
+	}
+}
+
+func TestCompareItems(t *tt.T) {
+	const address = "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+	base := Item{
+		MinedInBlockHash: "h", MinedInBlockHeight: 840001, TransactionHash: "w",
+		Fee:        Fee{Amount: "0.0001"},
+		Senders:    []Participant{{Address: "other", Amount: "1"}},
+		Recipients: []Participant{{Address: address, Amount: "0.5"}, {Address: address, Amount: "0.25"}},
+		BlockchainSpecific: BlockchainSpecific{
+			Vin:  []Vin{{Value: "1"}},
+			Vout: []Vout{{Value: "0.5"}, {Value: "0.25"}, {Value: "0.2499"}},
+		},
+	}
+	// The same tx with amounts formatted differently.
+	same := base
+	same.Fee = Fee{Amount: "0.00010000"}
+	same.Recipients = []Participant{{Address: address, Amount: "0.75000000"}}
+	same.BlockchainSpecific = BlockchainSpecific{
+		Vin:  []Vin{{Value: "1.00000000"}},
+		Vout: []Vout{{Value: "0.50000000"}, {Value: "0.25"}, {Value: "0.24990000"}},
+	}
+	if diffs := compareItems(address, base, same); len(diffs) != 0 {
+		t.Errorf("compareItems of the same tx = %+v", diffs)
+	}
+
+	other := same
+	other.MinedInBlockHeight = 840002
+	other.Fee = Fee{Amount: "0.0002"}
+	other.Recipients = []Participant{{Address: address, Amount: "0.7499"}}
+	other.BlockchainSpecific.Vout = []Vout{{Value: "0.5"}, {Value: "0.2499"}}
+	got := compareItems(address, base, other)
+	want := []Discrepancy{
+		{Field: "block_height", Value: "840001", Verified: "840002"},
+		{Field: "fee", Value: "0.00010000", Verified: "0.00020000"},
+		{Field: "received", Value: "0.75000000", Verified: "0.74990000"},
+		{Field: "outputs", Value: "3", Verified: "2"},
+		{Field: "output 1", Value: "0.25000000", Verified: "0.24990000"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("compareItems = %+v, want %+v", got, want)
+	}
+}
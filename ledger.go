@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Amounts are handled as integer base units (satoshis for BTC) so sums are
+// exact; the provider reports them as decimal strings.
+const btcDecimals = 8
+
+var errInvalidAmount = errors.New("invalid amount")
+
+// parseUnits converts a decimal string such as "0.00021250" into base units.
+func parseUnits(s string, decimals int) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if len(frac) > decimals {
+		// Extra digits must be zeros; anything else is below one base unit.
+		if strings.Trim(frac[decimals:], "0") != "" {
+			return 0, fmt.Errorf("%w: %q has more than %d decimals", errInvalidAmount, s, decimals)
+		}
+		frac = frac[:decimals]
+	}
+	frac += strings.Repeat("0", decimals-len(frac))
+	if whole == "" {
+		whole = "0"
+	}
+
+	v, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", errInvalidAmount, s)
+	}
+	if neg {
+		v = -v
+	}
+	return v, nil
+}
+
+// formatUnits renders base units as a decimal string with all decimals.
+func formatUnits(v int64, decimals int) string {
+	sign := ""
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	s := strconv.FormatInt(v, 10)
+	if decimals == 0 {
+		return sign + s
+	}
+	if len(s) <= decimals {
+		s = strings.Repeat("0", decimals-len(s)+1) + s
+	}
+	return sign + s[:len(s)-decimals] + "." + s[len(s)-decimals:]
+}
+
+// Tx directions relative to a single address.
+const (
+	directionReceive = "receive"
+	directionSend    = "send"
+	directionSelf    = "self"
+)
+
+// TxView is a tx as seen from one address: what it received, what it sent
+// and its share of the fee. Amounts are in base units.
+type TxView struct {
+	Address     string    `json:"address"`
+	TxId        string    `json:"txId"`
+	Hash        string    `json:"hash"`
+	Timestamp   time.Time `json:"timestamp"`
+	BlockHeight int       `json:"blockHeight"`
+	BlockHash   string    `json:"blockHash"`
+	Direction   string    `json:"direction"`
+	Received    int64     `json:"received"`
+	Sent        int64     `json:"sent"`
+	Net         int64     `json:"net"`
+	Fee         int64     `json:"fee"`
+	Unit        string    `json:"unit"`
+
+	// Status is the tx's status in the txs table and Confirmations its
+	// depth below the last chain tip we saw.
+	Status        string `json:"status,omitempty"`
+	Confirmations int    `json:"confirmations"`
+
+	// Transfer is set when the tx moved funds between tracked addresses;
+	// TransferWith lists the other tracked addresses involved. Addresses is
+	// set on views merged across several addresses.
+	Transfer     bool     `json:"transfer,omitempty"`
+	TransferWith []string `json:"transferWith,omitempty"`
+	Addresses    []string `json:"addresses,omitempty"`
+
+	// Source and Kind are set on views of off-chain ledger entries, whose
+	// Address is the ledger account.
+	Source string `json:"source,omitempty"`
+	Kind   string `json:"kind,omitempty"`
+
+	Fiat     *FiatValue    `json:"fiat,omitempty"`
+	Item     *Item         `json:"item,omitempty"`
+	EVMTx    *EVMTx        `json:"evmTx,omitempty"`
+	Scripts  *ScriptReport `json:"scripts,omitempty"`
+	Payloads []Payload     `json:"payloads,omitempty"`
+}
+
+// viewTx classifies item from address's point of view. The fee is charged
+// to the address in proportion to its share of the inputs, rounded down;
+// the last sender also pays what rounding left over, so the senders' shares
+// add up to the fee.
+func viewTx(item Item, address string) (TxView, error) {
+	v := TxView{
+		Address:     address,
+		TxId:        item.TransactionId,
+		Hash:        item.TransactionHash,
+		Timestamp:   time.Unix(item.Timestamp, 0).UTC(),
+		BlockHeight: item.MinedInBlockHeight,
+		BlockHash:   item.MinedInBlockHash,
+		Unit:        item.Fee.Unit,
+	}
+	if v.Unit == "" {
+		v.Unit = chainBitcoin.Unit
+	}
+	decimals := unitDecimals(v.Unit)
+
+	var totalIn int64
+	senders := participants{}
+	for _, s := range item.Senders {
+		amount, err := parseUnits(s.Amount, decimals)
+		if err != nil {
+			return v, err
+		}
+		totalIn += amount
+		senders.add(s.Address, amount)
+		if s.Address == address {
+			v.Sent += amount
+		}
+	}
+
+	onlySelf := len(item.Recipients) > 0
+	for _, r := range item.Recipients {
+		amount, err := parseUnits(r.Amount, decimals)
+		if err != nil {
+			return v, err
+		}
+		if r.Address == address {
+			v.Received += amount
+		} else {
+			onlySelf = false
+		}
+	}
+
+	if v.Sent > 0 && totalIn > 0 {
+		fee, err := parseUnits(item.Fee.Amount, decimals)
+		if err != nil {
+			return v, err
+		}
+		v.Fee = mulDiv(fee, v.Sent, totalIn)
+		if last := len(senders.order) - 1; senders.order[last] == address {
+			v.Fee = fee
+			for _, a := range senders.order[:last] {
+				v.Fee -= mulDiv(fee, senders.amount[a], totalIn)
+			}
+		}
+	}
+
+	v.Net = v.Received - v.Sent
+	switch {
+	case v.Sent > 0 && onlySelf:
+		v.Direction = directionSelf
+	case v.Net < 0:
+		v.Direction = directionSend
+	default:
+		v.Direction = directionReceive
+	}
+	return v, nil
+}
+
+// BalancePoint is the balance of an address right after a tx.
+type BalancePoint struct {
+	Timestamp time.Time  `json:"timestamp"`
+	TxId      string     `json:"txId"`
+	Balance   int64      `json:"balance"`
+	Fiat      *FiatValue `json:"fiat,omitempty"`
+}
+
+// balanceHistory returns the running balance over views, which must be sorted
+// oldest first.
+func balanceHistory(views []TxView) []BalancePoint {
+	points := make([]BalancePoint, 0, len(views))
+	var balance int64
+	for _, v := range confirmedOnly(views) {
+		balance += v.Net
+		points = append(points, BalancePoint{Timestamp: v.Timestamp, TxId: v.TxId, Balance: balance})
+	}
+	return points
+}
+
+// inUnit keeps the views in unit.
+func inUnit(views []TxView, unit string) []TxView {
+	kept := make([]TxView, 0, len(views))
+	for _, v := range views {
+		if v.Unit == unit {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// soleUnit returns the unit all views are in, or BTC if they are mixed or
+// there are none.
+func soleUnit(views []TxView) string {
+	if len(views) == 0 {
+		return chainBitcoin.Unit
+	}
+	for _, v := range views[1:] {
+		if v.Unit != views[0].Unit {
+			return chainBitcoin.Unit
+		}
+	}
+	return views[0].Unit
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LedgerEntry is off-chain activity on an account that is not an address,
+// such as a Lightning node, stored in ledger_entries. Amount is the signed
+// change to the account's balance, fee included, in the unit's base units.
+// TxId links the entry to the on-chain tx that moved the funds in or out
+// of the account, if any, so the two net out as a transfer.
+type LedgerEntry struct {
+	Id          int             `json:"id"`
+	Source      string          `json:"source"`
+	Account     string          `json:"account"`
+	EntryId     string          `json:"entryId"`
+	Kind        string          `json:"kind"`
+	Unit        string          `json:"unit"`
+	Amount      int64           `json:"amount"`
+	Fee         int64           `json:"fee"`
+	TxId        string          `json:"txId,omitempty"`
+	OccurredAt  time.Time       `json:"occurredAt"`
+	Description string          `json:"description,omitempty"`
+	Raw         json.RawMessage `json:"raw,omitempty"`
+}
+
+// storeLedgerEntries stores entries, skipping those already imported, and
+// returns how many were new.
+func storeLedgerEntries(db *sql.DB, entries []LedgerEntry) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO ledger_entries (source, account, entry_id, kind, unit, amount, fee, tx_id, occurred_at, description, raw, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (account, entry_id) DO NOTHING`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now().UTC()
+	inserted := 0
+	for _, e := range entries {
+		raw := e.Raw
+		if len(raw) == 0 {
+			raw = json.RawMessage("{}")
+		}
+		res, err := stmt.Exec(e.Source, e.Account, e.EntryId, e.Kind, e.Unit, e.Amount, e.Fee, e.TxId,
+			e.OccurredAt.UTC(), e.Description, string(raw), now)
+		if err != nil {
+			return 0, fmt.Errorf("failed to store entry %s: %w", e.EntryId, err)
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			inserted += int(n)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return inserted, nil
+}
+
+// ledgerAccounts returns every account with ledger entries, in the order
+// they were first imported.
+func ledgerAccounts(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT account FROM ledger_entries GROUP BY account ORDER BY MIN(id)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []string{}
+	for rows.Next() {
+		var a string
+		if err := rows.Scan(&a); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+// ledgerViewsSQL selects ledger entries with the hash of their confirmed
+// on-chain tx, by which views of it are grouped, when we hold it.
+const ledgerViewsSQL = `
+	SELECT e.id, e.source, e.account, e.entry_id, e.kind, e.unit, e.amount, e.fee, e.tx_id, e.occurred_at, e.description,
+		COALESCE((SELECT t.raw->>'transactionHash' FROM txs t WHERE t.tx_id = e.tx_id AND t.status = 'CONFIRMED' LIMIT 1), '')
+	FROM ledger_entries e`
+
+// loadLedgerViews returns the entries of account as views, oldest first.
+func loadLedgerViews(db *sql.DB, account string) ([]TxView, error) {
+	return queryLedgerViews(db, ledgerViewsSQL+` WHERE e.account = $1 ORDER BY e.occurred_at, e.id`, account)
+}
+
+// linkedLedgerViews returns the entries linked to the on-chain txs of
+// address, as views.
+func linkedLedgerViews(db *sql.DB, address string) ([]TxView, error) {
+	return queryLedgerViews(db, ledgerViewsSQL+`
+		WHERE e.tx_id <> '' AND e.tx_id IN (SELECT tx_id FROM txs WHERE address = $1)
+		ORDER BY e.occurred_at, e.id`, address)
+}
+
+func queryLedgerViews(db *sql.DB, query string, args ...interface{}) ([]TxView, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	views := []TxView{}
+	for rows.Next() {
+		var e LedgerEntry
+		var hash string
+		if err := rows.Scan(&e.Id, &e.Source, &e.Account, &e.EntryId, &e.Kind, &e.Unit, &e.Amount, &e.Fee, &e.TxId,
+			&e.OccurredAt, &e.Description, &hash); err != nil {
+			return nil, err
+		}
+		views = append(views, viewLedgerEntry(e, hash))
+	}
+	return views, rows.Err()
+}
+
+// viewLedgerEntry shows an entry as a view of its account. An entry linked
+// to an on-chain tx takes the tx's id and hash, so it is grouped with the
+// tx's views.
+func viewLedgerEntry(e LedgerEntry, hash string) TxView {
+	v := TxView{
+		Address:   e.Account,
+		TxId:      e.TxId,
+		Hash:      hash,
+		Timestamp: e.OccurredAt.UTC(),
+		Net:       e.Amount,
+		Fee:       e.Fee,
+		Unit:      e.Unit,
+		Status:    txConfirmed,
+		Source:    e.Source,
+		Kind:      e.Kind,
+	}
+	if v.TxId == "" {
+		v.TxId = e.EntryId
+	}
+	if e.Amount < 0 {
+		v.Sent = -e.Amount
+	} else {
+		v.Received = e.Amount
+	}
+	if v.Net < 0 {
+		v.Direction = directionSend
+	} else {
+		v.Direction = directionReceive
+	}
+	return v
+}
+
+// portfolioAccounts returns every tracked address, then every ledger
+// account.
+func portfolioAccounts(db *sql.DB) ([]string, error) {
+	addresses, err := trackedAddresses(db)
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := ledgerAccounts(db)
+	if err != nil {
+		return nil, err
+	}
+	return append(addresses, accounts...), nil
+}
+
+// handleListLedger serves GET /api/ledger, newest first, paged with ?limit=
+// and ?offset=, optionally narrowed to one ?account= or ?source=.
+func (s *apiServer) handleListLedger(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := pagingParams(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	rows, err := s.db.Query(`
+		SELECT id, source, account, entry_id, kind, unit, amount, fee, tx_id, occurred_at, description, raw,
+			COUNT(*) OVER ()
+		FROM ledger_entries WHERE ($1 = '' OR account = $1) AND ($2 = '' OR source = $2)
+		ORDER BY occurred_at DESC, id DESC LIMIT $3 OFFSET $4`,
+		q.Get("account"), strings.ToLower(q.Get("source")), limit, offset)
+	if err != nil {
+		s.internalError(w, "failed to list ledger entries", err)
+		return
+	}
+	defer rows.Close()
+
+	total := 0
+	entries := []LedgerEntry{}
+	for rows.Next() {
+		var e LedgerEntry
+		var raw []byte
+		if err := rows.Scan(&e.Id, &e.Source, &e.Account, &e.EntryId, &e.Kind, &e.Unit, &e.Amount, &e.Fee, &e.TxId,
+			&e.OccurredAt, &e.Description, &raw, &total); err != nil {
+			s.internalError(w, "failed to list ledger entries", err)
+			return
+		}
+		e.Raw = raw
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		s.internalError(w, "failed to list ledger entries", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"total": total, "entries": entries})
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	tt "testing"
+)
+
+func TestViewTxLargeFeeShare(t *tt.T) {
+	// 10,000 DOGE times a 0.1 DOGE fee overflows int64 in base units.
+	item := Item{
+		TransactionId: "d1", Timestamp: 1708000000,
+		Senders: []Participant{
+			{Address: "DA", Amount: "10000.00000000"},
+			{Address: "DB", Amount: "30000.00000000"},
+		},
+		Recipients: []Participant{{Address: "DC", Amount: "39999.90000000"}},
+		Fee:        Fee{Amount: "0.10000000", Unit: "DOGE"},
+	}
+	v, err := viewTx(item, "DA")
+	if err != nil {
+		t.Fatalf("viewTx: %v", err)
+	}
+	if v.Unit != "DOGE" || v.Sent != 1000000000000 || v.Fee != 2500000 || v.Net != -1000000000000 || v.Direction != directionSend {
+		t.Errorf("got %s sent %d fee %d net %d %s, want DOGE sent 1e12 fee 2500000", v.Unit, v.Sent, v.Fee, v.Net, v.Direction)
+	}
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultLNDURL = "https://127.0.0.1:8080"
+
+// lndPageSize is how many payments or invoices are listed per request.
+const lndPageSize = 500
+
+// Ledger sources and the kinds of entry they import.
+const (
+	sourceLND          = "lnd"
+	sourceLightningCSV = "lightning-csv"
+
+	kindLNPayment    = "ln_payment"
+	kindLNInvoice    = "ln_invoice"
+	kindChannelOpen  = "channel_open"
+	kindChannelClose = "channel_close"
+)
+
+// lndConfig is how to reach LND's REST API. The macaroon is sent hex
+// encoded; a read-only one is enough.
+type lndConfig struct {
+	URL      string
+	Macaroon string
+	TLSCert  string
+	Insecure bool
+}
+
+// lndClient reads a node's payments, invoices and channels from LND's
+// REST API.
+type lndClient struct {
+	baseURL  string
+	macaroon string
+	client   *http.Client
+}
+
+func newLNDClient(c lndConfig) (*lndClient, error) {
+	if c.URL == "" {
+		c.URL = defaultLNDURL
+	}
+	l := &lndClient{baseURL: strings.TrimRight(c.URL, "/"), client: &http.Client{Timeout: 30 * time.Second}}
+	if c.Macaroon != "" {
+		mac, err := os.ReadFile(c.Macaroon)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read macaroon: %w", err)
+		}
+		l.macaroon = hex.EncodeToString(mac)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.Insecure}
+	if c.TLSCert != "" {
+		pem, err := os.ReadFile(c.TLSCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", c.TLSCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	l.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	return l, nil
+}
+
+// lndInt is an integer LND writes as a JSON string, as it does all 64 bit
+// integers, or as a number.
+type lndInt int64
+
+func (n *lndInt) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*n = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s", data)
+	}
+	*n = lndInt(v)
+	return nil
+}
+
+type lndInfo struct {
+	IdentityPubkey string `json:"identity_pubkey"`
+	Alias          string `json:"alias"`
+	Chains         []struct {
+		Chain   string `json:"chain"`
+		Network string `json:"network"`
+	} `json:"chains"`
+}
+
+type lndPayment struct {
+	PaymentHash    string `json:"payment_hash"`
+	ValueMsat      lndInt `json:"value_msat"`
+	FeeMsat        lndInt `json:"fee_msat"`
+	CreationDate   lndInt `json:"creation_date"`
+	CreationTimeNs lndInt `json:"creation_time_ns"`
+	Status         string `json:"status"`
+	PaymentRequest string `json:"payment_request"`
+	PaymentIndex   lndInt `json:"payment_index"`
+}
+
+type lndInvoice struct {
+	Memo        string `json:"memo"`
+	RHash       string `json:"r_hash"`
+	AmtPaidMsat lndInt `json:"amt_paid_msat"`
+	SettleDate  lndInt `json:"settle_date"`
+	State       string `json:"state"`
+	IsKeysend   bool   `json:"is_keysend"`
+	AddIndex    lndInt `json:"add_index"`
+}
+
+type lndChannel struct {
+	ChannelPoint  string `json:"channel_point"`
+	ChanId        string `json:"chan_id"`
+	Capacity      lndInt `json:"capacity"`
+	Initiator     bool   `json:"initiator"`
+	PushAmountSat lndInt `json:"push_amount_sat"`
+}
+
+type lndClosedChannel struct {
+	ChannelPoint      string `json:"channel_point"`
+	ChanId            string `json:"chan_id"`
+	ClosingTxHash     string `json:"closing_tx_hash"`
+	Capacity          lndInt `json:"capacity"`
+	SettledBalance    lndInt `json:"settled_balance"`
+	TimeLockedBalance lndInt `json:"time_locked_balance"`
+	CloseType         string `json:"close_type"`
+	OpenInitiator     string `json:"open_initiator"`
+}
+
+func (c *lndClient) get(path string, query url.Values, out interface{}) error {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if c.macaroon != "" {
+		req.Header.Set("Grpc-Metadata-macaroon", c.macaroon)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Message != "" {
+			return fmt.Errorf("lnd %s: %s", path, e.Message)
+		}
+		return fmt.Errorf("lnd %s: unexpected status %d", path, res.StatusCode)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to unmarshal JSON: %w", err)
+	}
+	return nil
+}
+
+// payments lists every succeeded payment, oldest first.
+func (c *lndClient) payments() ([]lndPayment, error) {
+	var all []lndPayment
+	offset := lndInt(0)
+	for {
+		var page struct {
+			Payments        []lndPayment `json:"payments"`
+			LastIndexOffset lndInt       `json:"last_index_offset"`
+		}
+		q := url.Values{"index_offset": {strconv.FormatInt(int64(offset), 10)}, "max_payments": {strconv.Itoa(lndPageSize)},
+			"include_incomplete": {"false"}}
+		if err := c.get("/v1/payments", q, &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page.Payments...)
+		if len(page.Payments) < lndPageSize || page.LastIndexOffset <= offset {
+			return all, nil
+		}
+		offset = page.LastIndexOffset
+	}
+}
+
+// invoices lists every invoice, oldest first.
+func (c *lndClient) invoices() ([]lndInvoice, error) {
+	var all []lndInvoice
+	offset := lndInt(0)
+	for {
+		var page struct {
+			Invoices        []lndInvoice `json:"invoices"`
+			LastIndexOffset lndInt       `json:"last_index_offset"`
+		}
+		q := url.Values{"index_offset": {strconv.FormatInt(int64(offset), 10)}, "num_max_invoices": {strconv.Itoa(lndPageSize)}}
+		if err := c.get("/v1/invoices", q, &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page.Invoices...)
+		if len(page.Invoices) < lndPageSize || page.LastIndexOffset <= offset {
+			return all, nil
+		}
+		offset = page.LastIndexOffset
+	}
+}
+
+// lndEntries reads the node's activity as ledger entries of account, or of
+// lnd:PUBKEY if account is empty. txTime dates channel opens and closes by
+// their on-chain tx.
+func lndEntries(c *lndClient, account string, txTime func(txId string) (time.Time, error)) ([]LedgerEntry, error) {
+	if account == "" {
+		var info lndInfo
+		if err := c.get("/v1/getinfo", nil, &info); err != nil {
+			return nil, err
+		}
+		account = "lnd:" + info.IdentityPubkey
+	}
+	entry := func(kind string, id string, v interface{}) LedgerEntry {
+		raw, _ := json.Marshal(v)
+		return LedgerEntry{Source: sourceLND, Account: account, EntryId: id, Kind: kind, Unit: chainBitcoin.Unit, Raw: raw}
+	}
+	var entries []LedgerEntry
+
+	payments, err := c.payments()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list payments: %w", err)
+	}
+	for _, p := range payments {
+		if p.Status != "SUCCEEDED" {
+			continue
+		}
+		e := entry(kindLNPayment, p.PaymentHash, p)
+		e.Fee = int64(p.FeeMsat) / 1000
+		e.Amount = -int64(p.ValueMsat+p.FeeMsat) / 1000
+		e.OccurredAt = time.Unix(0, int64(p.CreationTimeNs)).UTC()
+		if p.CreationTimeNs == 0 {
+			e.OccurredAt = time.Unix(int64(p.CreationDate), 0).UTC()
+		}
+		entries = append(entries, e)
+	}
+
+	invoices, err := c.invoices()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invoices: %w", err)
+	}
+	for _, inv := range invoices {
+		if inv.State != "SETTLED" {
+			continue
+		}
+		hash, err := base64.StdEncoding.DecodeString(inv.RHash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid invoice hash %q", inv.RHash)
+		}
+		e := entry(kindLNInvoice, hex.EncodeToString(hash), inv)
+		e.Amount = int64(inv.AmtPaidMsat) / 1000
+		e.OccurredAt = time.Unix(int64(inv.SettleDate), 0).UTC()
+		e.Description = inv.Memo
+		entries = append(entries, e)
+	}
+
+	// Funds enter the node's Lightning balance when it opens a channel and
+	// leave it when a channel closes; both are on-chain txs.
+	var open struct {
+		Channels []lndChannel `json:"channels"`
+	}
+	if err := c.get("/v1/channels", nil, &open); err != nil {
+		return nil, fmt.Errorf("failed to list channels: %w", err)
+	}
+	var closed struct {
+		Channels []lndClosedChannel `json:"channels"`
+	}
+	if err := c.get("/v1/channels/closed", nil, &closed); err != nil {
+		return nil, fmt.Errorf("failed to list closed channels: %w", err)
+	}
+	channelEntry := func(kind string, point string, txId string, amount int64, v interface{}) error {
+		at, err := txTime(txId)
+		if err != nil {
+			return fmt.Errorf("failed to date channel %s: %w", point, err)
+		}
+		e := entry(kind, kind+":"+point, v)
+		e.Amount, e.TxId, e.OccurredAt = amount, txId, at
+		entries = append(entries, e)
+		return nil
+	}
+	for _, ch := range open.Channels {
+		if !ch.Initiator {
+			continue
+		}
+		fundingTx, _, _ := strings.Cut(ch.ChannelPoint, ":")
+		if err := channelEntry(kindChannelOpen, ch.ChannelPoint, fundingTx, int64(ch.Capacity-ch.PushAmountSat), ch); err != nil {
+			return nil, err
+		}
+	}
+	for _, ch := range closed.Channels {
+		fundingTx, _, _ := strings.Cut(ch.ChannelPoint, ":")
+		if ch.OpenInitiator == "INITIATOR_LOCAL" {
+			if err := channelEntry(kindChannelOpen, ch.ChannelPoint, fundingTx, int64(ch.Capacity), ch); err != nil {
+				return nil, err
+			}
+		}
+		if out := int64(ch.SettledBalance + ch.TimeLockedBalance); out > 0 {
+			if err := channelEntry(kindChannelClose, ch.ChannelPoint, ch.ClosingTxHash, -out, ch); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return entries, nil
+}
+
+// lndChain returns the chain the node runs on, from getinfo.
+func lndChain(c *lndClient) (*Chain, error) {
+	var info lndInfo
+	if err := c.get("/v1/getinfo", nil, &info); err != nil {
+		return nil, err
+	}
+	if len(info.Chains) == 0 {
+		return chainBitcoin, nil
+	}
+	return chainOf(info.Chains[0].Chain, info.Chains[0].Network)
+}
+
+// onchainTxTime returns when a tx on chain was mined, from our copy if we
+// hold one, else from the chain's provider.
+func onchainTxTime(db *sql.DB, chain *Chain) func(txId string) (time.Time, error) {
+	return func(txId string) (time.Time, error) {
+		var ts int64
+		err := db.QueryRow(`SELECT (raw->>'timestamp')::bigint FROM txs WHERE tx_id = $1 AND chain = $2 AND network = $3 LIMIT 1`,
+			txId, chain.Name, chain.Network).Scan(&ts)
+		if err == nil {
+			return time.Unix(ts, 0).UTC(), nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}, err
+		}
+		p, err := providerFor(chain)
+		if err != nil {
+			return time.Time{}, err
+		}
+		item, err := p.Tx(txId)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(item.Timestamp, 0).UTC(), nil
+	}
+}
+
+// lightningCSVColumns maps the fields read from a wallet's CSV export to
+// the column names wallets use for them, compared in lower case without
+// spaces or punctuation.
+var lightningCSVColumns = map[string][]string{
+	"date":        {"date", "time", "timestamp", "createdat", "completedat", "settledat", "utcdate"},
+	"type":        {"type", "direction", "kind"},
+	"status":      {"status", "state"},
+	"amountMsat":  {"amountmsat", "amountmillisatoshi", "amountmillisatoshis", "valuemsat"},
+	"amountSat":   {"amountsat", "amountsats", "amountsatoshi", "amountsatoshis", "amount", "value", "valuesat"},
+	"amountBTC":   {"amountbtc"},
+	"feeMsat":     {"feemsat", "feesmsat", "feemillisatoshi", "feesmillisatoshi"},
+	"feeSat":      {"feesat", "feesats", "fee", "fees"},
+	"id":          {"paymenthash", "hash", "id", "paymentid"},
+	"txId":        {"txid", "transactionid", "onchaintxid"},
+	"description": {"description", "memo", "note", "comment", "label"},
+}
+
+var csvColumnJunk = regexp.MustCompile(`[^a-z0-9]`)
+
+// csvHeaderIndex maps each field of columns to the index of the first
+// header naming it.
+func csvHeaderIndex(header []string, columns map[string][]string) map[string]int {
+	names := map[string]int{}
+	for i, h := range header {
+		h = csvColumnJunk.ReplaceAllString(strings.ToLower(h), "")
+		if _, ok := names[h]; !ok {
+			names[h] = i
+		}
+	}
+	index := map[string]int{}
+	for field, aliases := range columns {
+		for _, a := range aliases {
+			if i, ok := names[a]; ok {
+				index[field] = i
+				break
+			}
+		}
+	}
+	return index
+}
+
+// csvRowIds names the rows of a CSV file that have no id of their own by
+// their content, so the file can be imported again. Identical rows, such as
+// two fills of an order in the same second, are numbered.
+type csvRowIds map[string]int
+
+func (ids csvRowIds) id(row []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(row, "\x1f")))
+	id := "row:" + hex.EncodeToString(sum[:16])
+	n := ids[id]
+	ids[id]++
+	if n > 0 {
+		id += ":" + strconv.Itoa(n)
+	}
+	return id
+}
+
+// csvRecord is a row as JSON, keyed by the header.
+func csvRecord(header []string, row []string) json.RawMessage {
+	rec := map[string]string{}
+	for i, h := range header {
+		if i < len(row) {
+			rec[h] = row[i]
+		}
+	}
+	raw, _ := json.Marshal(rec)
+	return raw
+}
+
+// lightningCompleted are the statuses of payments that went through;
+// rows with another status are skipped.
+var lightningCompleted = map[string]bool{"": true, "complete": true, "completed": true, "succeeded": true,
+	"success": true, "settled": true, "paid": true, "confirmed": true}
+
+// readLightningCSV reads a Lightning wallet's CSV export as ledger entries
+// of account. Columns are found by name; amounts may be signed, or
+// unsigned with a type saying which way they went. Unless feeIncluded, an
+// outgoing amount excludes the fee.
+func readLightningCSV(r io.Reader, account string, feeIncluded bool) ([]LedgerEntry, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("empty CSV file")
+	}
+	index := csvHeaderIndex(rows[0], lightningCSVColumns)
+	if _, ok := index["date"]; !ok {
+		return nil, errors.New("no date column")
+	}
+	col := func(row []string, field string) string {
+		if i, ok := index[field]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	amount := func(row []string, msat string, sat string, btc string) (int64, error) {
+		if v := col(row, msat); v != "" {
+			n, err := parseUnits(v, 0)
+			return n / 1000, err
+		}
+		if v := col(row, sat); v != "" {
+			return parseUnits(v, 0)
+		}
+		return parseUnits(col(row, btc), btcDecimals)
+	}
+
+	entries := []LedgerEntry{}
+	ids := csvRowIds{}
+	for i, row := range rows[1:] {
+		line := i + 2
+		if !lightningCompleted[strings.ToLower(col(row, "status"))] {
+			continue
+		}
+		at, err := parseLedgerTime(col(row, "date"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		value, err := amount(row, "amountMsat", "amountSat", "amountBTC")
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		fee, err := amount(row, "feeMsat", "feeSat", "")
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if fee < 0 {
+			fee = -fee
+		}
+
+		outgoing := value < 0
+		if value > 0 {
+			switch t := strings.ToLower(col(row, "type")); {
+			case strings.Contains(t, "receiv") || strings.Contains(t, "incoming") || strings.Contains(t, "invoice") ||
+				strings.Contains(t, "deposit"):
+			case strings.Contains(t, "send") || strings.Contains(t, "sent") || strings.Contains(t, "outgoing") ||
+				strings.Contains(t, "withdraw") || strings.Contains(t, "payment"):
+				outgoing = true
+			case t != "":
+				return nil, fmt.Errorf("line %d: cannot tell which way a %q went", line, col(row, "type"))
+			}
+		}
+		if value < 0 {
+			value = -value
+		}
+
+		e := LedgerEntry{Source: sourceLightningCSV, Account: account, Kind: kindLNInvoice, Unit: chainBitcoin.Unit,
+			Amount: value, TxId: col(row, "txId"), OccurredAt: at, Description: col(row, "description")}
+		if outgoing {
+			e.Kind, e.Fee = kindLNPayment, fee
+			e.Amount = -(value + fee)
+			if feeIncluded {
+				e.Amount = -value
+			}
+		}
+		e.EntryId = col(row, "id")
+		if e.EntryId == "" {
+			e.EntryId = ids.id(row)
+		}
+		e.Raw = csvRecord(rows[0], row)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// parseLedgerTime reads a timestamp in the formats prices take, or in
+// milliseconds since the epoch.
+func parseLedgerTime(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil && ms > 1e11 {
+		return time.UnixMilli(ms).UTC(), nil
+	}
+	return parsePriceTime(s)
+}
+
+// runLightning implements the lightning command: "lightning import-lnd"
+// imports a node's activity over LND's REST API and "lightning import-csv
+// FILE" a wallet's CSV export.
+func runLightning(db *sql.DB, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: lightning import-lnd|import-csv ...")
+	}
+	sub, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("lightning "+sub, flag.ExitOnError)
+	account := fs.String("account", "", "ledger account to import into (default lnd:PUBKEY for LND, else lightning)")
+	var lnd lndConfig
+	fs.StringVar(&lnd.URL, "lnd-url", envOr("LND_REST_URL", defaultLNDURL), "URL of LND's REST API")
+	fs.StringVar(&lnd.Macaroon, "macaroon", envOr("LND_MACAROON", ""), "path to an LND macaroon, such as readonly.macaroon")
+	fs.StringVar(&lnd.TLSCert, "tls-cert", envOr("LND_TLS_CERT", ""), "path to LND's tls.cert (default the system roots)")
+	fs.BoolVar(&lnd.Insecure, "insecure", false, "accept any TLS certificate from LND")
+	feeIncluded := fs.Bool("fee-included", false, "outgoing CSV amounts already include the fee")
+	fs.Parse(args)
+
+	var entries []LedgerEntry
+	switch sub {
+	case "import-lnd":
+		c, err := newLNDClient(lnd)
+		if err != nil {
+			return err
+		}
+		chain, err := lndChain(c)
+		if err != nil {
+			return err
+		}
+		entries, err = lndEntries(c, *account, onchainTxTime(db, chain))
+		if err != nil {
+			return err
+		}
+	case "import-csv":
+		if fs.NArg() != 1 {
+			return errors.New("usage: lightning import-csv [flags] FILE")
+		}
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		entries, err = readLightningCSV(f, firstNonEmpty(*account, "lightning"), *feeIncluded)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", fs.Arg(0), err)
+		}
+	default:
+		return fmt.Errorf("unknown lightning command %q", sub)
+	}
+
+	n, err := storeLedgerEntries(db, entries)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "imported %d new entries of %d\n", n, len(entries))
+	return nil
+}
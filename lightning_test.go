@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	tt "testing"
+	"time"
+)
+
+// lndStub serves a node's getinfo, payments, invoices and channels over TLS
+// as LND's REST API does, with 64 bit integers as strings.
+func lndStub(t *tt.T, payments []map[string]interface{}, invoices []map[string]interface{}) *lndClient {
+	t.Helper()
+	macaroon := []byte{0x02, 0x01, 0x03, 0x6c, 0x6e, 0x64}
+	page := func(w http.ResponseWriter, r *http.Request, key string, limitParam string, rows []map[string]interface{}) {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("index_offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get(limitParam))
+		var out []map[string]interface{}
+		last := offset
+		for i, row := range rows {
+			if i+1 > offset && len(out) < limit {
+				out = append(out, row)
+				last = i + 1
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{key: out, "last_index_offset": strconv.Itoa(last)})
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Grpc-Metadata-macaroon") != hex.EncodeToString(macaroon) {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]interface{}{"code": 2, "message": "verification failed"})
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/getinfo":
+			fmt.Fprint(w, `{"identity_pubkey": "02abc", "alias": "node", "chains": [{"chain": "bitcoin", "network": "testnet"}]}`)
+		case "/v1/payments":
+			page(w, r, "payments", "max_payments", payments)
+		case "/v1/invoices":
+			page(w, r, "invoices", "num_max_invoices", invoices)
+		case "/v1/channels":
+			fmt.Fprint(w, `{"channels": [
+				{"channel_point": "f1:0", "chan_id": "1", "capacity": "1000000", "initiator": true, "push_amount_sat": "10000"},
+				{"channel_point": "f2:1", "chan_id": "2", "capacity": "500000", "initiator": false}]}`)
+		case "/v1/channels/closed":
+			fmt.Fprint(w, `{"channels": [{"channel_point": "f3:0", "chan_id": "3", "closing_tx_hash": "c3", "capacity": "200000",
+				"settled_balance": "150000", "time_locked_balance": "20000", "close_type": "REMOTE_FORCE_CLOSE", "open_initiator": "INITIATOR_LOCAL"}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	path := filepath.Join(t.TempDir(), "readonly.macaroon")
+	if err := os.WriteFile(path, macaroon, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newLNDClient(lndConfig{URL: srv.URL, Macaroon: path, Insecure: true})
+	if err != nil {
+		t.Fatalf("newLNDClient: %v", err)
+	}
+	return c
+}
+
+func TestLNDEntries(t *tt.T) {
+	hash := make([]byte, 32)
+	hash[0] = 0xab
+	payments := []map[string]interface{}{
+		{"payment_hash": "p1", "value_msat": "100500", "fee_msat": "1500", "creation_date": "1708000000",
+			"creation_time_ns": "1708000000123000000", "status": "SUCCEEDED"},
+		{"payment_hash": "p2", "value_msat": "5000", "fee_msat": "0", "creation_date": "1708000100", "status": "FAILED"},
+	}
+	invoices := []map[string]interface{}{
+		{"r_hash": base64.StdEncoding.EncodeToString(hash), "memo": "coffee", "amt_paid_msat": "250999", "settle_date": "1708000200", "state": "SETTLED"},
+		{"r_hash": base64.StdEncoding.EncodeToString(make([]byte, 32)), "amt_paid_msat": "0", "state": "OPEN"},
+	}
+	c := lndStub(t, payments, invoices)
+
+	dates := map[string]time.Time{
+		"f1": time.Unix(1707000000, 0).UTC(), "f3": time.Unix(1706000000, 0).UTC(), "c3": time.Unix(1709000000, 0).UTC(),
+	}
+	txTime := func(txId string) (time.Time, error) {
+		at, ok := dates[txId]
+		if !ok {
+			return time.Time{}, fmt.Errorf("unexpected tx %s", txId)
+		}
+		return at, nil
+	}
+
+	entries, err := lndEntries(c, "", txTime)
+	if err != nil {
+		t.Fatalf("lndEntries: %v", err)
+	}
+	type want struct {
+		kind, id, txId string
+		amount, fee    int64
+		at             time.Time
+	}
+	wants := []want{
+		// 100.5 sats sent for a 1.5 sat fee is 102 sats out.
+		{kindLNPayment, "p1", "", -102, 1, time.Unix(0, 1708000000123000000).UTC()},
+		{kindLNInvoice, hex.EncodeToString(hash), "", 250, 0, time.Unix(1708000200, 0).UTC()},
+		// Opened for 1000000 with 10000 pushed to the peer.
+		{kindChannelOpen, "channel_open:f1:0", "f1", 990000, 0, dates["f1"]},
+		{kindChannelOpen, "channel_open:f3:0", "f3", 200000, 0, dates["f3"]},
+		{kindChannelClose, "channel_close:f3:0", "c3", -170000, 0, dates["c3"]},
+	}
+	if len(entries) != len(wants) {
+		t.Fatalf("got %d entries, want %d: %+v", len(entries), len(wants), entries)
+	}
+	for i, w := range wants {
+		e := entries[i]
+		if e.Kind != w.kind || e.EntryId != w.id || e.TxId != w.txId || e.Amount != w.amount || e.Fee != w.fee || !e.OccurredAt.Equal(w.at) {
+			t.Errorf("entry %d = %s %s %s %d fee %d at %s, want %+v", i, e.Kind, e.EntryId, e.TxId, e.Amount, e.Fee, e.OccurredAt, w)
+		}
+		if e.Source != sourceLND || e.Account != "lnd:02abc" || len(e.Raw) == 0 {
+			t.Errorf("entry %d source %s account %s raw %s", i, e.Source, e.Account, e.Raw)
+		}
+	}
+	if entries[1].Description != "coffee" {
+		t.Errorf("invoice description = %q", entries[1].Description)
+	}
+}
+
+func TestLNDPaymentsPaging(t *tt.T) {
+	var payments []map[string]interface{}
+	for i := 0; i < lndPageSize+1; i++ {
+		payments = append(payments, map[string]interface{}{"payment_hash": fmt.Sprintf("p%d", i), "value_msat": "1000",
+			"creation_date": "1708000000", "status": "SUCCEEDED", "payment_index": strconv.Itoa(i + 1)})
+	}
+	c := lndStub(t, payments, nil)
+
+	got, err := c.payments()
+	if err != nil {
+		t.Fatalf("payments: %v", err)
+	}
+	if len(got) != lndPageSize+1 || got[lndPageSize].PaymentHash != fmt.Sprintf("p%d", lndPageSize) {
+		t.Fatalf("got %d payments, want %d in order", len(got), lndPageSize+1)
+	}
+}
+
+func TestLNDChainAndErrors(t *tt.T) {
+	c := lndStub(t, nil, nil)
+	chain, err := lndChain(c)
+	if err != nil || chain != chainBitcoinTestnet {
+		t.Fatalf("lndChain = %v, %v; want bitcoin testnet", chain, err)
+	}
+
+	c.macaroon = ""
+	err = c.get("/v1/getinfo", nil, &lndInfo{})
+	if err == nil || err.Error() != "lnd /v1/getinfo: verification failed" {
+		t.Fatalf("get without a macaroon: %v", err)
+	}
+}
+
+func TestReadLightningCSV(t *tt.T) {
+	const data = `Date,Type,Amount (msat),Fee (sat),Status,Payment Hash,Memo
+2024-02-15 10:00:00,Sent,-100500,2,Completed,h1,pizza
+1708000000000,Received,250999,,settled,h2,
+2024-02-16,Sent,5000,0,Failed,h3,
+2024-02-17,Receive,1000,,,,tip
+2024-02-17,Receive,1000,,,,tip
+`
+	entries, err := readLightningCSV(strings.NewReader(data), "phone", false)
+	if err != nil {
+		t.Fatalf("readLightningCSV: %v", err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("got %d entries, want 4 without the failed one: %+v", len(entries), entries)
+	}
+	if e := entries[0]; e.Kind != kindLNPayment || e.Amount != -102 || e.Fee != 2 || e.EntryId != "h1" || e.Description != "pizza" ||
+		!e.OccurredAt.Equal(time.Date(2024, 2, 15, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("payment = %+v", e)
+	}
+	if e := entries[1]; e.Kind != kindLNInvoice || e.Amount != 250 || e.Fee != 0 || !e.OccurredAt.Equal(time.UnixMilli(1708000000000)) {
+		t.Errorf("invoice = %+v", e)
+	}
+	// Identical rows without an id still get distinct ids.
+	if a, b := entries[2].EntryId, entries[3].EntryId; a == "" || a == b || !strings.HasPrefix(a, "row:") {
+		t.Errorf("row ids = %q, %q", a, b)
+	}
+
+	entries, err = readLightningCSV(strings.NewReader(data), "phone", true)
+	if err != nil {
+		t.Fatalf("readLightningCSV: %v", err)
+	}
+	if entries[0].Amount != -100 {
+		t.Errorf("with fees included, payment amount = %d, want -100", entries[0].Amount)
+	}
+
+	if _, err := readLightningCSV(strings.NewReader("Date,Type,Amount\n2024-02-15,Swap,5\n"), "phone", false); err == nil {
+		t.Error("readLightningCSV accepted a row of unknown direction")
+	}
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"fmt"
-	"log"
 	"net/http"
+	"os"
+	"strings"
 
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
@@ -19,67 +22,205 @@ const (
 
 const address = "bc1qm34lsc65zpw79lxes69zkqmk6ee3ewf0j77s3h"
 
+const usage = `Usage: cointracker [flags] [command] [command flags]
+
+Commands:
+  sync      sync txs for an address, then keep serving (default)
+  serve     serve the UI, API and /metrics without syncing
+  history   list past syncs for an address, or the txs a sync added
+  export    write stored txs as CSV (generic, koinly, cointracking, coinledger)
+  prices    import coin→fiat prices from CSV/JSON, or look one up
+  gains     realized gains per tax year (FIFO, LIFO, HIFO or specific ID)
+  wallet    group addresses into named wallets, show or sync a wallet
+  payloads  list OP_RETURN and inscription payloads, or reindex stored txs
+  lightning import Lightning payments from LND or a wallet's CSV export
+  exchange  import Coinbase, Kraken or Binance CSV exports, or match their transfers
+
+Flags:
+`
+
 func main() {
-	fs := http.FileServer(http.Dir("./static"))
-	http.Handle("/", fs)
+	logFormat := flag.String("log-format", envOr("LOG_FORMAT", "text"), "log output format: text (logfmt) or json")
+	logLevel := flag.String("log-level", envOr("LOG_LEVEL", "info"), "minimum log level: debug, info, warn or error")
+	showProgress := flag.Bool("progress", isTerminal(os.Stderr), "draw a progress bar while syncing")
+	listenAddr := flag.String("listen", envOr("LISTEN_ADDR", ":8080"), "address to serve the UI, API and /metrics on; empty to exit after syncing")
+	providerFlag := flag.String("provider", envOr("PROVIDER", ""), "tx data provider: fake, cryptoapis, esplora, core or electrum, or a comma-separated list to fail over between (default fake while testing, else cryptoapis)")
+	verifyFlag := flag.String("verify-provider", envOr("VERIFY_PROVIDER", ""), "second provider to check a sample of each sync's txs against; empty to not verify")
+	flag.IntVar(&verifySampleSize, "verify-sample", verifySampleSize, "txs checked against -verify-provider per sync")
+	esploraURL := flag.String("esplora-url", envOr("ESPLORA_URL", defaultEsploraURL), "base URL of the Esplora API")
+	var core coreConfig
+	flag.StringVar(&core.URL, "core-url", envOr("CORE_RPC_URL", defaultCoreURL), "URL of the Bitcoin Core JSON-RPC server")
+	flag.StringVar(&core.User, "core-user", envOr("CORE_RPC_USER", ""), "Bitcoin Core RPC user; empty to use the cookie file")
+	flag.StringVar(&core.Password, "core-password", envOr("CORE_RPC_PASSWORD", ""), "Bitcoin Core RPC password")
+	flag.StringVar(&core.CookieFile, "core-cookie", envOr("CORE_RPC_COOKIE", ""), "Bitcoin Core RPC cookie file (default ~/.bitcoin/.cookie)")
+	flag.StringVar(&core.Wallet, "core-wallet", envOr("CORE_RPC_WALLET", ""), "Bitcoin Core wallet that watches synced addresses")
+	var electrum electrumConfig
+	flag.StringVar(&electrum.URL, "electrum-url", envOr("ELECTRUM_URL", defaultElectrumURL), "Electrum server as ssl://host:port or tcp://host:port")
+	flag.BoolVar(&electrum.InsecureTLS, "electrum-insecure", envOr("ELECTRUM_INSECURE", "") == "true", "accept any TLS certificate from the Electrum server")
+	flag.Func("chain-provider", "provider for a chain other than Bitcoin mainnet, as chain=fake, chain=cryptoapis or chain=esplora[:url], or for EVM chains chain=etherscan[:url]; repeatable, and CHAIN_PROVIDERS takes a comma-separated list (default cryptoapis, or etherscan for EVM chains)", parseChainProvider)
+	flag.StringVar(&etherscanAPIKey, "etherscan-key", envOr("ETHERSCAN_API_KEY", ""), "Etherscan API key for EVM chains")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	for _, v := range strings.Split(envOr("CHAIN_PROVIDERS", ""), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if err := parseChainProvider(v); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	flag.Parse()
+
+	l, err := newLogger(os.Stderr, *logFormat, *logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger = l
+
+	p, err := newProvider(providerConfig{Name: *providerFlag, EsploraURL: *esploraURL, Core: core, Electrum: electrum})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	provider = p
+	if *verifyFlag != "" {
+		v, err := newProvider(providerConfig{Name: *verifyFlag, EsploraURL: *esploraURL, Core: core, Electrum: electrum})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		verifier = v
+	}
+
+	command := "sync"
+	args := flag.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	db, err := openDB()
+	if err != nil {
+		fatal("failed to open database", err)
+	}
+	defer db.Close()
+
+	syncs := newSyncRunner(db)
+	switch command {
+	case "sync":
+		err = runSync(syncs, args, *showProgress, *listenAddr)
+	case "serve":
+		err = serve(syncs, *listenAddr)
+	case "history":
+		err = runHistory(db, args, os.Stdout)
+	case "export":
+		err = runExport(db, args, os.Stdout)
+	case "prices":
+		err = runPrices(db, args, os.Stdout)
+	case "gains":
+		err = runGains(db, args, os.Stdout)
+	case "payloads":
+		err = runPayloads(db, args, os.Stdout)
+	case "wallet":
+		err = runWallet(syncs, args, os.Stdout)
+	case "lightning":
+		err = runLightning(db, args, os.Stdout)
+	case "exchange":
+		err = runExchange(db, args, os.Stdout)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(command+" failed", err)
+	}
+}
 
+func openDB() (*sql.DB, error) {
 	psqlInfo := fmt.Sprintf("host=%s port=%d dbname=%s sslmode=disable",
 		host, db_port, dbname)
 	db, err := sql.Open("postgres", psqlInfo)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer db.Close()
 
 	err = db.Ping()
 	if err != nil {
-		panic(err)
-	}
-
-	fmt.Println("Successfully connected!")
-
-	createTablesSQL := `
-    CREATE TABLE IF NOT EXISTS addresses (
-        id SERIAL PRIMARY KEY,
-        address TEXT UNIQUE NOT NULL,
-        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-    );
-	
-	CREATE TABLE IF NOT EXISTS syncs (
-		id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
-		address text,
-		status text,
-		txs_synced integer,
-		total_sync_txs integer,
-		total_txs integer,
-		created_at timestamp with time zone,
-		finished_at timestamp with time zone
-	);
-
-	CREATE TABLE IF NOT EXISTS sync_errors (
-		id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
-		sync_id text,
-		page integer,
-		error text
-	);
-
-	CREATE TABLE IF NOT EXISTS txs (
-		id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
-		address text,
-		tx_id text UNIQUE,
-		raw jsonb,
-		page integer,
-		created_at timestamp with time zone,
-		sync_id text
-	);
-	`
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	logger.Info("Successfully connected!", "dbname", dbname)
+
 	_, err = db.Exec(createTablesSQL)
 	if err != nil {
-		log.Fatalf("Failed to create table: %v", err)
+		db.Close()
+		return nil, fmt.Errorf("failed to create tables: %w", err)
+	}
+	logger.Debug("tables created or already exist")
+
+	return db, nil
+}
+
+// runSync syncs one address and then, unless listenAddr is empty, keeps
+// serving. The server is started first so progress and metrics are live
+// during the sync.
+func runSync(syncs *syncRunner, args []string, showProgress bool, listenAddr string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	addr := fs.String("address", address, "address to sync")
+	fs.Parse(args)
+
+	serverErr := make(chan error, 1)
+	if listenAddr != "" {
+		go func() {
+			serverErr <- serve(syncs, listenAddr)
+		}()
+	}
+
+	barDone := make(chan struct{})
+	barStopped := make(chan struct{})
+	if showProgress {
+		go func() {
+			runProgressBar(os.Stderr, barDone)
+			close(barStopped)
+		}()
 	} else {
-		log.Println("Table created or already exists")
+		close(barStopped)
+	}
+	err := syncs.run(*addr)
+	close(barDone)
+	<-barStopped
+	if err != nil {
+		return err
+	}
+
+	if listenAddr != "" {
+		return <-serverErr
 	}
+	return nil
+}
+
+// serve serves the dashboard, the JSON API and /metrics until it fails.
+func serve(syncs *syncRunner, listenAddr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/", dashboardHandler())
+	mux.Handle("/metrics", promhttp.Handler())
+	registerAPI(mux, syncs.db, syncs)
+	go func() {
+		if err := syncs.watchAll(); err != nil {
+			logger.Error("failed to subscribe to address activity", "error", err)
+		}
+	}()
+
+	logger.Info("serving http", "addr", listenAddr)
+	return http.ListenAndServe(listenAddr, mux)
+}
 
-	txFetcher := GetNewTxFetcher(db, address, pageLimit)
-	txFetcher.SyncTxs()
+// fatal logs err and exits. Only main may end the process.
+func fatal(msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
 }
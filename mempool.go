@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Statuses of txs that are not in a block: PENDING while in the mempool and
+// DROPPED if they leave it without being mined, e.g. replaced by fee.
+const (
+	txPending = "PENDING"
+	txDropped = "DROPPED"
+)
+
+// syncPending stores the address's mempool txs as PENDING, then looks up
+// each stored pending tx that has left the mempool: mined ones are promoted
+// to CONFIRMED with their block, and ones the provider no longer knows are
+// DROPPED. Confirmed txs are never downgraded, but orphaned ones back in the
+// mempool after a reorg are pending again. It returns the number of txs now
+// pending.
+func (txFetcher TxFetcher) syncPending(log *slog.Logger, syncId string) (int, error) {
+	db := txFetcher.db
+	txFetcher.stats.request(txFetcher.provider)
+	items, err := txFetcher.provider.PendingTxs(txFetcher.Address)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get pending txs: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	inMempool := map[string]bool{}
+	for _, item := range items {
+		inMempool[item.TransactionId] = true
+		txFetcher.chain.normalizeItem(&item)
+		raw, err := json.Marshal(item)
+		if err != nil {
+			return 0, errors.New("failed to marshal JSON")
+		}
+		args := []interface{}{txFetcher.Address, item.TransactionId, syncId, string(raw), now, txPending,
+			txFetcher.chain.Name, txFetcher.chain.Network}
+		for _, status := range replacedByPending {
+			args = append(args, status)
+		}
+		_, err = tx.Exec(upsertPendingQuery(), args...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to store pending tx: %w", err)
+		}
+		if _, err := storePayloads(tx, item); err != nil {
+			return 0, fmt.Errorf("failed to store payloads: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	rows, err := db.Query(`SELECT tx_id FROM txs WHERE address = $1 AND status = $2`, txFetcher.Address, txPending)
+	if err != nil {
+		return 0, err
+	}
+	var left []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !inMempool[id] {
+			left = append(left, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range left {
+		txFetcher.stats.request(txFetcher.provider)
+		item, err := txFetcher.provider.Tx(id)
+		switch {
+		case errors.Is(err, errProviderNotFound):
+			log.Info("pending tx dropped from the mempool", "tx_id", id)
+			_, err = db.Exec(`UPDATE txs SET status = $3 WHERE address = $1 AND tx_id = $2 AND status = $4`,
+				txFetcher.Address, id, txDropped, txPending)
+		case err != nil:
+			return 0, fmt.Errorf("failed to look up pending tx %s: %w", id, err)
+		case item.MinedInBlockHeight > 0:
+			log.Info("pending tx mined", "tx_id", id, "height", item.MinedInBlockHeight)
+			txFetcher.chain.normalizeItem(&item)
+			err = promoteTx(db, txFetcher.Address, item)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to update pending tx %s: %w", id, err)
+		}
+	}
+
+	var pending int
+	err = db.QueryRow(`SELECT COUNT(*) FROM txs WHERE address = $1 AND status = $2`, txFetcher.Address, txPending).Scan(&pending)
+	return pending, err
+}
+
+// replacedByPending are the statuses a tx seen in the mempool overwrites: an
+// earlier sighting, a drop, and an orphaning by a reorg that returned the tx
+// to the mempool.
+var replacedByPending = []string{txPending, txDropped, txOrphaned}
+
+// upsertPendingQuery stores a mempool tx unless it is stored with a status
+// other than replacedByPending, whose values are bound from $9 on.
+func upsertPendingQuery() string {
+	in := make([]string, len(replacedByPending))
+	for i := range in {
+		in[i] = fmt.Sprintf("$%d", i+9)
+	}
+	return `
+		INSERT INTO txs (address, tx_id, sync_id, raw, created_at, status, chain, network)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (address, tx_id) DO UPDATE SET raw = EXCLUDED.raw, status = EXCLUDED.status
+		WHERE txs.status IN (` + strings.Join(in, ", ") + `)`
+}
+
+// promoteTx stores the mined form of a pending tx and confirms it.
+func promoteTx(db *sql.DB, address string, item Item) error {
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return errors.New("failed to marshal JSON")
+	}
+	_, err = db.Exec(`UPDATE txs SET raw = $3, status = $4 WHERE address = $1 AND tx_id = $2 AND status <> $4`,
+		address, item.TransactionId, string(raw), txConfirmed)
+	return err
+}
+
+// confirmedOnly drops pending txs from views, for figures such as gains
+// that only count what is in a block.
+func confirmedOnly(views []TxView) []TxView {
+	kept := make([]TxView, 0, len(views))
+	for _, v := range views {
+		if v.Status != txPending {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
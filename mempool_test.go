@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	tt "testing"
+)
+
+func TestUpsertPendingQuery(t *tt.T) {
+	replaced := map[string]bool{}
+	for _, status := range replacedByPending {
+		replaced[status] = true
+	}
+	// A tx back in the mempool after its block was orphaned is pending
+	// again, but a confirmed one is never downgraded.
+	for status, want := range map[string]bool{txPending: true, txDropped: true, txOrphaned: true, txConfirmed: false} {
+		if replaced[status] != want {
+			t.Errorf("pending replaces %s = %v, want %v", status, replaced[status], want)
+		}
+	}
+
+	// Each status has its own placeholder after the 8 insert arguments.
+	query := upsertPendingQuery()
+	if want := "WHERE txs.status IN ($9, $10, $11)"; !strings.HasSuffix(query, want) {
+		t.Errorf("query = %s, want it to end with %s", query, want)
+	}
+	if strings.Contains(query, "$12") {
+		t.Errorf("query binds more values than statuses: %s", query)
+	}
+}
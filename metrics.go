@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics for syncs and the tx data provider, served on /metrics.
+var (
+	providerRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cointracker_provider_requests_total",
+		Help: "Requests sent to the tx data provider, by provider, endpoint and HTTP status.",
+	}, []string{"provider", "endpoint", "status"})
+
+	providerRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cointracker_provider_request_duration_seconds",
+		Help:    "Latency of requests to the tx data provider.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider", "endpoint"})
+
+	pageRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cointracker_page_retries_total",
+		Help: "Page fetches retried after a failed attempt.",
+	}, []string{"address"})
+
+	rateLimitWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cointracker_rate_limit_wait_seconds",
+		Help:    "Time spent waiting on the request rate limiter before dispatching a page.",
+		Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1},
+	})
+
+	pagesSynced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cointracker_pages_synced_total",
+		Help: "Pages processed per address, by result (ok or failed).",
+	}, []string{"address", "result"})
+
+	txsSynced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cointracker_txs_synced_total",
+		Help: "Txs received from the provider and newly written, by chain and provider.",
+	}, []string{"chain", "provider"})
+
+	dbInsertDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cointracker_db_insert_duration_seconds",
+		Help:    "Latency of the per-page tx insert transaction.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	scriptMismatches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cointracker_script_mismatches_total",
+		Help: "Provider script fields that disagree with our own decoding of the script.",
+	})
+
+	orphanedBlocks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cointracker_orphaned_blocks_total",
+		Help: "Stored blocks found to have been orphaned by a chain reorganization.",
+	})
+
+	providerFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cointracker_provider_failures_total",
+		Help: "Failed requests to a failover backend, by backend provider.",
+	}, []string{"provider"})
+
+	providerDiscrepancies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cointracker_provider_discrepancies_total",
+		Help: "Differences between the provider and the verification provider, by field.",
+	}, []string{"field"})
+
+	activeSyncs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cointracker_active_syncs",
+		Help: "Syncs currently in progress.",
+	})
+)
+
+// providerName is the provider label used on request metrics.
+func providerName() string {
+	return provider.Name()
+}
+
+// observeProviderRequest records one provider request. status is the HTTP
+// status code, or 0 if no response was received.
+func observeProviderRequest(endpoint string, status int, started time.Time) {
+	label := "error"
+	if status != 0 {
+		label = strconv.Itoa(status)
+	}
+	providerRequests.WithLabelValues(providerName(), endpoint, label).Inc()
+	providerRequestDuration.WithLabelValues(providerName(), endpoint).Observe(time.Since(started).Seconds())
+}
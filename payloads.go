@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// Payload kinds.
+const (
+	payloadOpReturn    = "op_return"
+	payloadInscription = "inscription"
+)
+
+// Protocols recognised from their OP_RETURN markers.
+const (
+	protocolOmni   = "omni"
+	protocolRunes  = "runes"
+	protocolStacks = "stacks"
+)
+
+// payloadFilters are the accepted values of the ?payload= tx list filter.
+var payloadFilters = []string{"any", payloadOpReturn, payloadInscription, protocolOmni, protocolRunes, protocolStacks}
+
+// Payload is data carried by a tx rather than value: an OP_RETURN output or
+// an ordinals inscription revealed in a taproot witness. Index is the vout
+// of an OP_RETURN and the vin of an inscription.
+type Payload struct {
+	Kind        string `json:"kind"`
+	Index       int    `json:"index"`
+	Protocol    string `json:"protocol,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int    `json:"size"`
+	Hex         string `json:"hex"`
+	Text        string `json:"text,omitempty"`
+}
+
+// extractPayloads returns the OP_RETURN and inscription payloads of item.
+func extractPayloads(item Item) []Payload {
+	payloads := []Payload{}
+	for i, vout := range item.BlockchainSpecific.Vout {
+		script, err := hex.DecodeString(vout.ScriptPubKey.Hex)
+		if err != nil || len(script) == 0 || script[0] != txscript.OP_RETURN {
+			continue
+		}
+		payloads = append(payloads, opReturnPayload(i, script))
+	}
+	for i, vin := range item.BlockchainSpecific.Vin {
+		if p, ok := inscriptionPayload(i, vin.Txinwitness); ok {
+			payloads = append(payloads, p)
+		}
+	}
+	return payloads
+}
+
+// opReturnPayload concatenates the data pushed after OP_RETURN.
+func opReturnPayload(vout int, script []byte) Payload {
+	var data []byte
+	tok := txscript.MakeScriptTokenizer(0, script[1:])
+	runes := false
+	for first := true; tok.Next(); first = false {
+		if first && tok.Opcode() == txscript.OP_13 {
+			// A runestone is OP_RETURN OP_13 followed by its integers.
+			runes = true
+			continue
+		}
+		data = append(data, tok.Data()...)
+	}
+
+	p := Payload{Kind: payloadOpReturn, Index: vout, Size: len(data), Hex: hex.EncodeToString(data)}
+	switch {
+	case runes:
+		p.Protocol = protocolRunes
+	case bytes.HasPrefix(data, []byte("omni")):
+		p.Protocol = protocolOmni
+	case bytes.HasPrefix(data, []byte("id")) && len(data) == 80:
+		p.Protocol = protocolStacks
+	}
+	if p.Protocol == "" {
+		p.Text = printableText(data)
+	}
+	return p
+}
+
+// inscriptionPayload finds an ordinals envelope (OP_FALSE OP_IF "ord" ...
+// OP_ENDIF) in the tapscript of a script path spend.
+func inscriptionPayload(vin int, witnessHex []string) (Payload, bool) {
+	witness := make([][]byte, 0, len(witnessHex))
+	for _, w := range witnessHex {
+		b, err := hex.DecodeString(w)
+		if err != nil {
+			return Payload{}, false
+		}
+		witness = append(witness, b)
+	}
+	// Drop the annex, then the control block; the tapscript comes before it.
+	if n := len(witness); n >= 2 && len(witness[n-1]) > 0 && witness[n-1][0] == 0x50 {
+		witness = witness[:n-1]
+	}
+	if len(witness) < 2 {
+		return Payload{}, false
+	}
+	script := witness[len(witness)-2]
+
+	tok := txscript.MakeScriptTokenizer(0, script)
+	var before, last byte = txscript.OP_INVALIDOPCODE, txscript.OP_INVALIDOPCODE
+	for tok.Next() {
+		if before == txscript.OP_FALSE && last == txscript.OP_IF && bytes.Equal(tok.Data(), []byte("ord")) {
+			return readEnvelope(vin, &tok), true
+		}
+		before, last = last, tok.Opcode()
+	}
+	return Payload{}, false
+}
+
+// readEnvelope reads the tag/value fields and body of an envelope after its
+// "ord" marker.
+func readEnvelope(vin int, tok *txscript.ScriptTokenizer) Payload {
+	p := Payload{Kind: payloadInscription, Index: vin}
+	var body []byte
+	inBody := false
+	for tok.Next() {
+		op := tok.Opcode()
+		if op == txscript.OP_ENDIF {
+			break
+		}
+		if inBody {
+			body = append(body, tok.Data()...)
+			continue
+		}
+		if op == txscript.OP_0 {
+			inBody = true
+			continue
+		}
+		tag := tok.Data()
+		if op == txscript.OP_1 {
+			tag = []byte{1}
+		}
+		if !tok.Next() {
+			break
+		}
+		if bytes.Equal(tag, []byte{1}) {
+			p.ContentType = string(tok.Data())
+		}
+	}
+	p.Size = len(body)
+	p.Hex = hex.EncodeToString(body)
+	if strings.HasPrefix(p.ContentType, "text/") || strings.HasPrefix(p.ContentType, "application/json") {
+		p.Text = printableText(body)
+	}
+	return p
+}
+
+// printableText returns data as a string if it is valid UTF-8 made of
+// printable characters, and "" otherwise.
+func printableText(data []byte) string {
+	if len(data) == 0 || !utf8.Valid(data) {
+		return ""
+	}
+	s := string(data)
+	for _, r := range s {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return ""
+		}
+	}
+	return s
+}
+
+// insertPayloadStmt stores a payload; it is keyed by tx hash since a tx
+// stored for several addresses carries the same payloads.
+const insertPayloadStmt = `
+	INSERT INTO tx_payloads (tx_hash, kind, idx, protocol, content_type, size, hex, text)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT (tx_hash, kind, idx) DO NOTHING`
+
+// execer is satisfied by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// storePayloads records the payloads of item.
+func storePayloads(db execer, item Item) (int, error) {
+	payloads := extractPayloads(item)
+	for _, p := range payloads {
+		_, err := db.Exec(insertPayloadStmt, item.TransactionHash, p.Kind, p.Index, p.Protocol, p.ContentType, p.Size, p.Hex, p.Text)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(payloads), nil
+}
+
+// payloadTxHashes returns the hashes of the txs with payloads matching
+// filter: "any", a kind or a protocol.
+func payloadTxHashes(db *sql.DB, filter string) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT DISTINCT tx_hash FROM tx_payloads WHERE $1 = 'any' OR kind = $1 OR protocol = $1`, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := map[string]bool{}
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, err
+		}
+		hashes[h] = true
+	}
+	return hashes, rows.Err()
+}
+
+func isPayloadFilter(filter string) bool {
+	for _, f := range payloadFilters {
+		if f == filter {
+			return true
+		}
+	}
+	return false
+}
+
+// filterByPayload keeps the views whose tx has a payload matching the
+// ?payload= filter, if one was given.
+func (s *apiServer) filterByPayload(w http.ResponseWriter, r *http.Request, views []TxView) ([]TxView, bool) {
+	filter := r.URL.Query().Get("payload")
+	if filter == "" {
+		return views, true
+	}
+	if !isPayloadFilter(filter) {
+		writeError(w, http.StatusBadRequest, "unknown payload filter")
+		return nil, false
+	}
+	hashes, err := payloadTxHashes(s.db, filter)
+	if err != nil {
+		s.internalError(w, "failed to load payloads", err)
+		return nil, false
+	}
+	kept := []TxView{}
+	for _, v := range views {
+		if hashes[v.Hash] {
+			kept = append(kept, v)
+		}
+	}
+	return kept, true
+}
+
+// reindexPayloads extracts the payloads of every stored tx, for txs synced
+// before payloads were stored. Account chain txs carry no payloads.
+func reindexPayloads(db *sql.DB) (int, error) {
+	rows, err := db.Query(`SELECT DISTINCT ON (tx_id) raw FROM txs WHERE model = $1 ORDER BY tx_id, id`, modelUTXO)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var items []Item
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return 0, err
+		}
+		var item Item
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return 0, err
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, item := range items {
+		n, err := storePayloads(db, item)
+		if err != nil {
+			return total, fmt.Errorf("failed to store payloads of %s: %w", item.TransactionId, err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// runPayloads implements the payloads command.
+func runPayloads(db *sql.DB, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: payloads list|reindex ...")
+	}
+	sub, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("payloads "+sub, flag.ExitOnError)
+	filter := fs.String("filter", "any", "one of "+strings.Join(payloadFilters, ", "))
+	limit := fs.Int("limit", 50, "maximum number of payloads to list")
+	fs.Parse(args)
+
+	switch sub {
+	case "reindex":
+		n, err := reindexPayloads(db)
+		if err != nil {
+			return err
+		}
+		logger.Info("reindexed payloads", "payloads", n)
+		return nil
+	case "list":
+		if !isPayloadFilter(*filter) {
+			return fmt.Errorf("unknown payload filter %q", *filter)
+		}
+		rows, err := db.Query(`
+			SELECT tx_hash, kind, idx, protocol, content_type, size, COALESCE(text, '')
+			FROM tx_payloads WHERE $1 = 'any' OR kind = $1 OR protocol = $1
+			ORDER BY tx_hash, kind, idx LIMIT $2`, *filter, *limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TX\tKIND\tINDEX\tPROTOCOL\tTYPE\tSIZE\tTEXT")
+		for rows.Next() {
+			var p Payload
+			var hash string
+			if err := rows.Scan(&hash, &p.Kind, &p.Index, &p.Protocol, &p.ContentType, &p.Size, &p.Text); err != nil {
+				return err
+			}
+			if r := []rune(p.Text); len(r) > 40 {
+				p.Text = string(r[:40]) + "…"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%d\t%q\n", hash, p.Kind, p.Index, p.Protocol, p.ContentType, p.Size, p.Text)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown payloads command %q", sub)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	tt "testing"
+)
+
+func TestOpReturnPayload(t *tt.T) {
+	stacks := "id" + strings.Repeat("\x01", 78)
+	tests := []struct {
+		name     string
+		script   string
+		protocol string
+		data     string
+		text     string
+	}{
+		{"text", "6a0568656c6c6f", "", "hello", "hello"},
+		// Pushes are concatenated.
+		{"two pushes", "6a0368656c026c6f", "", "hello", "hello"},
+		{"binary", "6a0400ff0102", "", "\x00\xff\x01\x02", ""},
+		{"omni", "6a146f6d6e69000000000000001f000000002faf0800", protocolOmni, "omni\x00\x00\x00\x00\x00\x00\x00\x1f\x00\x00\x00\x00\x2f\xaf\x08\x00", ""},
+		{"runes", "6a5d0614c0a2331441", protocolRunes, "\x14\xc0\xa2\x33\x14\x41", ""},
+		{"stacks", "6a4c50" + hex.EncodeToString([]byte(stacks)), protocolStacks, stacks, ""},
+		{"empty", "6a", "", "", ""},
+	}
+	for _, tc := range tests {
+		script, _ := hex.DecodeString(tc.script)
+		p := opReturnPayload(2, script)
+		want := Payload{Kind: payloadOpReturn, Index: 2, Protocol: tc.protocol, Size: len(tc.data), Hex: hex.EncodeToString([]byte(tc.data)), Text: tc.text}
+		if p != want {
+			t.Errorf("%s: payload = %+v, want %+v", tc.name, p, want)
+		}
+	}
+}
+
+// envelope is a tapscript revealing an inscription: a key spend guarded by
+// OP_FALSE OP_IF "ord" ... OP_ENDIF, with fields and body pushes in hex.
+func envelope(fields string, body ...string) string {
+	script := "20" + strings.Repeat("11", 32) + "ac" + "0063036f7264" + fields + "00"
+	for _, b := range body {
+		script += hex.EncodeToString([]byte{byte(len(b) / 2)}) + b
+	}
+	return script + "68"
+}
+
+func TestInscriptionPayload(t *tt.T) {
+	sig := strings.Repeat("ab", 64)
+	control := "c0" + strings.Repeat("22", 32)
+	contentType := func(s string) string {
+		return "0101" + hex.EncodeToString([]byte{byte(len(s))}) + hex.EncodeToString([]byte(s))
+	}
+	text := hex.EncodeToString([]byte("Hello, world!"))
+
+	tests := []struct {
+		name        string
+		witness     []string
+		ok          bool
+		contentType string
+		body        string
+		text        string
+	}{
+		{"text", []string{sig, envelope(contentType("text/plain;charset=utf-8"), text), control}, true,
+			"text/plain;charset=utf-8", "Hello, world!", "Hello, world!"},
+		// The content type tag as OP_1, a body in two pushes, and an annex.
+		{"op_1 tag and annex", []string{sig, envelope("5109"+hex.EncodeToString([]byte("image/png")), "89504e47", "0d0a"), control, "50aa"}, true,
+			"image/png", "\x89PNG\r\n", ""},
+		{"json", []string{sig, envelope(contentType("application/json"), hex.EncodeToString([]byte(`{"p":"brc-20"}`))), control}, true,
+			"application/json", `{"p":"brc-20"}`, `{"p":"brc-20"}`},
+		{"no envelope", []string{sig, "20" + strings.Repeat("11", 32) + "ac", control}, false, "", "", ""},
+		{"key path", []string{sig}, false, "", "", ""},
+		{"bad hex", []string{sig, "zz", control}, false, "", "", ""},
+	}
+	for _, tc := range tests {
+		p, ok := inscriptionPayload(1, tc.witness)
+		if ok != tc.ok {
+			t.Errorf("%s: found = %v, want %v", tc.name, ok, tc.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		want := Payload{Kind: payloadInscription, Index: 1, ContentType: tc.contentType, Size: len(tc.body),
+			Hex: hex.EncodeToString([]byte(tc.body)), Text: tc.text}
+		if p != want {
+			t.Errorf("%s: payload = %+v, want %+v", tc.name, p, want)
+		}
+	}
+}
+
+func TestExtractPayloads(t *tt.T) {
+	item := Item{BlockchainSpecific: BlockchainSpecific{
+		Vin: []Vin{
+			{Txinwitness: []string{strings.Repeat("30", 71), testPubKey}},
+			{Txinwitness: []string{strings.Repeat("ab", 64), envelope("", "00"), "c0" + strings.Repeat("22", 32)}},
+		},
+		Vout: []Vout{
+			{ScriptPubKey: ScriptPubKey{Hex: testP2WPKHScript}},
+			{ScriptPubKey: ScriptPubKey{Hex: "6a0568656c6c6f"}},
+		},
+	}}
+	payloads := extractPayloads(item)
+	if len(payloads) != 2 || payloads[0].Kind != payloadOpReturn || payloads[0].Index != 1 ||
+		payloads[1].Kind != payloadInscription || payloads[1].Index != 1 || payloads[1].Hex != "00" {
+		t.Errorf("payloads = %+v, want the OP_RETURN of vout 1 and the inscription of vin 1", payloads)
+	}
+}
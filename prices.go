@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fiat amounts are integer minor units (cents). Prices are stored with
+// priceDecimals so sub-cent quotes survive.
+const fiatDecimals = 2
+const priceDecimals = 8
+
+// Price granularities and how stale a price may be before a tx at a later
+// time counts as unpriced.
+const (
+	granularityDaily  = "daily"
+	granularityHourly = "hourly"
+)
+
+var maxPriceAge = map[string]time.Duration{
+	granularityDaily:  36 * time.Hour,
+	granularityHourly: 2 * time.Hour,
+}
+
+var errNoPrice = errors.New("no price data")
+
+// PricePoint is one coin→fiat quote.
+type PricePoint struct {
+	At          time.Time
+	Price       int64 // fiat per coin with priceDecimals
+	Granularity string
+}
+
+// priceTable holds the quotes for one fiat currency, oldest first, for each
+// base unit such as BTC or LTC.
+type priceTable struct {
+	Currency string
+	points   map[string][]PricePoint
+}
+
+func loadPriceTable(db *sql.DB, currency string) (*priceTable, error) {
+	rows, err := db.Query(`SELECT base, at, price::text, granularity FROM prices WHERE currency = $1 ORDER BY at`, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	table := &priceTable{Currency: currency, points: map[string][]PricePoint{}}
+	for rows.Next() {
+		var p PricePoint
+		var base, price string
+		if err := rows.Scan(&base, &p.At, &price, &p.Granularity); err != nil {
+			return nil, err
+		}
+		if p.Price, err = parseUnits(price, priceDecimals); err != nil {
+			return nil, err
+		}
+		table.points[base] = append(table.points[base], p)
+	}
+	return table, rows.Err()
+}
+
+// at returns the latest base→fiat quote at or before t, provided it is
+// recent enough for its granularity. Otherwise it returns errNoPrice.
+func (t *priceTable) at(base string, ts time.Time) (PricePoint, error) {
+	points := t.points[base]
+	i := sort.Search(len(points), func(i int) bool { return points[i].At.After(ts) })
+	if i == 0 {
+		return PricePoint{}, fmt.Errorf("%w for %s/%s at %s", errNoPrice, base, t.Currency, ts.Format(time.RFC3339))
+	}
+	p := points[i-1]
+	if ts.Sub(p.At) > maxPriceAge[p.Granularity] {
+		return PricePoint{}, fmt.Errorf("%w for %s/%s at %s: latest earlier price is from %s",
+			errNoPrice, base, t.Currency, ts.Format(time.RFC3339), p.At.Format(time.RFC3339))
+	}
+	return p, nil
+}
+
+// fiatValue converts base units (satoshis for BTC) of an amount with
+// decimals to fiat minor units at price, rounding half away from zero.
+func fiatValue(amount int64, decimals int, price int64) int64 {
+	v := new(big.Int).Mul(big.NewInt(amount), big.NewInt(price))
+	// amount has decimals, price has priceDecimals; keep fiatDecimals.
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals+priceDecimals-fiatDecimals)), nil)
+	q, r := new(big.Int).QuoRem(v, scale, new(big.Int))
+	if new(big.Int).Abs(r).Cmp(new(big.Int).Rsh(scale, 1)) >= 0 {
+		if v.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q.Int64()
+}
+
+// FiatValue is a tx or balance valued in fiat. When no usable price exists
+// Missing is set and the amounts are zero; callers must not treat that as a
+// real zero value.
+type FiatValue struct {
+	Currency string     `json:"currency"`
+	Price    string     `json:"price,omitempty"`
+	PricedAt *time.Time `json:"pricedAt,omitempty"`
+	Net      int64      `json:"net"`
+	Fee      int64      `json:"fee"`
+	Balance  *int64     `json:"balance,omitempty"`
+	Missing  bool       `json:"missing,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+}
+
+// valueAt prices an amount (and fee) in unit at ts.
+func (t *priceTable) valueAt(unit string, ts time.Time, net int64, fee int64) *FiatValue {
+	fv := &FiatValue{Currency: t.Currency}
+	p, err := t.at(unit, ts)
+	if err != nil {
+		fv.Missing = true
+		fv.Reason = err.Error()
+		return fv
+	}
+	pricedAt := p.At
+	fv.Price = formatUnits(p.Price, priceDecimals)
+	fv.PricedAt = &pricedAt
+	fv.Net = fiatValue(net, unitDecimals(unit), p.Price)
+	fv.Fee = fiatValue(fee, unitDecimals(unit), p.Price)
+	return fv
+}
+
+// valueViews attaches a fiat valuation to each view at its timestamp and
+// returns how many could not be priced.
+func (t *priceTable) valueViews(views []TxView) int {
+	missing := 0
+	for i := range views {
+		views[i].Fiat = t.valueAt(views[i].Unit, views[i].Timestamp, views[i].Net, views[i].Fee)
+		if views[i].Fiat.Missing {
+			missing++
+		}
+	}
+	return missing
+}
+
+// valueBalance prices a balance in unit at ts.
+func (t *priceTable) valueBalance(unit string, ts time.Time, balance int64) *FiatValue {
+	fv := &FiatValue{Currency: t.Currency}
+	p, err := t.at(unit, ts)
+	if err != nil {
+		fv.Missing = true
+		fv.Reason = err.Error()
+		return fv
+	}
+	pricedAt := p.At
+	b := fiatValue(balance, unitDecimals(unit), p.Price)
+	fv.Price = formatUnits(p.Price, priceDecimals)
+	fv.PricedAt = &pricedAt
+	fv.Balance = &b
+	return fv
+}
+
+// importPrices reads quotes from a CSV or JSON file and upserts them. CSV
+// files have a header with a timestamp or date column and a price column,
+// and optionally currency and base columns. JSON files hold an array of
+// objects with the same keys. Timestamps may be RFC 3339, YYYY-MM-DD or unix
+// seconds. base is the unit quoted when the file has no base column.
+func importPrices(db *sql.DB, r io.Reader, format string, base string, currency string, granularity string) (int, error) {
+	if _, ok := maxPriceAge[granularity]; !ok {
+		return 0, fmt.Errorf("unknown granularity %q", granularity)
+	}
+
+	var records []map[string]string
+	var err error
+	switch format {
+	case "csv":
+		records, err = readPriceCSV(r)
+	case "json":
+		records, err = readPriceJSON(r)
+	default:
+		return 0, fmt.Errorf("unknown price file format %q", format)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO prices (base, currency, at, price, granularity) VALUES ($5, $1, $2, $3, $4)
+		ON CONFLICT (base, currency, at) DO UPDATE SET price = EXCLUDED.price, granularity = EXCLUDED.granularity`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	for i, rec := range records {
+		at, err := parsePriceTime(firstNonEmpty(rec["timestamp"], rec["date"], rec["time"]))
+		if err != nil {
+			return 0, fmt.Errorf("record %d: %w", i+1, err)
+		}
+		price, err := parseUnits(firstNonEmpty(rec["price"], rec["close"]), priceDecimals)
+		if err != nil || price <= 0 {
+			return 0, fmt.Errorf("record %d: invalid price %q", i+1, firstNonEmpty(rec["price"], rec["close"]))
+		}
+		cur := strings.ToUpper(firstNonEmpty(rec["currency"], currency))
+		if cur == "" {
+			return 0, fmt.Errorf("record %d: no currency in file or -currency flag", i+1)
+		}
+
+		b := strings.ToUpper(firstNonEmpty(rec["base"], base))
+		if _, err := stmt.Exec(cur, at, formatUnits(price, priceDecimals), granularity, b); err != nil {
+			return 0, fmt.Errorf("record %d: %w", i+1, err)
+		}
+	}
+	return len(records), tx.Commit()
+}
+
+func readPriceCSV(r io.Reader) ([]map[string]string, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("empty price file")
+	}
+	header := rows[0]
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+	records := make([]map[string]string, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		rec := make(map[string]string, len(header))
+		for i, v := range row {
+			if i < len(header) {
+				rec[header[i]] = strings.TrimSpace(v)
+			}
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func readPriceJSON(r io.Reader) ([]map[string]string, error) {
+	var raw []map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	records := make([]map[string]string, 0, len(raw))
+	for _, obj := range raw {
+		rec := make(map[string]string, len(obj))
+		for k, v := range obj {
+			switch v := v.(type) {
+			case string:
+				rec[strings.ToLower(k)] = v
+			case float64:
+				rec[strings.ToLower(k)] = strconv.FormatFloat(v, 'f', -1, 64)
+			}
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func parsePriceTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, errors.New("missing timestamp")
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised timestamp %q", s)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// runPrices implements the prices command: "prices import FILE" loads quotes
+// and "prices at TIME" shows the quote a tx at TIME would be valued with.
+func runPrices(db *sql.DB, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: prices import|at ...")
+	}
+	sub, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("prices "+sub, flag.ExitOnError)
+	currency := fs.String("currency", "USD", "fiat currency of the quotes")
+	base := fs.String("base", "BTC", "unit quoted, such as BTC or LTC")
+	granularity := fs.String("granularity", granularityDaily, "daily or hourly")
+	format := fs.String("format", "", "csv or json (default from the file extension)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: prices %s [flags] ARG", sub)
+	}
+
+	switch sub {
+	case "import":
+		path := fs.Arg(0)
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		ff := *format
+		if ff == "" {
+			ff = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+		}
+		n, err := importPrices(db, f, ff, strings.ToUpper(*base), strings.ToUpper(*currency), *granularity)
+		if err != nil {
+			return err
+		}
+		logger.Info("imported prices", "file", path, "quotes", n)
+		return nil
+	case "at":
+		ts, err := parsePriceTime(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		table, err := loadPriceTable(db, strings.ToUpper(*currency))
+		if err != nil {
+			return err
+		}
+		p, err := table.at(strings.ToUpper(*base), ts)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s %s per %s (%s quote at %s)\n", formatUnits(p.Price, priceDecimals), table.Currency, strings.ToUpper(*base),
+			p.Granularity, p.At.Format(time.RFC3339))
+		return nil
+	default:
+		return fmt.Errorf("unknown prices command %q", sub)
+	}
+}
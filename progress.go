@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long finished syncs stay visible in the progress API.
+const finishedProgressTTL = 10 * time.Minute
+
+// SyncProgress is a point-in-time view of a running or recently finished sync.
+type SyncProgress struct {
+	SyncId      string     `json:"syncId"`
+	Address     string     `json:"address"`
+	Status      string     `json:"status"`
+	TotalPages  int        `json:"totalPages"`
+	PagesDone   int        `json:"pagesDone"`
+	PagesFailed int        `json:"pagesFailed"`
+	TotalTxs    int        `json:"totalTxs"`
+	TxsInserted int        `json:"txsInserted"`
+	TxsPerSec   float64    `json:"txsPerSec"`
+	EtaSeconds  float64    `json:"etaSeconds"`
+	StartedAt   time.Time  `json:"startedAt"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+}
+
+// progressHub tracks the progress of every sync in this process and fans
+// updates out to subscribers (SSE clients and the CLI progress bar).
+type progressHub struct {
+	mu    sync.Mutex
+	syncs map[string]*SyncProgress
+	subs  map[chan SyncProgress]struct{}
+	nowFn func() time.Time
+}
+
+var syncProgress = newProgressHub()
+
+func newProgressHub() *progressHub {
+	return &progressHub{
+		syncs: make(map[string]*SyncProgress),
+		subs:  make(map[chan SyncProgress]struct{}),
+		nowFn: time.Now,
+	}
+}
+
+// start registers a new sync and publishes its initial state.
+func (h *progressHub) start(syncId string, address string, totalPages int, totalTxs int) {
+	h.update(syncId, func(p *SyncProgress) {
+		p.Address = address
+		p.Status = "STARTED"
+		p.TotalPages = totalPages
+		p.TotalTxs = totalTxs
+		p.StartedAt = h.nowFn()
+	})
+}
+
+// pageDone records a successfully synced page and the txs it inserted.
+func (h *progressHub) pageDone(syncId string, inserted int) {
+	h.update(syncId, func(p *SyncProgress) {
+		p.PagesDone++
+		p.TxsInserted += inserted
+	})
+}
+
+// pageFailed records a page that failed after all retries.
+func (h *progressHub) pageFailed(syncId string) {
+	h.update(syncId, func(p *SyncProgress) {
+		p.PagesFailed++
+	})
+}
+
+// finish marks the sync as ended with the given status.
+func (h *progressHub) finish(syncId string, status string) {
+	h.update(syncId, func(p *SyncProgress) {
+		now := h.nowFn()
+		p.Status = status
+		p.FinishedAt = &now
+		p.EtaSeconds = 0
+	})
+}
+
+func (h *progressHub) update(syncId string, fn func(p *SyncProgress)) {
+	h.mu.Lock()
+	p, ok := h.syncs[syncId]
+	if !ok {
+		p = &SyncProgress{SyncId: syncId}
+		h.syncs[syncId] = p
+	}
+	fn(p)
+	h.recompute(p)
+	snapshot := *p
+	h.pruneLocked()
+
+	for ch := range h.subs {
+		// Slow subscribers miss intermediate updates rather than block the sync.
+		select {
+		case ch <- snapshot:
+		default:
+		}
+	}
+	h.mu.Unlock()
+}
+
+// recompute refreshes the rate and ETA from the page and tx counters.
+func (h *progressHub) recompute(p *SyncProgress) {
+	if p.FinishedAt != nil {
+		return
+	}
+	elapsed := h.nowFn().Sub(p.StartedAt).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	p.TxsPerSec = float64(p.TxsInserted) / elapsed
+
+	processed := p.PagesDone + p.PagesFailed
+	remaining := p.TotalPages - processed
+	if processed > 0 && remaining > 0 {
+		p.EtaSeconds = float64(remaining) / (float64(processed) / elapsed)
+	} else {
+		p.EtaSeconds = 0
+	}
+}
+
+func (h *progressHub) pruneLocked() {
+	cutoff := h.nowFn().Add(-finishedProgressTTL)
+	for id, p := range h.syncs {
+		if p.FinishedAt != nil && p.FinishedAt.Before(cutoff) {
+			delete(h.syncs, id)
+		}
+	}
+}
+
+// get returns the progress of a sync, if it is known to this process.
+func (h *progressHub) get(syncId string) (SyncProgress, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.syncs[syncId]
+	if !ok {
+		return SyncProgress{}, false
+	}
+	return *p, true
+}
+
+// list returns all known syncs, most recently started first.
+func (h *progressHub) list() []SyncProgress {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pruneLocked()
+	out := make([]SyncProgress, 0, len(h.syncs))
+	for _, p := range h.syncs {
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.After(out[j].StartedAt) })
+	return out
+}
+
+// subscribe returns a channel of progress updates. Call the returned func to
+// unsubscribe.
+func (h *progressHub) subscribe() (<-chan SyncProgress, func()) {
+	ch := make(chan SyncProgress, 64)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+// handleProgressList serves GET /api/progress, optionally filtered by address.
+func handleProgressList(w http.ResponseWriter, r *http.Request) {
+	address := r.URL.Query().Get("address")
+	all := syncProgress.list()
+	out := make([]SyncProgress, 0, len(all))
+	for _, p := range all {
+		if address == "" || p.Address == address {
+			out = append(out, p)
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleProgressGet serves GET /api/progress/{syncId}.
+func handleProgressGet(w http.ResponseWriter, r *http.Request) {
+	p, ok := syncProgress.get(r.PathValue("syncId"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no progress for sync")
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// handleProgressEvents streams progress updates as server-sent events. The
+// current state of every matching sync is sent first, then each update.
+// ?sync_id= and ?address= narrow the stream.
+func handleProgressEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	syncId := r.URL.Query().Get("sync_id")
+	address := r.URL.Query().Get("address")
+	matches := func(p SyncProgress) bool {
+		return (syncId == "" || p.SyncId == syncId) && (address == "" || p.Address == address)
+	}
+
+	updates, unsubscribe := syncProgress.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, p := range syncProgress.list() {
+		if matches(p) {
+			writeProgressEvent(w, p)
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case p := <-updates:
+			if !matches(p) {
+				continue
+			}
+			writeProgressEvent(w, p)
+			flusher.Flush()
+		}
+	}
+}
+
+func writeProgressEvent(w io.Writer, p SyncProgress) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: progress\nid: %s\ndata: %s\n\n", p.SyncId, data)
+}
+
+// runProgressBar draws a single-line progress bar for each update until done
+// is closed.
+func runProgressBar(w io.Writer, done <-chan struct{}) {
+	updates, unsubscribe := syncProgress.subscribe()
+	defer unsubscribe()
+	for {
+		select {
+		case <-done:
+			fmt.Fprintln(w)
+			return
+		case p := <-updates:
+			fmt.Fprint(w, "\r"+renderProgressBar(p, 30))
+		}
+	}
+}
+
+func renderProgressBar(p SyncProgress, width int) string {
+	processed := p.PagesDone + p.PagesFailed
+	filled := 0
+	if p.TotalPages > 0 {
+		filled = processed * width / p.TotalPages
+	}
+	if filled > width {
+		filled = width
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	eta := (time.Duration(p.EtaSeconds) * time.Second).String()
+	return fmt.Sprintf("[%s] %d/%d pages (%d failed) %d txs %.1f tx/s eta %s ",
+		bar, processed, p.TotalPages, p.PagesFailed, p.TxsInserted, p.TxsPerSec, eta)
+}
+
+// isTerminal reports whether f is attached to a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
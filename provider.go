@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Provider is a source of chain data for one chain. Besides these
+// methods a provider pages through an address's confirmed txs as an
+// offsetPager or a cursorPager.
+type Provider interface {
+	Name() string
+	// CountTxs returns the number of confirmed txs of address.
+	CountTxs(address string) (int, error)
+	// PendingTxs returns the address's txs in the mempool.
+	PendingTxs(address string) ([]Item, error)
+	// Tx returns a tx by id, or errProviderNotFound.
+	Tx(txId string) (Item, error)
+	ChainTip() (ChainTip, error)
+	// BlockHash returns the hash of the block at height in the best chain.
+	BlockHash(height int) (string, error)
+}
+
+// AccountProvider is a source of chain data for one account chain. There
+// is no mempool to follow and no total to plan against: txs are walked
+// newest first a page at a time, as with a cursorPager, until the last page
+// or until they are all stored.
+type AccountProvider interface {
+	Name() string
+	// AccountTxsAfter returns a page of the address's confirmed txs, newest
+	// first, and the cursor of the next page, or "" after the last; the
+	// first page is fetched with "".
+	AccountTxsAfter(address string, cursor string) ([]EVMTx, string, error)
+	ChainTip() (ChainTip, error)
+	BlockHash(height int) (string, error)
+}
+
+// tipSource is the part of a provider that chain tips and reorg checks
+// need, which both kinds of provider have.
+type tipSource interface {
+	ChainTip() (ChainTip, error)
+	BlockHash(height int) (string, error)
+}
+
+// offsetPager fetches pages of confirmed txs, newest first, by offset, so
+// pages can be fetched in parallel.
+type offsetPager interface {
+	TxsAt(address string, offset int, limit int) ([]Item, error)
+}
+
+// cursorPager fetches confirmed txs, newest first, a page at a time. Each
+// page returns the cursor of the next, or "" after the last; the first page
+// is fetched with "".
+type cursorPager interface {
+	PageSize() int
+	TxsAfter(address string, cursor string) ([]Item, string, error)
+}
+
+// metered is implemented by providers that charge credits per request.
+type metered interface {
+	creditsPerRequest() int
+}
+
+// notifier is implemented by providers that push new activity on an
+// address, so it is synced without waiting for the next manual sync.
+type notifier interface {
+	Subscribe(address string, notify func(address string)) error
+}
+
+var errNotifyUnsupported = errors.New("the provider does not push address activity")
+
+var errProviderNotFound = errors.New("not found by the provider")
+
+// Provider names accepted by -provider and -chain-provider.
+const (
+	providerFake       = "fake"
+	providerCryptoapis = "cryptoapis"
+	providerEsplora    = "esplora"
+	providerCore       = "core"
+	providerElectrum   = "electrum"
+	providerEtherscan  = "etherscan"
+)
+
+// provider is the provider syncs use; main sets it from -provider.
+var provider Provider = defaultProvider()
+
+func defaultProvider() Provider {
+	if testing {
+		return fakeProvider{}
+	}
+	return newCryptoapisProvider(chainBitcoin)
+}
+
+// providerConfig is how main configures the provider.
+type providerConfig struct {
+	Name       string
+	EsploraURL string
+	Core       coreConfig
+	Electrum   electrumConfig
+}
+
+// newProvider builds the named provider. A comma-separated list of names
+// builds a failoverProvider over them, in priority order.
+func newProvider(c providerConfig) (Provider, error) {
+	if names := strings.Split(c.Name, ","); len(names) > 1 {
+		backends := make([]Provider, 0, len(names))
+		for _, name := range names {
+			bc := c
+			bc.Name = strings.TrimSpace(name)
+			if bc.Name == "" {
+				return nil, fmt.Errorf("empty provider name in %q", c.Name)
+			}
+			p, err := newProvider(bc)
+			if err != nil {
+				return nil, err
+			}
+			backends = append(backends, p)
+		}
+		return newFailoverProvider(backends), nil
+	}
+
+	switch c.Name {
+	case "":
+		return defaultProvider(), nil
+	case providerFake:
+		return fakeProvider{}, nil
+	case providerCryptoapis:
+		return newCryptoapisProvider(chainBitcoin), nil
+	case providerEsplora:
+		return newEsploraProvider(c.EsploraURL), nil
+	case providerCore:
+		return newCoreProvider(c.Core), nil
+	case providerElectrum:
+		return newElectrumProvider(c.Electrum)
+	default:
+		return nil, fmt.Errorf("unknown provider %q; use %s", c.Name,
+			strings.Join([]string{providerFake, providerCryptoapis, providerEsplora, providerCore, providerElectrum}, ", "))
+	}
+}
+
+// fakeProvider serves copies of one real tx under fresh ids, with simulated
+// latency, so syncs can be exercised without an API key.
+type fakeProvider struct{}
+
+func (fakeProvider) Name() string { return providerFake }
+
+func (fakeProvider) CountTxs(address string) (int, error) { return testTotalNumTxs, nil }
+
+func (fakeProvider) TxsAt(address string, offset int, limit int) ([]Item, error) {
+	// Simulate a request that takes between 0.5 and 2 seconds
+	max := 2000
+	min := 500
+	reqTimeInMs := rand.Intn(max-min) + min
+	requested := time.Now()
+	time.Sleep(time.Duration(reqTimeInMs) * time.Millisecond)
+	observeProviderRequest("transactions", http.StatusOK, requested)
+
+	items, err := generateFakeItems(offset/limit, limit, testTotalNumTxs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate fake items: %w", err)
+	}
+	return items, nil
+}
+
+// PendingTxs returns one pending tx per address that never gets mined.
+func (fakeProvider) PendingTxs(address string) ([]Item, error) {
+	item, err := fakeTx()
+	if err != nil {
+		return nil, err
+	}
+	item.TransactionId = uuid.NewSHA1(uuid.NameSpaceOID, []byte("pending:"+address)).String()
+	item.MinedInBlockHash, item.MinedInBlockHeight = "", 0
+	item.Timestamp = time.Now().Unix()
+	return []Item{item}, nil
+}
+
+func (fakeProvider) Tx(txId string) (Item, error) {
+	item, err := fakeTx()
+	item.TransactionId = txId
+	return item, err
+}
+
+func (fakeProvider) ChainTip() (ChainTip, error) {
+	return ChainTip{Height: fakeTipHeight, Hash: fakeHashAt(fakeTipHeight), UpdatedAt: time.Now().UTC()}, nil
+}
+
+func (fakeProvider) BlockHash(height int) (string, error) { return fakeHashAt(height), nil }
+
+func fakeTx() (Item, error) {
+	var item Item
+	if err := json.Unmarshal([]byte(fakeItem), &item); err != nil {
+		return item, errors.New("failed to unmarshal JSON")
+	}
+	return item, nil
+}
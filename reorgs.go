@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Tx statuses. A tx whose block is orphaned by a reorg keeps its row, so it
+// can be restored if it is mined again, but no longer counts.
+const (
+	txConfirmed = "CONFIRMED"
+	txOrphaned  = "ORPHANED"
+)
+
+// reorgDepth is how many blocks below the tip are re-verified on each sync.
+// Deeper blocks are treated as final; no reorg has come close to it.
+const reorgDepth = 100
+
+// Reorg is a stored block found to be no longer in the best chain.
+type Reorg struct {
+	Id           int       `json:"id"`
+	Chain        string    `json:"chain"`
+	Height       int       `json:"height"`
+	OrphanedHash string    `json:"orphanedHash"`
+	NewHash      string    `json:"newHash"`
+	TxsOrphaned  int       `json:"txsOrphaned"`
+	DetectedAt   time.Time `json:"detectedAt"`
+}
+
+// checkReorgs updates the tip of chain c and re-verifies the blocks of the
+// address's txs within reorgDepth of it. Txs in blocks that are no longer in
+// the best chain, for any address on c, are marked orphaned. It returns the
+// reorgs found.
+func checkReorgs(db *sql.DB, c *Chain, p tipSource, log *slog.Logger, address string) ([]Reorg, error) {
+	tip, err := updateChainTip(db, c, p)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT DISTINCT (raw->>'minedInBlockHeight')::int, raw->>'minedInBlockHash' FROM txs
+		WHERE address = $1 AND status = $2 AND (raw->>'minedInBlockHeight')::int > $3`,
+		address, txConfirmed, tip.Height-reorgDepth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load recent blocks: %w", err)
+	}
+	var blocks []minedBlock
+	for rows.Next() {
+		var b minedBlock
+		if err := rows.Scan(&b.height, &b.hash); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	found, err := findOrphaned(p, blocks)
+	if err != nil {
+		return nil, err
+	}
+	reorgs := []Reorg{}
+	for _, f := range found {
+		reorg, err := orphanBlock(db, c, f.Height, f.OrphanedHash, f.NewHash)
+		if err != nil {
+			return reorgs, err
+		}
+		orphanedBlocks.Inc()
+		log.Warn("block orphaned by a reorg",
+			"height", reorg.Height,
+			"orphaned_hash", reorg.OrphanedHash,
+			"new_hash", reorg.NewHash,
+			"txs_orphaned", reorg.TxsOrphaned,
+		)
+		reorgs = append(reorgs, reorg)
+	}
+	log.Debug("verified recent blocks", "tip", tip.Height, "blocks", len(blocks), "reorgs", len(reorgs))
+	return reorgs, nil
+}
+
+// minedBlock is a block stored txs were mined in.
+type minedBlock struct {
+	height int
+	hash   string
+}
+
+// findOrphaned asks p for the hash at each block's height and returns the
+// blocks whose hash changed, with the hash that replaced them.
+func findOrphaned(p tipSource, blocks []minedBlock) ([]Reorg, error) {
+	var found []Reorg
+	for _, b := range blocks {
+		hash, err := p.BlockHash(b.height)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get block %d: %w", b.height, err)
+		}
+		if hash != b.hash {
+			found = append(found, Reorg{Height: b.height, OrphanedHash: b.hash, NewHash: hash})
+		}
+	}
+	return found, nil
+}
+
+// orphanBlock marks every tx stored from the block of chain c orphaned and
+// records the reorg.
+func orphanBlock(db *sql.DB, c *Chain, height int, orphanedHash string, newHash string) (Reorg, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Reorg{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE txs SET status = $1 WHERE raw->>'minedInBlockHash' = $2 AND status = $3 AND chain = $4 AND network = $5`,
+		txOrphaned, orphanedHash, txConfirmed, c.Name, c.Network)
+	if err != nil {
+		return Reorg{}, fmt.Errorf("failed to orphan txs: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Reorg{}, err
+	}
+
+	r := Reorg{Chain: c.Key(), Height: height, OrphanedHash: orphanedHash, NewHash: newHash, TxsOrphaned: int(n), DetectedAt: time.Now().UTC()}
+	err = tx.QueryRow(`
+		INSERT INTO reorgs (chain, height, orphaned_hash, new_hash, txs_orphaned, detected_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		r.Chain, r.Height, r.OrphanedHash, r.NewHash, r.TxsOrphaned, r.DetectedAt).Scan(&r.Id)
+	if err != nil {
+		return Reorg{}, fmt.Errorf("failed to record reorg: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return Reorg{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return r, nil
+}
+
+// listReorgs returns the recorded reorgs of chain c, newest first.
+func listReorgs(db *sql.DB, c *Chain, limit int, offset int) ([]Reorg, error) {
+	rows, err := db.Query(`
+		SELECT id, chain, height, orphaned_hash, new_hash, txs_orphaned, detected_at FROM reorgs
+		WHERE chain = $1 ORDER BY detected_at DESC, id DESC LIMIT $2 OFFSET $3`, c.Key(), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reorgs := []Reorg{}
+	for rows.Next() {
+		var r Reorg
+		if err := rows.Scan(&r.Id, &r.Chain, &r.Height, &r.OrphanedHash, &r.NewHash, &r.TxsOrphaned, &r.DetectedAt); err != nil {
+			return nil, err
+		}
+		reorgs = append(reorgs, r)
+	}
+	return reorgs, rows.Err()
+}
+
+// handleListReorgs serves GET /api/reorgs, newest first, paged with ?limit=
+// and ?offset=, along with the current chain tip. ?chain= picks the chain by
+// key and defaults to Bitcoin.
+func (s *apiServer) handleListReorgs(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := pagingParams(w, r)
+	if !ok {
+		return
+	}
+	c := chainBitcoin
+	if key := r.URL.Query().Get("chain"); key != "" {
+		var err error
+		if c, err = chainByKey(key); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	reorgs, err := listReorgs(s.db, c, limit, offset)
+	if err != nil {
+		s.internalError(w, "failed to list reorgs", err)
+		return
+	}
+	tip, err := loadChainTip(s.db, c)
+	if err != nil {
+		s.internalError(w, "failed to load chain tip", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tip":    tip,
+		"reorgs": reorgs,
+	})
+}
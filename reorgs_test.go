@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	tt "testing"
+)
+
+// hashesAt is a chain whose blocks have the given hashes by height.
+type hashesAt map[int]string
+
+func (h hashesAt) ChainTip() (ChainTip, error) { return ChainTip{}, nil }
+
+func (h hashesAt) BlockHash(height int) (string, error) {
+	hash, ok := h[height]
+	if !ok {
+		return "", errors.New("no such block")
+	}
+	return hash, nil
+}
+
+func TestFindOrphaned(t *tt.T) {
+	chain := hashesAt{100: "a", 101: "b2", 102: "c2"}
+	blocks := []minedBlock{{100, "a"}, {101, "b"}, {102, "c"}}
+	found, err := findOrphaned(chain, blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Reorg{{Height: 101, OrphanedHash: "b", NewHash: "b2"}, {Height: 102, OrphanedHash: "c", NewHash: "c2"}}
+	if !reflect.DeepEqual(found, want) {
+		t.Errorf("findOrphaned = %+v, want %+v", found, want)
+	}
+
+	if found, err := findOrphaned(chain, blocks[:1]); err != nil || len(found) != 0 {
+		t.Errorf("findOrphaned of a block still in the chain = %+v, %v", found, err)
+	}
+	if _, err := findOrphaned(chain, []minedBlock{{103, "d"}}); err == nil {
+		t.Error("findOrphaned ignored a failed block lookup")
+	}
+}
+
+func TestConfirmations(t *tt.T) {
+	tip := ChainTip{Height: 840010}
+	tests := map[int]int{840010: 1, 840001: 10, 0: 0, -1: 0, 840011: 0}
+	for height, want := range tests {
+		if got := tip.confirmations(height); got != want {
+			t.Errorf("confirmations(%d) = %d, want %d", height, got, want)
+		}
+	}
+	if got := (ChainTip{}).confirmations(840001); got != 0 {
+		t.Errorf("confirmations with no tip = %d, want 0", got)
+	}
+}
+
+func TestUnspentInAfterReorg(t *tt.T) {
+	const address = "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+	pays := func(value string) Vout {
+		return Vout{Value: value, ScriptPubKey: ScriptPubKey{Addresses: []string{address}}}
+	}
+	other := Vout{Value: "0.5", ScriptPubKey: ScriptPubKey{Addresses: []string{"1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"}}}
+	funding := Item{TransactionId: "f", MinedInBlockHeight: 840001,
+		BlockchainSpecific: BlockchainSpecific{Vout: []Vout{pays("0.1"), other, pays("0.2")}}}
+	spend := Item{TransactionId: "s", MinedInBlockHeight: 840005,
+		BlockchainSpecific: BlockchainSpecific{Vin: []Vin{{Txid: "f", Vout: 0}}, Vout: []Vout{other, pays("0.05")}}}
+	tip := ChainTip{Height: 840010}
+
+	got, err := unspentIn([]Item{spend, funding}, address, chainBitcoin, tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []UTXO{{TxId: "f", Vout: 2, Value: 20000000, BlockHeight: 840001, Confirmations: 10},
+		{TxId: "s", Vout: 1, Value: 5000000, BlockHeight: 840005, Confirmations: 6}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unspentIn = %+v, want %+v", got, want)
+	}
+
+	// Once the spend is orphaned, and so no longer loaded, the output it
+	// spent is unspent again.
+	got, err = unspentIn([]Item{funding}, address, chainBitcoin, tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []UTXO{{TxId: "f", Vout: 0, Value: 10000000, BlockHeight: 840001, Confirmations: 10},
+		{TxId: "f", Vout: 2, Value: 20000000, BlockHeight: 840001, Confirmations: 10}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unspentIn without the orphaned spend = %+v, want %+v", got, want)
+	}
+}
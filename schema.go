@@ -0,0 +1,178 @@
+package main
+
+// createTablesSQL creates the schema, and migrates older databases forward
+// with ADD COLUMN IF NOT EXISTS. It runs on every start.
+const createTablesSQL = `
+    CREATE TABLE IF NOT EXISTS addresses (
+        id SERIAL PRIMARY KEY,
+        address TEXT UNIQUE NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+    );
+
+	ALTER TABLE addresses ADD COLUMN IF NOT EXISTS address_type text;
+	ALTER TABLE addresses ADD COLUMN IF NOT EXISTS network text;
+	ALTER TABLE addresses ADD COLUMN IF NOT EXISTS chain text;
+
+	CREATE TABLE IF NOT EXISTS syncs (
+		id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+		address text,
+		status text,
+		txs_synced integer,
+		total_sync_txs integer,
+		total_txs integer,
+		created_at timestamp with time zone,
+		finished_at timestamp with time zone
+	);
+
+	ALTER TABLE syncs ADD COLUMN IF NOT EXISTS api_requests integer DEFAULT 0;
+	ALTER TABLE syncs ADD COLUMN IF NOT EXISTS credits_used integer DEFAULT 0;
+	ALTER TABLE syncs ADD COLUMN IF NOT EXISTS chain text NOT NULL DEFAULT 'bitcoin';
+	ALTER TABLE syncs ADD COLUMN IF NOT EXISTS network text NOT NULL DEFAULT 'mainnet';
+
+	CREATE TABLE IF NOT EXISTS sync_errors (
+		id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+		sync_id text,
+		page integer,
+		error text
+	);
+
+	CREATE TABLE IF NOT EXISTS txs (
+		id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+		address text,
+		tx_id text,
+		raw jsonb,
+		page integer,
+		created_at timestamp with time zone,
+		sync_id text
+	);
+
+	-- A tx involving several tracked addresses is stored once per address.
+	ALTER TABLE txs DROP CONSTRAINT IF EXISTS txs_tx_id_key;
+	CREATE UNIQUE INDEX IF NOT EXISTS txs_address_tx_id_key ON txs (address, tx_id);
+
+	-- CONFIRMED, or ORPHANED once the tx's block has left the best chain.
+	-- Mempool txs are PENDING, and DROPPED if they leave it unmined.
+	ALTER TABLE txs ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'CONFIRMED';
+
+	-- Everything stored before other chains were supported is Bitcoin mainnet.
+	ALTER TABLE txs ADD COLUMN IF NOT EXISTS chain text NOT NULL DEFAULT 'bitcoin';
+	ALTER TABLE txs ADD COLUMN IF NOT EXISTS network text NOT NULL DEFAULT 'mainnet';
+
+	-- raw holds an Item on UTXO chains and an EVMTx on account chains.
+	ALTER TABLE txs ADD COLUMN IF NOT EXISTS model text NOT NULL DEFAULT 'utxo';
+
+	CREATE INDEX IF NOT EXISTS txs_sync_id_idx ON txs (sync_id);
+	CREATE INDEX IF NOT EXISTS syncs_address_idx ON syncs (address, created_at);
+
+	CREATE TABLE IF NOT EXISTS prices (
+		base text NOT NULL,
+		currency text NOT NULL,
+		at timestamp with time zone NOT NULL,
+		price numeric NOT NULL,
+		granularity text NOT NULL,
+		PRIMARY KEY (base, currency, at)
+	);
+
+	CREATE TABLE IF NOT EXISTS lot_selections (
+		id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+		disposal_tx_id text NOT NULL,
+		lot_tx_id text NOT NULL,
+		lot_address text NOT NULL DEFAULT '',
+		amount bigint NOT NULL,
+		created_at timestamp with time zone
+	);
+	-- amount is in unit's base units, as views are.
+	ALTER TABLE lot_selections ADD COLUMN IF NOT EXISTS unit text NOT NULL DEFAULT 'BTC';
+
+	CREATE TABLE IF NOT EXISTS wallets (
+		id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+		name text NOT NULL,
+		owner text NOT NULL DEFAULT '',
+		created_at timestamp with time zone,
+		UNIQUE (owner, name)
+	);
+
+	CREATE TABLE IF NOT EXISTS wallet_addresses (
+		wallet_id integer NOT NULL REFERENCES wallets (id) ON DELETE CASCADE,
+		address text NOT NULL,
+		created_at timestamp with time zone,
+		PRIMARY KEY (wallet_id, address)
+	);
+
+	-- Wallets imported from an extended public key or output descriptor, and
+	-- the derivation path of each discovered address: derivation_chain is
+	-- the BIP 32 chain, 0 for receive and 1 for change, not a blockchain.
+	ALTER TABLE wallets ADD COLUMN IF NOT EXISTS xpub text NOT NULL DEFAULT '';
+	ALTER TABLE wallets ADD COLUMN IF NOT EXISTS descriptor text NOT NULL DEFAULT '';
+	ALTER TABLE wallets ADD COLUMN IF NOT EXISTS script_type text NOT NULL DEFAULT '';
+	ALTER TABLE wallets ADD COLUMN IF NOT EXISTS gap_limit integer NOT NULL DEFAULT 0;
+	ALTER TABLE wallet_addresses ADD COLUMN IF NOT EXISTS derivation_chain integer;
+	ALTER TABLE wallet_addresses ADD COLUMN IF NOT EXISTS child_index integer;
+
+	CREATE TABLE IF NOT EXISTS tx_payloads (
+		tx_hash text NOT NULL,
+		kind text NOT NULL,
+		idx integer NOT NULL,
+		protocol text NOT NULL DEFAULT '',
+		content_type text NOT NULL DEFAULT '',
+		size integer NOT NULL,
+		hex text NOT NULL,
+		text text,
+		PRIMARY KEY (tx_hash, kind, idx)
+	);
+	CREATE INDEX IF NOT EXISTS tx_payloads_protocol_idx ON tx_payloads (protocol);
+
+	-- chain_tip and reorgs are keyed by chain key: the chain's name on
+	-- mainnet, else name-network, e.g. bitcoin-testnet.
+	CREATE TABLE IF NOT EXISTS chain_tip (
+		chain text PRIMARY KEY,
+		height integer NOT NULL,
+		hash text NOT NULL,
+		updated_at timestamp with time zone
+	);
+
+	CREATE TABLE IF NOT EXISTS reorgs (
+		id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+		height integer NOT NULL,
+		orphaned_hash text NOT NULL,
+		new_hash text NOT NULL,
+		txs_orphaned integer NOT NULL,
+		detected_at timestamp with time zone
+	);
+	ALTER TABLE reorgs ADD COLUMN IF NOT EXISTS chain text NOT NULL DEFAULT 'bitcoin';
+
+	-- Fields on which the verification provider disagreed with the provider.
+	CREATE TABLE IF NOT EXISTS provider_discrepancies (
+		id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+		sync_id text NOT NULL,
+		address text NOT NULL,
+		tx_id text NOT NULL DEFAULT '',
+		field text NOT NULL,
+		provider text NOT NULL,
+		value text NOT NULL,
+		verifier text NOT NULL,
+		verified_value text NOT NULL,
+		detected_at timestamp with time zone
+	);
+	CREATE INDEX IF NOT EXISTS provider_discrepancies_address_idx ON provider_discrepancies (address, detected_at);
+
+	-- Off-chain activity of accounts that are not addresses, such as
+	-- Lightning nodes. tx_id is the on-chain tx an entry moved funds with.
+	CREATE TABLE IF NOT EXISTS ledger_entries (
+		id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+		source text NOT NULL,
+		account text NOT NULL,
+		entry_id text NOT NULL,
+		kind text NOT NULL,
+		unit text NOT NULL,
+		amount bigint NOT NULL,
+		fee bigint NOT NULL DEFAULT 0,
+		tx_id text NOT NULL DEFAULT '',
+		occurred_at timestamp with time zone NOT NULL,
+		description text NOT NULL DEFAULT '',
+		raw jsonb,
+		created_at timestamp with time zone,
+		UNIQUE (account, entry_id)
+	);
+	CREATE INDEX IF NOT EXISTS ledger_entries_tx_id_idx ON ledger_entries (tx_id);
+	`
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// Script types without an address of their own.
+const (
+	scriptP2PK           = "p2pk"
+	scriptMultisig       = "multisig"
+	scriptNullData       = "nulldata"
+	scriptWitnessUnknown = "witness_unknown"
+	scriptNonStandard    = "nonstandard"
+)
+
+var scriptClassTypes = map[txscript.ScriptClass]string{
+	txscript.PubKeyHashTy:          scriptP2PKH,
+	txscript.ScriptHashTy:          scriptP2SH,
+	txscript.WitnessV0PubKeyHashTy: scriptP2WPKH,
+	txscript.WitnessV0ScriptHashTy: scriptP2WSH,
+	txscript.WitnessV1TaprootTy:    scriptP2TR,
+	txscript.PubKeyTy:              scriptP2PK,
+	txscript.MultiSigTy:            scriptMultisig,
+	txscript.NullDataTy:            scriptNullData,
+	txscript.WitnessUnknownTy:      scriptWitnessUnknown,
+	txscript.NonStandardTy:         scriptNonStandard,
+}
+
+// providerScriptTypes maps the provider's (bitcoind style) type names to
+// ours.
+var providerScriptTypes = map[string]string{
+	"pubkeyhash":            scriptP2PKH,
+	"scripthash":            scriptP2SH,
+	"witness_v0_keyhash":    scriptP2WPKH,
+	"witness_v0_scripthash": scriptP2WSH,
+	"witness_v1_taproot":    scriptP2TR,
+	"pubkey":                scriptP2PK,
+	"multisig":              scriptMultisig,
+	"nulldata":              scriptNullData,
+	"witness_unknown":       scriptWitnessUnknown,
+	"nonstandard":           scriptNonStandard,
+}
+
+// DecodedScript is our own reading of an output script.
+type DecodedScript struct {
+	Asm       string   `json:"asm"`
+	Type      string   `json:"type"`
+	Addresses []string `json:"addresses,omitempty"`
+	ReqSigs   int      `json:"reqSigs,omitempty"`
+}
+
+// decodeScript parses a hex output script into opcodes, classifies it and
+// derives its address on chain c.
+func decodeScript(c *Chain, scriptHex string) (DecodedScript, error) {
+	script, err := hex.DecodeString(scriptHex)
+	if err != nil {
+		return DecodedScript{}, fmt.Errorf("invalid script hex: %w", err)
+	}
+	asm, err := txscript.DisasmString(script)
+	if err != nil {
+		return DecodedScript{Asm: asm, Type: scriptNonStandard}, fmt.Errorf("failed to parse script: %w", err)
+	}
+	class, addrs, reqSigs, err := txscript.ExtractPkScriptAddrs(script, c.params)
+	if err != nil {
+		return DecodedScript{Asm: asm, Type: scriptNonStandard}, nil
+	}
+
+	d := DecodedScript{Asm: asm, Type: scriptClassTypes[class], ReqSigs: reqSigs}
+	// A bare multisig or pubkey script pays to keys, not to an address.
+	if class != txscript.MultiSigTy && class != txscript.PubKeyTy {
+		for _, a := range addrs {
+			d.Addresses = append(d.Addresses, c.encodeAddress(a))
+		}
+	}
+	return d, nil
+}
+
+// OutputScript is the decoding of one output and how the provider's data
+// differs from it.
+type OutputScript struct {
+	Vout int `json:"vout"`
+	DecodedScript
+	Mismatches []string `json:"mismatches,omitempty"`
+}
+
+// InputScript is what the scriptSig and witness of one input reveal about
+// the output it spends. Address is empty when the spend does not commit to
+// it, e.g. a taproot key path spend.
+type InputScript struct {
+	Vin        int      `json:"vin"`
+	Asm        string   `json:"asm"`
+	Type       string   `json:"type,omitempty"`
+	Address    string   `json:"address,omitempty"`
+	Mismatches []string `json:"mismatches,omitempty"`
+}
+
+// ScriptReport checks the provider's script data for a tx against our own
+// decoding.
+type ScriptReport struct {
+	Outputs    []OutputScript `json:"outputs"`
+	Inputs     []InputScript  `json:"inputs"`
+	Mismatches int            `json:"mismatches"`
+}
+
+// verifyScripts decodes every output and input script of item, a tx on
+// chain c, and flags where the provider's type, asm or addresses disagree.
+func verifyScripts(c *Chain, item Item) ScriptReport {
+	r := ScriptReport{Outputs: []OutputScript{}, Inputs: []InputScript{}}
+
+	for i, vout := range item.BlockchainSpecific.Vout {
+		spk := vout.ScriptPubKey
+		out := OutputScript{Vout: i}
+		d, err := decodeScript(c, spk.Hex)
+		out.DecodedScript = d
+		if err != nil {
+			out.Mismatches = append(out.Mismatches, err.Error())
+		} else {
+			if t, ok := providerScriptTypes[spk.Type]; !ok || t != d.Type {
+				out.Mismatches = append(out.Mismatches, fmt.Sprintf("type is %s, provider says %q", d.Type, spk.Type))
+			}
+			if spk.Asm != "" && spk.Asm != d.Asm {
+				out.Mismatches = append(out.Mismatches, "asm differs from the script hex")
+			}
+			if !sameAddresses(d.Addresses, spk.Addresses) {
+				out.Mismatches = append(out.Mismatches, fmt.Sprintf("script pays %s, provider says %s",
+					strings.Join(d.Addresses, ","), strings.Join(spk.Addresses, ",")))
+			}
+		}
+		r.Mismatches += len(out.Mismatches)
+		r.Outputs = append(r.Outputs, out)
+	}
+
+	for i, vin := range item.BlockchainSpecific.Vin {
+		in := inspectInput(c, vin)
+		in.Vin = i
+		if t, ok := providerScriptTypes[vin.ScriptSig.Type]; ok && in.Type != "" && t != in.Type {
+			in.Mismatches = append(in.Mismatches, fmt.Sprintf("spends %s, provider says %q", in.Type, vin.ScriptSig.Type))
+		}
+		if in.Address != "" && len(vin.Addresses) > 0 && !sameAddresses([]string{in.Address}, vin.Addresses) {
+			in.Mismatches = append(in.Mismatches, fmt.Sprintf("spends from %s, provider says %s",
+				in.Address, strings.Join(vin.Addresses, ",")))
+		}
+		r.Mismatches += len(in.Mismatches)
+		r.Inputs = append(r.Inputs, in)
+	}
+	return r
+}
+
+// inspectInput infers the type and address of the output an input spends
+// from the shape of its scriptSig and witness.
+func inspectInput(c *Chain, vin Vin) InputScript {
+	var in InputScript
+	sig, err := hex.DecodeString(vin.ScriptSig.Hex)
+	if err != nil {
+		in.Mismatches = append(in.Mismatches, fmt.Sprintf("invalid scriptSig hex: %v", err))
+		return in
+	}
+	witness := make([][]byte, 0, len(vin.Txinwitness))
+	for _, w := range vin.Txinwitness {
+		b, err := hex.DecodeString(w)
+		if err != nil {
+			in.Mismatches = append(in.Mismatches, fmt.Sprintf("invalid witness hex: %v", err))
+			return in
+		}
+		witness = append(witness, b)
+	}
+	in.Asm, _ = txscript.DisasmString(sig)
+	pushes, err := txscript.PushedData(sig)
+	if err != nil {
+		return in
+	}
+
+	var addr btcutil.Address
+	switch {
+	case len(sig) == 0 && len(witness) == 2 && len(witness[1]) == 33:
+		in.Type = scriptP2WPKH
+		addr, err = btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(witness[1]), c.params)
+	case len(sig) == 0 && len(witness) == 1 && (len(witness[0]) == 64 || len(witness[0]) == 65):
+		in.Type = scriptP2TR
+	case len(sig) == 0 && len(witness) >= 2:
+		// Either a P2WSH spend, whose last item is the witness script, or
+		// a taproot script path spend, whose last item is the control block.
+		last := witness[len(witness)-1]
+		if len(last) >= 33 && (len(last)-33)%32 == 0 && last[0]&0xfe == 0xc0 {
+			in.Type = scriptP2TR
+			break
+		}
+		in.Type = scriptP2WSH
+		h := sha256.Sum256(last)
+		addr, err = btcutil.NewAddressWitnessScriptHash(h[:], c.params)
+	case len(pushes) == 1 && len(witness) > 0:
+		// Nested segwit: the scriptSig pushes the witness program.
+		in.Type = scriptP2SH
+		addr, err = btcutil.NewAddressScriptHash(pushes[0], c.params)
+	case len(pushes) == 2 && len(witness) == 0 && (len(pushes[1]) == 33 || len(pushes[1]) == 65):
+		in.Type = scriptP2PKH
+		addr, err = btcutil.NewAddressPubKeyHash(btcutil.Hash160(pushes[1]), c.params)
+	case len(pushes) >= 2 && len(witness) == 0:
+		in.Type = scriptP2SH
+		addr, err = btcutil.NewAddressScriptHash(pushes[len(pushes)-1], c.params)
+	}
+	if err == nil && addr != nil {
+		in.Address = c.encodeAddress(addr)
+	}
+	return in
+}
+
+func sameAddresses(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := map[string]int{}
+	for _, s := range a {
+		seen[s]++
+	}
+	for _, s := range b {
+		seen[s]--
+	}
+	for _, n := range seen {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	tt "testing"
+)
+
+// The public key of the secp256k1 generator point, and what pays to it.
+const (
+	testPubKey       = "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	testP2WPKHScript = "0014751e76e8199196d454941c45d1b3a323f1433bd6"
+	testP2WPKH       = "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+)
+
+func TestDecodeScript(t *tt.T) {
+	tests := []struct {
+		name      string
+		hex       string
+		typ       string
+		addresses []string
+		reqSigs   int
+	}{
+		{"p2pkh", "76a914751e76e8199196d454941c45d1b3a323f1433bd688ac", scriptP2PKH, []string{"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"}, 1},
+		{"p2sh", "a914b472a266d0bd89c13706a4132ccfb16f7c3b9fcb87", scriptP2SH, []string{"3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy"}, 1},
+		{"p2wpkh", testP2WPKHScript, scriptP2WPKH, []string{testP2WPKH}, 1},
+		{"p2wsh", "00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262", scriptP2WSH,
+			[]string{"bc1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3qccfmv3"}, 1},
+		{"p2tr", "5120a60869f0dbcf1dc659c9cecbaf8050135ea9e8cdc487053f1dc6880949dc684c", scriptP2TR,
+			[]string{"bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr"}, 1},
+		// Bare pubkey and multisig scripts pay to keys, not addresses.
+		{"p2pk", "21" + testPubKey + "ac", scriptP2PK, nil, 1},
+		{"multisig", "5121" + testPubKey + "21" + testPubKey + "52ae", scriptMultisig, nil, 1},
+		{"nulldata", "6a0568656c6c6f", scriptNullData, nil, 0},
+		{"nonstandard", "51", scriptNonStandard, nil, 0},
+	}
+	for _, tc := range tests {
+		d, err := decodeScript(chainBitcoin, tc.hex)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if d.Type != tc.typ || !reflect.DeepEqual(d.Addresses, tc.addresses) || d.ReqSigs != tc.reqSigs {
+			t.Errorf("%s: decoded %s %v reqSigs %d, want %s %v reqSigs %d", tc.name, d.Type, d.Addresses, d.ReqSigs,
+				tc.typ, tc.addresses, tc.reqSigs)
+		}
+	}
+
+	d, err := decodeScript(chainBitcoin, "6a0568656c6c6f")
+	if err != nil || d.Asm != "OP_RETURN 68656c6c6f" {
+		t.Errorf("nulldata asm = %q, %v", d.Asm, err)
+	}
+	if _, err := decodeScript(chainBitcoin, "zz"); err == nil {
+		t.Error("decodeScript accepted invalid hex")
+	}
+	// A push that runs past the end of the script.
+	if d, err := decodeScript(chainBitcoin, "4c05aa"); err == nil || d.Type != scriptNonStandard {
+		t.Errorf("truncated push = %s, %v; want nonstandard with an error", d.Type, err)
+	}
+}
+
+func TestInspectInput(t *tt.T) {
+	sig := strings.Repeat("30", 71)
+	tests := []struct {
+		name    string
+		vin     Vin
+		typ     string
+		address string
+	}{
+		{"p2wpkh", Vin{Txinwitness: []string{sig, testPubKey}}, scriptP2WPKH, testP2WPKH},
+		{"taproot key path", Vin{Txinwitness: []string{strings.Repeat("ab", 64)}}, scriptP2TR, ""},
+		{"taproot script path", Vin{Txinwitness: []string{sig, "51", "c0" + strings.Repeat("11", 32)}}, scriptP2TR, ""},
+		{"p2wsh", Vin{Txinwitness: []string{"", sig, "21" + testPubKey + "ac"}}, scriptP2WSH,
+			"bc1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3qccfmv3"},
+		{"p2sh-p2wpkh", Vin{ScriptSig: ScriptSig{Hex: "16" + testP2WPKHScript}, Txinwitness: []string{sig, testPubKey}}, scriptP2SH,
+			"3JvL6Ymt8MVWiCNHC7oWU6nLeHNJKLZGLN"},
+		{"p2pkh", Vin{ScriptSig: ScriptSig{Hex: "47" + sig + "21" + testPubKey}}, scriptP2PKH, "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"},
+		{"coinbase", Vin{ScriptSig: ScriptSig{Hex: "03a0bb0d"}}, "", ""},
+	}
+	for _, tc := range tests {
+		in := inspectInput(chainBitcoin, tc.vin)
+		if in.Type != tc.typ || in.Address != tc.address || len(in.Mismatches) > 0 {
+			t.Errorf("%s: spends %s from %q (%v), want %s from %q", tc.name, in.Type, in.Address, in.Mismatches, tc.typ, tc.address)
+		}
+	}
+
+	if in := inspectInput(chainBitcoin, Vin{Txinwitness: []string{"xyz"}}); len(in.Mismatches) != 1 {
+		t.Errorf("invalid witness hex: mismatches = %v", in.Mismatches)
+	}
+}
+
+func TestVerifyScripts(t *tt.T) {
+	p2pkh := "76a914751e76e8199196d454941c45d1b3a323f1433bd688ac"
+	item := Item{BlockchainSpecific: BlockchainSpecific{
+		Vin: []Vin{
+			{Txinwitness: []string{strings.Repeat("30", 71), testPubKey}, ScriptSig: ScriptSig{Type: "witness_v0_keyhash"},
+				Addresses: []string{testP2WPKH}},
+			// The provider has the spent output's type wrong.
+			{ScriptSig: ScriptSig{Hex: "47" + strings.Repeat("30", 71) + "21" + testPubKey, Type: "scripthash"}},
+		},
+		Vout: []Vout{
+			{ScriptPubKey: ScriptPubKey{Hex: testP2WPKHScript, Type: "witness_v0_keyhash", Addresses: []string{testP2WPKH},
+				Asm: "0 751e76e8199196d454941c45d1b3a323f1433bd6"}},
+			// The provider has the address and asm wrong.
+			{ScriptPubKey: ScriptPubKey{Hex: p2pkh, Type: "pubkeyhash", Addresses: []string{"1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"},
+				Asm: "OP_DUP"}},
+			// And an unknown type for an OP_RETURN.
+			{ScriptPubKey: ScriptPubKey{Hex: "6a0568656c6c6f", Type: "opreturn"}},
+		},
+	}}
+	r := verifyScripts(chainBitcoin, item)
+	wants := [][]string{nil, {"asm differs", "script pays 1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"}, {"type is nulldata"}}
+	for i, want := range wants {
+		got := r.Outputs[i].Mismatches
+		if len(got) != len(want) {
+			t.Errorf("output %d mismatches = %q, want %d", i, got, len(want))
+			continue
+		}
+		for j := range want {
+			if !strings.HasPrefix(got[j], want[j]) {
+				t.Errorf("output %d mismatch %d = %q, want %q", i, j, got[j], want[j])
+			}
+		}
+	}
+	if len(r.Inputs[0].Mismatches) != 0 || len(r.Inputs[1].Mismatches) != 1 ||
+		r.Inputs[1].Mismatches[0] != `spends p2pkh, provider says "scripthash"` {
+		t.Errorf("inputs = %+v", r.Inputs)
+	}
+	if r.Mismatches != 4 {
+		t.Errorf("Mismatches = %d, want 4", r.Mismatches)
+	}
+}
@@ -0,0 +1,343 @@
+// CoinTracker dashboard. Everything comes from the JSON API under /api.
+(function () {
+  'use strict';
+
+  const PAGE_SIZE = 25;
+
+  // Decimals of amounts per unit, as unitDecimals on the server: 8 for the
+  // UTXO chains, 9 (gwei) for the EVM chains and 6 for most tokens.
+  const UNIT_DECIMALS = { BTC: 8, tBTC: 8, rBTC: 8, LTC: 8, DOGE: 8, BCH: 8, ETH: 9, POL: 9, WETH: 9, WBTC: 8 };
+  const TOKEN_DECIMALS = 6;
+
+  const state = {
+    addresses: [],
+    selected: null,
+    txOffset: 0,
+    txTotal: 0,
+    events: null,
+    fiat: '',
+  };
+
+  const $ = (id) => document.getElementById(id);
+
+  async function api(path, options) {
+    const res = await fetch('/api' + path, options);
+    const body = await res.json().catch(() => ({}));
+    if (!res.ok) {
+      throw new Error(body.error || res.statusText);
+    }
+    return body;
+  }
+
+  // formatUnits renders integer base units (satoshis) as a decimal string.
+  function formatUnits(value, decimals) {
+    const negative = value < 0;
+    let s = String(Math.abs(value)).padStart(decimals + 1, '0');
+    s = s.slice(0, s.length - decimals) + '.' + s.slice(s.length - decimals);
+    return (negative ? '-' : '') + s;
+  }
+
+  function formatAmount(value, unit) {
+    unit = unit || 'BTC';
+    return formatUnits(value, UNIT_DECIMALS[unit] || TOKEN_DECIMALS) + ' ' + unit;
+  }
+
+  // formatFiat renders a FiatValue field (minor units), or why it is missing.
+  function formatFiat(fv, field) {
+    if (!fv) return '';
+    if (fv.missing) return 'no price';
+    const v = fv[field];
+    return (v / 100).toLocaleString(undefined, { style: 'currency', currency: fv.currency });
+  }
+
+  function fiatParam(sep) {
+    return state.fiat ? sep + 'fiat=' + state.fiat : '';
+  }
+
+  function formatTime(iso) {
+    return new Date(iso).toLocaleString();
+  }
+
+  function formatDuration(seconds) {
+    if (seconds == null) return '-';
+    if (seconds < 60) return seconds.toFixed(1) + 's';
+    const m = Math.floor(seconds / 60);
+    return m + 'm ' + Math.round(seconds % 60) + 's';
+  }
+
+  function el(tag, attrs, ...children) {
+    const node = document.createElement(tag);
+    Object.entries(attrs || {}).forEach(([k, v]) => {
+      if (k === 'onclick') node.addEventListener('click', v);
+      else node.setAttribute(k, v);
+    });
+    children.forEach((c) => node.append(c instanceof Node ? c : document.createTextNode(c)));
+    return node;
+  }
+
+  // Addresses
+
+  async function loadAddresses() {
+    state.addresses = await api('/addresses');
+    renderAddresses();
+  }
+
+  function renderAddresses() {
+    const list = $('addresses');
+    list.replaceChildren(...state.addresses.map((a) => el('li', {
+      class: a.address === state.selected ? 'selected' : '',
+      onclick: () => selectAddress(a.address),
+    },
+      el('div', { class: 'mono' }, a.address),
+      el('div', { class: 'muted' }, [a.chain !== 'bitcoin' && a.chain, a.type, a.network !== 'mainnet' && a.network,
+        formatAmount(a.balance, a.unit), ...(a.tokens || []).map((t) => formatAmount(t.balance, t.unit)), a.txCount + ' txs',
+        a.pendingTxCount && formatAmount(a.pendingBalance, a.unit) + ' pending']
+        .filter(Boolean).join(' · ')),
+    )));
+  }
+
+  $('add-address').addEventListener('submit', async (e) => {
+    e.preventDefault();
+    const input = e.target.elements.address;
+    const error = $('add-error');
+    error.hidden = true;
+    try {
+      const created = await api('/addresses', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ address: input.value.trim() }),
+      });
+      input.value = '';
+      await loadAddresses();
+      selectAddress(created.address);
+    } catch (err) {
+      error.textContent = err.message;
+      error.hidden = false;
+    }
+  });
+
+  async function selectAddress(address) {
+    state.selected = address;
+    state.txOffset = 0;
+    renderAddresses();
+    $('empty').hidden = true;
+    $('detail').hidden = false;
+    $('tx-detail').hidden = true;
+    $('detail-address').textContent = address;
+    watchProgress(address);
+    await refreshDetail();
+  }
+
+  async function refreshDetail() {
+    const address = state.selected;
+    const enc = encodeURIComponent(address);
+    const [summary, history, syncs] = await Promise.all([
+      api('/addresses/' + enc + fiatParam('?')),
+      api('/addresses/' + enc + '/balance-history'),
+      api('/addresses/' + enc + '/syncs?limit=20'),
+    ]);
+    if (address !== state.selected) return;
+
+    $('detail-balance').textContent = [formatAmount(summary.balance, summary.unit),
+      ...(summary.tokens || []).map((t) => formatAmount(t.balance, t.unit))].join(', ');
+    $('detail-fiat').textContent = formatFiat(summary.fiat, 'balance');
+    $('detail-count').textContent = summary.txCount;
+    renderChart(history);
+    renderSyncs(syncs);
+    await loadTxs();
+  }
+
+  // Balance chart
+
+  function renderChart(points) {
+    const svg = $('chart');
+    const width = 800;
+    const height = 220;
+    svg.replaceChildren();
+    if (points.length === 0) {
+      const text = document.createElementNS('http://www.w3.org/2000/svg', 'text');
+      text.setAttribute('x', 10);
+      text.setAttribute('y', 20);
+      text.setAttribute('class', 'muted');
+      text.textContent = 'No transactions yet';
+      svg.append(text);
+      return;
+    }
+
+    const times = points.map((p) => new Date(p.timestamp).getTime());
+    const values = points.map((p) => p.balance);
+    const minT = Math.min(...times);
+    const maxT = Math.max(...times);
+    const minV = Math.min(0, ...values);
+    const maxV = Math.max(...values, 1);
+    const x = (t) => (maxT === minT ? width / 2 : ((t - minT) / (maxT - minT)) * width);
+    const y = (v) => height - ((v - minV) / (maxV - minV)) * (height - 10);
+
+    // Step line: the balance holds until the next tx.
+    let d = '';
+    points.forEach((p, i) => {
+      const px = x(times[i]);
+      const py = y(values[i]);
+      if (i === 0) d += 'M' + px + ',' + y(0) + ' L' + px + ',' + py;
+      else d += ' L' + px + ',' + y(values[i - 1]) + ' L' + px + ',' + py;
+    });
+    d += ' L' + width + ',' + y(values[values.length - 1]);
+
+    const area = document.createElementNS('http://www.w3.org/2000/svg', 'path');
+    area.setAttribute('d', d + ' L' + width + ',' + height + ' L' + x(times[0]) + ',' + height + ' Z');
+    area.setAttribute('class', 'area');
+    const line = document.createElementNS('http://www.w3.org/2000/svg', 'path');
+    line.setAttribute('d', d);
+    line.setAttribute('class', 'line');
+    svg.append(area, line);
+  }
+
+  // Transactions
+
+  async function loadTxs() {
+    const enc = encodeURIComponent(state.selected);
+    const page = await api('/addresses/' + enc + '/txs?limit=' + PAGE_SIZE + '&offset=' + state.txOffset + fiatParam('&'));
+    state.txTotal = page.total;
+    $('txs').replaceChildren(...page.txs.map((tx) => el('tr', { onclick: () => showTx(tx.txId) },
+      el('td', {}, formatTime(tx.timestamp)),
+      el('td', { class: tx.direction }, (tx.transfer ? 'transfer' : tx.direction) + (tx.status === 'PENDING' ? ' (pending)' : '')),
+      el('td', { class: 'num ' + tx.direction }, formatAmount(tx.net, tx.unit)),
+      el('td', { class: 'num' }, tx.fee ? formatAmount(tx.fee, tx.unit) : '-'),
+      el('td', { class: 'num' }, formatFiat(tx.fiat, 'net')),
+      el('td', { class: 'mono' }, (tx.hash || tx.txId).slice(0, 16) + '…'),
+    )));
+
+    const from = page.total === 0 ? 0 : state.txOffset + 1;
+    const to = Math.min(state.txOffset + PAGE_SIZE, page.total);
+    $('txs-page').textContent = from + '–' + to + ' of ' + page.total;
+    $('txs-prev').disabled = state.txOffset === 0;
+    $('txs-next').disabled = to >= page.total;
+  }
+
+  $('txs-prev').addEventListener('click', () => {
+    state.txOffset = Math.max(0, state.txOffset - PAGE_SIZE);
+    loadTxs();
+  });
+
+  $('txs-next').addEventListener('click', () => {
+    state.txOffset += PAGE_SIZE;
+    loadTxs();
+  });
+
+  async function showTx(txId) {
+    const tx = await api('/txs/' + encodeURIComponent(txId) + '?address=' + encodeURIComponent(state.selected));
+    const fields = [
+      ['Tx ID', tx.txId],
+      ['Hash', tx.hash],
+      ['Time', formatTime(tx.timestamp)],
+      ['Block', tx.blockHeight + ' (' + tx.blockHash + ')'],
+      ['Status', { ORPHANED: 'orphaned by a reorg', PENDING: 'pending in the mempool', DROPPED: 'dropped from the mempool' }[tx.status]
+        || tx.confirmations + ' confirmations'],
+      ['Direction', tx.direction],
+      ['Transfer with', (tx.transferWith || []).join(', ') || '-'],
+      ['Received', formatAmount(tx.received, tx.unit)],
+      ['Sent', formatAmount(tx.sent, tx.unit)],
+      ['Net', formatAmount(tx.net, tx.unit)],
+      ['Fee share', formatAmount(tx.fee, tx.unit)],
+    ];
+    (tx.payloads || []).forEach((p) => fields.push([
+      p.kind === 'inscription' ? 'Inscription (vin ' + p.index + ')' : 'OP_RETURN (vout ' + p.index + ')',
+      [p.protocol, p.contentType, p.text ? JSON.stringify(p.text) : p.hex].filter(Boolean).join(' · '),
+    ]));
+    if (tx.scripts && tx.scripts.mismatches) fields.push(['Script mismatches', tx.scripts.mismatches]);
+    const evm = tx.evmTx;
+    if (evm) {
+      fields.push(['Result', evm.status], ['Nonce', evm.nonce], ['Gas used', evm.gasUsed + ' of ' + evm.gas]);
+    }
+    $('tx-fields').replaceChildren(...fields.flatMap(([k, v]) => [el('dt', {}, k), el('dd', { class: 'mono' }, String(v))]));
+
+    const participants = (list) => (list || []).map((p) => el('li', {}, p.address + ' · ' + p.amount));
+    if (evm) {
+      // Each transfer of the tx lists its sender and its recipient; wei and
+      // token amounts are shown as stored, in their smallest unit.
+      const transfers = [
+        evm.from && { from: evm.from, to: evm.to || evm.contractAddress, amount: evm.value + ' wei' },
+        ...(evm.internal || []).map((t) => ({ from: t.from, to: t.to, amount: t.value + ' wei (internal)' })),
+        ...(evm.tokenTransfers || []).map((t) => ({ from: t.from, to: t.to, amount: t.value + ' ' + t.symbol + ' / 10^' + t.decimals })),
+      ].filter(Boolean);
+      $('tx-senders').replaceChildren(...transfers.map((t) => el('li', {}, t.from + ' · ' + t.amount)));
+      $('tx-recipients').replaceChildren(...transfers.map((t) => el('li', {}, t.to + ' · ' + t.amount)));
+    } else {
+      $('tx-senders').replaceChildren(...participants(tx.item && tx.item.senders));
+      $('tx-recipients').replaceChildren(...participants(tx.item && tx.item.recipients));
+    }
+    $('tx-detail').hidden = false;
+    $('tx-detail').scrollIntoView({ behavior: 'smooth' });
+  }
+
+  $('export').addEventListener('click', () => {
+    const format = $('export-format').value;
+    window.location = '/api/export?format=' + format + '&address=' + encodeURIComponent(state.selected) + fiatParam('&');
+  });
+
+  $('fiat').addEventListener('change', (e) => {
+    state.fiat = e.target.value;
+    if (state.selected) refreshDetail();
+  });
+
+  $('tx-close').addEventListener('click', () => { $('tx-detail').hidden = true; });
+
+  // Syncs
+
+  function renderSyncs(syncs) {
+    $('syncs').replaceChildren(...syncs.map((s) => el('tr', {},
+      el('td', {}, s.id),
+      el('td', {}, formatTime(s.createdAt)),
+      el('td', {}, formatDuration(s.durationSeconds)),
+      el('td', { class: 'num' }, s.txsSynced + '/' + s.totalSyncTxs),
+      el('td', { class: 'num' }, s.errorCount),
+      el('td', { class: 'num' }, s.creditsUsed),
+      el('td', {}, s.outcome),
+    )));
+  }
+
+  $('sync-now').addEventListener('click', async () => {
+    const button = $('sync-now');
+    button.disabled = true;
+    try {
+      await api('/addresses/' + encodeURIComponent(state.selected) + '/sync', { method: 'POST' });
+    } catch (err) {
+      alert(err.message);
+      button.disabled = false;
+    }
+  });
+
+  // Live progress over server-sent events.
+  function watchProgress(address) {
+    if (state.events) state.events.close();
+    $('progress').hidden = true;
+    $('sync-now').disabled = false;
+
+    const events = new EventSource('/api/progress/events?address=' + encodeURIComponent(address));
+    events.addEventListener('progress', (e) => {
+      const p = JSON.parse(e.data);
+      const processed = p.pagesDone + p.pagesFailed;
+      const pct = p.totalPages ? Math.round((processed / p.totalPages) * 100) : 100;
+      $('progress').hidden = false;
+      $('progress-bar').style.width = pct + '%';
+
+      let text = processed + '/' + p.totalPages + ' pages · ' + p.txsInserted + ' txs · ' + p.txsPerSec.toFixed(1) + ' tx/s';
+      if (p.pagesFailed) text += ' · ' + p.pagesFailed + ' failed';
+      if (p.finishedAt) {
+        text = p.status.toLowerCase() + ' · ' + text;
+        $('sync-now').disabled = false;
+        refreshDetail();
+        loadAddresses();
+      } else {
+        text += ' · ETA ' + formatDuration(p.etaSeconds);
+        $('sync-now').disabled = true;
+      }
+      $('progress-text').textContent = text;
+    });
+    state.events = events;
+  }
+
+  loadAddresses().then(() => {
+    if (state.addresses.length > 0) selectAddress(state.addresses[0].address);
+  });
+})();
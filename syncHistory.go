@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"text/tabwriter"
+	"time"
+)
+
+var errSyncNotFound = errors.New("sync not found")
+
+// SyncRecord is a row of the syncs table with derived audit figures.
+type SyncRecord struct {
+	Id           string     `json:"id"`
+	Address      string     `json:"address"`
+	Chain        string     `json:"chain"`
+	Network      string     `json:"network"`
+	Status       string     `json:"status"`
+	Outcome      string     `json:"outcome"`
+	TxsSynced    int        `json:"txsSynced"`
+	TotalSyncTxs int        `json:"totalSyncTxs"`
+	TotalTxs     int        `json:"totalTxs"`
+	ErrorCount   int        `json:"errorCount"`
+	ApiRequests  int        `json:"apiRequests"`
+	CreditsUsed  int        `json:"creditsUsed"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	FinishedAt   *time.Time `json:"finishedAt,omitempty"`
+	DurationSecs *float64   `json:"durationSeconds,omitempty"`
+	TxsPerSec    *float64   `json:"txsPerSec,omitempty"`
+}
+
+const syncRecordQuery = `
+	SELECT s.id::text, s.address, s.chain, s.network, s.status, COALESCE(s.txs_synced, 0),
+		COALESCE(s.total_sync_txs, 0), COALESCE(s.total_txs, 0),
+		COALESCE(s.api_requests, 0), COALESCE(s.credits_used, 0),
+		s.created_at, s.finished_at,
+		(SELECT COUNT(*) FROM sync_errors e WHERE e.sync_id = s.id::text)
+	FROM syncs s`
+
+func scanSyncRecord(row interface{ Scan(...interface{}) error }) (SyncRecord, error) {
+	var r SyncRecord
+	var finishedAt sql.NullTime
+	err := row.Scan(&r.Id, &r.Address, &r.Chain, &r.Network, &r.Status, &r.TxsSynced, &r.TotalSyncTxs, &r.TotalTxs,
+		&r.ApiRequests, &r.CreditsUsed, &r.CreatedAt, &finishedAt, &r.ErrorCount)
+	if err != nil {
+		return r, err
+	}
+
+	if finishedAt.Valid {
+		r.FinishedAt = &finishedAt.Time
+		duration := finishedAt.Time.Sub(r.CreatedAt).Seconds()
+		r.DurationSecs = &duration
+		if duration > 0 {
+			rate := float64(r.TxsSynced) / duration
+			r.TxsPerSec = &rate
+		}
+	}
+	r.Outcome = syncOutcome(r)
+	return r, nil
+}
+
+// syncOutcome summarises a sync's status. A STARTED sync that this process
+// is not running was interrupted (the process exited mid-sync).
+func syncOutcome(r SyncRecord) string {
+	switch r.Status {
+	case "COMPLETED":
+		return "success"
+	case "COMPLETED_WITH_ERRORS":
+		return "partial"
+	case "STARTED":
+		if p, ok := syncProgress.get(r.Id); ok && p.FinishedAt == nil {
+			return "running"
+		}
+		return "interrupted"
+	default:
+		return "failed"
+	}
+}
+
+// listSyncs returns the most recent syncs, newest first. An empty address
+// lists syncs for every address.
+func listSyncs(db *sql.DB, address string, limit int) ([]SyncRecord, error) {
+	query := syncRecordQuery + ` WHERE ($1 = '' OR s.address = $1) ORDER BY s.created_at DESC, s.id DESC LIMIT $2`
+	rows, err := db.Query(query, address, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []SyncRecord{}
+	for rows.Next() {
+		r, err := scanSyncRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func getSync(db *sql.DB, syncId string) (SyncRecord, error) {
+	r, err := scanSyncRecord(db.QueryRow(syncRecordQuery+` WHERE s.id::text = $1`, syncId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return r, errSyncNotFound
+	}
+	return r, err
+}
+
+// SyncTxsAdded lists the txs first stored by a sync. Txs already present,
+// including pending or orphaned ones a later sync confirms, stay attributed
+// to the sync that added them.
+type SyncTxsAdded struct {
+	SyncId string   `json:"syncId"`
+	Added  []string `json:"added"`
+}
+
+func syncAddedTxIds(db *sql.DB, syncId string) (SyncTxsAdded, error) {
+	rows, err := db.Query(`SELECT tx_id FROM txs WHERE sync_id = $1 ORDER BY page, id`, syncId)
+	if err != nil {
+		return SyncTxsAdded{}, err
+	}
+	defer rows.Close()
+
+	added := SyncTxsAdded{SyncId: syncId, Added: []string{}}
+	for rows.Next() {
+		var txId string
+		if err := rows.Scan(&txId); err != nil {
+			return added, err
+		}
+		added.Added = append(added.Added, txId)
+	}
+	return added, rows.Err()
+}
+
+// handleListSyncs serves GET /api/addresses/{address}/syncs.
+func (s *apiServer) handleListSyncs(w http.ResponseWriter, r *http.Request) {
+	limit, _, ok := pagingParams(w, r)
+	if !ok {
+		return
+	}
+	address, ok := addressFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	records, err := listSyncs(s.db, address, limit)
+	if err != nil {
+		s.internalError(w, "failed to list syncs", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// handleGetSync serves GET /api/syncs/{syncId}.
+func (s *apiServer) handleGetSync(w http.ResponseWriter, r *http.Request) {
+	record, err := getSync(s.db, r.PathValue("syncId"))
+	if errors.Is(err, errSyncNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		s.internalError(w, "failed to get sync", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, record)
+}
+
+// handleSyncTxs serves GET /api/syncs/{syncId}/txs.
+func (s *apiServer) handleSyncTxs(w http.ResponseWriter, r *http.Request) {
+	syncId := r.PathValue("syncId")
+	if _, err := getSync(s.db, syncId); errors.Is(err, errSyncNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		s.internalError(w, "failed to get sync", err)
+		return
+	}
+
+	added, err := syncAddedTxIds(s.db, syncId)
+	if err != nil {
+		s.internalError(w, "failed to list sync txs", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, added)
+}
+
+// runHistory implements the history command.
+func runHistory(db *sql.DB, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	addr := fs.String("address", "", "only list syncs for this address")
+	limit := fs.Int("limit", 20, "maximum number of syncs to list")
+	syncId := fs.String("sync", "", "print the tx ids added by this sync instead of listing syncs")
+	fs.Parse(args)
+
+	if *syncId != "" {
+		added, err := syncAddedTxIds(db, *syncId)
+		if err != nil {
+			return err
+		}
+		for _, txId := range added.Added {
+			fmt.Fprintln(out, "+", txId)
+		}
+		fmt.Fprintf(out, "%d txs added by sync %s\n", len(added.Added), *syncId)
+		return nil
+	}
+
+	records, err := listSyncs(db, *addr, *limit)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tADDRESS\tSTARTED\tDURATION\tTXS\tTX/S\tERRORS\tREQUESTS\tCREDITS\tOUTCOME")
+	for _, r := range records {
+		duration, rate := "-", "-"
+		if r.DurationSecs != nil {
+			duration = (time.Duration(*r.DurationSecs * float64(time.Second))).Round(time.Millisecond).String()
+		}
+		if r.TxsPerSec != nil {
+			rate = fmt.Sprintf("%.2f", *r.TxsPerSec)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d/%d\t%s\t%d\t%d\t%d\t%s\n",
+			r.Id, r.Address, r.CreatedAt.Local().Format(time.RFC3339), duration,
+			r.TxsSynced, r.TotalSyncTxs, rate, r.ErrorCount, r.ApiRequests, r.CreditsUsed, r.Outcome)
+	}
+	return tw.Flush()
+}
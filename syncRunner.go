@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+var errSyncRunning = errors.New("a sync is already running for this address")
+
+// maxBackgroundSyncs is how many background syncs run at once; the rest
+// wait their turn.
+const maxBackgroundSyncs = 4
+
+// syncRunner starts background syncs, at most one per address at a time.
+type syncRunner struct {
+	db *sql.DB
+	// slots holds a token for each background sync running.
+	slots chan struct{}
+
+	mu      sync.Mutex
+	running map[string]bool
+	watched map[string]bool
+}
+
+func newSyncRunner(db *sql.DB) *syncRunner {
+	return &syncRunner{db: db, slots: make(chan struct{}, maxBackgroundSyncs), running: make(map[string]bool),
+		watched: make(map[string]bool)}
+}
+
+// start plans a sync for address and runs it in the background once a
+// slot is free. Planning errors are returned; sync errors are logged.
+func (r *syncRunner) start(address string) error {
+	if !r.acquire(address) {
+		return errSyncRunning
+	}
+	r.watch(address)
+
+	txFetcher, err := GetNewTxFetcher(r.db, address, pageLimit)
+	if err != nil {
+		r.release(address)
+		return err
+	}
+
+	go func() {
+		defer r.release(address)
+		r.slots <- struct{}{}
+		defer func() { <-r.slots }()
+		if err := txFetcher.SyncTxs(); err != nil {
+			logger.Error("background sync failed", "address", address, "error", err)
+		}
+	}()
+	return nil
+}
+
+// startAll queues a background sync for each address, run at most
+// maxBackgroundSyncs at a time. Each is planned when its turn comes, so a
+// large wallet does not hold up the caller; planning errors are logged.
+// Addresses that are already syncing or queued are returned in running.
+func (r *syncRunner) startAll(addresses []string) (started []string, running []string) {
+	started, running = []string{}, []string{}
+	for _, address := range addresses {
+		if !r.acquire(address) {
+			running = append(running, address)
+			continue
+		}
+		started = append(started, address)
+		go func(address string) {
+			defer r.release(address)
+			r.slots <- struct{}{}
+			defer func() { <-r.slots }()
+			r.watch(address)
+			txFetcher, err := GetNewTxFetcher(r.db, address, pageLimit)
+			if err == nil {
+				err = txFetcher.SyncTxs()
+			}
+			if err != nil {
+				logger.Error("background sync failed", "address", address, "error", err)
+			}
+		}(address)
+	}
+	return started, running
+}
+
+// run syncs address and waits for the sync to finish.
+func (r *syncRunner) run(address string) error {
+	if !r.acquire(address) {
+		return errSyncRunning
+	}
+	defer r.release(address)
+	r.watch(address)
+
+	txFetcher, err := GetNewTxFetcher(r.db, address, pageLimit)
+	if err != nil {
+		return err
+	}
+	return txFetcher.SyncTxs()
+}
+
+// watch subscribes to address's activity once, if its chain's provider pushes it,
+// and starts a background sync on each notification.
+func (r *syncRunner) watch(address string) {
+	p, err := providerFor(addressChain(address))
+	if err != nil {
+		return
+	}
+	n, ok := p.(notifier)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	if r.watched[address] {
+		r.mu.Unlock()
+		return
+	}
+	r.watched[address] = true
+	r.mu.Unlock()
+
+	err = n.Subscribe(address, func(address string) {
+		logger.Info("provider pushed new activity", "address", address)
+		if err := r.start(address); err != nil && !errors.Is(err, errSyncRunning) {
+			logger.Error("failed to start sync on new activity", "address", address, "error", err)
+		}
+	})
+	if errors.Is(err, errNotifyUnsupported) {
+		return
+	}
+	if err != nil {
+		logger.Warn("failed to subscribe to address activity", "address", address, "error", err)
+		r.mu.Lock()
+		delete(r.watched, address)
+		r.mu.Unlock()
+	}
+}
+
+// watchAll subscribes to the activity of every tracked address.
+func (r *syncRunner) watchAll() error {
+	if _, ok := provider.(notifier); !ok {
+		return nil
+	}
+	rows, err := r.db.Query(`SELECT address FROM addresses`)
+	if err != nil {
+		return err
+	}
+	var addresses []string
+	for rows.Next() {
+		var a string
+		if err := rows.Scan(&a); err != nil {
+			rows.Close()
+			return err
+		}
+		addresses = append(addresses, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, a := range addresses {
+		r.watch(a)
+	}
+	return nil
+}
+
+func (r *syncRunner) acquire(address string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running[address] {
+		return false
+	}
+	r.running[address] = true
+	return true
+}
+
+func (r *syncRunner) release(address string) {
+	r.mu.Lock()
+	delete(r.running, address)
+	r.mu.Unlock()
+}
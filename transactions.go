@@ -0,0 +1,276 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+var errTxNotFound = errors.New("tx not found")
+
+// loadTxViews returns the confirmed and pending txs of address, oldest
+// first. Txs orphaned by a reorg or dropped from the mempool are left out.
+func loadTxViews(db *sql.DB, address string) ([]TxView, error) {
+	chain, err := storedChain(db, address)
+	if err != nil {
+		return nil, err
+	}
+	return chainTxViews(db, address, chain)
+}
+
+// chainTxViews is loadTxViews for an address whose chain is known.
+func chainTxViews(db *sql.DB, address string, chain *Chain) ([]TxView, error) {
+	tip, err := loadChainTip(db, chain)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT raw, status, model FROM txs WHERE address = $1 AND status IN ($2, $3) ORDER BY (raw->>'timestamp')::bigint, id`,
+		address, txConfirmed, txPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	views := []TxView{}
+	for rows.Next() {
+		var raw []byte
+		var status, model string
+		if err := rows.Scan(&raw, &status, &model); err != nil {
+			return nil, err
+		}
+		txViews, err := storedViews(raw, model, address, chain)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range txViews {
+			v.Status = status
+			v.Confirmations = tip.confirmations(v.BlockHeight)
+			views = append(views, v)
+		}
+	}
+	return views, rows.Err()
+}
+
+// storedViews classifies a stored tx of chain c from address's point of
+// view: a UTXO tx gives one view and an account tx one per unit it moved.
+func storedViews(raw []byte, model string, address string, c *Chain) ([]TxView, error) {
+	if model == modelAccount {
+		var tx EVMTx
+		if err := json.Unmarshal(raw, &tx); err != nil {
+			return nil, err
+		}
+		return viewEVMTx(tx, address, c)
+	}
+	var item Item
+	if err := json.Unmarshal(raw, &item); err != nil {
+		return nil, err
+	}
+	v, err := viewTx(item, address)
+	if err != nil {
+		return nil, err
+	}
+	return []TxView{v}, nil
+}
+
+// getTxView returns a stored tx with its full provider data, payloads and our
+// check of its scripts, seen from address. If address is empty the first address that
+// stored it is used. Orphaned txs are returned with their status. An account
+// tx is returned as its first view, with the whole tx attached.
+func getTxView(db *sql.DB, txId string, address string) (TxView, error) {
+	var raw []byte
+	var status, chainName, network, model string
+	err := db.QueryRow(`
+		SELECT address, raw, status, chain, network, model FROM txs WHERE tx_id = $1 AND ($2 = '' OR address = $2)
+		ORDER BY id LIMIT 1`,
+		txId, address).Scan(&address, &raw, &status, &chainName, &network, &model)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TxView{}, errTxNotFound
+	}
+	if err != nil {
+		return TxView{}, err
+	}
+	chain, err := chainOf(chainName, network)
+	if err != nil {
+		return TxView{}, err
+	}
+	tip, err := loadChainTip(db, chain)
+	if err != nil {
+		return TxView{}, err
+	}
+
+	if model == modelAccount {
+		var tx EVMTx
+		if err := json.Unmarshal(raw, &tx); err != nil {
+			return TxView{}, err
+		}
+		views, err := viewEVMTx(tx, address, chain)
+		if err != nil {
+			return TxView{}, err
+		}
+		v := views[0]
+		v.Status = status
+		if status == txConfirmed {
+			v.Confirmations = tip.confirmations(v.BlockHeight)
+		}
+		v.EVMTx = &tx
+		return v, nil
+	}
+
+	var item Item
+	if err := json.Unmarshal(raw, &item); err != nil {
+		return TxView{}, err
+	}
+	v, err := viewTx(item, address)
+	if err != nil {
+		return v, err
+	}
+	v.Status = status
+	if status == txConfirmed {
+		v.Confirmations = tip.confirmations(v.BlockHeight)
+	}
+	v.Item = &item
+	scripts := verifyScripts(chain, item)
+	v.Scripts = &scripts
+	v.Payloads = extractPayloads(item)
+	return v, nil
+}
+
+// handleListTxs serves GET /api/addresses/{address}/txs, newest first, paged
+// with ?limit= and ?offset=. Transfers with other tracked addresses are
+// flagged.
+func (s *apiServer) handleListTxs(w http.ResponseWriter, r *http.Request) {
+	address, ok := addressFromPath(w, r)
+	if !ok {
+		return
+	}
+	s.writeViewsPage(w, r, func() ([]TxView, error) {
+		views, err := loadTxViews(s.db, address)
+		if err != nil {
+			return nil, err
+		}
+		return views, markAddressTransfers(s.db, address, views)
+	})
+}
+
+// writeViewsPage writes one page of the views returned by load, newest
+// first, valued in the ?fiat= currency if given. ?payload= keeps only txs
+// carrying a matching payload.
+func (s *apiServer) writeViewsPage(w http.ResponseWriter, r *http.Request, load func() ([]TxView, error)) {
+	limit, offset, ok := pagingParams(w, r)
+	if !ok {
+		return
+	}
+	prices, ok := s.fiatPrices(w, r)
+	if !ok {
+		return
+	}
+
+	views, err := load()
+	if err != nil {
+		s.internalError(w, "failed to load txs", err)
+		return
+	}
+	views, ok = s.filterByPayload(w, r, views)
+	if !ok {
+		return
+	}
+
+	page := []TxView{}
+	for i := len(views) - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, views[i])
+	}
+	resp := map[string]interface{}{
+		"total": len(views),
+		"txs":   page,
+	}
+	if prices != nil {
+		resp["unpriced"] = prices.valueViews(page)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleGetTx serves GET /api/txs/{txId}, optionally ?address= to pick the
+// point of view.
+func (s *apiServer) handleGetTx(w http.ResponseWriter, r *http.Request) {
+	prices, ok := s.fiatPrices(w, r)
+	if !ok {
+		return
+	}
+	v, err := getTxView(s.db, r.PathValue("txId"), r.URL.Query().Get("address"))
+	if errors.Is(err, errTxNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		s.internalError(w, "failed to load tx", err)
+		return
+	}
+	views := []TxView{v}
+	if err := markAddressTransfers(s.db, v.Address, views); err != nil {
+		s.internalError(w, "failed to match transfers", err)
+		return
+	}
+	v = views[0]
+	if prices != nil {
+		v.Fiat = prices.valueAt(v.Unit, v.Timestamp, v.Net, v.Fee)
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// handleBalanceHistory serves GET /api/addresses/{address}/balance-history.
+func (s *apiServer) handleBalanceHistory(w http.ResponseWriter, r *http.Request) {
+	address, ok := addressFromPath(w, r)
+	if !ok {
+		return
+	}
+	s.writeBalanceHistory(w, r, func() ([]TxView, error) { return loadTxViews(s.db, address) })
+}
+
+// writeBalanceHistory writes the running balance over the views returned by
+// load, valued in the ?fiat= currency if given. Balances are in one unit:
+// ?unit=, or the only unit of the views, else BTC.
+func (s *apiServer) writeBalanceHistory(w http.ResponseWriter, r *http.Request, load func() ([]TxView, error)) {
+	prices, ok := s.fiatPrices(w, r)
+	if !ok {
+		return
+	}
+	views, err := load()
+	if err != nil {
+		s.internalError(w, "failed to load txs", err)
+		return
+	}
+	unit := r.URL.Query().Get("unit")
+	if unit == "" {
+		unit = soleUnit(views)
+	}
+	points := balanceHistory(inUnit(views, unit))
+	if prices != nil {
+		for i := range points {
+			points[i].Fiat = prices.valueBalance(unit, points[i].Timestamp, points[i].Balance)
+		}
+	}
+	writeJSON(w, http.StatusOK, points)
+}
+
+func pagingParams(w http.ResponseWriter, r *http.Request) (limit int, offset int, ok bool) {
+	limit, offset = 50, 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return 0, 0, false
+		}
+		limit = n
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid offset")
+			return 0, 0, false
+		}
+		offset = n
+	}
+	return limit, offset, true
+}
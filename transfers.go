@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// directionTransfer marks a merged tx that only moved funds between tracked
+// addresses; its net effect on the portfolio is the fee.
+const directionTransfer = "transfer"
+
+// txKey groups views of the same tx across addresses. An account tx has a
+// view per unit, and each is grouped on its own.
+func txKey(v TxView) string {
+	key := v.TxId
+	if v.Hash != "" {
+		key = v.Hash
+	}
+	return key + "/" + v.Unit
+}
+
+// markTransfers flags views whose tx moved funds from one tracked address to
+// another: within a tx hash, at least one member address paid out and another
+// received. views may span any number of addresses.
+func markTransfers(views []TxView) {
+	groups := map[string][]int{}
+	for i, v := range views {
+		groups[txKey(v)] = append(groups[txKey(v)], i)
+	}
+
+	for _, idx := range groups {
+		if len(idx) < 2 {
+			continue
+		}
+		var paid, received bool
+		for _, i := range idx {
+			paid = paid || views[i].Net < 0
+			received = received || views[i].Net > 0
+		}
+		if !paid || !received {
+			continue
+		}
+		for _, i := range idx {
+			views[i].Transfer = true
+			views[i].TransferWith = nil
+			for _, j := range idx {
+				if views[j].Address != views[i].Address {
+					views[i].TransferWith = append(views[i].TransferWith, views[j].Address)
+				}
+			}
+		}
+	}
+}
+
+// mergeTransfers returns one view per tx, summing the members of txs that
+// touch several tracked addresses so internal movements net out. A tx that
+// only moved funds internally gets directionTransfer. The result is sorted
+// oldest first.
+func mergeTransfers(views []TxView) []TxView {
+	markTransfers(views)
+
+	var order []string
+	merged := map[string]*TxView{}
+	for _, v := range views {
+		key := txKey(v)
+		m, ok := merged[key]
+		if !ok {
+			cp := v
+			cp.Addresses = []string{v.Address}
+			cp.TransferWith = nil
+			merged[key] = &cp
+			order = append(order, key)
+			continue
+		}
+		m.Addresses = append(m.Addresses, v.Address)
+		m.Received += v.Received
+		m.Sent += v.Sent
+		m.Net += v.Net
+		m.Fee += v.Fee
+	}
+
+	out := make([]TxView, 0, len(order))
+	for _, key := range order {
+		m := merged[key]
+		if len(m.Addresses) > 1 {
+			m.Address = ""
+			switch {
+			case m.Transfer && m.Net == -m.Fee:
+				m.Direction = directionTransfer
+			case m.Net < 0:
+				m.Direction = directionSend
+			default:
+				m.Direction = directionReceive
+			}
+		} else {
+			m.Addresses = nil
+		}
+		out = append(out, *m)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Timestamp.Before(out[j].Timestamp) })
+	return out
+}
+
+// markAddressTransfers flags the views of a single address that are
+// transfers with other tracked addresses, using the other addresses' stored
+// copies of the same txs, or with ledger accounts linked to the txs.
+func markAddressTransfers(db *sql.DB, address string, views []TxView) error {
+	rows, err := db.Query(`
+		SELECT b.address, b.raw, b.model FROM txs a
+		JOIN txs b ON b.raw->>'transactionHash' = a.raw->>'transactionHash' AND b.address <> a.address
+		WHERE a.address = $1 AND a.raw->>'transactionHash' <> '' AND b.status IN ($2, $3)`, address, txConfirmed, txPending)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	peers := []TxView{}
+	for rows.Next() {
+		var peer, model string
+		var raw []byte
+		if err := rows.Scan(&peer, &raw, &model); err != nil {
+			return err
+		}
+		v, err := storedViews(raw, model, peer, addressChain(peer))
+		if err != nil {
+			return err
+		}
+		peers = append(peers, v...)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	linked, err := linkedLedgerViews(db, address)
+	if err != nil {
+		return err
+	}
+	peers = append(peers, linked...)
+	if len(peers) == 0 {
+		return nil
+	}
+
+	all := append(append([]TxView{}, views...), peers...)
+	markTransfers(all)
+	copy(views, all[:len(views)])
+	return nil
+}
+
+// loadPortfolioViews returns the txs of the given addresses, and the
+// entries of the given ledger accounts, with internal transfers merged,
+// oldest first.
+func loadPortfolioViews(db *sql.DB, addresses []string) ([]TxView, error) {
+	accounts, err := ledgerAccounts(db)
+	if err != nil {
+		return nil, err
+	}
+	ledger := map[string]bool{}
+	for _, a := range accounts {
+		ledger[a] = true
+	}
+
+	views := []TxView{}
+	for _, address := range addresses {
+		load := loadTxViews
+		if ledger[address] {
+			load = loadLedgerViews
+		}
+		v, err := load(db, address)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, v...)
+	}
+	return mergeTransfers(views), nil
+}
+
+func trackedAddresses(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT address FROM addresses ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := []string{}
+	for rows.Next() {
+		var a string
+		if err := rows.Scan(&a); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, a)
+	}
+	return addresses, rows.Err()
+}
+
+// PortfolioSummary is the combined position of every tracked address and
+// ledger account.
+// Balance and PendingBalance are in BTC; Units breaks the position down by
+// unit, and Fiat values all of them together.
+type PortfolioSummary struct {
+	Addresses []string      `json:"addresses"`
+	TxCount   int           `json:"txCount"`
+	Transfers int           `json:"transfers"`
+	Balance   int64         `json:"balance"`
+	Units     []UnitBalance `json:"units"`
+	Fiat      *FiatValue    `json:"fiat,omitempty"`
+
+	PendingTxCount int   `json:"pendingTxCount"`
+	PendingBalance int64 `json:"pendingBalance"`
+}
+
+// UnitBalance is the part of a portfolio in one unit.
+type UnitBalance struct {
+	Unit           string     `json:"unit"`
+	TxCount        int        `json:"txCount"`
+	Balance        int64      `json:"balance"`
+	PendingBalance int64      `json:"pendingBalance"`
+	Fiat           *FiatValue `json:"fiat,omitempty"`
+}
+
+// summarizePortfolio totals views; pending txs count towards the pending
+// figures only. An account tx with views in several units counts once.
+func summarizePortfolio(addresses []string, views []TxView) PortfolioSummary {
+	s := PortfolioSummary{Addresses: addresses, Units: []UnitBalance{}}
+	unit := func(name string) *UnitBalance {
+		for i := range s.Units {
+			if s.Units[i].Unit == name {
+				return &s.Units[i]
+			}
+		}
+		s.Units = append(s.Units, UnitBalance{Unit: name})
+		return &s.Units[len(s.Units)-1]
+	}
+	counted := map[string]bool{}
+	for _, v := range views {
+		u := unit(v.Unit)
+		first := !counted[v.TxId]
+		counted[v.TxId] = true
+		if v.Status == txPending {
+			if first {
+				s.PendingTxCount++
+			}
+			u.PendingBalance += v.Net
+			continue
+		}
+		if first {
+			s.TxCount++
+		}
+		u.TxCount++
+		u.Balance += v.Net
+		if v.Transfer {
+			s.Transfers++
+		}
+	}
+	for _, u := range s.Units {
+		if u.Unit == chainBitcoin.Unit {
+			s.Balance, s.PendingBalance = u.Balance, u.PendingBalance
+		}
+	}
+	return s
+}
+
+// formatBalances writes the balance in each unit, such as
+// "0.50000000 BTC, 12.00000000 LTC".
+func (s PortfolioSummary) formatBalances() string {
+	if len(s.Units) == 0 {
+		return formatUnits(0, btcDecimals) + " " + chainBitcoin.Unit
+	}
+	parts := make([]string, 0, len(s.Units))
+	for _, u := range s.Units {
+		parts = append(parts, formatUnits(u.Balance, unitDecimals(u.Unit))+" "+u.Unit)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// valuePortfolio values each unit of s at ts and returns their total. The
+// total is missing if any unit could not be priced.
+func (t *priceTable) valuePortfolio(s *PortfolioSummary, ts time.Time) *FiatValue {
+	var total int64
+	fv := &FiatValue{Currency: t.Currency, Balance: &total}
+	for i := range s.Units {
+		u := &s.Units[i]
+		u.Fiat = t.valueBalance(u.Unit, ts, u.Balance)
+		if u.Fiat.Missing {
+			fv.Missing = true
+			fv.Reason = u.Fiat.Reason
+			continue
+		}
+		total += *u.Fiat.Balance
+	}
+	if fv.Missing {
+		fv.Balance = nil
+	}
+	return fv
+}
+
+// handlePortfolio serves GET /api/portfolio.
+func (s *apiServer) handlePortfolio(w http.ResponseWriter, r *http.Request) {
+	prices, ok := s.fiatPrices(w, r)
+	if !ok {
+		return
+	}
+	addresses, err := portfolioAccounts(s.db)
+	if err != nil {
+		s.internalError(w, "failed to list addresses", err)
+		return
+	}
+	views, err := loadPortfolioViews(s.db, addresses)
+	if err != nil {
+		s.internalError(w, "failed to load txs", err)
+		return
+	}
+	summary := summarizePortfolio(addresses, views)
+	if prices != nil {
+		summary.Fiat = prices.valuePortfolio(&summary, time.Now().UTC())
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// handlePortfolioTxs serves GET /api/portfolio/txs: every tracked address's
+// txs and every ledger entry, newest first, with internal transfers shown
+// once.
+func (s *apiServer) handlePortfolioTxs(w http.ResponseWriter, r *http.Request) {
+	addresses, err := portfolioAccounts(s.db)
+	if err != nil {
+		s.internalError(w, "failed to list addresses", err)
+		return
+	}
+	s.writeViewsPage(w, r, func() ([]TxView, error) { return loadPortfolioViews(s.db, addresses) })
+}
+
+// handlePortfolioBalanceHistory serves GET /api/portfolio/balance-history.
+func (s *apiServer) handlePortfolioBalanceHistory(w http.ResponseWriter, r *http.Request) {
+	addresses, err := portfolioAccounts(s.db)
+	if err != nil {
+		s.internalError(w, "failed to list addresses", err)
+		return
+	}
+	s.writeBalanceHistory(w, r, func() ([]TxView, error) { return loadPortfolioViews(s.db, addresses) })
+}
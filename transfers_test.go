@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	tt "testing"
+)
+
+// viewsOf returns item's views for each of addresses.
+func viewsOf(t *tt.T, item Item, addresses ...string) []TxView {
+	t.Helper()
+	views := make([]TxView, 0, len(addresses))
+	for _, a := range addresses {
+		v, err := viewTx(item, a)
+		if err != nil {
+			t.Fatalf("viewTx(%s): %v", a, err)
+		}
+		views = append(views, v)
+	}
+	return views
+}
+
+func TestViewTxFeeSharesAddUp(t *tt.T) {
+	// Three equal inputs share a 10 sat fee as 3, 3 and 4.
+	item := Item{
+		TransactionId: "t1", TransactionHash: "t1", Timestamp: 1708000000,
+		Senders: []Participant{
+			{Address: "a", Amount: "0.00100000"}, {Address: "b", Amount: "0.00100000"}, {Address: "c", Amount: "0.00100000"},
+		},
+		Recipients: []Participant{{Address: "d", Amount: "0.00299990"}},
+		Fee:        Fee{Amount: "0.00000010", Unit: "BTC"},
+	}
+	var fees []int64
+	for _, v := range viewsOf(t, item, "a", "b", "c", "d") {
+		fees = append(fees, v.Fee)
+	}
+	if want := []int64{3, 3, 4, 0}; !reflect.DeepEqual(fees, want) {
+		t.Errorf("fees = %v, want %v", fees, want)
+	}
+}
+
+func TestMergeTransfers(t *tt.T) {
+	consolidate := Item{
+		TransactionId: "t1", TransactionHash: "t1", Timestamp: 1708000000,
+		Senders: []Participant{
+			{Address: "a", Amount: "0.00100000"}, {Address: "b", Amount: "0.00100000"}, {Address: "c", Amount: "0.00100000"},
+		},
+		Recipients: []Participant{{Address: "d", Amount: "0.00299990"}},
+		Fee:        Fee{Amount: "0.00000010", Unit: "BTC"},
+	}
+	payment := Item{
+		TransactionId: "t2", TransactionHash: "t2", Timestamp: 1708000100,
+		Senders:    []Participant{{Address: "d", Amount: "0.00299990"}},
+		Recipients: []Participant{{Address: "shop", Amount: "0.00100000"}, {Address: "a", Amount: "0.00199790"}},
+		Fee:        Fee{Amount: "0.00000200", Unit: "BTC"},
+	}
+	income := Item{
+		TransactionId: "t3", TransactionHash: "t3", Timestamp: 1708000200,
+		Senders:    []Participant{{Address: "employer", Amount: "0.01000000"}},
+		Recipients: []Participant{{Address: "b", Amount: "0.00500000"}, {Address: "employer", Amount: "0.00499000"}},
+		Fee:        Fee{Amount: "0.00001000", Unit: "BTC"},
+	}
+	views := append(viewsOf(t, consolidate, "a", "b", "c", "d"), viewsOf(t, payment, "d", "a")...)
+	views = append(views, viewsOf(t, income, "b")...)
+
+	merged := mergeTransfers(views)
+	if len(merged) != 3 {
+		t.Fatalf("got %d merged views, want 3: %+v", len(merged), merged)
+	}
+	tests := []struct {
+		direction string
+		net, fee  int64
+		addresses []string
+	}{
+		// A consolidation nets out to its fee, however the fee was split.
+		{directionTransfer, -10, 10, []string{"a", "b", "c", "d"}},
+		{directionSend, -100200, 200, []string{"d", "a"}},
+		{directionReceive, 500000, 0, nil},
+	}
+	for i, w := range tests {
+		m := merged[i]
+		if m.Direction != w.direction || m.Net != w.net || m.Fee != w.fee || !reflect.DeepEqual(m.Addresses, w.addresses) {
+			t.Errorf("merged[%d] = %s net %d fee %d %v, want %+v", i, m.Direction, m.Net, m.Fee, m.Addresses, w)
+		}
+	}
+	if !views[0].Transfer || !reflect.DeepEqual(views[0].TransferWith, []string{"b", "c", "d"}) || views[len(views)-1].Transfer {
+		t.Errorf("transfer flags: %v %v, income %v", views[0].Transfer, views[0].TransferWith, views[len(views)-1].Transfer)
+	}
+}
@@ -5,35 +5,42 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"math"
-	"math/rand"
 	"net/http"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const apiKey = "f45402fbaf2f7649ce26a55aa9ab555033c48b7f"
-
 var client = &http.Client{}
 
 const testing = true
 const testTotalNumTxs = 20
 
-const limitNumResultsInProd = true
-const limitNumResults = 10
-
 // const testTotalNumTxs = 1305156
 
 const pageLimit = 1
 const maxRequestsPerSecond = 10
 
+// A page is attempted up to maxPageAttempts times, waiting retryBaseDelay,
+// then twice that, and so on between attempts.
+const maxPageAttempts = 3
+const retryBaseDelay = 500 * time.Millisecond
+
 type TxFetcher struct {
 	Address     string
 	CurrentPage int
 	db          *sql.DB
+	log         *slog.Logger
+	stats       *syncStats
+	chain       *Chain
+	provider    Provider
+
+	// account replaces provider on account chains. completed is set if an
+	// earlier sync of the address completed, so its walk can stop early.
+	account   AccountProvider
+	completed bool
 
 	TotalNumPages int // The total number of pages for the address
 	TotalNumTxs   int // The total number of txs for the address
@@ -43,234 +50,367 @@ type TxFetcher struct {
 	TotalTxsSynced int // The total number of txs we've already synced
 }
 
-func GetNewTxFetcher(db *sql.DB, address string, pageLimit int) TxFetcher {
-	totalNumTxs, _ := getTotalNumberOfTxs(address)
+// syncStats counts provider usage during one sync.
+type syncStats struct {
+	requests atomic.Int64
+	credits  atomic.Int64
+}
+
+// request counts one request to p, a Provider or an AccountProvider.
+func (s *syncStats) request(p interface{}) {
+	s.requests.Add(1)
+	if m, ok := p.(metered); ok {
+		s.credits.Add(int64(m.creditsPerRequest()))
+	}
+}
+
+func GetNewTxFetcher(db *sql.DB, address string, pageLimit int) (TxFetcher, error) {
+	// Reject bad input before it reaches the provider.
+	info, err := validateAddress(address)
+	if err != nil {
+		return TxFetcher{}, err
+	}
+	address = info.Address
+	chain, err := chainOf(info.Chain, info.Network)
+	if err != nil {
+		return TxFetcher{}, err
+	}
+	if chain.Model == modelAccount {
+		return newAccountTxFetcher(db, info, chain)
+	}
+	p, err := providerFor(chain)
+	if err != nil {
+		return TxFetcher{}, err
+	}
+	log := logger.With("address", address, "type", info.Type, "chain", chain.Key(), "provider", p.Name())
+	if cp, ok := p.(cursorPager); ok {
+		pageLimit = cp.PageSize()
+	}
+
+	totalNumTxs, err := p.CountTxs(address)
+	if err != nil {
+		return TxFetcher{}, fmt.Errorf("failed to get total number of txs: %w", err)
+	}
 	totalNumPages := int(math.Ceil(float64(totalNumTxs) / float64(pageLimit)))
 
 	// Record the address
-	now := time.Now().UTC()
-	stmt := `INSERT INTO addresses (address, created_at) VALUES ($1, $2) ON CONFLICT (address) DO NOTHING`
-	_, err := db.Exec(stmt, address, now)
+	_, err = trackAddress(db, address)
 	if err != nil {
-		log.Fatal(err)
+		return TxFetcher{}, fmt.Errorf("failed to record address: %w", err)
+	}
+
+	// Drop txs whose blocks were reorganized away before counting what we
+	// have, so they are fetched again.
+	if _, err := checkReorgs(db, chain, p, log, address); err != nil {
+		return TxFetcher{}, fmt.Errorf("failed to check for reorgs: %w", err)
 	}
 
 	// Get the total number of txs we've already synced
-	query := `SELECT COALESCE(SUM(txs_synced), 0) FROM syncs`
+	query := `SELECT COUNT(*) FROM txs WHERE address = $1 AND status = $2`
 	var totalTxsSynced int // The total number of txs we've already synced
-	err = db.QueryRow(query).Scan(&totalTxsSynced)
+	err = db.QueryRow(query, address, txConfirmed).Scan(&totalTxsSynced)
 	if err != nil {
-		log.Fatal(err)
+		return TxFetcher{}, fmt.Errorf("failed to count synced txs: %w", err)
 	}
 
 	totalSyncPages := (totalNumTxs - totalTxsSynced + pageLimit - 1) / pageLimit
 
-	fmt.Println("Total Number of Address's Txs: ", totalNumTxs)
-	fmt.Println("Total Number of Addresses Synced: ", totalTxsSynced)
-	fmt.Println("Total Number of Address's Pages: ", totalNumPages)
-	fmt.Println("Total Number of Pages to Sync: ", totalSyncPages)
+	log.Info("planned sync",
+		"total_txs", totalNumTxs,
+		"txs_synced", totalTxsSynced,
+		"total_pages", totalNumPages,
+		"sync_pages", totalSyncPages,
+	)
 
 	return TxFetcher{
 		Address:        address,
 		db:             db,
+		log:            log,
+		chain:          chain,
+		provider:       p,
 		CurrentPage:    0,
 		TotalNumPages:  totalNumPages,
 		TotalNumTxs:    totalNumTxs,
 		TotalSyncPages: totalSyncPages,
 		TotalSyncTxs:   totalNumTxs - totalTxsSynced,
 		TotalTxsSynced: totalTxsSynced,
-	}
+	}, nil
 }
 
-func (txFetcher TxFetcher) SyncTxs() {
-	fmt.Println("Syncing txs for address: ", txFetcher.Address)
+func (txFetcher TxFetcher) SyncTxs() error {
+	started := time.Now()
 
 	// Record the sync txs attempt
-	now := time.Now().UTC()
-	stmt := `INSERT INTO syncs (address, status, txs_synced, total_sync_txs, total_txs, created_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+	now := started.UTC()
+	stmt := `INSERT INTO syncs (address, chain, network, status, txs_synced, total_sync_txs, total_txs, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
 	var syncId string
-	err := txFetcher.db.QueryRow(stmt, txFetcher.Address, "STARTED", 0, txFetcher.TotalSyncTxs, txFetcher.TotalNumTxs, now).Scan(&syncId)
+	err := txFetcher.db.QueryRow(stmt, txFetcher.Address, txFetcher.chain.Name, txFetcher.chain.Network, "STARTED", 0, txFetcher.TotalSyncTxs, txFetcher.TotalNumTxs, now).Scan(&syncId)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to record sync: %w", err)
 	}
 
+	log := txFetcher.log.With("sync_id", syncId)
+	log.Info("syncing txs", "sync_pages", txFetcher.TotalSyncPages)
+	txFetcher.stats = &syncStats{}
+
+	activeSyncs.Inc()
+	defer activeSyncs.Dec()
+
+	syncProgress.start(syncId, txFetcher.Address, txFetcher.TotalSyncPages, txFetcher.TotalSyncTxs)
+
+	failedPages := txFetcher.syncConfirmed(log, syncId)
+
+	// Mempool txs are best effort: a failure here leaves the confirmed txs
+	// synced and pending ones as they were. Account chains have none.
+	var pending int
+	if txFetcher.account == nil {
+		pending, err = txFetcher.syncPending(log, syncId)
+		if err != nil {
+			log.Warn("failed to sync pending txs", "error", err)
+		}
+	}
+
+	// Verification only reports; it never changes what was stored. The
+	// verifier serves Bitcoin mainnet.
+	if verifier != nil && txFetcher.chain == chainBitcoin {
+		if _, err := txFetcher.verify(log, syncId); err != nil {
+			log.Warn("failed to verify txs against second provider", "error", err)
+		}
+	}
+
+	// Get the number of confirmed txs synced
+	query := `SELECT COUNT(*) FROM txs WHERE sync_id = $1 AND status = $2`
+	var count int
+	err = txFetcher.db.QueryRow(query, syncId, txConfirmed).Scan(&count)
+	if err != nil {
+		syncProgress.finish(syncId, "FAILED")
+		return fmt.Errorf("failed to count synced txs: %w", err)
+	}
+
+	status := "COMPLETED"
+	if failedPages > 0 {
+		status = "COMPLETED_WITH_ERRORS"
+	}
+
+	// Update the sync txs status
+	now = time.Now().UTC()
+	stmt = `UPDATE syncs SET STATUS = $1, FINISHED_AT = $2, TXS_SYNCED = $3, API_REQUESTS = $4, CREDITS_USED = $5 WHERE id = $6`
+	_, err = txFetcher.db.Exec(stmt, status, now, count, txFetcher.stats.requests.Load(), txFetcher.stats.credits.Load(), syncId)
+	if err != nil {
+		syncProgress.finish(syncId, "FAILED")
+		return fmt.Errorf("failed to update sync status: %w", err)
+	}
+	syncProgress.finish(syncId, status)
+
+	log.Info("sync finished",
+		"status", status,
+		"txs_synced", count,
+		"pending_txs", pending,
+		"failed_pages", failedPages,
+		"api_requests", txFetcher.stats.requests.Load(),
+		"duration", time.Since(started),
+	)
+	return nil
+}
+
+// syncConfirmed fetches the planned pages of confirmed txs and returns how
+// many failed.
+func (txFetcher TxFetcher) syncConfirmed(log *slog.Logger, syncId string) int {
 	ticker := time.NewTicker(time.Second / time.Duration(maxRequestsPerSecond))
 	defer ticker.Stop()
 
+	if txFetcher.account != nil {
+		return txFetcher.syncAccount(log, syncId, ticker)
+	}
+	if cp, ok := txFetcher.provider.(cursorPager); ok {
+		return txFetcher.syncCursor(log, syncId, cp, ticker)
+	}
+	op, ok := txFetcher.provider.(offsetPager)
+	if !ok {
+		log.Error("provider cannot page through txs")
+		return txFetcher.TotalSyncPages
+	}
+
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failedPages := 0
 	for txFetcher.CurrentPage < txFetcher.TotalSyncPages {
+		waitStart := time.Now()
 		select {
-		case t := <-ticker.C:
+		case <-ticker.C:
+			rateLimitWait.Observe(time.Since(waitStart).Seconds())
 			wg.Add(1)
 
 			// Send a request
 			go func(page int) {
 				defer wg.Done()
 
-				err := txFetcher.worker(txFetcher.db, page, int64(t.UnixMilli()), syncId)
+				fetch := func() ([]Item, string, error) {
+					items, err := op.TxsAt(txFetcher.Address, page*pageLimit, pageLimit)
+					return items, "", err
+				}
+				inserted, _, err := txFetcher.syncPage(log.With("page", page), page, syncId, fetch)
 				if err != nil {
-					// TODO: retry 2 more times with exponential backoff
-					// TODO: store error into sync error table
-					log.Fatal(err)
+					pagesSynced.WithLabelValues(txFetcher.Address, "failed").Inc()
+					syncProgress.pageFailed(syncId)
+					mu.Lock()
+					failedPages++
+					mu.Unlock()
+					return
 				}
+				pagesSynced.WithLabelValues(txFetcher.Address, "ok").Inc()
+				syncProgress.pageDone(syncId, inserted)
 			}(txFetcher.CurrentPage)
 			txFetcher.CurrentPage++
 		}
 	}
 
 	wg.Wait() // Wait for all workers to finish
-
-	// Get the number of txs synced
-	query := `SELECT COUNT(*) FROM txs WHERE sync_id = $1`
-	var count int
-	err = txFetcher.db.QueryRow(query, syncId).Scan(&count)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Update the sync txs status to COMPLETED
-	now = time.Now().UTC()
-	stmt = `UPDATE syncs SET STATUS = $1, FINISHED_AT = $2, TXS_SYNCED = $3 WHERE id = $4`
-	_, err = txFetcher.db.Exec(stmt, "COMPLETED", now, count, syncId)
-	if err != nil {
-		log.Fatal(err)
-	}
+	return failedPages
 }
 
-func (txFetcher TxFetcher) worker(db *sql.DB, page int, timestamp int64, sync_id string) error {
-	fmt.Printf("Making request for page %d at timestamp %d\n", page, timestamp)
-
-	var body []byte
-	var response APIResponse
-	var txBytes []byte
-	if !testing {
-		url := fmt.Sprintf(
-			"https://rest.cryptoapis.io/blockchain-data/bitcoin/mainnet/addresses/%s/transactions?context=yourExampleString&limit=%d&offset=%d",
-			address,
-			pageLimit,
-			page*pageLimit,
-		)
-		method := "GET"
-
-		req, err := http.NewRequest(method, url, nil)
+// syncCursor walks the address's txs newest first, one page at a time,
+// until the last page, or a page with nothing new once we hold as many txs
+// as the provider counts. A failed page ends the walk, since the pages
+// after it cannot be reached without its cursor.
+func (txFetcher TxFetcher) syncCursor(log *slog.Logger, syncId string, cp cursorPager, ticker *time.Ticker) int {
+	cursor := ""
+	held := txFetcher.TotalTxsSynced
+	for page := 0; ; page++ {
+		waitStart := time.Now()
+		<-ticker.C
+		rateLimitWait.Observe(time.Since(waitStart).Seconds())
+
+		fetch := func() ([]Item, string, error) { return cp.TxsAfter(txFetcher.Address, cursor) }
+		inserted, next, err := txFetcher.syncPage(log.With("page", page), page, syncId, fetch)
 		if err != nil {
-			return errors.New("failed to create request")
+			pagesSynced.WithLabelValues(txFetcher.Address, "failed").Inc()
+			syncProgress.pageFailed(syncId)
+			return 1
 		}
+		pagesSynced.WithLabelValues(txFetcher.Address, "ok").Inc()
+		syncProgress.pageDone(syncId, inserted)
 
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("X-API-Key", apiKey)
+		held += inserted
+		if next == "" || (inserted == 0 && held >= txFetcher.TotalNumTxs) {
+			return 0
+		}
+		cursor = next
+	}
+}
 
-		res, err := client.Do(req)
-		if err != nil {
-			fmt.Println(err)
-			return errors.New("failed to send request")
+// syncPage runs the worker for a page, retrying with exponential backoff, and
+// returns the number of new txs inserted and the next page's cursor. If every
+// attempt fails the last error is stored in sync_errors and returned.
+func (txFetcher TxFetcher) syncPage(log *slog.Logger, page int, syncId string, fetch func() ([]Item, string, error)) (int, string, error) {
+	return txFetcher.retryPage(log, page, syncId, func(log *slog.Logger) (int, string, error) {
+		return txFetcher.worker(log, txFetcher.db, page, syncId, fetch)
+	})
+}
+
+// retryPage retries run, which fetches and stores one page, as syncPage
+// describes.
+func (txFetcher TxFetcher) retryPage(log *slog.Logger, page int, syncId string, run func(log *slog.Logger) (int, string, error)) (int, string, error) {
+	var err error
+	for attempt := 1; attempt <= maxPageAttempts; attempt++ {
+		attemptLog := log.With("attempt", attempt)
+
+		start := time.Now()
+		var inserted int
+		var next string
+		inserted, next, err = run(attemptLog)
+		if err == nil {
+			attemptLog.Debug("page synced", "duration", time.Since(start), "inserted", inserted)
+			return inserted, next, nil
 		}
-		defer res.Body.Close()
+		attemptLog.Warn("page sync failed", "duration", time.Since(start), "error", err)
 
-		body, err = ioutil.ReadAll(res.Body)
-		if err != nil {
-			fmt.Println(err)
-			return errors.New("failed to read response body")
+		if attempt < maxPageAttempts {
+			pageRetries.WithLabelValues(txFetcher.Address).Inc()
+			time.Sleep(retryBaseDelay * time.Duration(1<<(attempt-1)))
 		}
-	} else {
-		// Simulate a request that takes between 0.5 and 2 seconds
-		max := 2000
-		min := 500
-		reqTimeInMs := rand.Intn(max-min) + min
-		time.Sleep(time.Duration(reqTimeInMs) * time.Millisecond)
-
-		body = []byte(fakeResponse)
 	}
 
-	// Unmarshal the JSON data into the struct
-	err := json.Unmarshal(body, &response)
-	if err != nil {
-		return errors.New("failed to unmarshal JSON")
+	log.Error("giving up on page", "attempts", maxPageAttempts, "error", err)
+	stmt := `INSERT INTO sync_errors (sync_id, page, error) VALUES ($1, $2, $3)`
+	if _, dbErr := txFetcher.db.Exec(stmt, syncId, page, err.Error()); dbErr != nil {
+		log.Error("failed to record sync error", "error", dbErr)
 	}
+	return 0, "", err
+}
 
-	if testing {
-		fakeItems, err := generateFakeItems(page, pageLimit, txFetcher.TotalSyncTxs)
-		if err != nil {
-			return errors.New("failed to generate fake items")
-		}
-		response.Data.Items = fakeItems
+// worker fetches one page of txs and stores them, returning how many were new
+// and the next page's cursor.
+func (txFetcher TxFetcher) worker(log *slog.Logger, db *sql.DB, page int, sync_id string, fetch func() ([]Item, string, error)) (int, string, error) {
+	log.Debug("making request")
+
+	txFetcher.stats.request(txFetcher.provider)
+	items, next, err := fetch()
+	if err != nil {
+		return 0, "", err
 	}
 
-	fmt.Println("Num Txs: ", len(response.Data.Items))
+	log.Debug("received txs", "num_txs", len(items))
+	inserted, err := txFetcher.storeTxs(log, db, page, sync_id, items)
+	return inserted, next, err
+}
 
+// storeTxs stores a page of confirmed txs, returning how many were new.
+func (txFetcher TxFetcher) storeTxs(log *slog.Logger, db *sql.DB, page int, sync_id string, items []Item) (int, error) {
+	var txBytes []byte
+	insertStart := time.Now()
 	tx, err := db.Begin()
 	if err != nil {
-		log.Fatal(err)
-		return errors.New("failed to begin transaction")
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
 	}
-
-	// Prepare the statement for batch inserting
-	fmt.Println("Prepare statement for batch inserting")
-	stmt, err := tx.Prepare("INSERT INTO txs (address, tx_id, sync_id, raw, page, created_at) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (tx_id) DO NOTHING")
+	defer tx.Rollback()
+
+	// Prepare the statement for batch inserting. A pending tx that was mined,
+	// or an orphaned one mined again, is confirmed with its block but stays
+	// attributed to the sync that first stored it.
+	stmt, err := tx.Prepare(`INSERT INTO txs (address, tx_id, sync_id, raw, page, created_at, chain, network) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (address, tx_id) DO UPDATE SET raw = EXCLUDED.raw, status = 'CONFIRMED'
+		WHERE txs.status <> 'CONFIRMED'`)
 	if err != nil {
-		return errors.New("failed to prepare statement for batch inserting")
+		return 0, fmt.Errorf("failed to prepare statement for batch inserting: %w", err)
 	}
 	defer stmt.Close()
 
 	// Execute the statement for each tx
 	now := time.Now().UTC()
-	fmt.Println("Execute statement for each tx")
-	for _, item := range response.Data.Items {
-		fmt.Println("Inserting tx: ", item.TransactionId)
+	inserted := 0
+	for _, item := range items {
+		log.Debug("inserting tx", "tx_id", item.TransactionId)
+		txFetcher.chain.normalizeItem(&item)
+		if report := verifyScripts(txFetcher.chain, item); report.Mismatches > 0 {
+			log.Warn("provider script data does not match the scripts", "tx_id", item.TransactionId,
+				"mismatches", report.Mismatches)
+			scriptMismatches.Add(float64(report.Mismatches))
+		}
 		txBytes, err = json.Marshal(item)
 		if err != nil {
-			return errors.New("failed to marshal JSON")
+			return 0, errors.New("failed to marshal JSON")
 		}
 
-		_, err = stmt.Exec(address, item.TransactionId, sync_id, string(txBytes), page, now)
+		res, err := stmt.Exec(txFetcher.Address, item.TransactionId, sync_id, string(txBytes), page, now,
+			txFetcher.chain.Name, txFetcher.chain.Network)
 		if err != nil {
-			return errors.New("failed to execute statement for batch inserting")
+			return 0, fmt.Errorf("failed to execute statement for batch inserting: %w", err)
+		}
+		if _, err := storePayloads(tx, item); err != nil {
+			return 0, fmt.Errorf("failed to store payloads: %w", err)
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			inserted += int(n)
 		}
 	}
 
 	// Commit the transaction
-	fmt.Println("Commit the transaction")
 	if err := tx.Commit(); err != nil {
-		return errors.New("failed to commit transaction")
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
 	}
+	dbInsertDuration.Observe(time.Since(insertStart).Seconds())
+	txsSynced.WithLabelValues(txFetcher.chain.Name, txFetcher.provider.Name()).Add(float64(inserted))
 
-	return nil
-}
-
-func getTotalNumberOfTxs(address string) (int, error) {
-	if !testing {
-		url := "https://rest.cryptoapis.io/blockchain-data/bitcoin/mainnet/addresses/" + address + "/transactions?context=yourExampleString&limit=" + strconv.Itoa(pageLimit) + "&offset=1304404"
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			fmt.Println(err)
-			return -1, errors.New("failed to create request")
-		}
-
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("X-API-Key", apiKey)
-
-		res, err := client.Do(req)
-		if err != nil {
-			return -1, errors.New("failed to send request")
-		}
-		defer res.Body.Close()
-
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return -1, errors.New("failed to read response body")
-		}
-
-		var response APIResponse
-		err = json.Unmarshal(body, &response)
-		if err != nil {
-			return -1, errors.New("failed to unmarshal JSON")
-		}
-
-		if limitNumResultsInProd {
-			return limitNumResults, nil
-		}
-		return response.Data.Total, nil
-	} else {
-		return testTotalNumTxs, nil
-	}
+	return inserted, nil
 }
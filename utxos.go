@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// UTXO is an output paying a tracked address that no stored tx spends.
+type UTXO struct {
+	TxId          string `json:"txId"`
+	Vout          int    `json:"vout"`
+	Value         int64  `json:"value"`
+	BlockHeight   int    `json:"blockHeight"`
+	Confirmations int    `json:"confirmations"`
+}
+
+// unspentOutputs recomputes the unspent outputs of address from its stored
+// txs, oldest first. The provider's isSpent flags are a snapshot from when
+// the tx was fetched, so spends are taken from the stored inputs instead:
+// an orphaned spend puts its output back in the set. Only confirmed txs
+// count, so outputs of pending txs are not yet listed. Addresses on account
+// chains have none.
+func unspentOutputs(db *sql.DB, address string) ([]UTXO, error) {
+	chain, err := storedChain(db, address)
+	if err != nil {
+		return nil, err
+	}
+	tip, err := loadChainTip(db, chain)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT raw FROM txs WHERE address = $1 AND status = $2 AND model = $3`, address, txConfirmed, modelUTXO)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []Item
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		var item Item
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return unspentIn(items, address, chain, tip)
+}
+
+// unspentIn returns the outputs of items paying address on chain c that no
+// input of items spends, oldest first.
+func unspentIn(items []Item, address string, c *Chain, tip ChainTip) ([]UTXO, error) {
+	type outpoint struct {
+		txId string
+		vout int
+	}
+	outputs := map[outpoint]UTXO{}
+	spent := map[outpoint]bool{}
+	for _, item := range items {
+		for _, vin := range item.BlockchainSpecific.Vin {
+			spent[outpoint{vin.Txid, vin.Vout}] = true
+		}
+		for i, vout := range item.BlockchainSpecific.Vout {
+			if !paysTo(vout, address) {
+				continue
+			}
+			value, err := parseUnits(vout.Value, c.Decimals)
+			if err != nil {
+				return nil, fmt.Errorf("bad value in %s:%d: %w", item.TransactionId, i, err)
+			}
+			outputs[outpoint{item.TransactionId, i}] = UTXO{
+				TxId:          item.TransactionId,
+				Vout:          i,
+				Value:         value,
+				BlockHeight:   item.MinedInBlockHeight,
+				Confirmations: tip.confirmations(item.MinedInBlockHeight),
+			}
+		}
+	}
+
+	utxos := []UTXO{}
+	for op, u := range outputs {
+		if !spent[op] {
+			utxos = append(utxos, u)
+		}
+	}
+	sort.Slice(utxos, func(i, j int) bool {
+		if utxos[i].BlockHeight != utxos[j].BlockHeight {
+			return utxos[i].BlockHeight < utxos[j].BlockHeight
+		}
+		if utxos[i].TxId != utxos[j].TxId {
+			return utxos[i].TxId < utxos[j].TxId
+		}
+		return utxos[i].Vout < utxos[j].Vout
+	})
+	return utxos, nil
+}
+
+// handleListUTXOs serves GET /api/addresses/{address}/utxos with the
+// unspent outputs and their total.
+func (s *apiServer) handleListUTXOs(w http.ResponseWriter, r *http.Request) {
+	address, ok := addressFromPath(w, r)
+	if !ok {
+		return
+	}
+	utxos, err := unspentOutputs(s.db, address)
+	if err != nil {
+		s.internalError(w, "failed to load utxos", err)
+		return
+	}
+	var total int64
+	for _, u := range utxos {
+		total += u.Value
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total": total,
+		"utxos": utxos,
+	})
+}
+
+func paysTo(vout Vout, address string) bool {
+	for _, a := range vout.ScriptPubKey.Addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// verifier, when set from -verify-provider, is a second provider that a
+// sample of each sync's txs are checked against.
+var verifier Provider
+
+// verifySampleSize is how many stored txs each sync checks; -verify-sample
+// sets it.
+var verifySampleSize = 5
+
+// Discrepancy is a field on which the provider and the verifier disagree.
+type Discrepancy struct {
+	Id         int       `json:"id"`
+	SyncId     string    `json:"syncId"`
+	Address    string    `json:"address"`
+	TxId       string    `json:"txId,omitempty"`
+	Field      string    `json:"field"`
+	Provider   string    `json:"provider"`
+	Value      string    `json:"value"`
+	Verifier   string    `json:"verifier"`
+	Verified   string    `json:"verifiedValue"`
+	DetectedAt time.Time `json:"detectedAt"`
+}
+
+// verify compares the address's tx count, and a sample of its stored txs
+// favouring those this sync added, against the verifier, and records each
+// discrepancy. It returns how many were found.
+func (txFetcher TxFetcher) verify(log *slog.Logger, syncId string) (int, error) {
+	db := txFetcher.db
+	var found []Discrepancy
+	add := func(txId string, field string, value string, verified string) {
+		found = append(found, Discrepancy{TxId: txId, Field: field, Value: value, Verified: verified})
+	}
+
+	txFetcher.stats.request(verifier)
+	count, err := verifier.CountTxs(txFetcher.Address)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count txs: %w", err)
+	}
+	if count != txFetcher.TotalNumTxs {
+		add("", "tx_count", strconv.Itoa(txFetcher.TotalNumTxs), strconv.Itoa(count))
+	}
+
+	rows, err := db.Query(`
+		SELECT raw FROM txs WHERE address = $1 AND status = $2
+		ORDER BY sync_id = $3 DESC NULLS LAST, random() LIMIT $4`,
+		txFetcher.Address, txConfirmed, syncId, verifySampleSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to sample txs: %w", err)
+	}
+	var sample []Item
+	for rows.Next() {
+		var raw string
+		var item Item
+		if err := rows.Scan(&raw); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if err := json.Unmarshal([]byte(raw), &item); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to unmarshal stored tx: %w", err)
+		}
+		sample = append(sample, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, item := range sample {
+		txFetcher.stats.request(verifier)
+		other, err := verifier.Tx(item.TransactionId)
+		if errors.Is(err, errProviderNotFound) {
+			add(item.TransactionId, "tx", "found", "not found")
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to get tx %s: %w", item.TransactionId, err)
+		}
+		for _, d := range compareItems(txFetcher.Address, item, other) {
+			add(item.TransactionId, d.Field, d.Value, d.Verified)
+		}
+	}
+
+	now := time.Now().UTC()
+	for _, d := range found {
+		log.Warn("providers disagree",
+			"tx_id", d.TxId,
+			"field", d.Field,
+			"value", d.Value,
+			"verified_value", d.Verified,
+			"verifier", verifier.Name(),
+		)
+		providerDiscrepancies.WithLabelValues(d.Field).Inc()
+		_, err := db.Exec(`
+			INSERT INTO provider_discrepancies
+			(sync_id, address, tx_id, field, provider, value, verifier, verified_value, detected_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			syncId, txFetcher.Address, d.TxId, d.Field, txFetcher.provider.Name(), d.Value, verifier.Name(), d.Verified, now)
+		if err != nil {
+			return len(found), fmt.Errorf("failed to record discrepancy: %w", err)
+		}
+	}
+	log.Info("verified txs against second provider", "verifier", verifier.Name(), "sampled", len(sample), "discrepancies", len(found))
+	return len(found), nil
+}
+
+// compareItems returns the fields on which two providers' copies of a tx
+// differ: its block, fee, the amounts address sent and received, and each
+// input and output amount. Amounts are compared as sats, so formatting does
+// not count.
+func compareItems(address string, a Item, b Item) []Discrepancy {
+	var diffs []Discrepancy
+	check := func(field string, x string, y string) {
+		if x != y {
+			diffs = append(diffs, Discrepancy{Field: field, Value: x, Verified: y})
+		}
+	}
+
+	check("block_hash", a.MinedInBlockHash, b.MinedInBlockHash)
+	check("block_height", strconv.Itoa(a.MinedInBlockHeight), strconv.Itoa(b.MinedInBlockHeight))
+	check("tx_hash", a.TransactionHash, b.TransactionHash)
+	check("fee", normalizeAmount(a.Fee.Amount), normalizeAmount(b.Fee.Amount))
+	check("sent", participantAmount(a.Senders, address), participantAmount(b.Senders, address))
+	check("received", participantAmount(a.Recipients, address), participantAmount(b.Recipients, address))
+
+	av, bv := a.BlockchainSpecific.Vin, b.BlockchainSpecific.Vin
+	check("inputs", strconv.Itoa(len(av)), strconv.Itoa(len(bv)))
+	for i := 0; i < len(av) && i < len(bv); i++ {
+		check(fmt.Sprintf("input %d", i), normalizeAmount(av[i].Value), normalizeAmount(bv[i].Value))
+	}
+	ao, bo := a.BlockchainSpecific.Vout, b.BlockchainSpecific.Vout
+	check("outputs", strconv.Itoa(len(ao)), strconv.Itoa(len(bo)))
+	for i := 0; i < len(ao) && i < len(bo); i++ {
+		check(fmt.Sprintf("output %d", i), normalizeAmount(ao[i].Value), normalizeAmount(bo[i].Value))
+	}
+	return diffs
+}
+
+// normalizeAmount formats a BTC amount with 8 decimals, or returns it as is
+// if it does not parse.
+func normalizeAmount(s string) string {
+	if s == "" {
+		return "0.00000000"
+	}
+	sats, err := parseUnits(s, btcDecimals)
+	if err != nil {
+		return s
+	}
+	return formatUnits(sats, btcDecimals)
+}
+
+func participantAmount(ps []Participant, address string) string {
+	var total int64
+	for _, p := range ps {
+		if p.Address != address {
+			continue
+		}
+		sats, err := parseUnits(p.Amount, btcDecimals)
+		if err != nil {
+			return p.Amount
+		}
+		total += sats
+	}
+	return formatUnits(total, btcDecimals)
+}
+
+// listDiscrepancies returns recorded discrepancies, newest first, for one
+// address or, if address is empty, all of them.
+func listDiscrepancies(db *sql.DB, address string, limit int, offset int) ([]Discrepancy, error) {
+	rows, err := db.Query(`
+		SELECT id, sync_id, address, tx_id, field, provider, value, verifier, verified_value, detected_at
+		FROM provider_discrepancies WHERE $1 = '' OR address = $1
+		ORDER BY detected_at DESC, id DESC LIMIT $2 OFFSET $3`, address, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	discrepancies := []Discrepancy{}
+	for rows.Next() {
+		var d Discrepancy
+		if err := rows.Scan(&d.Id, &d.SyncId, &d.Address, &d.TxId, &d.Field, &d.Provider, &d.Value,
+			&d.Verifier, &d.Verified, &d.DetectedAt); err != nil {
+			return nil, err
+		}
+		discrepancies = append(discrepancies, d)
+	}
+	return discrepancies, rows.Err()
+}
+
+// handleListDiscrepancies serves GET /api/discrepancies, newest first,
+// filtered with ?address= and paged with ?limit= and ?offset=.
+func (s *apiServer) handleListDiscrepancies(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := pagingParams(w, r)
+	if !ok {
+		return
+	}
+	discrepancies, err := listDiscrepancies(s.db, r.URL.Query().Get("address"), limit, offset)
+	if err != nil {
+		s.internalError(w, "failed to list discrepancies", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, discrepancies)
+}
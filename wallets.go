@@ -0,0 +1,533 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	errWalletNotFound = errors.New("wallet not found")
+	errWalletExists   = errors.New("a wallet with this name already exists for this owner")
+)
+
+// Wallet is a named group of tracked addresses belonging to an owner. Its
+// balance and tx count are over the member addresses' txs, with each tx
+// counted once. Wallets imported from an xpub or output descriptor also keep
+// it, and rediscover their addresses on every sync.
+type Wallet struct {
+	Id         int       `json:"id"`
+	Name       string    `json:"name"`
+	Owner      string    `json:"owner"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Xpub       string    `json:"xpub,omitempty"`
+	Descriptor string    `json:"descriptor,omitempty"`
+	ScriptType string    `json:"scriptType,omitempty"`
+	GapLimit   int       `json:"gapLimit,omitempty"`
+	PortfolioSummary
+}
+
+// key returns the xpub or descriptor of an HD wallet.
+func (w Wallet) key() walletKey {
+	return walletKey{Xpub: w.Xpub, Descriptor: w.Descriptor}
+}
+
+// isHD reports whether the wallet derives its addresses.
+func (w Wallet) isHD() bool {
+	return w.Xpub != "" || w.Descriptor != ""
+}
+
+// dbtx is satisfied by *sql.DB and *sql.Tx.
+type dbtx interface {
+	execer
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// createWallet adds an empty wallet.
+func createWallet(db dbtx, name string, owner string) (Wallet, error) {
+	w := Wallet{Name: name, Owner: owner, CreatedAt: time.Now().UTC()}
+	err := db.QueryRow(`
+		INSERT INTO wallets (name, owner, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (owner, name) DO NOTHING RETURNING id`, name, owner, w.CreatedAt).Scan(&w.Id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Wallet{}, errWalletExists
+	}
+	if err != nil {
+		return Wallet{}, err
+	}
+	w.Addresses = []string{}
+	return w, nil
+}
+
+// getWallet returns a wallet and its member addresses, without summarizing.
+func getWallet(db *sql.DB, id int) (Wallet, error) {
+	w := Wallet{Id: id}
+	err := db.QueryRow(`SELECT name, owner, created_at, xpub, descriptor, script_type, gap_limit FROM wallets WHERE id = $1`, id).
+		Scan(&w.Name, &w.Owner, &w.CreatedAt, &w.Xpub, &w.Descriptor, &w.ScriptType, &w.GapLimit)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Wallet{}, errWalletNotFound
+	}
+	if err != nil {
+		return Wallet{}, err
+	}
+	w.Addresses, err = walletAddresses(db, id)
+	return w, err
+}
+
+// findWallet looks a wallet up by owner and name.
+func findWallet(db *sql.DB, owner string, name string) (Wallet, error) {
+	var id int
+	err := db.QueryRow(`SELECT id FROM wallets WHERE owner = $1 AND name = $2`, owner, name).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Wallet{}, errWalletNotFound
+	}
+	if err != nil {
+		return Wallet{}, err
+	}
+	return getWallet(db, id)
+}
+
+// listWallets returns the wallets of owner, or of every owner if owner is
+// empty, oldest first and summarized.
+func listWallets(db *sql.DB, owner string) ([]Wallet, error) {
+	rows, err := db.Query(`SELECT id FROM wallets WHERE $1 = '' OR owner = $1 ORDER BY created_at, id`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	wallets := []Wallet{}
+	for _, id := range ids {
+		w, err := getWallet(db, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := summarizeWallet(db, &w); err != nil {
+			return nil, err
+		}
+		wallets = append(wallets, w)
+	}
+	return wallets, nil
+}
+
+func walletAddresses(db *sql.DB, id int) ([]string, error) {
+	rows, err := db.Query(`SELECT address FROM wallet_addresses WHERE wallet_id = $1 ORDER BY created_at, address`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := []string{}
+	for rows.Next() {
+		var a string
+		if err := rows.Scan(&a); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, a)
+	}
+	return addresses, rows.Err()
+}
+
+// addWalletAddress tracks address and adds it to the wallet. Adding a member
+// again is a no-op. Invalid addresses fail with errInvalidAddress.
+func addWalletAddress(db execer, id int, address string) error {
+	info, err := trackAddress(db, address)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO wallet_addresses (wallet_id, address, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (wallet_id, address) DO NOTHING`, id, info.Address, time.Now().UTC())
+	return err
+}
+
+// removeWalletAddress removes address from the wallet. The address stays
+// tracked, with its txs.
+func removeWalletAddress(db *sql.DB, id int, address string) error {
+	_, err := db.Exec(`DELETE FROM wallet_addresses WHERE wallet_id = $1 AND address = $2`, id, address)
+	return err
+}
+
+func deleteWallet(db *sql.DB, id int) error {
+	res, err := db.Exec(`DELETE FROM wallets WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errWalletNotFound
+	}
+	return nil
+}
+
+// summarizeWallet fills in the balance, tx count and transfers of w from
+// its members' txs.
+func summarizeWallet(db *sql.DB, w *Wallet) error {
+	views, err := loadPortfolioViews(db, w.Addresses)
+	if err != nil {
+		return err
+	}
+	w.PortfolioSummary = summarizePortfolio(w.Addresses, views)
+	return nil
+}
+
+// walletFromPath loads the wallet named by the {walletId} path value, writing
+// the error response if it cannot.
+func (s *apiServer) walletFromPath(w http.ResponseWriter, r *http.Request) (Wallet, bool) {
+	id, err := strconv.Atoi(r.PathValue("walletId"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid wallet id")
+		return Wallet{}, false
+	}
+	wallet, err := getWallet(s.db, id)
+	if errors.Is(err, errWalletNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return Wallet{}, false
+	}
+	if err != nil {
+		s.internalError(w, "failed to get wallet", err)
+		return Wallet{}, false
+	}
+	return wallet, true
+}
+
+// handleListWallets serves GET /api/wallets, optionally ?owner=.
+func (s *apiServer) handleListWallets(w http.ResponseWriter, r *http.Request) {
+	prices, ok := s.fiatPrices(w, r)
+	if !ok {
+		return
+	}
+	wallets, err := listWallets(s.db, r.URL.Query().Get("owner"))
+	if err != nil {
+		s.internalError(w, "failed to list wallets", err)
+		return
+	}
+	if prices != nil {
+		now := time.Now().UTC()
+		for i := range wallets {
+			wallets[i].Fiat = prices.valuePortfolio(&wallets[i].PortfolioSummary, now)
+		}
+	}
+	writeJSON(w, http.StatusOK, wallets)
+}
+
+// handleCreateWallet serves POST /api/wallets with a body of
+// {"name": "...", "owner": "...", "addresses": ["..."]}.
+func (s *apiServer) handleCreateWallet(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name      string   `json:"name"`
+		Owner     string   `json:"owner"`
+		Addresses []string `json:"addresses"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	var addresses []string
+	seen := map[string]bool{}
+	for _, a := range body.Addresses {
+		if strings.TrimSpace(a) == "" {
+			continue
+		}
+		info, err := validateAddress(a)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !seen[info.Address] {
+			seen[info.Address] = true
+			addresses = append(addresses, info.Address)
+		}
+	}
+
+	wallet, err := createWallet(s.db, name, strings.TrimSpace(body.Owner))
+	if errors.Is(err, errWalletExists) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		s.internalError(w, "failed to create wallet", err)
+		return
+	}
+	for _, a := range addresses {
+		if err := addWalletAddress(s.db, wallet.Id, a); err != nil {
+			s.internalError(w, "failed to add address", err)
+			return
+		}
+		wallet.Addresses = append(wallet.Addresses, a)
+	}
+	writeJSON(w, http.StatusCreated, wallet)
+}
+
+// handleGetWallet serves GET /api/wallets/{walletId}.
+func (s *apiServer) handleGetWallet(w http.ResponseWriter, r *http.Request) {
+	prices, ok := s.fiatPrices(w, r)
+	if !ok {
+		return
+	}
+	wallet, ok := s.walletFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := summarizeWallet(s.db, &wallet); err != nil {
+		s.internalError(w, "failed to summarize wallet", err)
+		return
+	}
+	if prices != nil {
+		wallet.Fiat = prices.valuePortfolio(&wallet.PortfolioSummary, time.Now().UTC())
+	}
+	writeJSON(w, http.StatusOK, wallet)
+}
+
+// handleDeleteWallet serves DELETE /api/wallets/{walletId}. Member addresses
+// stay tracked.
+func (s *apiServer) handleDeleteWallet(w http.ResponseWriter, r *http.Request) {
+	wallet, ok := s.walletFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := deleteWallet(s.db, wallet.Id); err != nil && !errors.Is(err, errWalletNotFound) {
+		s.internalError(w, "failed to delete wallet", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAddWalletAddress serves POST /api/wallets/{walletId}/addresses with a
+// body of {"address": "..."}.
+func (s *apiServer) handleAddWalletAddress(w http.ResponseWriter, r *http.Request) {
+	wallet, ok := s.walletFromPath(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	address := strings.TrimSpace(body.Address)
+	if address == "" {
+		writeError(w, http.StatusBadRequest, "address is required")
+		return
+	}
+	err := addWalletAddress(s.db, wallet.Id, address)
+	if errors.Is(err, errInvalidAddress) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		s.internalError(w, "failed to add address", err)
+		return
+	}
+	addresses, err := walletAddresses(s.db, wallet.Id)
+	if err != nil {
+		s.internalError(w, "failed to list wallet addresses", err)
+		return
+	}
+	wallet.Addresses = addresses
+	writeJSON(w, http.StatusOK, wallet)
+}
+
+// handleRemoveWalletAddress serves DELETE
+// /api/wallets/{walletId}/addresses/{address}.
+func (s *apiServer) handleRemoveWalletAddress(w http.ResponseWriter, r *http.Request) {
+	wallet, ok := s.walletFromPath(w, r)
+	if !ok {
+		return
+	}
+	address, ok := addressFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := removeWalletAddress(s.db, wallet.Id, address); err != nil {
+		s.internalError(w, "failed to remove address", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleWalletTxs serves GET /api/wallets/{walletId}/txs: the members' txs,
+// newest first, each shown once.
+func (s *apiServer) handleWalletTxs(w http.ResponseWriter, r *http.Request) {
+	wallet, ok := s.walletFromPath(w, r)
+	if !ok {
+		return
+	}
+	s.writeViewsPage(w, r, func() ([]TxView, error) { return loadPortfolioViews(s.db, wallet.Addresses) })
+}
+
+// handleWalletBalanceHistory serves GET /api/wallets/{walletId}/balance-history.
+func (s *apiServer) handleWalletBalanceHistory(w http.ResponseWriter, r *http.Request) {
+	wallet, ok := s.walletFromPath(w, r)
+	if !ok {
+		return
+	}
+	s.writeBalanceHistory(w, r, func() ([]TxView, error) { return loadPortfolioViews(s.db, wallet.Addresses) })
+}
+
+// handleSyncWallet serves POST /api/wallets/{walletId}/sync. Each member
+// address is queued for a background sync; members already syncing or
+// queued are reported as running rather than failing the request. An HD wallet first
+// rediscovers its addresses.
+func (s *apiServer) handleSyncWallet(w http.ResponseWriter, r *http.Request) {
+	wallet, ok := s.walletFromPath(w, r)
+	if !ok {
+		return
+	}
+	if wallet.isHD() {
+		if _, err := discoverWallet(s.db, wallet); err != nil {
+			s.internalError(w, "failed to discover addresses", err)
+			return
+		}
+		addresses, err := walletAddresses(s.db, wallet.Id)
+		if err != nil {
+			s.internalError(w, "failed to list wallet addresses", err)
+			return
+		}
+		wallet.Addresses = addresses
+	}
+	started, running := s.syncs.startAll(wallet.Addresses)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"walletId": wallet.Id,
+		"started":  started,
+		"running":  running,
+	})
+}
+
+// runWallet implements the wallet command.
+func runWallet(syncs *syncRunner, args []string, out io.Writer) error {
+	db := syncs.db
+	if len(args) == 0 {
+		return errors.New("usage: wallet list|show|create|import-xpub|import-descriptor|add|remove|delete|sync ...")
+	}
+	sub, args := args[0], args[1:]
+	switch sub {
+	case "import-xpub":
+		return runImportXpub(syncs, args, out)
+	case "import-descriptor":
+		return runImportDescriptor(syncs, args, out)
+	}
+
+	fs := flag.NewFlagSet("wallet "+sub, flag.ExitOnError)
+	owner := fs.String("owner", "", "owner of the wallet")
+	fs.Parse(args)
+
+	if sub == "list" {
+		wallets, err := listWallets(db, *owner)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tOWNER\tNAME\tADDRESSES\tTXS\tBALANCE")
+		for _, w := range wallets {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%s\n", w.Id, w.Owner, w.Name, len(w.Addresses), w.TxCount,
+				w.formatBalances())
+		}
+		return tw.Flush()
+	}
+
+	if fs.NArg() < 1 {
+		return fmt.Errorf("usage: wallet %s [-owner OWNER] NAME [ADDRESS...]", sub)
+	}
+	name, addresses := fs.Arg(0), fs.Args()[1:]
+
+	if sub == "create" {
+		w, err := createWallet(db, name, *owner)
+		if err != nil {
+			return err
+		}
+		for _, a := range addresses {
+			if err := addWalletAddress(db, w.Id, a); err != nil {
+				return err
+			}
+		}
+		logger.Info("created wallet", "wallet", w.Id, "name", name, "addresses", len(addresses))
+		return nil
+	}
+
+	w, err := findWallet(db, *owner, name)
+	if err != nil {
+		return fmt.Errorf("wallet %q: %w", name, err)
+	}
+	switch sub {
+	case "show":
+		if err := summarizeWallet(db, &w); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s (id %d): %s in %d txs, %d internal transfers\n", w.Name, w.Id,
+			w.formatBalances(), w.TxCount, w.Transfers)
+		for _, a := range w.Addresses {
+			fmt.Fprintln(out, " ", a)
+		}
+		return nil
+	case "add":
+		for _, a := range addresses {
+			if err := addWalletAddress(db, w.Id, a); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "remove":
+		for _, a := range addresses {
+			if err := removeWalletAddress(db, w.Id, a); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "delete":
+		return deleteWallet(db, w.Id)
+	case "sync":
+		if w.isHD() {
+			if _, err := discoverWallet(db, w); err != nil {
+				return err
+			}
+			if w.Addresses, err = walletAddresses(db, w.Id); err != nil {
+				return err
+			}
+		}
+		return syncWallet(syncs, w)
+	default:
+		return fmt.Errorf("unknown wallet command %q", sub)
+	}
+}
+
+// syncWallet syncs each member address in turn, carrying on past failures.
+func syncWallet(syncs *syncRunner, w Wallet) error {
+	var failed int
+	for _, a := range w.Addresses {
+		if err := syncs.run(a); err != nil {
+			logger.Error("sync failed", "wallet", w.Id, "address", a, "error", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d addresses failed to sync", failed, len(w.Addresses))
+	}
+	return nil
+}
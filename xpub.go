@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// Script types of single-key addresses.
+const (
+	scriptP2PKH      = "p2pkh"       // legacy, BIP44
+	scriptP2SHP2WPKH = "p2sh-p2wpkh" // nested segwit, BIP49
+	scriptP2WPKH     = "p2wpkh"      // native segwit, BIP84
+)
+
+// Derivation chains below an account key.
+const (
+	chainReceive = 0
+	chainChange  = 1
+)
+
+const (
+	defaultGapLimit = 20
+	// maxDerivationIndex stops discovery on a chain that never runs out of
+	// used addresses.
+	maxDerivationIndex = 1000
+	// fakeDerivationIndex stops discovery against the fake provider, which
+	// reports txs for every address.
+	fakeDerivationIndex = 5
+)
+
+// xpubVersion is the SLIP-132 version prefix of an extended public key,
+// which says which script type its addresses use.
+type xpubVersion struct {
+	prefix  string
+	version []byte
+	script  string
+	net     *chaincfg.Params
+}
+
+var xpubVersions = []xpubVersion{
+	{"xpub", []byte{0x04, 0x88, 0xb2, 0x1e}, scriptP2PKH, &chaincfg.MainNetParams},
+	{"ypub", []byte{0x04, 0x9d, 0x7c, 0xb2}, scriptP2SHP2WPKH, &chaincfg.MainNetParams},
+	{"zpub", []byte{0x04, 0xb2, 0x47, 0x46}, scriptP2WPKH, &chaincfg.MainNetParams},
+	{"tpub", []byte{0x04, 0x35, 0x87, 0xcf}, scriptP2PKH, &chaincfg.TestNet3Params},
+	{"upub", []byte{0x04, 0x4a, 0x52, 0x62}, scriptP2SHP2WPKH, &chaincfg.TestNet3Params},
+	{"vpub", []byte{0x04, 0x5f, 0x1c, 0xf6}, scriptP2WPKH, &chaincfg.TestNet3Params},
+}
+
+// hdAccount is an account-level extended public key (m/purpose'/coin'/account')
+// from which receive and change addresses are derived locally.
+type hdAccount struct {
+	Xpub   string
+	Script string
+	net    *chaincfg.Params
+	key    *hdkeychain.ExtendedKey
+}
+
+// parseXpub parses an xpub, ypub or zpub (or their testnet forms). Private
+// keys are refused: we only ever need to watch.
+func parseXpub(s string) (*hdAccount, error) {
+	s = strings.TrimSpace(s)
+	key, err := hdkeychain.NewKeyFromString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended key: %w", err)
+	}
+	if key.IsPrivate() {
+		return nil, errors.New("extended private keys are not accepted; export the account xpub instead")
+	}
+	for _, v := range xpubVersions {
+		if bytes.Equal(key.Version(), v.version) {
+			return &hdAccount{Xpub: s, Script: v.script, net: v.net, key: key}, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported extended key version %x", key.Version())
+}
+
+// address derives the address at chain/index.
+func (a *hdAccount) address(chain uint32, index uint32) (string, error) {
+	branch, err := a.key.Derive(chain)
+	if err != nil {
+		return "", err
+	}
+	child, err := branch.Derive(index)
+	if err != nil {
+		return "", err
+	}
+	pub, err := child.ECPubKey()
+	if err != nil {
+		return "", err
+	}
+	hash := btcutil.Hash160(pub.SerializeCompressed())
+
+	var addr btcutil.Address
+	switch a.Script {
+	case scriptP2PKH:
+		addr, err = btcutil.NewAddressPubKeyHash(hash, a.net)
+	case scriptP2SHP2WPKH:
+		redeem := append([]byte{0x00, 0x14}, hash...)
+		addr, err = btcutil.NewAddressScriptHash(redeem, a.net)
+	case scriptP2WPKH:
+		addr, err = btcutil.NewAddressWitnessPubKeyHash(hash, a.net)
+	default:
+		err = fmt.Errorf("unknown script type %q", a.Script)
+	}
+	if err != nil {
+		return "", err
+	}
+	return addr.EncodeAddress(), nil
+}
+
+func (a *hdAccount) isRanged() bool { return true }
+
+func (a *hdAccount) chains() []uint32 { return []uint32{chainReceive, chainChange} }
+
+// addressSource derives the addresses of an HD wallet: an xpub account or
+// an output descriptor.
+type addressSource interface {
+	isRanged() bool
+	chains() []uint32
+	address(chain uint32, index uint32) (string, error)
+}
+
+// walletKey is what an HD wallet derives its addresses from. Exactly one
+// field is set.
+type walletKey struct {
+	Xpub       string
+	Descriptor string
+}
+
+// source parses the key, returning its address source and script type.
+func (k walletKey) source() (addressSource, string, error) {
+	if k.Descriptor != "" {
+		d, err := parseDescriptor(k.Descriptor)
+		if err != nil {
+			return nil, "", err
+		}
+		return d, d.Script, nil
+	}
+	a, err := parseXpub(k.Xpub)
+	if err != nil {
+		return nil, "", err
+	}
+	return a, a.Script, nil
+}
+
+// DerivedAddress is an address found by discovery.
+type DerivedAddress struct {
+	Address string `json:"address"`
+	Chain   int    `json:"chain"`
+	Index   int    `json:"index"`
+	TxCount int    `json:"txCount"`
+}
+
+// discoverAddresses walks each chain of src, asking countTxs for each
+// address's tx count, until gapLimit consecutive addresses are unused or
+// maxIndex is reached. It
+// returns the used addresses. A source without a wildcard has one address
+// per chain, which is returned whether used or not.
+func discoverAddresses(src addressSource, gapLimit int, maxIndex int, countTxs func(address string) (int, error)) ([]DerivedAddress, error) {
+	used := []DerivedAddress{}
+	for _, chain := range src.chains() {
+		gap := 0
+		for index := 0; gap < gapLimit && index < maxIndex; index++ {
+			address, err := src.address(chain, uint32(index))
+			if err != nil {
+				return nil, fmt.Errorf("failed to derive %d/%d: %w", chain, index, err)
+			}
+			n, err := countTxs(address)
+			if err != nil {
+				return nil, fmt.Errorf("failed to look up %s: %w", address, err)
+			}
+			if !src.isRanged() {
+				used = append(used, DerivedAddress{Address: address, Chain: int(chain), Index: index, TxCount: n})
+				break
+			}
+			if n == 0 {
+				gap++
+				continue
+			}
+			gap = 0
+			used = append(used, DerivedAddress{Address: address, Chain: int(chain), Index: index, TxCount: n})
+		}
+		if src.isRanged() && gap < gapLimit {
+			logger.Warn("stopped discovery before the gap limit", "chain", chain, "max_index", maxIndex)
+		}
+	}
+	return used, nil
+}
+
+// countChainTxs counts address's txs on its own chain's provider, as the
+// address is synced, so testnet and Litecoin keys are not looked up on
+// Bitcoin mainnet.
+func countChainTxs(address string) (int, error) {
+	p, err := providerFor(addressChain(address))
+	if err != nil {
+		return 0, err
+	}
+	return p.CountTxs(address)
+}
+
+// discoverKey derives the used addresses of an HD wallet's key. It
+// returns them with the key's script type.
+func discoverKey(key walletKey, gapLimit int) ([]DerivedAddress, string, error) {
+	src, script, err := key.source()
+	if err != nil {
+		return nil, "", err
+	}
+	maxIndex := maxDerivationIndex
+	if first, err := src.address(src.chains()[0], 0); err == nil {
+		if p, err := providerFor(addressChain(first)); err == nil {
+			if _, ok := p.(fakeProvider); ok {
+				maxIndex = fakeDerivationIndex
+			}
+		}
+	}
+	found, err := discoverAddresses(src, gapLimit, maxIndex, countChainTxs)
+	if err != nil {
+		return nil, "", err
+	}
+	logger.Info("discovered addresses", "script", script, "used", len(found))
+	return found, script, nil
+}
+
+// discoverWallet derives the used addresses of an HD wallet and adds them
+// to it. It returns the addresses found.
+func discoverWallet(db *sql.DB, w Wallet) ([]DerivedAddress, error) {
+	found, _, err := discoverKey(w.key(), w.GapLimit)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for _, d := range found {
+		if err := addDerivedAddress(tx, w.Id, d); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return found, nil
+}
+
+// addDerivedAddress adds a discovered address to the wallet with its
+// derivation path.
+func addDerivedAddress(db execer, id int, d DerivedAddress) error {
+	if err := addWalletAddress(db, id, d.Address); err != nil {
+		return err
+	}
+	_, err := db.Exec(`UPDATE wallet_addresses SET derivation_chain = $3, child_index = $4 WHERE wallet_id = $1 AND address = $2`,
+		id, d.Address, d.Chain, d.Index)
+	return err
+}
+
+// importHDWallet discovers the used addresses of an xpub or descriptor,
+// then creates a wallet of them. Nothing is stored if discovery fails.
+func importHDWallet(db *sql.DB, name string, owner string, key walletKey, gapLimit int) (Wallet, []DerivedAddress, error) {
+	if gapLimit <= 0 {
+		gapLimit = defaultGapLimit
+	}
+	found, script, err := discoverKey(key, gapLimit)
+	if err != nil {
+		return Wallet{}, nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Wallet{}, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	w, err := createWallet(tx, name, owner)
+	if err != nil {
+		return Wallet{}, nil, err
+	}
+	_, err = tx.Exec(`UPDATE wallets SET xpub = $2, descriptor = $3, script_type = $4, gap_limit = $5 WHERE id = $1`,
+		w.Id, key.Xpub, key.Descriptor, script, gapLimit)
+	if err != nil {
+		return Wallet{}, nil, err
+	}
+	for _, d := range found {
+		if err := addDerivedAddress(tx, w.Id, d); err != nil {
+			return Wallet{}, nil, err
+		}
+		w.Addresses = append(w.Addresses, d.Address)
+	}
+	if err := tx.Commit(); err != nil {
+		return Wallet{}, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	w.Xpub, w.Descriptor, w.ScriptType, w.GapLimit = key.Xpub, key.Descriptor, script, gapLimit
+	return w, found, nil
+}
+
+// handleImportXpub serves POST /api/wallets/xpub with a body of
+// {"name": "...", "owner": "...", "xpub": "...", "gapLimit": 20}.
+func (s *apiServer) handleImportXpub(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name     string `json:"name"`
+		Owner    string `json:"owner"`
+		Xpub     string `json:"xpub"`
+		GapLimit int    `json:"gapLimit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	account, err := parseXpub(body.Xpub)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.importHDWallet(w, name, strings.TrimSpace(body.Owner), walletKey{Xpub: account.Xpub}, body.GapLimit)
+}
+
+// importHDWallet creates the wallet and responds with it and the discovered
+// addresses. Discovery runs before the response; syncs of the used
+// addresses are queued in the background.
+func (s *apiServer) importHDWallet(w http.ResponseWriter, name string, owner string, key walletKey, gapLimit int) {
+	wallet, found, err := importHDWallet(s.db, name, owner, key, gapLimit)
+	if errors.Is(err, errWalletExists) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		s.internalError(w, "failed to import wallet", err)
+		return
+	}
+	s.syncs.startAll(wallet.Addresses)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"wallet":     wallet,
+		"discovered": found,
+	})
+}
+
+// runImportXpub implements wallet import-xpub.
+func runImportXpub(syncs *syncRunner, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("wallet import-xpub", flag.ExitOnError)
+	owner := fs.String("owner", "", "owner of the wallet")
+	gapLimit := fs.Int("gap-limit", defaultGapLimit, "stop after this many consecutive unused addresses")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("usage: wallet import-xpub [-owner OWNER] [-gap-limit N] NAME XPUB")
+	}
+	return runImportHD(syncs, fs.Arg(0), *owner, walletKey{Xpub: strings.TrimSpace(fs.Arg(1))}, *gapLimit, out)
+}
+
+// runImportHD imports an HD wallet, prints the discovered addresses and
+// syncs them.
+func runImportHD(syncs *syncRunner, name string, owner string, key walletKey, gapLimit int, out io.Writer) error {
+	w, found, err := importHDWallet(syncs.db, name, owner, key, gapLimit)
+	if err != nil {
+		return err
+	}
+	for _, d := range found {
+		fmt.Fprintf(out, "%d/%d\t%s\t%d txs\n", d.Chain, d.Index, d.Address, d.TxCount)
+	}
+	return syncWallet(syncs, w)
+}
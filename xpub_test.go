@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	tt "testing"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// countingProvider reports txs for the addresses in used and records every
+// address it is asked about.
+type countingProvider struct {
+	fakeProvider
+	used  map[string]int
+	asked *[]string
+}
+
+func (p countingProvider) CountTxs(address string) (int, error) {
+	*p.asked = append(*p.asked, address)
+	return p.used[address], nil
+}
+
+// testnetAccount returns the BIP84 account key of a fixed testnet seed as a
+// vpub.
+func testnetAccount(t *tt.T) string {
+	t.Helper()
+	master, err := hdkeychain.NewMaster([]byte("0123456789abcdef0123456789abcdef"), &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := master
+	for _, i := range []uint32{84, 1, 0} {
+		if key, err = key.Derive(hdkeychain.HardenedKeyStart + i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pub, err := key.Neuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Re-encode the tpub with the SLIP-132 vpub version.
+	vpub, err := pub.CloneWithVersion([]byte{0x04, 0x5f, 0x1c, 0xf6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vpub.String()
+}
+
+func TestDiscoverAddressesUsesAddressChainProvider(t *tt.T) {
+	src, _, err := walletKey{Xpub: testnetAccount(t)}.source()
+	if err != nil {
+		t.Fatalf("source: %v", err)
+	}
+	first, _ := src.address(chainReceive, 0)
+	third, _ := src.address(chainReceive, 2)
+	if !strings.HasPrefix(first, "tb1q") {
+		t.Fatalf("derived %s, want a testnet P2WPKH address", first)
+	}
+
+	var testnetAsked, mainnetAsked []string
+	key := chainBitcoinTestnet.Key()
+	old, hadOld := chainProviders[key]
+	chainProviders[key] = countingProvider{used: map[string]int{first: 2, third: 1}, asked: &testnetAsked}
+	oldMain := provider
+	provider = countingProvider{used: map[string]int{}, asked: &mainnetAsked}
+	defer func() {
+		provider = oldMain
+		if hadOld {
+			chainProviders[key] = old
+		} else {
+			delete(chainProviders, key)
+		}
+	}()
+
+	found, err := discoverAddresses(src, 3, maxDerivationIndex, countChainTxs)
+	if err != nil {
+		t.Fatalf("discoverAddresses: %v", err)
+	}
+	if len(mainnetAsked) != 0 {
+		t.Errorf("asked the mainnet provider about %v", mainnetAsked)
+	}
+	// Receive: 0 and 2 used, then 3 unused; change: 3 unused.
+	if len(testnetAsked) != 6+3 {
+		t.Errorf("asked the testnet provider about %d addresses, want 9", len(testnetAsked))
+	}
+	if len(found) != 2 || found[0].Address != first || found[1].Address != third || found[1].Index != 2 {
+		t.Errorf("found %+v, want receive addresses 0 and 2", found)
+	}
+}
+
+func TestDiscoverKeyStopsEarlyAgainstFakeProvider(t *tt.T) {
+	found, script, err := discoverKey(walletKey{Xpub: testnetAccount(t)}, defaultGapLimit)
+	if err != nil {
+		t.Fatalf("discoverKey: %v", err)
+	}
+	if script != scriptP2WPKH {
+		t.Errorf("script = %q, want %q", script, scriptP2WPKH)
+	}
+	// The fake provider reports txs for every address, so each chain stops
+	// at fakeDerivationIndex rather than maxDerivationIndex.
+	if len(found) != 2*fakeDerivationIndex {
+		t.Errorf("found %d addresses, want %d", len(found), 2*fakeDerivationIndex)
+	}
+}